@@ -16,7 +16,9 @@
 package dockerutil
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -26,14 +28,18 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"testing"
 	"time"
 
 	"github.com/kr/pty"
 	"gvisor.dev/gvisor/pkg/test/testutil"
+	"gvisor.dev/gvisor/runsc/cgroup"
 )
 
 var (
@@ -72,48 +78,174 @@ func EnsureSupportedDockerVersion() {
 	}
 }
 
-// RuntimePath returns the binary path for the current runtime.
-func RuntimePath() (string, error) {
+// readConfig reads and unmarshals the Docker daemon configuration.
+func readConfig() (map[string]interface{}, error) {
 	// Read the configuration data; the file must exist.
 	configBytes, err := ioutil.ReadFile(*config)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Unmarshal the configuration.
 	c := make(map[string]interface{})
 	if err := json.Unmarshal(configBytes, &c); err != nil {
-		return "", err
+		return nil, err
+	}
+	return c, nil
+}
+
+// runtimeConfig returns the Docker daemon configuration of the current
+// runtime.
+func runtimeConfig() (map[string]interface{}, error) {
+	c, err := readConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	// Decode the expected configuration.
 	r, ok := c["runtimes"]
 	if !ok {
-		return "", fmt.Errorf("no runtimes declared: %v", c)
+		return nil, fmt.Errorf("no runtimes declared: %v", c)
 	}
 	rs, ok := r.(map[string]interface{})
 	if !ok {
 		// The runtimes are not a map.
-		return "", fmt.Errorf("unexpected format: %v", c)
+		return nil, fmt.Errorf("unexpected format: %v", c)
 	}
 	r, ok = rs[*runtime]
 	if !ok {
 		// The expected runtime is not declared.
-		return "", fmt.Errorf("runtime %q not found: %v", *runtime, c)
+		return nil, fmt.Errorf("runtime %q not found: %v", *runtime, c)
 	}
 	rs, ok = r.(map[string]interface{})
 	if !ok {
 		// The runtime is not a map.
-		return "", fmt.Errorf("unexpected format: %v", c)
+		return nil, fmt.Errorf("unexpected format: %v", c)
+	}
+	return rs, nil
+}
+
+// RuntimePath returns the binary path for the current runtime.
+func RuntimePath() (string, error) {
+	rs, err := runtimeConfig()
+	if err != nil {
+		return "", err
 	}
 	p, ok := rs["path"].(string)
 	if !ok {
 		// The runtime does not declare a path.
-		return "", fmt.Errorf("unexpected format: %v", c)
+		return "", fmt.Errorf("unexpected format: %v", rs)
 	}
 	return p, nil
 }
 
+// runtimeArgs returns the arguments passed to the current runtime, from
+// "runtimeArgs" in the Docker daemon configuration.
+func runtimeArgs() ([]string, error) {
+	rs, err := runtimeConfig()
+	if err != nil {
+		return nil, err
+	}
+	raw, _ := rs["runtimeArgs"].([]interface{})
+	args := make([]string, 0, len(raw))
+	for _, arg := range raw {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected format: %v", rs)
+		}
+		args = append(args, s)
+	}
+	return args, nil
+}
+
+// UsernsRemap returns the daemon's "userns-remap" setting, e.g. "default" or
+// "user:group". It returns an empty string if user namespace remapping is not
+// configured, in which case container IDs match host IDs.
+func UsernsRemap() (string, error) {
+	c, err := readConfig()
+	if err != nil {
+		return "", err
+	}
+	r, ok := c["userns-remap"]
+	if !ok {
+		return "", nil
+	}
+	remap, ok := r.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected format: %v", c)
+	}
+	return remap, nil
+}
+
+// RemappedIDs returns the host user and group IDs that the container IDs 'uid'
+// and 'gid' map to, based on UsernsRemap and the subordinate ID ranges in
+// /etc/subuid and /etc/subgid. IDs are returned unchanged if user namespace
+// remapping is not configured.
+func RemappedIDs(uid, gid int) (int, int, error) {
+	remap, err := UsernsRemap()
+	if err != nil {
+		return 0, 0, err
+	}
+	if remap == "" {
+		return uid, gid, nil
+	}
+	user, group := remap, remap
+	if remap == "default" {
+		// Docker creates and uses the "dockremap" user and group.
+		user, group = "dockremap", "dockremap"
+	} else if i := strings.Index(remap, ":"); i >= 0 {
+		user, group = remap[:i], remap[i+1:]
+	}
+	hostUID, err := remapID("/etc/subuid", user, uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	hostGID, err := remapID("/etc/subgid", group, gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return hostUID, hostGID, nil
+}
+
+// remapID returns the host ID that 'id' maps to in the subordinate ID ranges of
+// 'name' in 'path', formatted as described in subuid(5).
+func remapID(path, name string, id int) (int, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	hostID, err := parseSubID(string(out), name, id)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	return hostID, nil
+}
+
+// parseSubID returns the host ID that 'id' maps to, given the subordinate ID
+// ranges in 'subid', e.g. "dockremap:100000:65536". Like Docker, the ranges
+// of 'name' are concatenated in order.
+func parseSubID(subid, name string, id int) (int, error) {
+	for _, line := range strings.Split(subid, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || fields[0] != name {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid line %q: %v", line, err)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid line %q: %v", line, err)
+		}
+		if id < count {
+			return start + id, nil
+		}
+		id -= count
+	}
+	return 0, fmt.Errorf("no subordinate ID range of %q includes the ID", name)
+}
+
 // Save exports a container image to the given Writer.
 //
 // Note that the writer should be actively consuming the output, otherwise it
@@ -156,6 +288,10 @@ type Docker struct {
 	copyErr  error
 	mounts   []string
 	cleanups []func()
+
+	// hookDir is where the sandbox hook records the container start, or empty
+	// if the container was not started with RunOpts.SandboxHook.
+	hookDir string
 }
 
 // MakeDocker sets up the struct for a Docker container.
@@ -216,30 +352,78 @@ type RunOpts struct {
 	// Memory is the memory limit in kB.
 	Memory int
 
+	// OOMKillDisable disables the OOM killer for the container. When the
+	// memory limit is reached, processes are stopped until memory becomes
+	// available instead of being killed. Only applies to cgroup v1.
+	OOMKillDisable bool
+
+	// CPUSetCPUs are the CPUs the container may run on, in the form accepted
+	// by --cpuset-cpus, e.g. "0-3" or "1,3". If empty, all CPUs may be used.
+	CPUSetCPUs string
+
+	// CPUSetMems are the memory nodes the container may use, in the form
+	// accepted by --cpuset-mems. If empty, all memory nodes may be used.
+	CPUSetMems string
+
+	// CPUs is the number of CPUs exposed to the container. The container is
+	// pinned to CPUs 0 to CPUs-1 with --cpuset-cpus, from which the sandbox
+	// derives its CPU count. CPUSetCPUs takes precedence if both are set. If
+	// zero, all CPUs are exposed.
+	CPUs int
+
 	// Ports are the ports to be allocated.
 	Ports []int
 
+	// Network is the docker network to connect the container to, e.g. a user
+	// defined bridge created with 'docker network create'. If empty, the
+	// container is connected to docker's default bridge network.
+	Network string
+
+	// DNS are the DNS servers written to the container's /etc/resolv.conf,
+	// passed as --dns. If empty, docker derives them from the host. See
+	// Docker.Resolve to check resolution through them.
+	DNS []string
+
+	// ShmSize is the size of /dev/shm in bytes. If zero, Docker's default
+	// is used.
+	ShmSize int64
+
 	// WorkDir sets the working directory.
 	WorkDir string
 
-	// ReadOnly sets the read-only flag.
+	// ReadOnly mounts the container's root filesystem read-only. Mounts,
+	// including tmpfs mounts, remain writable. By default the root
+	// filesystem is writable.
 	ReadOnly bool
 
-	// Env are additional environment variables.
+	// Env are additional environment variables, in the form "KEY=VALUE". Each
+	// one is passed to docker as a separate argument, so values may contain
+	// spaces or quotes without any escaping.
 	Env []string
 
-	// User is the user to use.
+	// User is the user to use, in the form accepted by --user, e.g. "uid:gid".
+	// If empty, the image's user is used.
 	User string
 
 	// Privileged enables privileged mode.
 	Privileged bool
 
+	// Init runs docker's init shim, e.g. tini, as PID 1 in the container with
+	// --init, which then runs the command and reaps zombies. By default the
+	// command itself is PID 1.
+	Init bool
+
 	// CapAdd are the extra set of capabilities to add.
 	CapAdd []string
 
 	// CapDrop are the extra set of capabilities to drop.
 	CapDrop []string
 
+	// SeccompProfile is the path to a JSON seccomp profile applied to the
+	// container, passed as '--security-opt seccomp=<path>'. If empty, docker's
+	// default profile is used.
+	SeccompProfile string
+
 	// Pty indicates that a pty will be allocated. If this is non-nil, then
 	// this will run after start-up with the *exec.Command and Pty file
 	// passed in to the function.
@@ -250,10 +434,34 @@ type RunOpts struct {
 	// return value from the Run function.
 	Foreground bool
 
+	// Labels are labels to set on the container.
+	Labels map[string]string
+
+	// Annotations are OCI annotations passed through to the runtime in the
+	// container spec. This requires a Docker version that supports the
+	// --annotation flag.
+	Annotations map[string]string
+
+	// SandboxHook adds an OCI prestart hook that records the runtime's command
+	// line and the sandbox PID when the container starts. See
+	// Docker.SandboxHookRecord. The runtime must be installed with
+	// --TESTONLY-hook-dir=/tmp/runsc-test-hooks, as done by 'make test-install'.
+	SandboxHook bool
+
 	// Extra are extra arguments that may be passed.
 	Extra []string
 }
 
+// sortedKeyValues returns "key=value" pairs from the map, sorted by key.
+func sortedKeyValues(m map[string]string) []string {
+	var kvs []string
+	for k, v := range m {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(kvs)
+	return kvs
+}
+
 // args returns common arguments.
 //
 // Note that this does not define the complete behavior.
@@ -279,6 +487,9 @@ func (d *Docker) argsFor(r *RunOpts, command string, p []string) (rv []string) {
 	for _, c := range r.CapDrop {
 		rv = append(rv, fmt.Sprintf("--cap-drop=%s", c))
 	}
+	if r.SeccompProfile != "" && !isExec {
+		rv = append(rv, fmt.Sprintf("--security-opt=seccomp=%s", r.SeccompProfile))
+	}
 	for _, e := range r.Env {
 		rv = append(rv, fmt.Sprintf("--env=%s", e))
 	}
@@ -289,12 +500,41 @@ func (d *Docker) argsFor(r *RunOpts, command string, p []string) (rv []string) {
 		if r.Memory != 0 {
 			rv = append(rv, fmt.Sprintf("--memory=%dk", r.Memory))
 		}
+		if r.OOMKillDisable {
+			rv = append(rv, "--oom-kill-disable")
+		}
+		if r.CPUSetCPUs != "" {
+			rv = append(rv, fmt.Sprintf("--cpuset-cpus=%s", r.CPUSetCPUs))
+		} else if r.CPUs > 0 {
+			rv = append(rv, fmt.Sprintf("--cpuset-cpus=0-%d", r.CPUs-1))
+		}
+		if r.CPUSetMems != "" {
+			rv = append(rv, fmt.Sprintf("--cpuset-mems=%s", r.CPUSetMems))
+		}
 		for _, p := range r.Ports {
 			rv = append(rv, fmt.Sprintf("--publish=%d", p))
 		}
+		if r.Network != "" {
+			rv = append(rv, fmt.Sprintf("--network=%s", r.Network))
+		}
+		for _, dns := range r.DNS {
+			rv = append(rv, fmt.Sprintf("--dns=%s", dns))
+		}
+		if r.ShmSize != 0 {
+			rv = append(rv, fmt.Sprintf("--shm-size=%d", r.ShmSize))
+		}
 		if r.ReadOnly {
 			rv = append(rv, fmt.Sprintf("--read-only"))
 		}
+		if r.Init {
+			rv = append(rv, "--init")
+		}
+		for _, l := range sortedKeyValues(r.Labels) {
+			rv = append(rv, fmt.Sprintf("--label=%s", l))
+		}
+		for _, a := range sortedKeyValues(r.Annotations) {
+			rv = append(rv, fmt.Sprintf("--annotation=%s", a))
+		}
 		if len(p) > 0 {
 			rv = append(rv, "--entrypoint=")
 		}
@@ -332,6 +572,13 @@ func (d *Docker) run(r RunOpts, command string, p ...string) (string, error) {
 	} else {
 		basicArgs = append(basicArgs, command)
 	}
+	if r.SandboxHook && command != "exec" {
+		env, err := d.installHook()
+		if err != nil {
+			return "", err
+		}
+		r.Env = append(append([]string(nil), r.Env...), env)
+	}
 	customArgs := d.argsFor(&r, command, p)
 	cmd := testutil.Command(d.logger, append(basicArgs, customArgs...)...)
 	if r.Pty != nil {
@@ -345,12 +592,177 @@ func (d *Docker) run(r RunOpts, command string, p ...string) (string, error) {
 		r.Pty(cmd.Cmd, ptmx)
 	} else {
 		// Can't support PTY or streaming.
-		out, err := cmd.CombinedOutput()
+		out, err := runCommand(cmd)
 		return string(out), err
 	}
 	return "", nil
 }
 
+const (
+	// hookEnv is the container environment variable that the runtime looks up
+	// for the path of the sandbox hook.
+	hookEnv = "RUNSC_TEST_HOOK"
+
+	// hookRoot is the host directory that the runtime accepts sandbox hooks
+	// from, with --TESTONLY-hook-dir.
+	hookRoot = "/tmp/runsc-test-hooks"
+)
+
+// hookScript records the command line of the runtime process that executes
+// the hook, and the OCI state passed to the hook in stdin. Files are renamed
+// in place once complete, so they are never seen partially written.
+const hookScript = `#!/bin/sh
+set -e
+tr '\0' '\n' < /proc/$PPID/cmdline > "%[1]s/cmdline.tmp"
+cat > "%[1]s/state.json.tmp"
+mv "%[1]s/cmdline.tmp" "%[1]s/cmdline"
+mv "%[1]s/state.json.tmp" "%[1]s/state.json"
+`
+
+// checkHookRoot returns an error unless 'dir' is a directory owned by root or
+// the current user, that no other user can write to. hookRoot is under /tmp, so
+// it may have been created by another user, who could then replace the hooks
+// that the runtime executes on the host.
+func checkHookRoot(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok {
+		return fmt.Errorf("sandbox hook directory %q is not a directory", dir)
+	}
+	if uid := int(st.Uid); uid != 0 && uid != os.Geteuid() {
+		return fmt.Errorf("sandbox hook directory %q is owned by uid %d, want 0 or %d", dir, uid, os.Geteuid())
+	}
+	if perm := info.Mode().Perm(); perm&0022 != 0 {
+		return fmt.Errorf("sandbox hook directory %q is writable by other users, mode: %v", dir, perm)
+	}
+	return nil
+}
+
+// installHook writes the sandbox hook to a new directory, removed on CleanUp,
+// and returns the environment variable that points the runtime to it.
+func (d *Docker) installHook() (string, error) {
+	if d.hookDir == "" {
+		if err := os.MkdirAll(hookRoot, 0755); err != nil {
+			return "", fmt.Errorf("os.MkdirAll(%q) failed: %v", hookRoot, err)
+		}
+		if err := checkHookRoot(hookRoot); err != nil {
+			return "", err
+		}
+		dir, err := ioutil.TempDir(hookRoot, d.Name)
+		if err != nil {
+			return "", fmt.Errorf("ioutil.TempDir failed: %v", err)
+		}
+		d.cleanups = append(d.cleanups, func() {
+			os.RemoveAll(dir)
+			d.hookDir = ""
+		})
+		// The hook is executed by the runtime, which may not run as the
+		// test user.
+		if err := os.Chmod(dir, 0755); err != nil {
+			return "", fmt.Errorf("os.Chmod(%q, 0755) failed: %v", dir, err)
+		}
+		d.hookDir = dir
+	}
+	hook := filepath.Join(d.hookDir, "hook.sh")
+	if err := ioutil.WriteFile(hook, []byte(fmt.Sprintf(hookScript, d.hookDir)), 0755); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s=%s", hookEnv, hook), nil
+}
+
+// HookRecord is what the sandbox hook recorded when the container started.
+type HookRecord struct {
+	// Args is the command line of the runtime process that executed the hook.
+	Args []string
+
+	// ID is the container ID, from the OCI state.
+	ID string
+
+	// Pid is the sandbox PID, from the OCI state.
+	Pid int
+
+	// Bundle is the container's bundle directory, from the OCI state.
+	Bundle string
+}
+
+// SandboxHookRecord returns what the sandbox hook recorded when the container
+// started, see RunOpts.SandboxHook. Unlike SandboxPid, the PID is captured
+// before the container runs, so it's not affected by the container exiting.
+// If the hook didn't run, the error wraps os.ErrNotExist.
+func (d *Docker) SandboxHookRecord() (*HookRecord, error) {
+	if d.hookDir == "" {
+		return nil, fmt.Errorf("container %q was not started with RunOpts.SandboxHook", d.Name)
+	}
+	state, err := ioutil.ReadFile(filepath.Join(d.hookDir, "state.json"))
+	if err != nil {
+		return nil, fmt.Errorf("sandbox hook didn't run, the runtime requires --TESTONLY-hook-dir=%s: %w", hookRoot, err)
+	}
+	cmdline, err := ioutil.ReadFile(filepath.Join(d.hookDir, "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	return parseHookRecord(cmdline, state)
+}
+
+// parseHookRecord parses the files written by hookScript: the newline
+// separated command line and the OCI state in JSON.
+func parseHookRecord(cmdline, state []byte) (*HookRecord, error) {
+	var s struct {
+		ID     string `json:"id"`
+		Pid    int    `json:"pid"`
+		Bundle string `json:"bundle"`
+	}
+	if err := json.Unmarshal(state, &s); err != nil {
+		return nil, fmt.Errorf("parsing hook state %q: %v", state, err)
+	}
+	if s.Pid <= 0 {
+		return nil, fmt.Errorf("invalid sandbox pid in hook state %q", state)
+	}
+	return &HookRecord{
+		Args:   strings.Split(strings.TrimSuffix(string(cmdline), "\n"), "\n"),
+		ID:     s.ID,
+		Pid:    s.Pid,
+		Bundle: s.Bundle,
+	}, nil
+}
+
+// runCommand runs a command to completion and returns its combined output.
+// It's a variable so that tests can fake docker.
+var runCommand = func(cmd *testutil.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// transientErrors are substrings of docker errors that are caused by a busy
+// or flaky daemon, rather than by the container configuration.
+var transientErrors = []string{
+	"connection reset by peer",
+	"layer already exists",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"context deadline exceeded",
+	"Cannot connect to the Docker daemon",
+}
+
+// maxSpawnAttempts is the number of times SpawnWithRetry runs the container.
+const maxSpawnAttempts = 4
+
+// spawnBackoff is the delay before the first retry in SpawnWithRetry. It
+// doubles after each retry.
+var spawnBackoff = time.Second
+
+// isTransient returns true if docker's output contains a transient error.
+func isTransient(out string) bool {
+	for _, e := range transientErrors {
+		if strings.Contains(out, e) {
+			return true
+		}
+	}
+	return false
+}
+
 // Create calls 'docker create' with the arguments provided.
 func (d *Docker) Create(r RunOpts, args ...string) error {
 	out, err := d.run(r, "create", args...)
@@ -365,22 +777,112 @@ func (d *Docker) Start() error {
 	return testutil.Command(d.logger, "docker", "start", d.Name).Run()
 }
 
-// Stop calls 'docker stop'.
-func (d *Docker) Stop() error {
-	return testutil.Command(d.logger, "docker", "stop", d.Name).Run()
+// Stop calls 'docker stop', which sends SIGTERM to the container and SIGKILL
+// if it's still running after 'timeout'. The timeout is rounded up to seconds,
+// and zero kills the container right away. Stopping a container that has
+// already exited succeeds, and so does CleanUp afterwards. Use WaitForExit to
+// find out whether the container exited on its own or was killed.
+func (d *Docker) Stop(timeout time.Duration) error {
+	secs := int64((timeout + time.Second - 1) / time.Second)
+	return testutil.Command(d.logger, "docker", "stop", fmt.Sprintf("--time=%d", secs), d.Name).Run()
 }
 
-// Run calls 'docker run' with the arguments provided.
+// Run calls 'docker run' with the arguments provided. It waits for the
+// container to exit and returns its combined stdout and stderr. If the
+// container exits with a non-zero status, use ExitCode to get it from the
+// returned error.
 func (d *Docker) Run(r RunOpts, args ...string) (string, error) {
 	return d.run(r, "run", args...)
 }
 
+// RunBoth runs the command with 'docker run' under the runtime selected for
+// the test, i.e. runsc, and under runc, and returns the output of both, so that
+// tests can compare their behavior. If the command fails under either runtime,
+// both outputs are still returned, and the error says which runtime failed.
+// The test is skipped if docker doesn't have the runc runtime.
+func RunBoth(t testing.TB, r RunOpts, args ...string) (runscOut, runcOut string, err error) {
+	runtimes, err := dockerRuntimes(t)
+	if err != nil {
+		return "", "", err
+	}
+	if !runtimes["runc"] {
+		t.Skipf("runc runtime is not available, runtimes: %v", runtimes)
+	}
+
+	runsc := MakeDocker(t)
+	defer runsc.CleanUp()
+	runscOut, runscErr := runsc.Run(r, args...)
+
+	runc := MakeDocker(t)
+	runc.Runtime = "runc"
+	defer runc.CleanUp()
+	runcOut, runcErr := runc.Run(r, args...)
+
+	switch {
+	case runscErr != nil:
+		err = fmt.Errorf("%s: %w", runsc.Runtime, runscErr)
+	case runcErr != nil:
+		err = fmt.Errorf("runc: %w", runcErr)
+	}
+	return runscOut, runcOut, err
+}
+
+// dockerRuntimes returns the names of the runtimes configured in docker.
+func dockerRuntimes(logger testutil.Logger) (map[string]bool, error) {
+	out, err := runCommand(testutil.Command(logger, "docker", "info", "--format={{json .Runtimes}}"))
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving runtimes: %v", err)
+	}
+	var runtimes map[string]interface{}
+	if err := json.Unmarshal(out, &runtimes); err != nil {
+		return nil, fmt.Errorf("error parsing runtimes %q: %v", out, err)
+	}
+	names := make(map[string]bool)
+	for name := range runtimes {
+		names[name] = true
+	}
+	return names, nil
+}
+
+// ExitCode returns the exit status of the command that failed with err, 0 if
+// err is nil, or -1 if the command didn't run to completion.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
 // Spawn starts the container and detaches.
 func (d *Docker) Spawn(r RunOpts, args ...string) error {
 	_, err := d.run(r, "spawn", args...)
 	return err
 }
 
+// SpawnWithRetry is like Spawn, but retries with exponential backoff when
+// docker fails with one of transientErrors, up to maxSpawnAttempts times in
+// total. Other errors, e.g. a missing image or an invalid flag, are returned
+// right away.
+func (d *Docker) SpawnWithRetry(r RunOpts, args ...string) error {
+	delay := spawnBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := d.run(r, "spawn", args...)
+		if err == nil || attempt == maxSpawnAttempts || !isTransient(out) {
+			return err
+		}
+		d.logger.Logf("transient docker error (attempt %d/%d), retrying in %v: %v", attempt, maxSpawnAttempts, delay, err)
+		// A failed run may leave the container created, in which case the
+		// name would conflict on the next attempt.
+		runCommand(testutil.Command(d.logger, "docker", "rm", "-f", d.Name))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // Logs calls 'docker logs'.
 func (d *Docker) Logs() (string, error) {
 	// Don't capture the output; since it will swamp the logs.
@@ -393,16 +895,155 @@ func (d *Docker) Exec(r RunOpts, args ...string) (string, error) {
 	return d.run(r, "exec", args...)
 }
 
-// Pause calls 'docker pause'.
+// ExecBlocked runs 'docker exec' with the arguments provided, which are
+// expected to fail with an error message containing 'want', e.g. a command
+// making a syscall blocked by RunOpts.SeccompProfile failing with "Operation
+// not permitted". An error is returned if the command succeeds or fails
+// differently.
+func (d *Docker) ExecBlocked(want string, args ...string) error {
+	out, err := d.Exec(RunOpts{}, args...)
+	if err == nil {
+		return fmt.Errorf("%v succeeded, output: %q, want failure with %q", args, out, want)
+	}
+	if !strings.Contains(out, want) {
+		return fmt.Errorf("%v failed with %v, output: %q, want failure with %q", args, err, out, want)
+	}
+	return nil
+}
+
+// ExecProcess is a process started with ExecStream, that keeps running while
+// the test interacts with it.
+type ExecProcess struct {
+	// Stdin is connected to the standard input of the process. Closing it
+	// sends EOF to the process.
+	Stdin io.WriteCloser
+
+	// Stdout is connected to the standard output and error of the process.
+	Stdout io.Reader
+
+	// Pid is the PID of the process inside of the container.
+	Pid int
+
+	d      *Docker
+	cmd    *testutil.Cmd
+	stdout *os.File
+}
+
+// ExecStream starts 'docker exec' with the arguments provided, and returns
+// without waiting for it to exit. The process is cleaned up by CleanUp, if it
+// hasn't exited by then. The command is run through 'sh' in order to find its
+// PID, so the container must have a shell.
+func (d *Docker) ExecStream(r RunOpts, args ...string) (*ExecProcess, error) {
+	if d.copyErr != nil {
+		return nil, d.copyErr
+	}
+	// The shell prints its PID, then replaces itself with the command.
+	p := append([]string{"sh", "-c", `echo $$; exec "$@"`, "sh"}, args...)
+	cmd := testutil.Command(d.logger, append([]string{"docker", "exec"}, d.argsFor(&r, "exec", p)...)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
+	pw.Close()
+
+	ep := &ExecProcess{Stdin: stdin, d: d, cmd: cmd, stdout: pr}
+	d.cleanups = append(d.cleanups, ep.cleanUp)
+	stdout := bufio.NewReader(pr)
+	line, err := stdout.ReadString('\n')
+	if err == nil {
+		ep.Pid, err = strconv.Atoi(strings.TrimSpace(line))
+	}
+	if err != nil {
+		ep.cleanUp()
+		return nil, fmt.Errorf("reading PID of %v: %v, output: %q", args, err, line)
+	}
+	ep.Stdout = stdout
+	return ep, nil
+}
+
+// Signal sends 'sig' to the process, from inside of the container, so that
+// it's delivered by the sandbox.
+func (p *ExecProcess) Signal(sig syscall.Signal) error {
+	out, err := p.d.Exec(RunOpts{}, "kill", fmt.Sprintf("-%d", sig), strconv.Itoa(p.Pid))
+	if err != nil {
+		return fmt.Errorf("sending signal %d to PID %d: %v, output: %s", sig, p.Pid, err, out)
+	}
+	return nil
+}
+
+// Wait waits for the process to exit. The error has the exit code of the
+// process, see ExitCode. Stdout can still be read after Wait returns.
+func (p *ExecProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+// cleanUp kills the process if it's still running and releases its pipes.
+func (p *ExecProcess) cleanUp() {
+	p.Stdin.Close()
+	if p.cmd.ProcessState == nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+	}
+	p.stdout.Close()
+}
+
+// Environ returns the environment of a new process started with 'docker exec'
+// in the container, as constructed by the sandbox. Variables set with
+// RunOpts.Env when the container was started are expected to be present.
+func (d *Docker) Environ() (map[string]string, error) {
+	out, err := d.Exec(RunOpts{}, "env")
+	if err != nil {
+		return nil, fmt.Errorf("error reading environment: %v", err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			// Continuation of a value with a newline.
+			continue
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env, nil
+}
+
+// Pause calls 'docker pause'. Under runsc, this freezes the sandbox. It's a
+// noop if the container is already paused.
 func (d *Docker) Pause() error {
+	if paused, err := d.Paused(); err == nil && paused {
+		return nil
+	}
 	return testutil.Command(d.logger, "docker", "pause", d.Name).Run()
 }
 
-// Unpause calls 'docker pause'.
+// Unpause calls 'docker unpause'. It's a noop if the container is not paused.
 func (d *Docker) Unpause() error {
+	if paused, err := d.Paused(); err == nil && !paused {
+		return nil
+	}
 	return testutil.Command(d.logger, "docker", "unpause", d.Name).Run()
 }
 
+// Paused returns true if the container is paused.
+func (d *Docker) Paused() (bool, error) {
+	out, err := testutil.Command(d.logger, "docker", "inspect", "-f={{.State.Paused}}", d.Name).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("error retrieving paused state: %v", err)
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(out)))
+}
+
 // Checkpoint calls 'docker checkpoint'.
 func (d *Docker) Checkpoint(name string) error {
 	return testutil.Command(d.logger, "docker", "checkpoint", "create", d.Name, name).Run()
@@ -477,6 +1118,45 @@ func (d *Docker) FindIP() (net.IP, error) {
 	return ip, nil
 }
 
+// NetworkSettings returns the IP address of the container on each network it's
+// connected to, keyed by network name. Containers started without
+// RunOpts.Network are connected to the "bridge" network. Networks that don't
+// assign an address, e.g. "none", are omitted.
+func (d *Docker) NetworkSettings() (map[string]net.IP, error) {
+	const format = `{{json .NetworkSettings.Networks}}`
+	out, err := testutil.Command(d.logger, "docker", "inspect", "-f", format, d.Name).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving networks: %v", err)
+	}
+	var networks map[string]struct {
+		IPAddress string
+	}
+	if err := json.Unmarshal(out, &networks); err != nil {
+		return nil, fmt.Errorf("error parsing networks %q: %v", string(out), err)
+	}
+	ips := make(map[string]net.IP)
+	for name, n := range networks {
+		if n.IPAddress == "" {
+			continue
+		}
+		ip := net.ParseIP(n.IPAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP for network %q: %q", name, n.IPAddress)
+		}
+		ips[name] = ip
+	}
+	return ips, nil
+}
+
+// OOMKilled returns true if the container was killed by the OOM killer.
+func (d *Docker) OOMKilled() (bool, error) {
+	out, err := testutil.Command(d.logger, "docker", "inspect", "-f={{.State.OOMKilled}}", d.Name).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("error retrieving OOM state: %v", err)
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(out)))
+}
+
 // SandboxPid returns the PID to the sandbox process.
 func (d *Docker) SandboxPid() (int, error) {
 	out, err := testutil.Command(d.logger, "docker", "inspect", "-f={{.State.Pid}}", d.Name).CombinedOutput()
@@ -490,6 +1170,51 @@ func (d *Docker) SandboxPid() (int, error) {
 	return pid, nil
 }
 
+// SandboxResourceSnapshot returns the number of open file descriptors and
+// threads of the sandbox process, from /proc/[pid]/fd and /proc/[pid]/status.
+// Comparing snapshots taken before and after a workload finds leaks in the
+// sandbox. If the sandbox process has exited, the error wraps os.ErrNotExist.
+func (d *Docker) SandboxResourceSnapshot() (fds int, threads int, err error) {
+	pid, err := d.SandboxPid()
+	if err != nil {
+		return 0, 0, err
+	}
+	if pid == 0 {
+		return 0, 0, fmt.Errorf("container %q is not running: %w", d.Name, os.ErrNotExist)
+	}
+	dir := fmt.Sprintf("/proc/%d", pid)
+	f, err := os.Open(path.Join(dir, "fd"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading fds of sandbox %d: %w", pid, err)
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading fds of sandbox %d: %w", pid, err)
+	}
+	status, err := ioutil.ReadFile(path.Join(dir, "status"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading status of sandbox %d: %w", pid, err)
+	}
+	threads, err = parseThreads(string(status))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error parsing status of sandbox %d: %v", pid, err)
+	}
+	return len(names), threads, nil
+}
+
+// parseThreads returns the number of threads from the content of
+// /proc/[pid]/status.
+func parseThreads(status string) (int, error) {
+	for _, line := range strings.Split(status, "\n") {
+		if !strings.HasPrefix(line, "Threads:") {
+			continue
+		}
+		return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Threads:")))
+	}
+	return 0, fmt.Errorf("no Threads field in %q", status)
+}
+
 // ID returns the container ID.
 func (d *Docker) ID() (string, error) {
 	out, err := testutil.Command(d.logger, "docker", "inspect", "-f={{.Id}}", d.Name).CombinedOutput()
@@ -499,6 +1224,333 @@ func (d *Docker) ID() (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// CgroupPath returns the path of the container's cgroup relative to the root
+// of the cgroup hierarchy, e.g. "/docker/<id>", or "/<parent>/<id>" with
+// '--cgroup-parent'. It's read from /proc/[pid]/cgroup of the sandbox process,
+// so it reflects where the runtime actually placed the container, regardless
+// of docker's cgroup driver.
+func (d *Docker) CgroupPath() (string, error) {
+	pid, err := d.SandboxPid()
+	if err != nil {
+		return "", err
+	}
+	paths, err := cgroup.LoadPaths(strconv.Itoa(pid))
+	if err != nil {
+		return "", fmt.Errorf("error reading cgroups of pid %d: %v", pid, err)
+	}
+	// cgroup v1 has one path per controller, cgroup v2 a single one with an
+	// empty controller name.
+	for _, ctrl := range []string{"memory", ""} {
+		if p, ok := paths[ctrl]; ok {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no memory cgroup found for pid %d: %v", pid, paths)
+}
+
+// runscStateRoots are the root directories searched by RunscState when the
+// runtime's configuration doesn't set one: docker passes its default runtime
+// root, with the containerd namespace appended, and the containerd shim uses
+// its own.
+var runscStateRoots = []string{
+	"/run/docker/runtime-runc/moby",
+	"/run/docker/runtime-runc",
+	"/run/containerd/runsc/moby",
+}
+
+// RunscState returns the contents of the runtime's state files for the
+// container, keyed by their path, e.g. the container metadata and sandbox
+// state saved by runsc, to debug failed tests. The state is looked up in the
+// '--root' directory of the runtime's configuration, or in runscStateRoots.
+// Files that can't be read, e.g. because the test doesn't run as root, are
+// skipped. If no state is found, the error wraps os.ErrNotExist.
+func (d *Docker) RunscState() (map[string][]byte, error) {
+	id, err := d.ID()
+	if err != nil {
+		return nil, err
+	}
+	roots := runscStateRoots
+	if args, err := runtimeArgs(); err == nil {
+		if root := rootFlag(args); root != "" {
+			roots = []string{filepath.Join(root, "moby"), root}
+		}
+	}
+	for _, root := range roots {
+		state, err := readRunscState(d.logger, root, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(state) > 0 {
+			return state, nil
+		}
+	}
+	return nil, fmt.Errorf("no runsc state found for container %q in %v: %w", id, roots, os.ErrNotExist)
+}
+
+// rootFlag returns the value of the '--root' flag in the runtime arguments
+// 'args', or empty if it's not set.
+func rootFlag(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		switch {
+		case strings.HasPrefix(name, "root="):
+			return strings.TrimPrefix(name, "root=")
+		case name == "root" && arg != name && i+1 < len(args):
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// readRunscState reads the regular files of the container 'id' in the
+// runtime root directory 'root', i.e. the files and directories named after
+// the container ID. A missing or unreadable root is not an error, nothing is
+// returned for it.
+func readRunscState(logger testutil.Logger, root, id string) (map[string][]byte, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsPermission(err) {
+			logger.Logf("Skipping runsc root %q: %v", root, err)
+			return nil, nil
+		}
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading runsc root %q: %v", root, err)
+	}
+	state := make(map[string][]byte)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), id) {
+			continue
+		}
+		if err := filepath.Walk(filepath.Join(root, entry.Name()), func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsPermission(err) || os.IsNotExist(err) {
+					logger.Logf("Skipping runsc state %q: %v", p, err)
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				if os.IsPermission(err) || os.IsNotExist(err) {
+					logger.Logf("Skipping runsc state %q: %v", p, err)
+					return nil
+				}
+				return err
+			}
+			state[p] = data
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("error reading runsc state in %q: %v", root, err)
+		}
+	}
+	return state, nil
+}
+
+// CPUUsage returns the total CPU time consumed by the container, as accounted
+// by its cgroup on the host.
+func (d *Docker) CPUUsage() (time.Duration, error) {
+	cgPath, err := d.CgroupPath()
+	if err != nil {
+		return 0, err
+	}
+	cg := &cgroup.Cgroup{Name: cgPath}
+	stats, err := cg.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading cgroup stats: %v", err)
+	}
+	return stats.CPUUsage, nil
+}
+
+// CPUsAllowed returns the CPUs that PID 1 in the running container is allowed
+// to run on. The affinity is read with sched_getaffinity(2) through taskset,
+// which gVisor implements, unlike Cpus_allowed in /proc/[pid]/status.
+func (d *Docker) CPUsAllowed() ([]int, error) {
+	out, err := d.Exec(RunOpts{}, "taskset", "-p", "1")
+	if err != nil {
+		return nil, fmt.Errorf("error running taskset: %v", err)
+	}
+	// Output format:
+	//   pid 1's current affinity mask: 1
+	fields := strings.Fields(out)
+	if len(fields) == 0 || !strings.Contains(out, "affinity mask:") {
+		return nil, fmt.Errorf("unexpected taskset output: %q", out)
+	}
+	return parseCPUMask(fields[len(fields)-1])
+}
+
+// NumCPU returns the number of CPUs seen by processes in the running
+// container, as reported by nproc.
+func (d *Docker) NumCPU() (int, error) {
+	out, err := d.Exec(RunOpts{}, "nproc")
+	if err != nil {
+		return 0, fmt.Errorf("error running nproc: %v", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("invalid nproc output %q: %v", out, err)
+	}
+	return n, nil
+}
+
+// InitComm returns the command name of PID 1 in the running container, as
+// reported by /proc/1/comm, e.g. "docker-init" when started with Init.
+func (d *Docker) InitComm() (string, error) {
+	out, err := d.Exec(RunOpts{}, "cat", "/proc/1/comm")
+	if err != nil {
+		return "", fmt.Errorf("error reading /proc/1/comm: %v", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Resolve looks up 'host' with nslookup in the running container, and returns
+// its addresses. The query is sent to the DNS servers of the container, see
+// RunOpts.DNS, so it goes through the sandbox network stack. An error is
+// returned if 'host' can't be resolved, e.g. if the container has no network.
+func (d *Docker) Resolve(host string) ([]net.IP, error) {
+	out, err := d.Exec(RunOpts{}, "nslookup", host)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %q: %v, output: %s", host, err, out)
+	}
+	ips := parseNslookup(out)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address found for %q, output: %s", host, out)
+	}
+	return ips, nil
+}
+
+// parseNslookup returns the addresses of the looked up name in the output of
+// busybox's nslookup, formatted like:
+//
+//	Server:		8.8.8.8
+//	Address:	8.8.8.8:53
+//
+//	Non-authoritative answer:
+//	Name:	example.com
+//	Address: 93.184.216.34
+//
+// Older versions print "Address 1: 93.184.216.34 example.com" instead. The
+// server's address comes before the first "Name:" line and is skipped.
+func parseNslookup(out string) []net.IP {
+	var ips []net.IP
+	answer := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "Name:" {
+			answer = true
+			continue
+		}
+		if !answer || !strings.HasPrefix(fields[0], "Address") {
+			continue
+		}
+		addr := fields[1]
+		if !strings.HasSuffix(fields[0], ":") {
+			// "Address 1: <ip>".
+			if len(fields) < 3 {
+				continue
+			}
+			addr = fields[2]
+		}
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// probeSyscallScript makes the syscall whose number and arguments are passed on
+// the command line, and prints the resulting errno, or 0 if it succeeded.
+const probeSyscallScript = `import ctypes, sys
+libc = ctypes.CDLL(None, use_errno=True)
+libc.syscall.restype = ctypes.c_long
+ret = libc.syscall(*[ctypes.c_long(int(a)) for a in sys.argv[1:]])
+print(ctypes.get_errno() if ret == -1 else 0)`
+
+// ProbeSyscall makes the syscall number 'nr', e.g. unix.SYS_MSGGET, with the
+// given integer arguments in a new container, and returns the errno it failed
+// with, or 0 if it succeeded. It tells whether a syscall is emulated, e.g.
+// ENOSYS for syscalls that the sandbox doesn't implement. The container runs
+// the basic/python image, the syscall is made with ctypes.
+func (d *Docker) ProbeSyscall(nr uintptr, args ...uintptr) (syscall.Errno, error) {
+	cmd := []string{"python", "-c", probeSyscallScript, strconv.FormatUint(uint64(nr), 10)}
+	for _, a := range args {
+		cmd = append(cmd, strconv.FormatUint(uint64(a), 10))
+	}
+	out, err := d.Run(RunOpts{Image: "basic/python"}, cmd...)
+	if err != nil {
+		return 0, fmt.Errorf("probing syscall %d: %v, output: %s", nr, err, out)
+	}
+	errno, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("invalid probe output %q: %v", out, err)
+	}
+	return syscall.Errno(errno), nil
+}
+
+// parseCPUMask parses a hexadecimal CPU mask, e.g. "ff" or "00000000,00000003",
+// and returns the CPUs in it in ascending order.
+func parseCPUMask(mask string) ([]int, error) {
+	hex := strings.ReplaceAll(mask, ",", "")
+	var cpus []int
+	for i := len(hex) - 1; i >= 0; i-- {
+		digit, err := strconv.ParseUint(hex[i:i+1], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU mask %q: %v", mask, err)
+		}
+		for bit := 0; bit < 4; bit++ {
+			if digit&(1<<bit) != 0 {
+				cpus = append(cpus, (len(hex)-1-i)*4+bit)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+// ShmSize returns the size in bytes of /dev/shm, as reported by df inside the
+// running container.
+func (d *Docker) ShmSize() (int64, error) {
+	out, err := d.Exec(RunOpts{}, "df", "-k", "/dev/shm")
+	if err != nil {
+		return 0, fmt.Errorf("error running df: %v", err)
+	}
+	// Output format:
+	//   Filesystem 1K-blocks Used Available Use% Mounted on
+	//   shm            65536    0     65536   0% /dev/shm
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %q", out)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %q", out)
+	}
+	kb, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing df output %q: %v", out, err)
+	}
+	return kb * 1024, nil
+}
+
+// Labels returns the labels set on the container.
+func (d *Docker) Labels() (map[string]string, error) {
+	out, err := testutil.Command(d.logger, "docker", "inspect", "-f={{json .Config.Labels}}", d.Name).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving labels: %v", err)
+	}
+	labels := make(map[string]string)
+	if err := json.Unmarshal(out, &labels); err != nil {
+		return nil, fmt.Errorf("error parsing labels %q: %v", out, err)
+	}
+	return labels, nil
+}
+
 // Wait waits for container to exit, up to the given timeout. Returns error if
 // wait fails or timeout is hit. Returns the application return code otherwise.
 // Note that the application may have failed even if err == nil, always check
@@ -530,6 +1582,55 @@ func (d *Docker) Wait(timeout time.Duration) (syscall.WaitStatus, error) {
 	}
 }
 
+// ExitInfo describes how a container exited.
+type ExitInfo struct {
+	// ExitCode is the exit code reported by docker. Containers killed by a
+	// signal have an exit code of 128 plus the signal number.
+	ExitCode int
+
+	// Signal is the signal that killed the container, or 0 if it exited on
+	// its own.
+	Signal syscall.Signal
+
+	// OOMKilled is true if the container was killed by the OOM killer.
+	OOMKilled bool
+}
+
+// WaitForExit waits for the container to exit, e.g. after Stop, and returns
+// how it exited. It returns right away if the container has already exited.
+func (d *Docker) WaitForExit(timeout time.Duration) (ExitInfo, error) {
+	if _, err := d.Wait(timeout); err != nil {
+		return ExitInfo{}, err
+	}
+	out, err := testutil.Command(d.logger, "docker", "inspect", "-f={{.State.ExitCode}} {{.State.OOMKilled}}", d.Name).CombinedOutput()
+	if err != nil {
+		return ExitInfo{}, fmt.Errorf("error retrieving exit state: %v", err)
+	}
+	return parseExitInfo(string(out))
+}
+
+// parseExitInfo parses the exit code and OOM state of a container, separated
+// by a space.
+func parseExitInfo(s string) (ExitInfo, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return ExitInfo{}, fmt.Errorf("invalid exit state %q", s)
+	}
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return ExitInfo{}, fmt.Errorf("error parsing exit code %q: %v", fields[0], err)
+	}
+	oom, err := strconv.ParseBool(fields[1])
+	if err != nil {
+		return ExitInfo{}, fmt.Errorf("error parsing OOM state %q: %v", fields[1], err)
+	}
+	info := ExitInfo{ExitCode: code, OOMKilled: oom}
+	if code > 128 && code <= 128+64 {
+		info.Signal = syscall.Signal(code - 128)
+	}
+	return info, nil
+}
+
 // WaitForOutput calls 'docker logs' to retrieve containers output and searches
 // for the given pattern.
 func (d *Docker) WaitForOutput(pattern string, timeout time.Duration) (string, error) {
@@ -582,3 +1683,16 @@ func (d *Docker) WaitForOutputSubmatch(pattern string, timeout time.Duration) ([
 	}
 	return nil, fmt.Errorf("timeout waiting for output %q: %s", re.String(), lastOut)
 }
+
+// WaitForFile polls 'docker exec test -e <path>' until the path exists inside
+// the container, e.g. a socket or ready file created by the application.
+func (d *Docker) WaitForFile(path string, timeout time.Duration) error {
+	var lastErr error
+	for exp := time.Now().Add(timeout); time.Now().Before(exp); {
+		if _, lastErr = d.Exec(RunOpts{}, "test", "-e", path); lastErr == nil {
+			return nil // Success!
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timeout waiting for file %q, last error: %v", path, lastErr)
+}
@@ -0,0 +1,605 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerutil
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/test/testutil"
+)
+
+// fakeDocker replaces runCommand with a fake that fails 'docker run' with the
+// given outputs, in order, and succeeds once they are exhausted. It returns a
+// pointer to the number of 'docker run' invocations, and a function that
+// restores runCommand.
+func fakeDocker(failures ...string) (*int, func()) {
+	oldRun, oldBackoff := runCommand, spawnBackoff
+	spawnBackoff = 0
+	runs := 0
+	runCommand = func(cmd *testutil.Cmd) ([]byte, error) {
+		if cmd.Args[1] != "run" {
+			return nil, nil
+		}
+		runs++
+		if runs <= len(failures) {
+			return []byte(failures[runs-1]), errors.New("exit status 125")
+		}
+		return []byte("0123456789abcdef\n"), nil
+	}
+	return &runs, func() {
+		runCommand, spawnBackoff = oldRun, oldBackoff
+	}
+}
+
+// fakeRunCommand replaces runCommand with 'fn' until the test completes.
+func fakeRunCommand(t *testing.T, fn func(*testutil.Cmd) ([]byte, error)) {
+	oldRun := runCommand
+	t.Cleanup(func() { runCommand = oldRun })
+	runCommand = fn
+}
+
+// captureArgs replaces runCommand with a fake that returns 'out' until the
+// test completes. It returns a pointer to the arguments of the last command.
+func captureArgs(t *testing.T, out string) *[]string {
+	var args []string
+	fakeRunCommand(t, func(cmd *testutil.Cmd) ([]byte, error) {
+		args = cmd.Args
+		return []byte(out), nil
+	})
+	return &args
+}
+
+func TestParseSubID(t *testing.T) {
+	const subid = "alice:100000:65536\ndockremap:165536:1000\ndockremap:300000:65536\n"
+	for _, tc := range []struct {
+		name    string
+		id      int
+		want    int
+		wantErr bool
+	}{
+		{name: "alice", id: 0, want: 100000},
+		{name: "dockremap", id: 999, want: 166535},
+		{name: "dockremap", id: 1000, want: 300000},
+		{name: "dockremap", id: 66536, wantErr: true},
+		{name: "bob", id: 0, wantErr: true},
+	} {
+		got, err := parseSubID(subid, tc.name, tc.id)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("parseSubID(%q, %d) got error: %v, want error: %t", tc.name, tc.id, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseSubID(%q, %d) got: %d, want: %d", tc.name, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestSpawnWithRetry(t *testing.T) {
+	const (
+		transient = "docker: error during connect: read tcp: connection reset by peer."
+		permanent = "Unable to find image 'gvisor.dev/images/missing:latest' locally"
+	)
+	for _, tc := range []struct {
+		name     string
+		failures []string
+		wantErr  bool
+		wantRuns int
+	}{
+		{
+			name:     "success",
+			wantRuns: 1,
+		},
+		{
+			name:     "transient",
+			failures: []string{transient, transient},
+			wantRuns: 3,
+		},
+		{
+			name:     "permanent",
+			failures: []string{permanent},
+			wantErr:  true,
+			wantRuns: 1,
+		},
+		{
+			name:     "transient-then-permanent",
+			failures: []string{transient, permanent},
+			wantErr:  true,
+			wantRuns: 2,
+		},
+		{
+			name:     "exhausted",
+			failures: []string{transient, transient, transient, transient, transient},
+			wantErr:  true,
+			wantRuns: maxSpawnAttempts,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runs, restore := fakeDocker(tc.failures...)
+			defer restore()
+
+			d := MakeDocker(t)
+			err := d.SpawnWithRetry(RunOpts{Image: "basic/alpine"}, "sleep", "1000")
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("SpawnWithRetry() got error: %v, want error: %t", err, tc.wantErr)
+			}
+			if *runs != tc.wantRuns {
+				t.Errorf("docker run invoked %d times, want: %d", *runs, tc.wantRuns)
+			}
+		})
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	args := captureArgs(t, "hello\n")
+
+	d := MakeDocker(t)
+	out, err := d.Run(RunOpts{Image: "basic/alpine"}, "echo", "hello")
+	if err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	if out != "hello\n" {
+		t.Errorf("Run() got: %q, want: %q", out, "hello\n")
+	}
+	for _, arg := range *args {
+		if arg == "-d" {
+			t.Errorf("Run() should not detach, args: %v", *args)
+		}
+	}
+}
+
+func TestRunArgsCPUs(t *testing.T) {
+	args := captureArgs(t, "")
+
+	for _, tc := range []struct {
+		name string
+		opts RunOpts
+		want string
+	}{
+		{name: "cpus", opts: RunOpts{CPUs: 2}, want: "--cpuset-cpus=0-1"},
+		{name: "single", opts: RunOpts{CPUs: 1}, want: "--cpuset-cpus=0-0"},
+		{name: "cpuset", opts: RunOpts{CPUs: 2, CPUSetCPUs: "3"}, want: "--cpuset-cpus=3"},
+		{name: "unset", opts: RunOpts{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := MakeDocker(t)
+			tc.opts.Image = "basic/alpine"
+			if _, err := d.Run(tc.opts, "nproc"); err != nil {
+				t.Fatalf("Run() failed: %v", err)
+			}
+			var got []string
+			for _, arg := range *args {
+				if strings.HasPrefix(arg, "--cpuset-cpus=") {
+					got = append(got, arg)
+				}
+			}
+			if tc.want == "" {
+				if len(got) != 0 {
+					t.Errorf("Run() got: %v, want no --cpuset-cpus", got)
+				}
+			} else if len(got) != 1 || got[0] != tc.want {
+				t.Errorf("Run() got: %v, want: [%s]", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunArgsInit(t *testing.T) {
+	args := captureArgs(t, "")
+
+	for _, init := range []bool{false, true} {
+		d := MakeDocker(t)
+		if _, err := d.Run(RunOpts{Image: "basic/alpine", Init: init}, "true"); err != nil {
+			t.Fatalf("Run() failed: %v", err)
+		}
+		found := false
+		for _, arg := range *args {
+			if arg == "--init" {
+				found = true
+			}
+		}
+		if found != init {
+			t.Errorf("Run(Init: %t) got args: %v, want --init: %t", init, *args, init)
+		}
+	}
+}
+
+func TestRunArgsDNS(t *testing.T) {
+	args := captureArgs(t, "")
+
+	d := MakeDocker(t)
+	if _, err := d.Run(RunOpts{Image: "basic/alpine", DNS: []string{"8.8.8.8", "1.1.1.1"}}, "true"); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	var got []string
+	for _, arg := range *args {
+		if strings.HasPrefix(arg, "--dns") {
+			got = append(got, arg)
+		}
+	}
+	if want := []string{"--dns=8.8.8.8", "--dns=1.1.1.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Run() got: %v, want: %v", got, want)
+	}
+}
+
+func TestCheckHookRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook-root")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("os.Mkdir(): %v", err)
+	}
+	if err := checkHookRoot(root); err != nil {
+		t.Errorf("checkHookRoot(%q): %v", root, err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatalf("os.Symlink(): %v", err)
+	}
+	if err := checkHookRoot(link); err == nil {
+		t.Errorf("checkHookRoot(%q) should fail for a symlink", link)
+	}
+
+	if err := os.Chmod(root, 0777); err != nil {
+		t.Fatalf("os.Chmod(): %v", err)
+	}
+	if err := checkHookRoot(root); err == nil {
+		t.Errorf("checkHookRoot(%q) should fail for a world-writable directory", root)
+	}
+}
+
+func TestSandboxHook(t *testing.T) {
+	args := captureArgs(t, "")
+
+	d := MakeDocker(t)
+	if _, err := d.SandboxHookRecord(); err == nil {
+		t.Errorf("SandboxHookRecord() without hook succeeded")
+	}
+	if err := d.Spawn(RunOpts{Image: "basic/alpine", SandboxHook: true}, "true"); err != nil {
+		t.Fatalf("Spawn() failed: %v", err)
+	}
+	var hook string
+	for _, arg := range *args {
+		if strings.HasPrefix(arg, "--env="+hookEnv+"=") {
+			hook = strings.TrimPrefix(arg, "--env="+hookEnv+"=")
+		}
+	}
+	if hook == "" {
+		t.Fatalf("Spawn(SandboxHook: true) got args: %v, want --env=%s", *args, hookEnv)
+	}
+	if !strings.HasPrefix(hook, hookRoot+"/") {
+		t.Errorf("sandbox hook %q is not in %q, which the runtime requires", hook, hookRoot)
+	}
+	if _, err := d.SandboxHookRecord(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("SandboxHookRecord() before the hook ran got: %v, want: %v", err, os.ErrNotExist)
+	}
+
+	// Run the hook as the runtime would, passing the OCI state in stdin.
+	cmd := exec.Command(hook)
+	cmd.Stdin = strings.NewReader(`{"ociVersion":"1.0.0","id":"abc","status":"created","pid":1234,"bundle":"/bundle"}`)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("hook failed: %v, output: %s", err, out)
+	}
+	got, err := d.SandboxHookRecord()
+	if err != nil {
+		t.Fatalf("SandboxHookRecord() failed: %v", err)
+	}
+	if got.ID != "abc" || got.Pid != 1234 || got.Bundle != "/bundle" {
+		t.Errorf("SandboxHookRecord() got: %+v, want ID: abc, Pid: 1234, Bundle: /bundle", got)
+	}
+	// The hook's parent is this test.
+	if len(got.Args) == 0 || got.Args[0] != os.Args[0] {
+		t.Errorf("SandboxHookRecord() got args: %q, want: %q", got.Args, os.Args)
+	}
+
+	d.CleanUp()
+	if _, err := os.Stat(hook); !os.IsNotExist(err) {
+		t.Errorf("hook %q was not removed, stat: %v", hook, err)
+	}
+}
+
+func TestParseHookRecord(t *testing.T) {
+	got, err := parseHookRecord([]byte("runsc\n--root=/run/runsc\nstart\nabc\n"), []byte(`{"id":"abc","pid":42,"bundle":"/b"}`))
+	if err != nil {
+		t.Fatalf("parseHookRecord() failed: %v", err)
+	}
+	want := &HookRecord{
+		Args:   []string{"runsc", "--root=/run/runsc", "start", "abc"},
+		ID:     "abc",
+		Pid:    42,
+		Bundle: "/b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHookRecord() got: %+v, want: %+v", got, want)
+	}
+	for _, state := range []string{"", "{}", `{"pid":0}`} {
+		if _, err := parseHookRecord(nil, []byte(state)); err == nil {
+			t.Errorf("parseHookRecord(%q) succeeded", state)
+		}
+	}
+}
+
+func TestParseNslookup(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []net.IP
+	}{
+		{
+			name: "new",
+			out: `Server:		8.8.8.8
+Address:	8.8.8.8:53
+
+Non-authoritative answer:
+Name:	example.com
+Address: 93.184.216.34
+
+Non-authoritative answer:
+Name:	example.com
+Address: 2606:2800:220:1:248:1893:25c8:1946
+`,
+			want: []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1:248:1893:25c8:1946")},
+		},
+		{
+			name: "old",
+			out: `Server:    8.8.8.8
+Address 1: 8.8.8.8 dns.google
+
+Name:      example.com
+Address 1: 93.184.216.34
+`,
+			want: []net.IP{net.ParseIP("93.184.216.34")},
+		},
+		{
+			name: "not found",
+			out: `Server:		8.8.8.8
+Address:	8.8.8.8:53
+
+** server can't find nonexistent.invalid: NXDOMAIN
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseNslookup(tc.out); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseNslookup() got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExecStream(t *testing.T) {
+	// The fake docker prints a PID, like the shell wrapping the command, then
+	// echoes its input.
+	dir, err := ioutil.TempDir("", "dockerutil")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte("#!/bin/sh\necho 42\nexec cat\n"), 0755); err != nil {
+		t.Fatalf("ioutil.WriteFile() failed: %v", err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	d := MakeDocker(t)
+	p, err := d.ExecStream(RunOpts{}, "cat")
+	if err != nil {
+		t.Fatalf("ExecStream() failed: %v", err)
+	}
+	if p.Pid != 42 {
+		t.Errorf("ExecStream() got PID: %d, want: 42", p.Pid)
+	}
+	if _, err := p.Stdin.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("error writing to stdin: %v", err)
+	}
+	p.Stdin.Close()
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait() failed: %v", err)
+	}
+	out, err := ioutil.ReadAll(p.Stdout)
+	if err != nil {
+		t.Fatalf("error reading from stdout: %v", err)
+	}
+	if got, want := string(out), "hello\n"; got != want {
+		t.Errorf("Stdout got: %q, want: %q", got, want)
+	}
+	for _, c := range d.cleanups {
+		c()
+	}
+}
+
+func TestProbeSyscall(t *testing.T) {
+	args := captureArgs(t, "38\n")
+
+	d := MakeDocker(t)
+	errno, err := d.ProbeSyscall(180, 1, 2)
+	if err != nil {
+		t.Fatalf("ProbeSyscall() failed: %v", err)
+	}
+	if errno != syscall.ENOSYS {
+		t.Errorf("ProbeSyscall() got: %v, want: %v", errno, syscall.ENOSYS)
+	}
+	if got, want := (*args)[len(*args)-3:], []string{"180", "1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ProbeSyscall() got args: %v, want suffix: %v", *args, want)
+	}
+
+	fakeRunCommand(t, func(*testutil.Cmd) ([]byte, error) {
+		return []byte("Traceback"), nil
+	})
+	if _, err := d.ProbeSyscall(180); err == nil {
+		t.Errorf("ProbeSyscall() should have failed with invalid output")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if got := ExitCode(nil); got != 0 {
+		t.Errorf("ExitCode(nil) got: %d, want: 0", got)
+	}
+	if got := ExitCode(errors.New("no such image")); got != -1 {
+		t.Errorf("ExitCode(error) got: %d, want: -1", got)
+	}
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	if got := ExitCode(err); got != 3 {
+		t.Errorf("ExitCode(%v) got: %d, want: 3", err, got)
+	}
+}
+
+func TestParseExitInfo(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    ExitInfo
+		wantErr bool
+	}{
+		{in: "0 false\n", want: ExitInfo{}},
+		{in: "3 false\n", want: ExitInfo{ExitCode: 3}},
+		{in: "143 false\n", want: ExitInfo{ExitCode: 143, Signal: syscall.SIGTERM}},
+		{in: "137 true\n", want: ExitInfo{ExitCode: 137, Signal: syscall.SIGKILL, OOMKilled: true}},
+		{in: "255 false\n", want: ExitInfo{ExitCode: 255}},
+		{in: "0\n", wantErr: true},
+		{in: "abc false\n", wantErr: true},
+	} {
+		got, err := parseExitInfo(tc.in)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("parseExitInfo(%q) got error: %v, want error: %t", tc.in, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseExitInfo(%q) got: %+v, want: %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseThreads(t *testing.T) {
+	const status = "Name:\trunsc-sandbox\nState:\tS (sleeping)\nThreads:\t12\nSigQ:\t0/63456\n"
+	if got, err := parseThreads(status); err != nil || got != 12 {
+		t.Errorf("parseThreads() got: %d, %v, want: 12, nil", got, err)
+	}
+	if _, err := parseThreads("Name:\tsleep\n"); err == nil {
+		t.Errorf("parseThreads() should have failed without Threads")
+	}
+}
+
+func TestRootFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: nil, want: ""},
+		{args: []string{"--debug", "--root=/run/runsc"}, want: "/run/runsc"},
+		{args: []string{"-root", "/run/runsc", "--debug"}, want: "/run/runsc"},
+		{args: []string{"--root"}, want: ""},
+		{args: []string{"--rootless", "root"}, want: ""},
+	} {
+		if got := rootFlag(tc.args); got != tc.want {
+			t.Errorf("rootFlag(%q) got: %q, want: %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestReadRunscState(t *testing.T) {
+	root, err := ioutil.TempDir("", "runsc-state")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	const id = "0123456789abcdef"
+	files := map[string]string{
+		id + "/meta.json":                                 `{"id":"` + id + `"}`,
+		id + "/sandbox/state.json":                        `{"status":"running"}`,
+		id + "_sandbox:" + id + ".state":                  "{}",
+		"fedcba9876543210/meta.json":                      "other container",
+		"fedcba9876543210_sandbox:fedcba9876543210.state": "other container",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+	}
+
+	got, err := readRunscState(t, root, id)
+	if err != nil {
+		t.Fatalf("readRunscState(): %v", err)
+	}
+	want := make(map[string][]byte)
+	for name, content := range files {
+		if strings.HasPrefix(name, id) {
+			want[filepath.Join(root, name)] = []byte(content)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readRunscState() got: %q, want: %q", got, want)
+	}
+
+	// A missing root has no state.
+	if got, err := readRunscState(t, filepath.Join(root, "missing"), id); err != nil || len(got) != 0 {
+		t.Errorf("readRunscState() with a missing root got: %q, %v, want: empty, nil", got, err)
+	}
+}
+
+func TestRunBoth(t *testing.T) {
+	infoOut := `{"io.containerd.runc.v2":{"path":"runc"},"runc":{"path":"runc"},"runsc":{"path":"/usr/local/bin/runsc"}}`
+	fakeRunCommand(t, func(cmd *testutil.Cmd) ([]byte, error) {
+		switch cmd.Args[1] {
+		case "info":
+			return []byte(infoOut), nil
+		case "run":
+			for _, arg := range cmd.Args {
+				if arg == "--runtime=runc" {
+					return []byte("runc\n"), nil
+				}
+			}
+			return []byte("runsc\n"), errors.New("exit status 1")
+		}
+		return nil, nil
+	})
+
+	runscOut, runcOut, err := RunBoth(t, RunOpts{Image: "basic/alpine"}, "uname", "-s")
+	if runscOut != "runsc\n" || runcOut != "runc\n" {
+		t.Errorf("RunBoth() got outputs: %q, %q, want: %q, %q", runscOut, runcOut, "runsc\n", "runc\n")
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), *runtime+":") {
+		t.Errorf("RunBoth() got error: %v, want %s failure", err, *runtime)
+	}
+
+	// Without runc, the test is skipped.
+	infoOut = `{"runsc":{"path":"/usr/local/bin/runsc"}}`
+	var skipped bool
+	t.Run("skip", func(t *testing.T) {
+		defer func() { skipped = t.Skipped() }()
+		RunBoth(t, RunOpts{Image: "basic/alpine"}, "uname", "-s")
+	})
+	if !skipped {
+		t.Errorf("RunBoth() should skip the test without runc")
+	}
+}
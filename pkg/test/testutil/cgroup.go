@@ -0,0 +1,130 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// cgroupMount is where cgroup hierarchies are mounted. It's a variable so that
+// tests can provide a synthetic tree.
+var cgroupMount = "/sys/fs/cgroup"
+
+// CgroupSnapshot is the set of sandbox cgroup directories that existed when
+// it was taken by SnapshotCgroups.
+type CgroupSnapshot struct {
+	// trees are the cgroup directories that were scanned, under each
+	// hierarchy.
+	trees []string
+
+	// paths are the directories found in the trees.
+	paths map[string]struct{}
+}
+
+// SnapshotCgroups records the cgroup directories in the trees where sandbox
+// cgroups are created, i.e. "docker" and the given '--cgroup-parent' trees,
+// e.g. "/runsc-test", in every cgroup hierarchy. Together with
+// CgroupLeakCheck, it checks that a test doesn't leave cgroups behind:
+//
+//	defer testutil.CgroupLeakCheck(t, testutil.SnapshotCgroups(t, parent))
+//
+// Cgroups created concurrently by other tests are reported as leaks, so tests
+// using it must not run in parallel with tests that create sandboxes.
+func SnapshotCgroups(t testing.TB, parents ...string) *CgroupSnapshot {
+	t.Helper()
+	s := &CgroupSnapshot{}
+	for _, root := range cgroupHierarchies() {
+		for _, tree := range append([]string{"docker"}, parents...) {
+			s.trees = append(s.trees, filepath.Join(root, tree))
+		}
+	}
+	paths, err := cgroupDirs(s.trees)
+	if err != nil {
+		t.Fatalf("error listing cgroups: %v", err)
+	}
+	s.paths = paths
+	return s
+}
+
+// CgroupLeakCheck fails the test with the list of cgroup directories that
+// were created since 'before' was taken and still exist. See SnapshotCgroups.
+func CgroupLeakCheck(t testing.TB, before *CgroupSnapshot) {
+	t.Helper()
+	after, err := cgroupDirs(before.trees)
+	if err != nil {
+		t.Errorf("error listing cgroups: %v", err)
+		return
+	}
+	var leaked []string
+	for path := range after {
+		if _, ok := before.paths[path]; !ok {
+			leaked = append(leaked, path)
+		}
+	}
+	if len(leaked) > 0 {
+		sort.Strings(leaked)
+		t.Errorf("cgroups leaked: %s", strings.Join(leaked, ", "))
+	}
+}
+
+// cgroupHierarchies returns the mount points of the cgroup hierarchies, i.e.
+// cgroupMount on cgroup v2 hosts, or its directories with cgroup v1. Symlinks,
+// e.g. "cpu" to "cpu,cpuacct", are skipped to scan each hierarchy once.
+func cgroupHierarchies() []string {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err == nil {
+		return []string{cgroupMount}
+	}
+	infos, err := ioutil.ReadDir(cgroupMount)
+	if err != nil {
+		return nil
+	}
+	var roots []string
+	for _, info := range infos {
+		if info.IsDir() {
+			roots = append(roots, filepath.Join(cgroupMount, info.Name()))
+		}
+	}
+	return roots
+}
+
+// cgroupDirs returns all directories below 'trees'. Missing trees are
+// skipped.
+func cgroupDirs(trees []string) (map[string]struct{}, error) {
+	paths := make(map[string]struct{})
+	for _, tree := range trees {
+		if err := filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					// The tree doesn't exist, or a directory was removed
+					// while walking it.
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() && path != tree {
+				paths[path] = struct{}{}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
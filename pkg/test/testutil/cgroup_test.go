@@ -0,0 +1,86 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// errorRecorder records the errors of a test instead of failing it.
+type errorRecorder struct {
+	testing.TB
+	errors []string
+}
+
+// Errorf implements testing.TB.Errorf.
+func (r *errorRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCgroupLeakCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-leak")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldMount := cgroupMount
+	cgroupMount = dir
+	defer func() { cgroupMount = oldMount }()
+
+	mkdir := func(name string) {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(): %v", err)
+		}
+	}
+	// cgroup v1 hierarchies, with a pre-existing sandbox.
+	mkdir("memory/docker/existing")
+	mkdir("pids/docker")
+	if err := os.Symlink("memory", filepath.Join(dir, "mem")); err != nil {
+		t.Fatalf("os.Symlink(): %v", err)
+	}
+
+	before := SnapshotCgroups(t, "/runsc-parent")
+	mkdir("pids/docker/removed")
+	if err := os.Remove(filepath.Join(dir, "pids/docker/removed")); err != nil {
+		t.Fatalf("os.Remove(): %v", err)
+	}
+	r := &errorRecorder{TB: t}
+	CgroupLeakCheck(r, before)
+	if len(r.errors) != 0 {
+		t.Errorf("CgroupLeakCheck() without leaks got: %v", r.errors)
+	}
+
+	// Leaks are detected in docker and parent trees, including children.
+	mkdir("memory/docker/leaked")
+	mkdir("pids/runsc-parent/leaked/child")
+	r = &errorRecorder{TB: t}
+	CgroupLeakCheck(r, before)
+	if len(r.errors) != 1 {
+		t.Fatalf("CgroupLeakCheck() got errors: %v, want 1", r.errors)
+	}
+	for _, leak := range []string{"memory/docker/leaked", "pids/runsc-parent/leaked", "pids/runsc-parent/leaked/child"} {
+		if !strings.Contains(r.errors[0], filepath.Join(dir, leak)) {
+			t.Errorf("CgroupLeakCheck() got: %q, want leak: %q", r.errors[0], leak)
+		}
+	}
+	if strings.Contains(r.errors[0], "existing") || strings.Contains(r.errors[0], "/mem/") {
+		t.Errorf("CgroupLeakCheck() got: %q, want only new directories reported once", r.errors[0])
+	}
+}
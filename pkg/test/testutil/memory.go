@@ -0,0 +1,94 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxHostMemoryFraction is the largest fraction of MemAvailable that
+// AllocateHostMemory is allowed to take, so that tests never OOM the runner.
+const maxHostMemoryFraction = 0.5
+
+// meminfoPath is read to find the host's available memory. It's a variable so
+// that tests can provide a synthetic file.
+var meminfoPath = "/proc/meminfo"
+
+// HostMemAvailable returns the host's available memory in bytes, as reported
+// by MemAvailable in /proc/meminfo.
+func HostMemAvailable() (uint64, error) {
+	out, err := ioutil.ReadFile(meminfoPath)
+	if err != nil {
+		return 0, err
+	}
+	return parseMemAvailable(string(out))
+}
+
+// parseMemAvailable returns MemAvailable in bytes from the content of
+// /proc/meminfo, where it's reported in kB.
+func parseMemAvailable(meminfo string) (uint64, error) {
+	for _, line := range strings.Split(meminfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "MemAvailable:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid line %q: %v", line, err)
+		}
+		return kb << 10, nil
+	}
+	return 0, fmt.Errorf("no MemAvailable field in %q", meminfo)
+}
+
+// AllocateHostMemory allocates and touches 'size' bytes of anonymous host
+// memory, to reproduce low memory conditions on the host, e.g. to test how the
+// sandbox reacts to reclaim. The memory is held until the returned function is
+// called, which must be called exactly once, typically deferred.
+//
+// Requests above half of the host's MemAvailable fail instead of risking to
+// OOM the test runner.
+func AllocateHostMemory(size uint64) (func(), error) {
+	avail, err := HostMemAvailable()
+	if err != nil {
+		return nil, fmt.Errorf("error reading available memory: %v", err)
+	}
+	if max := uint64(float64(avail) * maxHostMemoryFraction); size > max {
+		return nil, fmt.Errorf("allocating %d bytes of host memory: over the limit of %d bytes (%.0f%% of MemAvailable)", size, max, maxHostMemoryFraction*100)
+	}
+	if size == 0 {
+		return func() {}, nil
+	}
+	mem, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("error allocating %d bytes of host memory: %v", size, err)
+	}
+	// Touch every page, so that it's backed by memory.
+	pageSize := os.Getpagesize()
+	for i := 0; i < len(mem); i += pageSize {
+		mem[i] = 1
+	}
+	return func() {
+		if err := syscall.Munmap(mem); err != nil {
+			log.Printf("error releasing %d bytes of host memory: %v", size, err)
+		}
+	}, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseMemAvailable(t *testing.T) {
+	const meminfo = "MemTotal:       16303428 kB\nMemFree:         1013616 kB\nMemAvailable:    9175040 kB\n"
+	got, err := parseMemAvailable(meminfo)
+	if err != nil {
+		t.Fatalf("parseMemAvailable(): %v", err)
+	}
+	if want := uint64(9175040 << 10); got != want {
+		t.Errorf("parseMemAvailable() got: %d, want: %d", got, want)
+	}
+	for _, s := range []string{"", "MemTotal: 16303428 kB\n", "MemAvailable: abc kB\n"} {
+		if _, err := parseMemAvailable(s); err == nil {
+			t.Errorf("parseMemAvailable(%q) should have failed", s)
+		}
+	}
+}
+
+// vmRSS returns the resident memory of this process in bytes, as reported by
+// VmRSS in /proc/self/status.
+func vmRSS(t *testing.T) uint64 {
+	t.Helper()
+	out, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "VmRSS:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		return kb << 10
+	}
+	t.Fatalf("no VmRSS field in %q", out)
+	return 0
+}
+
+func TestAllocateHostMemory(t *testing.T) {
+	avail, err := HostMemAvailable()
+	if err != nil {
+		t.Fatalf("HostMemAvailable(): %v", err)
+	}
+	if _, err := AllocateHostMemory(avail); err == nil {
+		t.Errorf("AllocateHostMemory(%d) over the limit should have failed", avail)
+	}
+
+	// The allocation is checked against this process' resident memory, which
+	// other processes on the host don't change. The Go runtime may allocate
+	// or release some memory concurrently, hence the slack.
+	size := uint64(64 << 20)
+	if max := avail / 8; size > max {
+		size = max
+	}
+	slack := size / 4
+	before := vmRSS(t)
+	release, err := AllocateHostMemory(size)
+	if err != nil {
+		t.Fatalf("AllocateHostMemory(%d): %v", size, err)
+	}
+	during := vmRSS(t)
+	release()
+	after := vmRSS(t)
+	if during < before+size-slack {
+		t.Errorf("VmRSS while allocated got: %d, want at least: %d", during, before+size-slack)
+	}
+	if after > during-size+slack {
+		t.Errorf("VmRSS after release got: %d, want at most: %d", after, during-size+slack)
+	}
+}
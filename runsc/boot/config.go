@@ -254,6 +254,13 @@ type Config struct {
 	// parameters to the runtime from docker.
 	TestOnlyTestNameEnv string
 
+	// TestOnlyHookDir should only be used in tests. It's a host directory from
+	// which the container environment may select an executable, with the
+	// RUNSC_TEST_HOOK variable, to be added as a prestart hook to the container
+	// spec. This allows tests to inspect the sandbox when it starts, since
+	// there is no way to add hooks from docker.
+	TestOnlyHookDir string
+
 	// CPUNumFromQuota sets CPU number count to available CPU quota, using
 	// least integer value greater than or equal to quota.
 	//
@@ -305,6 +312,9 @@ func (c *Config) ToFlags() []string {
 	if len(c.TestOnlyTestNameEnv) != 0 {
 		f = append(f, "--TESTONLY-test-name-env="+c.TestOnlyTestNameEnv)
 	}
+	if len(c.TestOnlyHookDir) != 0 {
+		f = append(f, "--TESTONLY-hook-dir="+c.TestOnlyHookDir)
+	}
 
 	if c.VFS2 {
 		f = append(f, "--vfs2=true")
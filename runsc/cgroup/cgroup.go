@@ -19,10 +19,13 @@ package cgroup
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -31,65 +34,141 @@ import (
 	"github.com/cenkalti/backoff"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/runsc/specutils"
 )
 
-const (
-	cgroupRoot = "/sys/fs/cgroup"
-)
+// ErrNotSupported is returned when the host's cgroup configuration doesn't
+// support the requested operation, e.g. a cgroup v2 only file on cgroup v1.
+var ErrNotSupported = errors.New("not supported by the host cgroup configuration")
+
+// ErrReadOnlyCgroupfs is returned by Install when the cgroup filesystem is
+// mounted read-only, e.g. in locked down CI environments, and cgroups can't be
+// created.
+var ErrReadOnlyCgroupfs = errors.New("cgroup filesystem is read-only")
+
+// ErrHasChildren is returned by Uninstall when the cgroup still has child
+// cgroups, e.g. created with Child.
+var ErrHasChildren = errors.New("cgroup has child cgroups")
+
+// cgroupRoot is the mount point for the cgroup hierarchies. It's a variable
+// so that tests can point it at a synthetic hierarchy.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// procRoot is the mount point of procfs. It's a variable so that tests can
+// provide synthetic /proc/[pid]/cgroup files.
+var procRoot = "/proc"
+
+// nodeRoot is where the kernel lists the host's NUMA nodes. It's a variable so
+// that tests can provide a synthetic list.
+var nodeRoot = "/sys/devices/system/node"
 
 var controllers = map[string]controller{
-	"blkio":    &blockIO{},
+	"blkio":    &blockIO{controllerCommon{isOptional: true}},
 	"cpu":      &cpu{},
 	"cpuset":   &cpuSet{},
 	"memory":   &memory{},
-	"net_cls":  &networkClass{},
-	"net_prio": &networkPrio{},
+	"net_cls":  &networkClass{controllerCommon{isOptional: true}},
+	"net_prio": &networkPrio{controllerCommon{isOptional: true}},
 	"pids":     &pids{},
 
 	// These controllers either don't have anything in the OCI spec or is
 	// irrelevant for a sandbox.
+	"cpuacct":    &noop{controllerCommon{isOptional: true}},
 	"devices":    &noop{},
 	"freezer":    &noop{},
-	"perf_event": &noop{},
-	"systemd":    &noop{},
+	"perf_event": &noop{controllerCommon{isOptional: true}},
+	"systemd":    &noop{controllerCommon{isOptional: true}},
+}
+
+// customLogger, if set, is used instead of runsc's global logger.
+var customLogger log.Logger
+
+// SetLogger sets the logger used by this package to report skipped
+// controllers, retries and other soft failures. Passing nil restores runsc's
+// global logger.
+func SetLogger(l log.Logger) {
+	customLogger = l
+}
+
+func logger() log.Logger {
+	if customLogger != nil {
+		return customLogger
+	}
+	return log.Log()
 }
 
-func setOptionalValueInt(path, name string, val *int64) error {
+func setOptionalValueInt(w Writer, path, name string, val *int64) error {
 	if val == nil || *val == 0 {
 		return nil
 	}
 	str := strconv.FormatInt(*val, 10)
-	return setValue(path, name, str)
+	return writeValue(w, path, name, str)
+}
+
+// setOptionalLimit writes a cgroup v1 limit, mapping negative values and
+// Unlimited to "-1". Nil and zero values are skipped.
+func setOptionalLimit(w Writer, path, name string, val *int64) error {
+	if val == nil || *val == 0 {
+		return nil
+	}
+	return writeValue(w, path, name, formatLimit(*val, false))
 }
 
-func setOptionalValueUint(path, name string, val *uint64) error {
+func setOptionalValueUint(w Writer, path, name string, val *uint64) error {
 	if val == nil || *val == 0 {
 		return nil
 	}
 	str := strconv.FormatUint(*val, 10)
-	return setValue(path, name, str)
+	return writeValue(w, path, name, str)
 }
 
-func setOptionalValueUint32(path, name string, val *uint32) error {
+func setOptionalValueUint32(w Writer, path, name string, val *uint32) error {
 	if val == nil || *val == 0 {
 		return nil
 	}
 	str := strconv.FormatUint(uint64(*val), 10)
-	return setValue(path, name, str)
+	return writeValue(w, path, name, str)
 }
 
-func setOptionalValueUint16(path, name string, val *uint16) error {
+func setOptionalValueUint16(w Writer, path, name string, val *uint16) error {
 	if val == nil || *val == 0 {
 		return nil
 	}
 	str := strconv.FormatUint(uint64(*val), 10)
-	return setValue(path, name, str)
+	return writeValue(w, path, name, str)
 }
 
+// writeFile is used to write to all cgroup files. It's a variable so that
+// tests can simulate failures, e.g. EACCES when running without privileges.
+var writeFile = ioutil.WriteFile
+
+// rmdir is used to remove cgroup directories. It's a variable so that tests can
+// simulate failures, e.g. EBUSY while tasks are exiting.
+var rmdir = syscall.Rmdir
+
+// rmdirRetryInterval is how long to wait before retrying to remove a busy
+// cgroup directory.
+const rmdirRetryInterval = 100 * time.Millisecond
+
+// rmdirTimeout is how long to keep retrying to remove a busy cgroup directory.
+// It's a variable so that tests, whose directories are never emptied by the
+// kernel, don't wait for it.
+var rmdirTimeout = 5 * time.Second
+
 func setValue(path, name, data string) error {
+	return writeValue(LocalWriter{}, path, name, data)
+}
+
+// writeValue is like setValue, with the write performed by 'w'.
+func writeValue(w Writer, path, name, data string) error {
 	fullpath := filepath.Join(path, name)
-	return ioutil.WriteFile(fullpath, []byte(data), 0700)
+	err := w.WriteFile(fullpath, data)
+	if os.IsNotExist(err) && enableMissingController(w, path, name) {
+		// Controller files only show up once the controller is enabled.
+		err = w.WriteFile(fullpath, data)
+	}
+	return err
 }
 
 func getValue(path, name string) (string, error) {
@@ -109,9 +188,91 @@ func getInt(path, name string) (int, error) {
 	return strconv.Atoi(strings.TrimSpace(s))
 }
 
+func getInt64(path, name string) (int64, error) {
+	s, err := getValue(path, name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+}
+
+// getKeyValues reads a flat keyed file, e.g. 'cgroup.events', where each line
+// has the format "<key> <value>".
+func getKeyValues(path, name string) (map[string]uint64, error) {
+	s, err := getValue(path, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyValues(s)
+}
+
+func parseKeyValues(s string) (map[string]uint64, error) {
+	vals := make(map[string]uint64)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid keyed line: %q", line)
+		}
+		val, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyed line: %q: %v", line, err)
+		}
+		vals[fields[0]] = val
+	}
+	return vals, nil
+}
+
+// Unlimited is returned by readers of cgroup limits when no limit is set,
+// regardless of how the file represents it.
+const Unlimited int64 = math.MaxInt64
+
+// unlimitedThreshold is the smallest value read from a limit file that is
+// considered unlimited. cgroup v1 reports unset limits as the largest multiple
+// of the page size, e.g. 9223372036854771712 with 4KiB pages. The threshold
+// accounts for pages of up to 64KiB.
+const unlimitedThreshold = math.MaxInt64 &^ (64<<10 - 1)
+
+// parseLimit parses the content of a limit file. "max" (cgroup v2), "-1"
+// (cgroup v1) and values above unlimitedThreshold are returned as Unlimited.
+func parseLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "max", "-1":
+		return Unlimited, nil
+	}
+	val, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q: %v", s, err)
+	}
+	if val < 0 {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+	if val >= unlimitedThreshold {
+		return Unlimited, nil
+	}
+	return val, nil
+}
+
+// formatLimit formats a limit to be written to a cgroup v1 or v2 file.
+// Unlimited and negative values, which the OCI spec uses for no limit, are
+// written as "max" with cgroup v2 and as "-1" with cgroup v1.
+func formatLimit(val int64, v2 bool) string {
+	if val < 0 || val == Unlimited {
+		if v2 {
+			return "max"
+		}
+		return "-1"
+	}
+	return strconv.FormatInt(val, 10)
+}
+
 // fillFromAncestor sets the value of a cgroup file from the first ancestor
-// that has content. It does nothing if the file in 'path' has already been set.
-func fillFromAncestor(path string) (string, error) {
+// that has content, writing with 'w'. It does nothing if the file in 'path'
+// has already been set.
+func fillFromAncestor(w Writer, path string) (string, error) {
 	out, err := ioutil.ReadFile(path)
 	if err != nil {
 		return "", err
@@ -125,11 +286,12 @@ func fillFromAncestor(path string) (string, error) {
 	// File is not set, recurse to parent and then  set here.
 	name := filepath.Base(path)
 	parent := filepath.Dir(filepath.Dir(path))
-	val, err = fillFromAncestor(filepath.Join(parent, name))
+	val, err = fillFromAncestor(w, filepath.Join(parent, name))
 	if err != nil {
 		return "", err
 	}
-	if err := ioutil.WriteFile(path, []byte(val), 0700); err != nil {
+	logger().Debugf("Setting cgroup %q to %q from ancestor", path, val)
+	if err := w.WriteFile(path, val); err != nil {
 		return "", err
 	}
 	return val, nil
@@ -138,40 +300,79 @@ func fillFromAncestor(path string) (string, error) {
 // countCpuset returns the number of CPU in a string formatted like:
 // 		"0-2,7,12-14  # bits 0, 1, 2, 7, 12, 13, and 14 set" - man 7 cpuset
 func countCpuset(cpuset string) (int, error) {
-	var count int
+	cpus, err := parseCpuset(cpuset)
+	if err != nil {
+		return 0, err
+	}
+	return len(cpus), nil
+}
+
+// parseCpuset returns the CPUs in a cpuset string formatted as described in
+// countCpuset, in the order they appear.
+func parseCpuset(cpuset string) ([]int, error) {
+	var cpus []int
 	for _, p := range strings.Split(cpuset, ",") {
 		interval := strings.Split(p, "-")
 		switch len(interval) {
 		case 1:
-			if _, err := strconv.Atoi(interval[0]); err != nil {
-				return 0, err
+			cpu, err := strconv.Atoi(interval[0])
+			if err != nil {
+				return nil, err
 			}
-			count++
+			cpus = append(cpus, cpu)
 
 		case 2:
 			start, err := strconv.Atoi(interval[0])
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
 			end, err := strconv.Atoi(interval[1])
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
 			if start < 0 || end < 0 || start > end {
-				return 0, fmt.Errorf("invalid cpuset: %q", p)
+				return nil, fmt.Errorf("invalid cpuset: %q", p)
+			}
+			for cpu := start; cpu <= end; cpu++ {
+				cpus = append(cpus, cpu)
 			}
-			count += end - start + 1
 
 		default:
-			return 0, fmt.Errorf("invalid cpuset: %q", p)
+			return nil, fmt.Errorf("invalid cpuset: %q", p)
 		}
 	}
-	return count, nil
+	return cpus, nil
+}
+
+// formatCpuset is the inverse of parseCpuset. Consecutive CPUs are merged
+// into intervals, e.g. [0 1 2 7] becomes "0-2,7".
+func formatCpuset(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// isV2 returns true if the controller is configured through the cgroup v2
+// unified hierarchy, in which case all such controllers share a single
+// directory per cgroup.
+func isV2(controllerName string) bool {
+	return getHierarchies().isV2(controllerName)
 }
 
 // LoadPaths loads cgroup paths for given 'pid', may be set to 'self'.
 func LoadPaths(pid string) (map[string]string, error) {
-	f, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	f, err := os.Open(filepath.Join(procRoot, pid, "cgroup"))
 	if err != nil {
 		return nil, err
 	}
@@ -198,10 +399,23 @@ func LoadPaths(pid string) (map[string]string, error) {
 
 // Cgroup represents a group inside all controllers. For example: Name='/foo/bar'
 // maps to /sys/fs/cgroup/<controller>/foo/bar on all controllers.
+//
+// Cgroup is safe for concurrent use. Methods that only read from the cgroup,
+// e.g. Stat, can run concurrently, while methods that change it, e.g. Install,
+// Uninstall and setters, are exclusive. Fields must not be changed directly
+// while methods may be running, and a Cgroup must not be copied after first use.
 type Cgroup struct {
 	Name    string            `json:"name"`
 	Parents map[string]string `json:"parents"`
 	Own     bool              `json:"own"`
+
+	// Controllers are the sorted names of the controllers that Install created
+	// or configured, which Join adds processes to. Controllers that were
+	// skipped, e.g. with InstallOpts.BestEffort, aren't included.
+	Controllers []string `json:"controllers,omitempty"`
+
+	// mu serializes changes to the cgroup, including its fields, with reads.
+	mu sync.RWMutex
 }
 
 // New creates a new Cgroup instance if the spec includes a cgroup path.
@@ -224,106 +438,620 @@ func New(spec *specs.Spec) (*Cgroup, error) {
 	}, nil
 }
 
+// Exists returns true if the cgroup directory of the memory controller (or the
+// cgroup v2 directory) exists. It's false once the cgroup has been removed,
+// e.g. after the sandbox exited and was cleaned up. An error is only returned
+// if the directory can't be checked.
+func (c *Cgroup) Exists() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.exists()
+}
+
+// exists is like Exists, with c.mu held.
+func (c *Cgroup) exists() (bool, error) {
+	path := c.makePath("memory")
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking cgroup %q: %v", path, err)
+	}
+	return true, nil
+}
+
+// Resolve makes the cgroup point to the cgroup of the running process 'pid' if
+// the recorded paths don't exist. That happens when the cgroup was created
+// under a different hierarchy mode than the current one, e.g. the host switched
+// from cgroup v1 to v2, in which case the recorded parents are keyed by v1
+// controllers. The parents are re-resolved from /proc/[pid]/cgroup, with the
+// process expected to be in a cgroup named after c.Name.
+func (c *Cgroup) Resolve(pid int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok, err := c.exists(); err != nil || ok {
+		return err
+	}
+	paths, err := LoadPaths(strconv.Itoa(pid))
+	if err != nil {
+		return fmt.Errorf("loading cgroups of PID %d: %v", pid, err)
+	}
+	name := filepath.Clean("/" + c.Name)
+	parents := make(map[string]string)
+	for ctrl, path := range paths {
+		if path == name {
+			parents[ctrl] = "/"
+		} else if strings.HasSuffix(path, name) {
+			parents[ctrl] = strings.TrimSuffix(path, name)
+		}
+	}
+	resolved := Cgroup{Name: c.Name, Parents: parents, Own: c.Own}
+	if ok, err := resolved.exists(); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("cgroup %q not found for PID %d, paths: %v", c.Name, pid, paths)
+	}
+	logger().Infof("Cgroup %q re-resolved from PID %d, parents: %v => %v", c.Name, pid, c.Parents, parents)
+	c.Parents = parents
+	return nil
+}
+
 // Install creates and configures cgroups according to 'res'. If cgroup path
 // already exists, it means that the caller has already provided a
 // pre-configured cgroups, and 'res' is ignored.
+//
+// Install only programs limits, it never moves tasks into the cgroup. Placing
+// tasks is a separate step, so that callers can compose them:
+//  1. Install creates the cgroup and sets its limits.
+//  2. Join moves the current process into it, so that processes started
+//     afterwards inherit it, and returns a function to move back. Callers
+//     that delegate task placement, e.g. to an orchestrator, skip this step
+//     and let it write to 'cgroup.procs'.
+//  3. Uninstall removes the cgroup once all tasks have exited.
 func (c *Cgroup) Install(res *specs.LinuxResources) error {
+	return c.InstallContext(context.Background(), res)
+}
+
+// InstallContext is like Install, but stops if 'ctx' is cancelled or expires.
+// The context is checked before each write to cgroupfs. If it's done, the
+// partially created cgroup is removed and an error wrapping ctx.Err() is
+// returned.
+//
+// Note that a write that is already blocked in the kernel can't be
+// interrupted; the context only prevents further operations from starting.
+func (c *Cgroup) InstallContext(ctx context.Context, res *specs.LinuxResources) error {
+	return c.InstallWithOpts(ctx, res, InstallOpts{})
+}
+
+// InstallOpts configures how InstallWithOpts creates and configures the
+// cgroup.
+type InstallOpts struct {
+	// BestEffort skips controllers that can't be created or configured due to
+	// missing privileges (EACCES or EPERM), e.g. when running rootless, as
+	// long as 'res' doesn't explicitly set anything for them. Skipped
+	// controllers are logged. Other errors, and permission errors on
+	// controllers that 'res' configures, still fail the installation.
+	//
+	// If the cgroup filesystem is read-only, no cgroup is created and Install
+	// succeeds, instead of failing with ErrReadOnlyCgroupfs.
+	BestEffort bool
+
+	// Delegated creates the cgroup within the subtree returned by
+	// DelegatedRoot if it's not already, e.g. when running rootless, where
+	// only that subtree is writable. The cgroup is then created under the
+	// delegated root, and Parents is updated accordingly. Requires cgroup v2.
+	Delegated bool
+
+	// Writer performs the writes to cgroupfs, including the creation of the
+	// cgroup directories, e.g. a HelperWriter that delegates them to a
+	// privileged helper process. If nil, a LocalWriter is used. Reads are
+	// always done directly.
+	//
+	// The Writer is only used by the installation, and by Uninstall with
+	// UninstallOpts.Writer. Join and the setters, e.g. SetCPUSetMems, always
+	// write from the current process, which must be allowed to.
+	Writer Writer
+
+	// SystemdUnit is the systemd unit that owns the cgroup, e.g. a transient
+	// scope created by the caller with "Delegate=yes". Resources are applied
+	// to the existing cgroup of the unit with systemd properties, e.g.
+	// MemoryMax, CPUQuota and TasksMax, so that systemd doesn't revert them
+	// when it reconciles the unit. Resources that systemd doesn't model are
+	// written directly, to the controllers in which the unit has a cgroup. The
+	// cgroup isn't owned by runsc, and is removed by systemd with the unit.
+	//
+	// Properties are set with 'systemctl set-property --runtime' rather than
+	// over D-Bus directly, to avoid depending on a D-Bus client. The system
+	// manager is used when running as root, and the user's manager, with
+	// 'systemctl --user', otherwise. systemctl must be in PATH.
+	SystemdUnit string
+}
+
+// writer returns the Writer to install the cgroup with.
+func (o InstallOpts) writer() Writer {
+	if o.Writer == nil {
+		return LocalWriter{}
+	}
+	return o.Writer
+}
+
+// skip returns true if 'err', which occurred while creating or configuring
+// the given controller, can be ignored according to the options.
+func (o InstallOpts) skip(controllerName string, res *specs.LinuxResources, err error) bool {
+	if !o.BestEffort || !errors.Is(err, os.ErrPermission) || configured(controllerName, res) {
+		return false
+	}
+	logger().Warningf("Skipping cgroup controller %q, insufficient privileges: %v", controllerName, err)
+	return true
+}
+
+// configured returns true if 'res' explicitly sets anything for the given
+// controller.
+func configured(controllerName string, res *specs.LinuxResources) bool {
+	if res == nil {
+		return false
+	}
+	switch controllerName {
+	case "memory":
+		return res.Memory != nil
+	case "cpu":
+		return res.CPU != nil && (res.CPU.Shares != nil || res.CPU.Quota != nil || res.CPU.Period != nil)
+	case "cpuset":
+		return res.CPU != nil && (res.CPU.Cpus != "" || res.CPU.Mems != "")
+	case "blkio":
+		return res.BlockIO != nil
+	case "net_cls", "net_prio":
+		return res.Network != nil
+	case "pids":
+		return res.Pids != nil
+	}
+	return false
+}
+
+// InstallWithOpts is like InstallContext, with failures handled according to
+// 'opts'.
+func (c *Cgroup) InstallWithOpts(ctx context.Context, res *specs.LinuxResources, opts InstallOpts) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Controllers = nil
+	h := getHierarchies()
+	if opts.Delegated {
+		if err := c.delegate(h); err != nil {
+			return err
+		}
+	}
+	if opts.SystemdUnit != "" {
+		if err := c.installSystemd(ctx, h, res, opts); err != nil {
+			return err
+		}
+		c.Controllers = c.existingControllers(h)
+		return nil
+	}
 	if _, err := os.Stat(c.makePath("memory")); err == nil {
 		// If cgroup has already been created; it has been setup by caller. Don't
 		// make any changes to configuration, just join when sandbox/gofer starts.
-		log.Debugf("Using pre-created cgroup %q", c.Name)
+		logger().Debugf("Using pre-created cgroup %q", c.Name)
+		c.Controllers = c.existingControllers(h)
 		return nil
 	}
 
-	log.Debugf("Creating cgroup %q", c.Name)
+	if mount := h.readOnlyMount(); mount != "" {
+		err := fmt.Errorf("%w: %q is mounted read-only", ErrReadOnlyCgroupfs, mount)
+		if opts.BestEffort {
+			logger().Warningf("Skipping creation of cgroup %q: %v", c.Name, err)
+			return nil
+		}
+		return err
+	}
+
+	logger().Debugf("Creating cgroup %q", c.Name)
 
 	// Mark that cgroup resources are owned by me.
 	c.Own = true
 
 	// The Cleanup object cleans up partially created cgroups when an error occurs.
 	// Errors occuring during cleanup itself are ignored.
-	clean := specutils.MakeCleanup(func() { _ = c.Uninstall() })
+	w := ctxWriter{ctx: ctx, w: opts.writer()}
+	clean := specutils.MakeCleanup(func() { _ = c.uninstall(context.Background(), UninstallOpts{Writer: opts.Writer}) })
 	defer clean.Clean()
 
-	for key, ctrl := range controllers {
-		path := c.makePath(key)
-		if err := os.MkdirAll(path, 0755); err != nil {
+	// fail handles errors creating or configuring the cgroup. The mount flags
+	// checked above may not reflect all cases of read-only cgroupfs, e.g. a
+	// read-only bind mount on top of it, which is reported as EROFS instead.
+	fail := func(err error) error {
+		if !errors.Is(err, syscall.EROFS) {
+			return err
+		}
+		err = fmt.Errorf("%w: %v", ErrReadOnlyCgroupfs, err)
+		if opts.BestEffort {
+			logger().Warningf("Skipping creation of cgroup %q: %v", c.Name, err)
+			clean.Clean()
+			c.Own = false
+			c.Controllers = nil
+			return nil
+		}
+		return err
+	}
+
+	if h.hasV2() {
+		path := c.makePath("")
+		if err := w.MkdirAll(path); err != nil {
+			if !opts.BestEffort || !errors.Is(err, os.ErrPermission) {
+				return fail(err)
+			}
+			// Each controller is checked below, failing if it's configured.
+			logger().Warningf("Creating cgroup %q: %v", path, err)
+		} else {
+			enableControllers(w, h.unified, path)
+		}
+	}
+	for key, ctrl := range h.controllers() {
+		if err := ctx.Err(); err != nil {
+			logger().Warningf("Aborting creation of cgroup %q: %v", c.Name, err)
 			return err
 		}
+		if skipController(key, ctrl) {
+			continue
+		}
+		path := c.makePath(key)
+		logger().Debugf("Configuring cgroup controller %q at %q", key, path)
+		if err := w.MkdirAll(path); err != nil {
+			if opts.skip(key, res, err) {
+				continue
+			}
+			return fail(err)
+		}
 		if res != nil {
-			if err := ctrl.set(res, path); err != nil {
-				return err
+			if err := ctrl.set(w, res, path); err != nil {
+				if opts.skip(key, res, err) {
+					continue
+				}
+				return fail(err)
 			}
 		}
+		c.Controllers = append(c.Controllers, key)
 	}
+	if _, ok := h.controllers()["memory"]; ok && !h.isV2("memory") {
+		warnMemoryHierarchy(c.makePath("memory"), h.v1Mount("memory"))
+	}
+	sort.Strings(c.Controllers)
 	clean.Release()
 	return nil
 }
 
+// existingControllers returns the sorted names of the controllers in which the
+// cgroup exists, e.g. when it was created by the caller.
+func (c *Cgroup) existingControllers(h *hierarchies) []string {
+	var keys []string
+	for key, ctrl := range h.controllers() {
+		if skipController(key, ctrl) {
+			continue
+		}
+		if _, err := os.Stat(c.makePath(key)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Child creates a child cgroup named 'name' under the cgroup, in all
+// controllers, configured according to 'res'. This is meant for pods, where
+// the sandbox cgroup is the parent of one cgroup per container. The cgroup
+// must exist, and 'name' must be a single path element.
+//
+// The child is installed like with Install: on cgroup v2, controllers are
+// enabled in the parent's 'cgroup.subtree_control', which fails if the parent
+// has tasks of its own. The parent can't be uninstalled while the child
+// exists, unless UninstallOpts.Cascade is set.
+func (c *Cgroup) Child(name string, res *specs.LinuxResources) (*Cgroup, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return nil, fmt.Errorf("invalid child cgroup name %q", name)
+	}
+	c.mu.RLock()
+	exists, err := c.exists()
+	child := &Cgroup{Name: filepath.Join(c.Name, name)}
+	if c.Parents != nil {
+		child.Parents = make(map[string]string, len(c.Parents))
+		for key, parent := range c.Parents {
+			child.Parents[key] = parent
+		}
+	}
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("creating child %q: cgroup %q doesn't exist", name, c.Name)
+	}
+	if err := child.Install(res); err != nil {
+		return nil, fmt.Errorf("creating child cgroup %q: %w", child.Name, err)
+	}
+	return child, nil
+}
+
+// UninstallOpts configures how UninstallWithOpts handles child cgroups.
+type UninstallOpts struct {
+	// Cascade removes child cgroups, deepest first, before removing the
+	// cgroup itself. Children must not have tasks left. Otherwise,
+	// ErrHasChildren is returned and nothing is removed.
+	Cascade bool
+
+	// Writer removes the cgroup directories, see InstallOpts.Writer. If nil,
+	// a LocalWriter is used.
+	Writer Writer
+}
+
+// writer returns the Writer to uninstall the cgroup with.
+func (o UninstallOpts) writer() Writer {
+	if o.Writer == nil {
+		return LocalWriter{}
+	}
+	return o.Writer
+}
+
 // Uninstall removes the settings done in Install(). If cgroup path already
-// existed when Install() was called, Uninstall is a noop.
+// existed when Install() was called, Uninstall is a noop. It fails with
+// ErrHasChildren if the cgroup has child cgroups.
 func (c *Cgroup) Uninstall() error {
+	return c.UninstallWithOpts(UninstallOpts{})
+}
+
+// UninstallWithOpts is like Uninstall, with child cgroups handled according
+// to 'opts'.
+func (c *Cgroup) UninstallWithOpts(opts UninstallOpts) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uninstall(context.Background(), opts)
+}
+
+// UninstallContext is like UninstallWithOpts with Cascade set, but stops if
+// 'ctx' is cancelled or expires. The context is checked before each directory
+// is removed and also bounds the EBUSY retries of each removal. If it's done,
+// an *UninstallError is returned with the directories removed so far and the
+// ones left, so that teardown of deep hierarchies can't hang shutdown.
+func (c *Cgroup) UninstallContext(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uninstall(ctx, UninstallOpts{Cascade: true})
+}
+
+// UninstallError is returned by UninstallContext when the context is done
+// before all cgroup directories are removed.
+type UninstallError struct {
+	// Removed lists the directories that were removed, in removal order.
+	Removed []string
+
+	// Remaining lists the directories that were not removed, in the order
+	// they would have been removed.
+	Remaining []string
+
+	// Err is the context error.
+	Err error
+}
+
+// Error implements error.
+func (e *UninstallError) Error() string {
+	return fmt.Sprintf("uninstalling cgroup: removed %d of %d directories: %v", len(e.Removed), len(e.Removed)+len(e.Remaining), e.Err)
+}
+
+// Unwrap returns the context error.
+func (e *UninstallError) Unwrap() error {
+	return e.Err
+}
+
+// uninstall is like UninstallWithOpts, with c.mu held. It stops if 'ctx' is
+// done, as described in UninstallContext.
+func (c *Cgroup) uninstall(ctx context.Context, opts UninstallOpts) error {
 	if !c.Own {
 		// cgroup is managed by caller, don't touch it.
 		return nil
 	}
-	log.Debugf("Deleting cgroup %q", c.Name)
-	for key := range controllers {
+	ctrls := getHierarchies().controllers()
+	keys := make([]string, 0, len(ctrls))
+	for key := range ctrls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !opts.Cascade {
+		for _, key := range keys {
+			path := c.makePath(key)
+			children, err := childCgroups(path)
+			if err != nil {
+				return err
+			}
+			if len(children) > 0 {
+				return fmt.Errorf("removing cgroup %q: %w: %v", path, ErrHasChildren, children)
+			}
+		}
+	}
+
+	// List the directories to remove upfront, children deepest first, to
+	// report progress if the context is done. Co-mounted controllers share
+	// directories, which are removed once.
+	var dirs []cgroupDir
+	seen := make(map[string]bool)
+	add := func(key, path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return
+		}
+		dirs = append(dirs, cgroupDir{key: key, path: path})
+	}
+	for _, key := range keys {
 		path := c.makePath(key)
-		log.Debugf("Removing cgroup controller for key=%q path=%q", key, path)
+		if opts.Cascade {
+			children, err := childCgroups(path)
+			if err != nil {
+				return err
+			}
+			// Children are listed parents first.
+			for i := len(children) - 1; i >= 0; i-- {
+				add(key, children[i])
+			}
+		}
+		add(key, path)
+	}
 
-		// If we try to remove the cgroup too soon after killing the
-		// sandbox we might get EBUSY, so we retry for a few seconds
-		// until it succeeds.
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		b := backoff.WithContext(backoff.NewConstantBackOff(100*time.Millisecond), ctx)
-		if err := backoff.Retry(func() error {
-			err := syscall.Rmdir(path)
+	logger().Debugf("Deleting cgroup %q", c.Name)
+	w := opts.writer()
+	var removed []string
+	for i, d := range dirs {
+		if err := ctx.Err(); err != nil {
+			return uninstallError(removed, dirs[i:], err)
+		}
+		if err := removeCgroupDir(ctx, w, d.key, d.path); err != nil {
+			if ctxErr := retryContextErr(ctx); ctxErr != nil {
+				return uninstallError(removed, dirs[i:], ctxErr)
+			}
+			return err
+		}
+		removed = append(removed, d.path)
+	}
+	return nil
+}
+
+// cgroupDir is a cgroup directory and the controller it belongs to.
+type cgroupDir struct {
+	key  string
+	path string
+}
+
+// retryContextErr returns the error of 'ctx' if it's done, or if it expires
+// before the next removal retry, in which case retries are abandoned early.
+func retryContextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < rmdirRetryInterval {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// uninstallError returns an *UninstallError for directories removed before
+// 'err' stopped the removal of the remaining ones.
+func uninstallError(removed []string, remaining []cgroupDir, err error) error {
+	e := &UninstallError{Removed: removed, Err: err}
+	for _, d := range remaining {
+		e.Remaining = append(e.Remaining, d.path)
+	}
+	return e
+}
+
+// childCgroups returns the paths of all descendants of the cgroup directory
+// 'path', parents before their children. It returns nil if 'path' doesn't
+// exist.
+func childCgroups(path string) ([]string, error) {
+	var children []string
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
 			if os.IsNotExist(err) {
 				return nil
 			}
 			return err
-		}, b); err != nil {
-			return fmt.Errorf("removing cgroup path %q: %v", path, err)
 		}
+		if info.IsDir() && p != path {
+			children = append(children, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing child cgroups of %q: %v", path, err)
+	}
+	return children, nil
+}
+
+// removeCgroupDir removes the directory of the controller's cgroup at 'path'.
+// It's not an error if it doesn't exist. Retries stop early if 'ctx' is done.
+func removeCgroupDir(ctx context.Context, w Writer, key, path string) error {
+	logger().Debugf("Removing cgroup controller for key=%q path=%q", key, path)
+
+	// If we try to remove the cgroup too soon after killing the
+	// sandbox we might get EBUSY, so we retry for a few seconds
+	// until it succeeds.
+	ctx, cancel := context.WithTimeout(ctx, rmdirTimeout)
+	defer cancel()
+	b := backoff.WithContext(backoff.NewConstantBackOff(rmdirRetryInterval), ctx)
+	if err := backoff.Retry(func() error {
+		err := w.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			logger().Debugf("Retrying removal of cgroup controller %q path %q: %v", key, path, err)
+		}
+		return err
+	}, b); err != nil {
+		return fmt.Errorf("removing cgroup path %q: %v", path, err)
 	}
 	return nil
 }
 
-// Join adds the current process to the all controllers. Returns function that
-// restores cgroup to the original state.
+// Join adds the current process to the controllers that Install created or
+// configured, see Controllers. Returns function that restores cgroup to the
+// original state. If there are none, e.g. because Install skipped the creation
+// of the cgroup, nothing is joined and the function does nothing.
 func (c *Cgroup) Join() (func(), error) {
-	// First save the current state so it can be restored.
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	undo := func() {}
+	if len(c.Controllers) == 0 {
+		logger().Debugf("No controllers to join for cgroup %q", c.Name)
+		return undo, nil
+	}
+	// First save the current state so it can be restored.
 	paths, err := LoadPaths("self")
 	if err != nil {
 		return undo, err
 	}
+	h := getHierarchies()
 	var undoPaths []string
-	for ctrlr, path := range paths {
-		// Skip controllers we don't handle.
-		if _, ok := controllers[ctrlr]; ok {
-			fullPath := filepath.Join(cgroupRoot, ctrlr, path)
+	seen := make(map[string]bool)
+	for _, key := range c.Controllers {
+		var fullPath string
+		if h.isV2(key) {
+			path, ok := paths[""]
+			if !ok {
+				continue
+			}
+			fullPath = filepath.Join(h.unified, path)
+		} else {
+			path, ok := paths[key]
+			if !ok {
+				continue
+			}
+			fullPath = filepath.Join(h.v1Mount(key), path)
+		}
+		if !seen[fullPath] {
+			seen[fullPath] = true
 			undoPaths = append(undoPaths, fullPath)
-			break
 		}
 	}
 
 	// Replace empty undo with the real thing before changes are made to cgroups.
 	undo = func() {
 		for _, path := range undoPaths {
-			log.Debugf("Restoring cgroup %q", path)
+			logger().Debugf("Restoring cgroup %q", path)
 			if err := setValue(path, "cgroup.procs", "0"); err != nil {
-				log.Warningf("Error restoring cgroup %q: %v", path, err)
+				logger().Warningf("Error restoring cgroup %q: %v", path, err)
 			}
 		}
 	}
 
-	// Now join the cgroups.
-	for key := range controllers {
+	// Now join the cgroups. Co-mounted controllers share a directory, which is
+	// joined once.
+	joined := make(map[string]bool)
+	for _, key := range c.Controllers {
 		path := c.makePath(key)
-		log.Debugf("Joining cgroup %q", path)
+		if joined[path] {
+			continue
+		}
+		joined[path] = true
+		logger().Debugf("Joining cgroup %q", path)
 		if err := setValue(path, "cgroup.procs", "0"); err != nil {
 			return undo, err
 		}
@@ -331,8 +1059,20 @@ func (c *Cgroup) Join() (func(), error) {
 	return undo, nil
 }
 
+// CPUQuota returns the CPU quota as a fraction of the period, e.g. 1.5 CPUs,
+// or -1 if no quota is set.
 func (c *Cgroup) CPUQuota() (float64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cpuQuota()
+}
+
+// cpuQuota is like CPUQuota, with c.mu held.
+func (c *Cgroup) cpuQuota() (float64, error) {
 	path := c.makePath("cpu")
+	if isV2("cpu") {
+		return cpuQuota2(path)
+	}
 	quota, err := getInt(path, "cpu.cfs_quota_us")
 	if err != nil {
 		return -1, err
@@ -347,191 +1087,1175 @@ func (c *Cgroup) CPUQuota() (float64, error) {
 	return float64(quota) / float64(period), nil
 }
 
-// NumCPU returns the number of CPUs configured in 'cpuset/cpuset.cpus'.
-func (c *Cgroup) NumCPU() (int, error) {
-	path := c.makePath("cpuset")
-	cpuset, err := getValue(path, "cpuset.cpus")
+// Populated returns true if the cgroup or any of its descendants has live
+// tasks. With cgroup v2 it's read from 'cgroup.events', otherwise it checks
+// whether 'cgroup.procs' in the memory controller is not empty.
+func (c *Cgroup) Populated() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path := c.makePath("memory")
+	if !isV2("memory") {
+		populated := false
+		err := c.forEachTask(func(int) bool {
+			populated = true
+			return false
+		})
+		return populated, err
+	}
+	events, err := getKeyValues(path, "cgroup.events")
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	return countCpuset(strings.TrimSpace(cpuset))
+	val, ok := events["populated"]
+	if !ok {
+		return false, fmt.Errorf("%q not found in %q", "populated", filepath.Join(path, "cgroup.events"))
+	}
+	return val != 0, nil
 }
 
-// MemoryLimit returns the memory limit.
-func (c *Cgroup) MemoryLimit() (uint64, error) {
-	path := c.makePath("memory")
-	limStr, err := getValue(path, "memory.limit_in_bytes")
+// WatchPopulated returns a channel that receives the populated state of the
+// cgroup, starting with the current state and then every time it changes. The
+// channel is closed when the returned cancel function is called or the state
+// can no longer be read. Requires cgroup v2.
+func (c *Cgroup) WatchPopulated() (<-chan bool, func(), error) {
+	if !isV2("memory") {
+		return nil, nil, fmt.Errorf("watching populated state requires cgroup v2")
+	}
+	c.mu.RLock()
+	path := filepath.Join(c.makePath("memory"), "cgroup.events")
+	c.mu.RUnlock()
+	events, stop, err := watch(path, eventModify)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
+	}
+
+	ch := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		first := true
+		var last bool
+		for {
+			populated, err := c.Populated()
+			if err != nil {
+				logger().Warningf("Error reading cgroup %q populated state: %v", path, err)
+				return
+			}
+			if first || populated != last {
+				select {
+				case ch <- populated:
+				case <-done:
+					return
+				}
+				first = false
+				last = populated
+			}
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+			stop()
+		})
 	}
-	return strconv.ParseUint(strings.TrimSpace(limStr), 10, 64)
+	return ch, cancel, nil
 }
 
-func (c *Cgroup) makePath(controllerName string) string {
+// WaitPopulated waits until the cgroup has at least one task, or until 'ctx'
+// is done. With cgroup v2 it waits for notifications on 'cgroup.events',
+// otherwise 'cgroup.procs' is polled.
+func (c *Cgroup) WaitPopulated(ctx context.Context) error {
+	if isV2("memory") {
+		ch, cancel, err := c.WatchPopulated()
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		for {
+			select {
+			case populated, ok := <-ch:
+				if !ok {
+					return fmt.Errorf("watch on cgroup %q stopped", c.Name)
+				}
+				if populated {
+					return nil
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		populated, err := c.Populated()
+		if err != nil {
+			return err
+		}
+		if populated {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Age returns how long ago the cgroup was created. cgroupfs doesn't record the
+// creation time, so the change time of the memory controller's directory (or
+// the cgroup v2 directory) is used instead. It's set when the directory is
+// created and is updated by changes to it, e.g. when a child cgroup is created,
+// so the result is a lower bound for cgroups that have children.
+func (c *Cgroup) Age() (time.Duration, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path := c.makePath("memory")
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, fmt.Errorf("stat(%q): %v", path, err)
+	}
+	return time.Since(time.Unix(st.Ctim.Unix())), nil
+}
+
+// CPUShares returns the value of 'cpu.shares'. Requires cgroup v1, see
+// CPUWeight for cgroup v2.
+func (c *Cgroup) CPUShares() (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("cpu") {
+		return 0, fmt.Errorf("cpu.shares: %w", ErrNotSupported)
+	}
+	return getUint(c.makePath("cpu"), "cpu.shares")
+}
+
+// SetCPUShares sets 'cpu.shares'. Requires cgroup v1, see SetCPUWeight for
+// cgroup v2.
+func (c *Cgroup) SetCPUShares(shares uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isV2("cpu") {
+		return fmt.Errorf("cpu.shares: %w", ErrNotSupported)
+	}
+	return setValue(c.makePath("cpu"), "cpu.shares", strconv.FormatUint(shares, 10))
+}
+
+// RTRuntime returns the value of 'cpu.rt_runtime_us', the time in microseconds
+// that realtime tasks in the cgroup may run for in each RTPeriod, or -1 if
+// it's unlimited. Requires cgroup v1 and a kernel with CONFIG_RT_GROUP_SCHED,
+// ErrNotSupported is returned otherwise.
+func (c *Cgroup) RTRuntime() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path, err := c.rtPath()
+	if err != nil {
+		return 0, err
+	}
+	return getInt64(path, "cpu.rt_runtime_us")
+}
+
+// SetRTRuntime sets 'cpu.rt_runtime_us'. The runtime must fit within the
+// parent's allocation: the runtimes of the cgroup and its siblings, relative to
+// their periods, can't add up to more than the parent's, and the kernel rejects
+// the write otherwise. Since new cgroups get no realtime runtime, ancestors up
+// to the root must be given some first. Requires cgroup v1 and a kernel with
+// CONFIG_RT_GROUP_SCHED, ErrNotSupported is returned otherwise.
+func (c *Cgroup) SetRTRuntime(us int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path, err := c.rtPath()
+	if err != nil {
+		return err
+	}
+	return setValue(path, "cpu.rt_runtime_us", strconv.FormatInt(us, 10))
+}
+
+// RTPeriod returns the value of 'cpu.rt_period_us', the period in microseconds
+// over which RTRuntime is allotted. Requires cgroup v1 and a kernel with
+// CONFIG_RT_GROUP_SCHED, ErrNotSupported is returned otherwise.
+func (c *Cgroup) RTPeriod() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path, err := c.rtPath()
+	if err != nil {
+		return 0, err
+	}
+	return getInt64(path, "cpu.rt_period_us")
+}
+
+// SetRTPeriod sets 'cpu.rt_period_us'. Like SetRTRuntime, the change is
+// rejected if the runtime no longer fits within the parent's allocation.
+// Requires cgroup v1 and a kernel with CONFIG_RT_GROUP_SCHED, ErrNotSupported
+// is returned otherwise.
+func (c *Cgroup) SetRTPeriod(us int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path, err := c.rtPath()
+	if err != nil {
+		return err
+	}
+	return setValue(path, "cpu.rt_period_us", strconv.FormatInt(us, 10))
+}
+
+// rtPath returns the path of the cpu controller, if it supports realtime
+// bandwidth control.
+func (c *Cgroup) rtPath() (string, error) {
+	if isV2("cpu") {
+		return "", fmt.Errorf("cpu.rt_runtime_us, realtime group scheduling is not supported by cgroup v2: %w", ErrNotSupported)
+	}
+	path := c.makePath("cpu")
+	if err := checkRT(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// NumCPU returns the number of CPUs configured in 'cpuset/cpuset.cpus'. With
+// cgroup v2, 'cpuset.cpus.effective' is used instead, since 'cpuset.cpus' is
+// empty unless explicitly set.
+func (c *Cgroup) NumCPU() (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path := c.makePath("cpuset")
+	name := "cpuset.cpus"
+	if isV2("cpuset") {
+		name = "cpuset.cpus.effective"
+	}
+	cpuset, err := getValue(path, name)
+	if err != nil {
+		return 0, err
+	}
+	return countCpuset(strings.TrimSpace(cpuset))
+}
+
+// SetCPUSetFromCount sets 'cpuset.cpus' to the first 'n' CPUs available to the
+// parent cgroup, i.e. in its 'cpuset.effective_cpus' (or
+// 'cpuset.cpus.effective' on cgroup v2). It fails if fewer than 'n' CPUs are
+// available.
+func (c *Cgroup) SetCPUSetFromCount(n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n <= 0 {
+		return fmt.Errorf("invalid CPU count: %d", n)
+	}
+	path := c.makePath("cpuset")
+	parent := filepath.Dir(path)
+	cpus, err := effectiveCpuset(parent, "cpus")
+	if err != nil {
+		return err
+	}
+	if len(cpus) < n {
+		return fmt.Errorf("not enough CPUs in %q, want: %d, available: %d (%s)", parent, n, len(cpus), formatCpuset(cpus))
+	}
+	return setValue(path, "cpuset.cpus", formatCpuset(cpus[:n]))
+}
+
+// SetCPUSetMems sets 'cpuset.mems' to the memory nodes in 'mems', e.g. "0-1".
+// The nodes are checked against the parent's effective nodes, or the host's
+// online nodes if they can't be read, so that a clear error listing the
+// invalid nodes is returned instead of EINVAL. If 'mems' is empty, the parent's
+// nodes are used.
+func (c *Cgroup) SetCPUSetMems(mems string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.makePath("cpuset")
+	if mems == "" {
+		if isV2("cpuset") {
+			// Empty means that the parent's effective nodes are used.
+			return setValue(path, "cpuset.mems", "")
+		}
+		val, err := fillFromAncestor(LocalWriter{}, filepath.Join(filepath.Dir(path), "cpuset.mems"))
+		if err != nil {
+			return err
+		}
+		return setValue(path, "cpuset.mems", val)
+	}
+	if err := validateMems(filepath.Dir(path), mems); err != nil {
+		return err
+	}
+	return setValue(path, "cpuset.mems", mems)
+}
+
+// validateMems checks that all memory nodes in 'mems' are available to the
+// cpuset in 'parent'. Validation is skipped if the available nodes can't be
+// determined, leaving it to the kernel.
+func validateMems(parent, mems string) error {
+	want, err := parseCpuset(mems)
+	if err != nil {
+		return fmt.Errorf("invalid cpuset.mems %q: %v", mems, err)
+	}
+	avail, err := effectiveCpuset(parent, "mems")
+	if err != nil || len(avail) == 0 {
+		online, err := getValue(nodeRoot, "online")
+		if err != nil {
+			logger().Debugf("Skipping validation of cpuset.mems %q, available nodes unknown: %v", mems, err)
+			return nil
+		}
+		if avail, err = parseCpuset(strings.TrimSpace(online)); err != nil {
+			return fmt.Errorf("parsing %q: %v", filepath.Join(nodeRoot, "online"), err)
+		}
+	}
+	ok := make(map[int]bool)
+	for _, node := range avail {
+		ok[node] = true
+	}
+	var invalid []int
+	for _, node := range want {
+		if !ok[node] {
+			invalid = append(invalid, node)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid memory nodes %s in cpuset.mems %q, available: %s", formatCpuset(invalid), mems, formatCpuset(avail))
+	}
+	return nil
+}
+
+// EffectiveCPUSetCPUs returns the CPUs the cgroup can actually run on, from
+// 'cpuset.effective_cpus' (or 'cpuset.cpus.effective' on cgroup v2). They can
+// differ from 'cpuset.cpus' when an ancestor is more restrictive or CPUs were
+// hot unplugged. On kernels without the effective file, 'cpuset.cpus' is used.
+func (c *Cgroup) EffectiveCPUSetCPUs() ([]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return effectiveCpuset(c.makePath("cpuset"), "cpus")
+}
+
+// EffectiveCPUSetMems is like EffectiveCPUSetCPUs, but for memory nodes.
+func (c *Cgroup) EffectiveCPUSetMems() ([]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return effectiveCpuset(c.makePath("cpuset"), "mems")
+}
+
+// effectiveCpuset reads the effective 'cpus' or 'mems' of the cpuset in
+// 'path', falling back to the requested ones if the effective file is missing.
+func effectiveCpuset(path, kind string) ([]int, error) {
+	name := "cpuset.effective_" + kind
+	if isV2("cpuset") {
+		name = "cpuset." + kind + ".effective"
+	}
+	val, err := getValue(path, name)
+	if os.IsNotExist(err) {
+		name = "cpuset." + kind
+		val, err = getValue(path, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := parseCpuset(strings.TrimSpace(val))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", filepath.Join(path, name), err)
+	}
+	return cpus, nil
+}
+
+// CPUSetPartition returns the partition type from 'cpuset.cpus.partition', e.g.
+// "member", "root" or "isolated". If the kernel couldn't make the cgroup a
+// valid partition, the returned value includes the reason, e.g. "root invalid
+// (Cpu list in cpuset.cpus not exclusive)". Requires cgroup v2.
+func (c *Cgroup) CPUSetPartition() (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("cpuset") {
+		return "", fmt.Errorf("cpuset.cpus.partition: %w", ErrNotSupported)
+	}
+	val, err := getValue(c.makePath("cpuset"), "cpuset.cpus.partition")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(val), nil
+}
+
+// SetCPUSetPartition sets 'cpuset.cpus.partition' to one of "member", "root"
+// or "isolated". Requires cgroup v2.
+//
+// For a cgroup to become a partition root, 'cpuset.cpus' must be set, must be
+// exclusive among its siblings, and the parent must be a partition root
+// itself. The kernel rejects the write otherwise, and that error is returned.
+func (c *Cgroup) SetCPUSetPartition(mode string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isV2("cpuset") {
+		return fmt.Errorf("cpuset.cpus.partition: %w", ErrNotSupported)
+	}
+	switch mode {
+	case "member", "root", "isolated":
+	default:
+		return fmt.Errorf("invalid cpuset partition %q, must be one of: member, root, isolated", mode)
+	}
+	if err := setValue(c.makePath("cpuset"), "cpuset.cpus.partition", mode); err != nil {
+		return fmt.Errorf("setting cpuset partition to %q: %v", mode, err)
+	}
+	return nil
+}
+
+// CPUSetExclusive returns the value of 'cpuset.cpu_exclusive'. Requires
+// cgroup v1.
+func (c *Cgroup) CPUSetExclusive() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cpuSetFlag("cpuset.cpu_exclusive")
+}
+
+// SetCPUSetExclusive sets 'cpuset.cpu_exclusive', which prevents siblings from
+// having overlapping 'cpuset.cpus'. Requires cgroup v1.
+//
+// A cpuset can only be made exclusive if its parent is exclusive, which is
+// always true for the top cpuset. If that's not the case, an error wrapping
+// EINVAL is returned.
+func (c *Cgroup) SetCPUSetExclusive(exclusive bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setCPUSetFlag("cpuset.cpu_exclusive", exclusive)
+}
+
+// CPUSetMemExclusive returns the value of 'cpuset.mem_exclusive'. Requires
+// cgroup v1.
+func (c *Cgroup) CPUSetMemExclusive() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cpuSetFlag("cpuset.mem_exclusive")
+}
+
+// SetCPUSetMemExclusive is like SetCPUSetExclusive, but for
+// 'cpuset.mem_exclusive'.
+func (c *Cgroup) SetCPUSetMemExclusive(exclusive bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setCPUSetFlag("cpuset.mem_exclusive", exclusive)
+}
+
+func (c *Cgroup) cpuSetFlag(name string) (bool, error) {
+	if isV2("cpuset") {
+		return false, fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	val, err := getInt(c.makePath("cpuset"), name)
+	if err != nil {
+		return false, err
+	}
+	return val != 0, nil
+}
+
+func (c *Cgroup) setCPUSetFlag(name string, val bool) error {
+	if isV2("cpuset") {
+		return fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	path := c.makePath("cpuset")
+	str := "0"
+	if val {
+		str = "1"
+		// Exclusivity must be inherited from the parent. The top cpuset is
+		// always exclusive, so there is nothing to check for it.
+		if parent := filepath.Dir(path); parent != getHierarchies().v1Mount("cpuset") {
+			if flag, err := getInt(parent, name); err == nil && flag == 0 {
+				return fmt.Errorf("setting %s in %q: parent %q is not exclusive: %w", name, path, parent, syscall.EINVAL)
+			}
+		}
+	}
+	if err := setValue(path, name, str); err != nil {
+		if errors.Is(err, syscall.EINVAL) {
+			return fmt.Errorf("setting %s in %q, parent must be exclusive and siblings must not overlap: %w", name, path, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// MemoryLimit returns the memory limit, or Unlimited if no limit is set.
+func (c *Cgroup) MemoryLimit() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.memoryLimit()
+}
+
+// MemoryUsage returns the current memory usage of the cgroup in bytes, from
+// 'memory.current' with cgroup v2 or 'memory.usage_in_bytes' with cgroup v1.
+// Together with MemoryLimit, it gives the memory headroom of the cgroup.
+func (c *Cgroup) MemoryUsage() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	usage, err := readMemoryUsage(c.makePath("memory"))
+	if err != nil {
+		return 0, err
+	}
+	return int64(usage), nil
+}
+
+// memoryLimit is like MemoryLimit, with c.mu held.
+func (c *Cgroup) memoryLimit() (int64, error) {
+	path := c.makePath("memory")
+	name := "memory.limit_in_bytes"
+	if isV2("memory") {
+		name = "memory.max"
+	}
+	limStr, err := getValue(path, name)
+	if err != nil {
+		return 0, err
+	}
+	return parseLimit(limStr)
+}
+
+// Path returns the absolute host path of the cgroup directory for the given
+// controller. With cgroup v1, each controller has its own hierarchy. With
+// cgroup v2, all controllers share the same directory.
+func (c *Cgroup) Path(controllerName string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.path(controllerName)
+}
+
+// path is like Path, with c.mu held.
+func (c *Cgroup) path(controllerName string) (string, error) {
+	_, ok1 := controllers[controllerName]
+	_, ok2 := controllers2[controllerName]
+	if !ok1 && !ok2 {
+		return "", fmt.Errorf("unknown cgroup controller %q", controllerName)
+	}
+	return c.makePath(controllerName), nil
+}
+
+// FilePath returns the absolute host path of the given file inside the cgroup
+// directory for the given controller, e.g. FilePath("memory",
+// "memory.limit_in_bytes").
+func (c *Cgroup) FilePath(controllerName, file string) (string, error) {
+	path, err := c.Path(controllerName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(path, file), nil
+}
+
+// String implements fmt.Stringer. It only reports the recorded fields,
+// without reading from the host, see Summary.
+func (c *Cgroup) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fmt.Sprintf("cgroup %q parents=%v own=%t", c.Name, c.Parents, c.Own)
+}
+
+// Summary returns a one line summary of the cgroup and its limits, e.g.
+// "cgroup v2 /kubepods/pod123 mem=1Gi cpu=2.0 pids=1024 controllers=cpu,memory",
+// as shown by 'runsc debug --cgroup'. Limits are read from the host every time
+// it's called. Limits that can't be read are reported as "?", and missing
+// controllers are omitted.
+func (c *Cgroup) Summary() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := getHierarchies()
+	version := "v1"
+	switch h.mode() {
+	case Unified:
+		version = "v2"
+	case Hybrid:
+		version = "hybrid"
+	}
+	parent, _ := c.parentFor("memory")
+	if h.isV2("memory") {
+		parent = c.Parents[""]
+	}
+
+	mem := "?"
+	if lim, err := c.memoryLimit(); err == nil {
+		mem = formatBytes(lim)
+	}
+	cpu := "?"
+	if quota, err := c.cpuQuota(); err == nil {
+		if quota < 0 {
+			cpu = "max"
+		} else {
+			cpu = strconv.FormatFloat(quota, 'f', -1, 64)
+			if !strings.Contains(cpu, ".") {
+				cpu += ".0"
+			}
+		}
+	}
+	pids := "?"
+	if val, err := getValue(c.makePath("pids"), "pids.max"); err == nil {
+		if lim, err := parseLimit(val); err == nil {
+			pids = "max"
+			if lim != Unlimited {
+				pids = strconv.FormatInt(lim, 10)
+			}
+		}
+	}
+
+	return fmt.Sprintf("cgroup %s %s mem=%s cpu=%s pids=%s controllers=%s",
+		version, filepath.Join("/", parent, c.Name), mem, cpu, pids, strings.Join(c.present(h), ","))
+}
+
+// present returns the sorted names of the controllers the cgroup exists in.
+// With cgroup v2, these are the controllers listed in 'cgroup.controllers'.
+func (c *Cgroup) present(h *hierarchies) []string {
+	var v2Ctrls map[string]bool
+	var names []string
+	for name := range h.controllers() {
+		if h.isV2(name) {
+			if v2Ctrls == nil {
+				v2Ctrls = make(map[string]bool)
+				if avail, err := getValue(c.makePath(""), "cgroup.controllers"); err == nil {
+					for _, ctrl := range strings.Fields(avail) {
+						v2Ctrls[ctrl] = true
+					}
+				}
+			}
+			if v2Ctrls[name] {
+				names = append(names, name)
+			}
+			continue
+		}
+		if _, err := os.Stat(c.makePath(name)); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatBytes formats a number of bytes using the largest binary unit that
+// represents it exactly, e.g. "1Gi" or "1536Ki". Unlimited is formatted as
+// "max".
+func formatBytes(val int64) string {
+	if val == Unlimited {
+		return "max"
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"Ti", 1 << 40},
+		{"Gi", 1 << 30},
+		{"Mi", 1 << 20},
+		{"Ki", 1 << 10},
+	} {
+		if val != 0 && val%unit.size == 0 {
+			return strconv.FormatInt(val/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(val, 10)
+}
+
+// memoryPeakFile returns the name of the file containing the peak memory usage.
+func memoryPeakFile() string {
+	if isV2("memory") {
+		return "memory.peak"
+	}
+	return "memory.max_usage_in_bytes"
+}
+
+// MemoryPeak returns the maximum memory usage recorded for the cgroup. It
+// returns ErrNotSupported if the kernel doesn't record it, e.g. cgroup v2
+// prior to Linux 5.19.
+func (c *Cgroup) MemoryPeak() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name := memoryPeakFile()
+	val, err := getValue(c.makePath("memory"), name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%s: %w", name, ErrNotSupported)
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+}
+
+// ResetMemoryPeak resets the maximum memory usage recorded for the cgroup to
+// the current usage. It's only supported on cgroup v1: with cgroup v2, resets
+// of memory.peak only affect reads from the same file descriptor.
+func (c *Cgroup) ResetMemoryPeak() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isV2("memory") {
+		return fmt.Errorf("resetting memory.peak: %w", ErrNotSupported)
+	}
+	return setValue(c.makePath("memory"), "memory.max_usage_in_bytes", "0")
+}
+
+// KernelMemoryUsage returns the kernel memory usage of the cgroup in bytes,
+// from 'memory.kmem.usage_in_bytes'. It's only supported on cgroup v1 kernels
+// with kernel memory accounting. cgroup v2 always accounts kernel memory as
+// part of the memory usage and doesn't report it separately, in which case
+// ErrNotSupported is returned.
+func (c *Cgroup) KernelMemoryUsage() (uint64, error) {
+	return c.kernelMemoryUsage("memory.kmem.usage_in_bytes")
+}
+
+// KernelMemoryTCPUsage is like KernelMemoryUsage, for the TCP buffer memory
+// in 'memory.kmem.tcp.usage_in_bytes'.
+func (c *Cgroup) KernelMemoryTCPUsage() (uint64, error) {
+	return c.kernelMemoryUsage("memory.kmem.tcp.usage_in_bytes")
+}
+
+func (c *Cgroup) kernelMemoryUsage(name string) (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("memory") {
+		return 0, fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	val, err := getUint(c.makePath("memory"), name)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	return val, err
+}
+
+// UseHierarchy returns the value of 'memory.use_hierarchy'. If false, the
+// memory usage of child cgroups isn't charged to the cgroup, so its limits
+// don't apply to them. cgroup v2 is always hierarchical, in which case true is
+// returned. ErrNotSupported is returned if the file doesn't exist on cgroup v1.
+func (c *Cgroup) UseHierarchy() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("memory") {
+		return true, nil
+	}
+	val, err := getUint(c.makePath("memory"), "memory.use_hierarchy")
+	if os.IsNotExist(err) {
+		return false, fmt.Errorf("memory.use_hierarchy: %w", ErrNotSupported)
+	}
+	return val != 0, err
+}
+
+// warnMemoryHierarchy logs a warning if an ancestor of the cgroup v1 memory
+// cgroup in 'path', up to 'mount', has a memory limit that doesn't apply to
+// the cgroup because 'memory.use_hierarchy' is disabled on the way.
+func warnMemoryHierarchy(path, mount string) {
+	var flat string
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, mount); dir = filepath.Dir(dir) {
+		if flat == "" && !memoryUseHierarchy(dir) {
+			// Limits of 'dir' and its ancestors don't cover the cgroup.
+			flat = dir
+		}
+		if flat != "" {
+			if limit, err := readLimit(dir, "memory.limit_in_bytes"); err == nil && limit != nil {
+				logger().Warningf("Memory limit %d of %q doesn't apply to cgroup %q, memory.use_hierarchy is disabled in %q", *limit, dir, path, flat)
+				return
+			}
+		}
+		if dir == mount {
+			break
+		}
+	}
+}
+
+// MemoryMin returns the memory protection set in 'memory.min', or Unlimited if
+// all memory is protected. Requires cgroup v2.
+func (c *Cgroup) MemoryMin() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("memory") {
+		return 0, fmt.Errorf("memory.min: %w", ErrNotSupported)
+	}
+	val, err := getValue(c.makePath("memory"), "memory.min")
+	if err != nil {
+		return 0, err
+	}
+	return parseLimit(val)
+}
+
+// SetMemoryMin sets 'memory.min', the amount of memory that is never
+// reclaimed from the cgroup. Requires cgroup v2.
+//
+// The protection is bounded by the ancestors: if an ancestor's memory.min is
+// smaller, the effective protection is capped to it. Protected memory also
+// shifts reclaim pressure onto sibling cgroups.
+//
+// Note that the OCI spec has no counterpart for memory.min, so Install doesn't
+// set it and callers must use this method instead.
+func (c *Cgroup) SetMemoryMin(val int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isV2("memory") {
+		return fmt.Errorf("memory.min: %w", ErrNotSupported)
+	}
+	return setValue(c.makePath("memory"), "memory.min", formatLimit(val, true))
+}
+
+// Swappiness returns 'memory.swappiness', how aggressively the cgroup's
+// anonymous memory is swapped out under reclaim, from 0 to 100. Requires cgroup
+// v1: cgroup v2 has no per-cgroup swappiness and reclaim uses the global
+// vm.swappiness sysctl, in which case ErrNotSupported is returned.
+func (c *Cgroup) Swappiness() (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("memory") {
+		return 0, fmt.Errorf("memory.swappiness: %w", ErrNotSupported)
+	}
+	val, err := getValue(c.makePath("memory"), "memory.swappiness")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("memory.swappiness: %w", ErrNotSupported)
+		}
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(val))
+}
+
+// SetSwappiness sets 'memory.swappiness', which must be between 0 and 100. A
+// swappiness of 0 disables swapping of anonymous memory. Requires cgroup v1,
+// see Swappiness.
+func (c *Cgroup) SetSwappiness(swappiness int) error {
+	if swappiness < 0 || swappiness > 100 {
+		return fmt.Errorf("invalid swappiness %d, must be between 0 and 100", swappiness)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isV2("memory") {
+		return fmt.Errorf("memory.swappiness: %w", ErrNotSupported)
+	}
+	return setValue(c.makePath("memory"), "memory.swappiness", strconv.Itoa(swappiness))
+}
+
+// makePath returns the cgroup directory for the given controller. An empty
+// controller name refers to the cgroup v2 directory.
+func (c *Cgroup) makePath(controllerName string) string {
+	h := getHierarchies()
+	if controllerName == "" || h.isV2(controllerName) {
+		// Unified hierarchy has a single entry in /proc/[pid]/cgroup with an
+		// empty controller list, e.g. "0::/user.slice".
+		path := c.Name
+		if parent, ok := c.Parents[""]; ok {
+			path = filepath.Join(parent, c.Name)
+		}
+		root := h.unified
+		if root == "" {
+			root = cgroupRoot
+		}
+		return filepath.Join(root, path)
+	}
 	path := c.Name
-	if parent, ok := c.Parents[controllerName]; ok {
+	if parent, ok := c.parentFor(controllerName); ok {
 		path = filepath.Join(parent, c.Name)
 	}
-	return filepath.Join(cgroupRoot, controllerName, path)
+	return filepath.Join(h.v1Mount(controllerName), path)
+}
+
+// parentFor returns the parent of the cgroup in the controller's cgroup v1
+// hierarchy. Co-mounted controllers may share a single key in Parents, e.g.
+// "cpu,cpuacct", in which case the parent is found under either name.
+func (c *Cgroup) parentFor(controllerName string) (string, bool) {
+	if parent, ok := c.Parents[controllerName]; ok {
+		return parent, true
+	}
+	for key, parent := range c.Parents {
+		for _, name := range strings.Split(key, ",") {
+			if name == controllerName {
+				return parent, true
+			}
+		}
+	}
+	return "", false
+}
+
+// skipController returns true if the controller is optional and its hierarchy
+// is not mounted on the host. A warning is logged when that is the case.
+func skipController(name string, ctrl controller) bool {
+	if !ctrl.optional() || isV2(name) {
+		return false
+	}
+	mount := getHierarchies().v1Mount(name)
+	if _, err := os.Stat(mount); !os.IsNotExist(err) {
+		return false
+	}
+	logger().Warningf("Skipping optional cgroup controller %q, %q not found", name, mount)
+	return true
 }
 
 type controller interface {
-	set(*specs.LinuxResources, string) error
+	// optional returns true if the controller may be missing from the host.
+	optional() bool
+
+	// set configures the controller in the given path according to the
+	// resources, writing with the Writer. A nil sub-resource, e.g.
+	// LinuxResources.Pids, means that the controller is not managed, and its
+	// files are left untouched. Within a sub-resource, nil fields are left
+	// untouched too, and so are zero values that aren't valid settings, e.g. a
+	// zero memory limit or CPU shares.
+	set(Writer, *specs.LinuxResources, string) error
+}
+
+type controllerCommon struct {
+	isOptional bool
+}
+
+func (c *controllerCommon) optional() bool {
+	return c.isOptional
 }
 
-type noop struct{}
+type noop struct {
+	controllerCommon
+}
 
-func (*noop) set(*specs.LinuxResources, string) error {
+func (*noop) set(Writer, *specs.LinuxResources, string) error {
 	return nil
 }
 
-type memory struct{}
+type memory struct {
+	controllerCommon
+}
 
-func (*memory) set(spec *specs.LinuxResources, path string) error {
+func (*memory) set(w Writer, spec *specs.LinuxResources, path string) error {
 	if spec.Memory == nil {
 		return nil
 	}
-	if err := setOptionalValueInt(path, "memory.limit_in_bytes", spec.Memory.Limit); err != nil {
+	// The swap limit is checked before anything is written, so that an
+	// unsupported limit doesn't leave the others half applied.
+	f := hostFeatures("memory", path, false)
+	if err := checkSwap(f, spec.Memory.Swap); err != nil {
 		return err
 	}
-	if err := setOptionalValueInt(path, "memory.soft_limit_in_bytes", spec.Memory.Reservation); err != nil {
+	if err := setOptionalLimit(w, path, "memory.limit_in_bytes", spec.Memory.Limit); err != nil {
 		return err
 	}
-	if err := setOptionalValueInt(path, "memory.memsw.limit_in_bytes", spec.Memory.Swap); err != nil {
+	if err := setOptionalLimit(w, path, "memory.soft_limit_in_bytes", spec.Memory.Reservation); err != nil {
 		return err
 	}
-	if err := setOptionalValueInt(path, "memory.kmem.limit_in_bytes", spec.Memory.Kernel); err != nil {
-		return err
+	if f.Swap {
+		if err := setOptionalLimit(w, path, "memory.memsw.limit_in_bytes", spec.Memory.Swap); err != nil {
+			return err
+		}
 	}
-	if err := setOptionalValueInt(path, "memory.kmem.tcp.limit_in_bytes", spec.Memory.KernelTCP); err != nil {
-		return err
+	// Newer kernels removed the kernel memory limits, which are accounted in
+	// the memory limit instead.
+	if f.KernelMemory {
+		if err := setOptionalLimit(w, path, "memory.kmem.limit_in_bytes", spec.Memory.Kernel); err != nil {
+			return err
+		}
+	} else if spec.Memory.Kernel != nil && *spec.Memory.Kernel != 0 {
+		logger().Warningf("Kernel memory limit is not supported by the host, ignoring: %s", knobs["memory.kernel"].reason)
 	}
-	if err := setOptionalValueUint(path, "memory.swappiness", spec.Memory.Swappiness); err != nil {
-		return err
+	if f.KernelMemoryTCP {
+		if err := setOptionalLimit(w, path, "memory.kmem.tcp.limit_in_bytes", spec.Memory.KernelTCP); err != nil {
+			return err
+		}
+	} else if spec.Memory.KernelTCP != nil && *spec.Memory.KernelTCP != 0 {
+		logger().Warningf("Kernel TCP memory limit is not supported by the host, ignoring: %s", knobs["memory.kernelTCP"].reason)
+	}
+	// A swappiness of 0 is valid, it disables swapping. runc uses -1 for the
+	// default swappiness, which is left untouched.
+	if sw := spec.Memory.Swappiness; sw != nil && int64(*sw) != -1 {
+		if err := writeValue(w, path, "memory.swappiness", strconv.FormatUint(*sw, 10)); err != nil {
+			return err
+		}
 	}
 
 	if spec.Memory.DisableOOMKiller != nil && *spec.Memory.DisableOOMKiller {
-		if err := setValue(path, "memory.oom_control", "1"); err != nil {
+		if err := writeValue(w, path, "memory.oom_control", "1"); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-type cpu struct{}
+type cpu struct {
+	controllerCommon
+}
 
-func (*cpu) set(spec *specs.LinuxResources, path string) error {
+func (*cpu) set(w Writer, spec *specs.LinuxResources, path string) error {
 	if spec.CPU == nil {
 		return nil
 	}
-	if err := setOptionalValueUint(path, "cpu.shares", spec.CPU.Shares); err != nil {
+	if err := setOptionalValueUint(w, path, "cpu.shares", spec.CPU.Shares); err != nil {
+		return err
+	}
+	if err := setOptionalValueInt(w, path, "cpu.cfs_quota_us", spec.CPU.Quota); err != nil {
+		return err
+	}
+	if err := setOptionalValueUint(w, path, "cpu.cfs_period_us", spec.CPU.Period); err != nil {
+		return err
+	}
+	if spec.CPU.RealtimePeriod == nil && spec.CPU.RealtimeRuntime == nil {
+		return nil
+	}
+	// Realtime bandwidth used to be ignored, so installing a cgroup doesn't
+	// fail if the host doesn't support it, or the parent doesn't have enough
+	// of it to give. SetRTRuntime and SetRTPeriod report these errors.
+	if err := setRT(w, path, spec.CPU); err != nil {
+		if !errors.Is(err, ErrNotSupported) && !errors.Is(err, syscall.EINVAL) {
+			return err
+		}
+		logger().Warningf("Skipping realtime CPU bandwidth of cgroup %q: %v", path, err)
+	}
+	return nil
+}
+
+// setRT writes the realtime bandwidth of 'spec' to the cgroup v1 cpu
+// controller in 'path'.
+func setRT(w Writer, path string, spec *specs.LinuxCPU) error {
+	if err := checkRT(path); err != nil {
+		return err
+	}
+	// The period is set first, since the runtime is validated against it.
+	if err := setOptionalValueUint(w, path, "cpu.rt_period_us", spec.RealtimePeriod); err != nil {
 		return err
 	}
-	if err := setOptionalValueInt(path, "cpu.cfs_quota_us", spec.CPU.Quota); err != nil {
+	return setOptionalValueInt(w, path, "cpu.rt_runtime_us", spec.RealtimeRuntime)
+}
+
+// checkRT returns ErrNotSupported if the cgroup v1 cpu controller in 'path'
+// doesn't have the realtime bandwidth files.
+func checkRT(path string) error {
+	if _, err := os.Stat(path); err != nil {
 		return err
 	}
-	return setOptionalValueUint(path, "cpu.cfs_period_us", spec.CPU.Period)
+	if !hostFeatures("cpu", path, false).RealtimeGroupSched {
+		return fmt.Errorf("cpu.rt_runtime_us, realtime group scheduling requires CONFIG_RT_GROUP_SCHED: %w", ErrNotSupported)
+	}
+	return nil
+}
+
+// checkSwap returns ErrNotSupported if a swap limit is requested, but the host
+// doesn't support it. An unlimited swap needs no file and is always allowed.
+func checkSwap(f Features, swap *int64) error {
+	if f.Swap || swap == nil || *swap == 0 || *swap == -1 {
+		return nil
+	}
+	return fmt.Errorf("memory swap limit: %w: %s", ErrNotSupported, knobs["memory.swap"].reason)
 }
 
-type cpuSet struct{}
+type cpuSet struct {
+	controllerCommon
+}
 
-func (*cpuSet) set(spec *specs.LinuxResources, path string) error {
+func (*cpuSet) set(w Writer, spec *specs.LinuxResources, path string) error {
 	// cpuset.cpus and mems are required fields, but are not set on a new cgroup.
 	// If not set in the spec, get it from one of the ancestors cgroup.
 	if spec.CPU == nil || spec.CPU.Cpus == "" {
-		if _, err := fillFromAncestor(filepath.Join(path, "cpuset.cpus")); err != nil {
+		if _, err := fillFromAncestor(w, filepath.Join(path, "cpuset.cpus")); err != nil {
 			return err
 		}
 	} else {
-		if err := setValue(path, "cpuset.cpus", spec.CPU.Cpus); err != nil {
+		if err := writeValue(w, path, "cpuset.cpus", spec.CPU.Cpus); err != nil {
 			return err
 		}
 	}
 
 	if spec.CPU == nil || spec.CPU.Mems == "" {
-		_, err := fillFromAncestor(filepath.Join(path, "cpuset.mems"))
+		_, err := fillFromAncestor(w, filepath.Join(path, "cpuset.mems"))
 		return err
 	}
 	mems := spec.CPU.Mems
-	return setValue(path, "cpuset.mems", mems)
+	if err := validateMems(filepath.Dir(path), mems); err != nil {
+		return err
+	}
+	return writeValue(w, path, "cpuset.mems", mems)
 }
 
-type blockIO struct{}
+type blockIO struct {
+	controllerCommon
+}
 
-func (*blockIO) set(spec *specs.LinuxResources, path string) error {
+func (*blockIO) set(w Writer, spec *specs.LinuxResources, path string) error {
 	if spec.BlockIO == nil {
 		return nil
 	}
 
-	if err := setOptionalValueUint16(path, "blkio.weight", spec.BlockIO.Weight); err != nil {
+	if err := setOptionalValueUint16(w, path, "blkio.weight", spec.BlockIO.Weight); err != nil {
 		return err
 	}
-	if err := setOptionalValueUint16(path, "blkio.leaf_weight", spec.BlockIO.LeafWeight); err != nil {
+	if err := setOptionalValueUint16(w, path, "blkio.leaf_weight", spec.BlockIO.LeafWeight); err != nil {
 		return err
 	}
 
 	for _, dev := range spec.BlockIO.WeightDevice {
-		val := fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, dev.Weight)
-		if err := setValue(path, "blkio.weight_device", val); err != nil {
-			return err
+		if dev.Weight != nil {
+			val := fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, *dev.Weight)
+			if err := writeValue(w, path, "blkio.weight_device", val); err != nil {
+				return err
+			}
 		}
-		val = fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, dev.LeafWeight)
-		if err := setValue(path, "blkio.leaf_weight_device", val); err != nil {
-			return err
+		if dev.LeafWeight != nil {
+			val := fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, *dev.LeafWeight)
+			if err := writeValue(w, path, "blkio.leaf_weight_device", val); err != nil {
+				return err
+			}
 		}
 	}
-	if err := setThrottle(path, "blkio.throttle.read_bps_device", spec.BlockIO.ThrottleReadBpsDevice); err != nil {
+	if err := setThrottle(w, path, "blkio.throttle.read_bps_device", spec.BlockIO.ThrottleReadBpsDevice); err != nil {
 		return err
 	}
-	if err := setThrottle(path, "blkio.throttle.write_bps_device", spec.BlockIO.ThrottleWriteBpsDevice); err != nil {
+	if err := setThrottle(w, path, "blkio.throttle.write_bps_device", spec.BlockIO.ThrottleWriteBpsDevice); err != nil {
 		return err
 	}
-	if err := setThrottle(path, "blkio.throttle.read_iops_device", spec.BlockIO.ThrottleReadIOPSDevice); err != nil {
+	if err := setThrottle(w, path, "blkio.throttle.read_iops_device", spec.BlockIO.ThrottleReadIOPSDevice); err != nil {
 		return err
 	}
-	return setThrottle(path, "blkio.throttle.write_iops_device", spec.BlockIO.ThrottleWriteIOPSDevice)
+	return setThrottle(w, path, "blkio.throttle.write_iops_device", spec.BlockIO.ThrottleWriteIOPSDevice)
 }
 
-func setThrottle(path, name string, devs []specs.LinuxThrottleDevice) error {
+func setThrottle(w Writer, path, name string, devs []specs.LinuxThrottleDevice) error {
 	for _, dev := range devs {
 		val := fmt.Sprintf("%d:%d %d", dev.Major, dev.Minor, dev.Rate)
-		if err := setValue(path, name, val); err != nil {
+		if err := writeValue(w, path, name, val); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-type networkClass struct{}
+// networkClass configures the class ID that tags packets sent from sockets of
+// tasks in the cgroup. It's set regardless of the sandbox's network mode, but
+// its effect differs: with host networking, application sockets are host
+// sockets created by the sandbox process, so they're classified like those of
+// any other host process. With sandboxed networking, application sockets only
+// exist in netstack and all traffic leaves through the sandbox's own endpoint,
+// so it all shares the same class ID. networkPrio behaves in the same way.
+type networkClass struct {
+	controllerCommon
+}
 
-func (*networkClass) set(spec *specs.LinuxResources, path string) error {
+func (*networkClass) set(w Writer, spec *specs.LinuxResources, path string) error {
 	if spec.Network == nil {
 		return nil
 	}
-	return setOptionalValueUint32(path, "net_cls.classid", spec.Network.ClassID)
+	return setOptionalValueUint32(w, path, "net_cls.classid", spec.Network.ClassID)
 }
 
-type networkPrio struct{}
+type networkPrio struct {
+	controllerCommon
+}
 
-func (*networkPrio) set(spec *specs.LinuxResources, path string) error {
+func (*networkPrio) set(w Writer, spec *specs.LinuxResources, path string) error {
 	if spec.Network == nil {
 		return nil
 	}
 	for _, prio := range spec.Network.Priorities {
 		val := fmt.Sprintf("%s %d", prio.Name, prio.Priority)
-		if err := setValue(path, "net_prio.ifpriomap", val); err != nil {
+		if err := writeValue(w, path, "net_prio.ifpriomap", val); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-type pids struct{}
+// pids limits the number of tasks in the cgroup. Unlike other controllers,
+// the limit isn't optional once spec.Pids is set: a zero limit is written as
+// is, and prevents the cgroup from creating any task. A negative limit removes
+// the limit. Callers that don't want to manage pids must leave spec.Pids nil.
+type pids struct {
+	controllerCommon
+}
 
-func (*pids) set(spec *specs.LinuxResources, path string) error {
+func (*pids) set(w Writer, spec *specs.LinuxResources, path string) error {
 	if spec.Pids == nil {
 		return nil
 	}
-	val := strconv.FormatInt(spec.Pids.Limit, 10)
-	return setValue(path, "pids.max", val)
+	val := "max"
+	if spec.Pids.Limit >= 0 {
+		val = strconv.FormatInt(spec.Pids.Limit, 10)
+	}
+	return writeValue(w, path, "pids.max", val)
 }
@@ -15,9 +15,88 @@
 package cgroup
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sync"
 )
 
+// setupRoot points cgroupRoot to a new temporary directory, and mountinfoPath
+// to a synthetic mount table with all controllers mounted under it. If unified
+// is true, the directory is made to look like a cgroup v2 unified hierarchy,
+// otherwise each controller has its own cgroup v1 hierarchy. Removal of cgroup
+// directories, which still have files in them, is only tried once. The returned
+// function restores all of the above, drops the cached features and removes the
+// directory.
+func setupRoot(t testing.TB, unified bool) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	oldRoot, oldMountinfo, oldTimeout := cgroupRoot, mountinfoPath, rmdirTimeout
+	cgroupRoot = dir
+	rmdirTimeout = rmdirRetryInterval
+	resetFeatures()
+	resetHierarchies()
+	mountinfoPath = filepath.Join(dir, "mountinfo")
+	if unified {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpuset cpu io memory pids"), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+		writeMountinfo(t, dir, ". cgroup2 rw")
+	} else {
+		var mounts []string
+		for name := range controllers {
+			opt := name
+			if name == "systemd" {
+				opt = "name=systemd"
+			}
+			mounts = append(mounts, fmt.Sprintf("%s cgroup rw,%s", name, opt))
+		}
+		writeMountinfo(t, dir, mounts...)
+	}
+	return dir, func() {
+		cgroupRoot, mountinfoPath, rmdirTimeout = oldRoot, oldMountinfo, oldTimeout
+		resetFeatures()
+		resetHierarchies()
+		os.RemoveAll(dir)
+	}
+}
+
+// writeMountinfo writes a mount table to mountinfoPath. Each mount is in the
+// form "<path relative to root> <fstype> <super options>", e.g.
+// "cpu cgroup rw,cpu,cpuacct" or "unified cgroup2 rw". Cached hierarchies are
+// dropped.
+func writeMountinfo(t testing.TB, root string, mounts ...string) {
+	t.Helper()
+	lines := []string{"22 1 0:21 / / rw,relatime shared:1 - ext4 /dev/root rw"}
+	for i, m := range mounts {
+		fields := strings.Fields(m)
+		if len(fields) != 3 {
+			t.Fatalf("invalid mount %q", m)
+		}
+		path, fstype, opts := filepath.Join(root, fields[0]), fields[1], fields[2]
+		lines = append(lines, fmt.Sprintf("%d 22 0:%d / %s rw,nosuid,nodev,noexec,relatime shared:%d - %s %s %s", 30+i, 30+i, path, 10+i, fstype, fstype, opts))
+	}
+	if err := ioutil.WriteFile(mountinfoPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+	resetHierarchies()
+}
+
 func TestUninstallEnoent(t *testing.T) {
 	c := Cgroup{
 		// set a non-existent name
@@ -65,3 +144,1710 @@ func TestCountCpuset(t *testing.T) {
 		})
 	}
 }
+
+func TestPath(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		unified  bool
+		cg       *Cgroup
+		ctrl     string
+		want     string
+		wantFile string
+	}{
+		{
+			name:     "v1",
+			cg:       &Cgroup{Name: "/docker/123"},
+			ctrl:     "memory",
+			want:     "memory/docker/123",
+			wantFile: "memory/docker/123/memory.limit_in_bytes",
+		},
+		{
+			name:     "v1-parent",
+			cg:       &Cgroup{Name: "123", Parents: map[string]string{"cpu": "/user.slice"}},
+			ctrl:     "cpu",
+			want:     "cpu/user.slice/123",
+			wantFile: "cpu/user.slice/123/memory.limit_in_bytes",
+		},
+		{
+			name:     "v2",
+			unified:  true,
+			cg:       &Cgroup{Name: "/docker/123"},
+			ctrl:     "memory",
+			want:     "docker/123",
+			wantFile: "docker/123/memory.limit_in_bytes",
+		},
+		{
+			name:     "v2-parent",
+			unified:  true,
+			cg:       &Cgroup{Name: "123", Parents: map[string]string{"": "/user.slice"}},
+			ctrl:     "pids",
+			want:     "user.slice/123",
+			wantFile: "user.slice/123/memory.limit_in_bytes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+
+			got, err := tc.cg.Path(tc.ctrl)
+			if err != nil {
+				t.Fatalf("Path(%q): %v", tc.ctrl, err)
+			}
+			if want := filepath.Join(root, tc.want); got != want {
+				t.Errorf("Path(%q) got: %q, want: %q", tc.ctrl, got, want)
+			}
+			got, err = tc.cg.FilePath(tc.ctrl, "memory.limit_in_bytes")
+			if err != nil {
+				t.Fatalf("FilePath(%q): %v", tc.ctrl, err)
+			}
+			if want := filepath.Join(root, tc.wantFile); got != want {
+				t.Errorf("FilePath(%q) got: %q, want: %q", tc.ctrl, got, want)
+			}
+			if _, err := tc.cg.Path("invalid"); err == nil {
+				t.Errorf("Path(%q) should have failed", "invalid")
+			}
+		})
+	}
+}
+
+// captureEmitter records all emitted log lines.
+type captureEmitter struct {
+	lines []string
+}
+
+// Emit implements log.Emitter.Emit.
+func (e *captureEmitter) Emit(_ int, level log.Level, _ time.Time, format string, v ...interface{}) {
+	e.lines = append(e.lines, fmt.Sprintf("%v: %s", level, fmt.Sprintf(format, v...)))
+}
+
+func TestOptionalControllerMissing(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	var emitter captureEmitter
+	SetLogger(&log.BasicLogger{Level: log.Debug, Emitter: &emitter})
+	defer SetLogger(nil)
+
+	// Mount all controllers, except for an optional one.
+	const missing = "net_prio"
+	for name := range controllers {
+		if name == missing {
+			continue
+		}
+		if err := os.Mkdir(filepath.Join(root, name), 0755); err != nil {
+			t.Fatalf("os.Mkdir(): %v", err)
+		}
+	}
+
+	c := Cgroup{Name: "test-optional"}
+	if err := c.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer c.Uninstall()
+
+	if _, err := os.Stat(c.makePath(missing)); !os.IsNotExist(err) {
+		t.Errorf("controller %q should not have been created, stat: %v", missing, err)
+	}
+	found := false
+	for _, line := range emitter.lines {
+		if strings.HasPrefix(line, log.Warning.String()) && strings.Contains(line, missing) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("no warning logged for missing controller %q, lines: %v", missing, emitter.lines)
+	}
+}
+
+// overwriteFile writes to an existing file without truncating it first. This
+// mimics cgroupfs, where readers never observe a partially updated file. It
+// doesn't fail the test, so that it can be called from other goroutines.
+func overwriteFile(path, contents string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	return err
+}
+
+func TestPopulated(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	c := Cgroup{Name: "test-populated"}
+	dir := filepath.Join(root, c.Name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("os.Mkdir(): %v", err)
+	}
+	events := filepath.Join(dir, "cgroup.events")
+	if err := ioutil.WriteFile(events, []byte("populated 1\nfrozen 0\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+
+	if got, err := c.Populated(); err != nil || !got {
+		t.Fatalf("Populated() got: %t, %v, want: true, nil", got, err)
+	}
+
+	ch, cancel, err := c.WatchPopulated()
+	if err != nil {
+		t.Fatalf("WatchPopulated(): %v", err)
+	}
+	defer cancel()
+
+	if got := <-ch; !got {
+		t.Errorf("initial populated state got: %t, want: true", got)
+	}
+	if err := overwriteFile(events, "populated 0\nfrozen 0\n"); err != nil {
+		t.Fatalf("overwriteFile(): %v", err)
+	}
+	select {
+	case got := <-ch:
+		if got {
+			t.Errorf("populated state got: %t, want: false", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for populated state change")
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestMemoryMin(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	c := Cgroup{Name: "test-memory-min"}
+	if err := os.Mkdir(filepath.Join(root, c.Name), 0755); err != nil {
+		t.Fatalf("os.Mkdir(): %v", err)
+	}
+	const want = 64 << 20
+	if err := c.SetMemoryMin(want); err != nil {
+		t.Fatalf("SetMemoryMin(%d): %v", want, err)
+	}
+	got, err := c.MemoryMin()
+	if err != nil {
+		t.Fatalf("MemoryMin(): %v", err)
+	}
+	if got != want {
+		t.Errorf("MemoryMin() got: %d, want: %d", got, want)
+	}
+}
+
+func TestMemoryMinV1(t *testing.T) {
+	_, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := Cgroup{Name: "test-memory-min"}
+	if err := c.SetMemoryMin(1); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetMemoryMin() got: %v, want: %v", err, ErrNotSupported)
+	}
+	if _, err := c.MemoryMin(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("MemoryMin() got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestSwappiness(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := &Cgroup{Name: "test"}
+	if _, err := c.Swappiness(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Swappiness() without memory.swappiness got: %v, want: %v", err, ErrNotSupported)
+	}
+	writeFiles(t, root, map[string]string{"memory/test/memory.swappiness": "60\n"})
+	if got, err := c.Swappiness(); err != nil || got != 60 {
+		t.Errorf("Swappiness() got: %d, %v, want: 60, nil", got, err)
+	}
+	for _, val := range []int{-1, 101} {
+		if err := c.SetSwappiness(val); err == nil {
+			t.Errorf("SetSwappiness(%d) should have failed", val)
+		}
+	}
+	if err := c.SetSwappiness(0); err != nil {
+		t.Fatalf("SetSwappiness(0): %v", err)
+	}
+	if got := readFile(t, root, "memory/test/memory.swappiness"); got != "0" {
+		t.Errorf("memory.swappiness got: %q, want: %q", got, "0")
+	}
+
+	_, v2Cleanup := setupRoot(t, true)
+	defer v2Cleanup()
+	if _, err := c.Swappiness(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Swappiness() on cgroup v2 got: %v, want: %v", err, ErrNotSupported)
+	}
+	if err := c.SetSwappiness(10); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetSwappiness() on cgroup v2 got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/test/memory.usage_in_bytes": "4096\n",
+				"memory/test/memory.limit_in_bytes": "8192\n",
+			},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/memory.current": "4096\n",
+				"test/memory.max":     "8192\n",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+
+			c := &Cgroup{Name: "test"}
+			if _, err := c.MemoryUsage(); err == nil {
+				t.Errorf("MemoryUsage() without usage file should have failed")
+			}
+			writeFiles(t, root, tc.files)
+			if got, err := c.MemoryUsage(); err != nil || got != 4096 {
+				t.Errorf("MemoryUsage() got: %d, %v, want: 4096, nil", got, err)
+			}
+			if got, err := c.MemoryLimit(); err != nil || got != 8192 {
+				t.Errorf("MemoryLimit() got: %d, %v, want: 8192, nil", got, err)
+			}
+		})
+	}
+}
+
+func TestMemoryPeak(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		file    string
+		reset   bool
+	}{
+		{
+			name:  "v1",
+			file:  "memory/test/memory.max_usage_in_bytes",
+			reset: true,
+		},
+		{
+			name:    "v2",
+			unified: true,
+			file:    "test/memory.peak",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+
+			c := Cgroup{Name: "test"}
+			if _, err := c.MemoryPeak(); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("MemoryPeak() without peak file got: %v, want: %v", err, ErrNotSupported)
+			}
+
+			writeFiles(t, root, map[string]string{tc.file: "1048576\n"})
+			peak, err := c.MemoryPeak()
+			if err != nil {
+				t.Fatalf("MemoryPeak(): %v", err)
+			}
+			if peak != 1048576 {
+				t.Errorf("MemoryPeak() got: %d, want: %d", peak, 1048576)
+			}
+
+			err = c.ResetMemoryPeak()
+			if !tc.reset {
+				if !errors.Is(err, ErrNotSupported) {
+					t.Errorf("ResetMemoryPeak() got: %v, want: %v", err, ErrNotSupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResetMemoryPeak(): %v", err)
+			}
+			after, err := c.MemoryPeak()
+			if err != nil {
+				t.Fatalf("MemoryPeak(): %v", err)
+			}
+			if after >= peak {
+				t.Errorf("MemoryPeak() after reset got: %d, want less than %d", after, peak)
+			}
+		})
+	}
+}
+
+func TestKernelMemoryUsage(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := &Cgroup{Name: "test"}
+	if _, err := c.KernelMemoryUsage(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("KernelMemoryUsage() without kmem files got: %v, want: %v", err, ErrNotSupported)
+	}
+	writeFiles(t, root, map[string]string{
+		"memory/test/memory.kmem.usage_in_bytes":     "65536\n",
+		"memory/test/memory.kmem.tcp.usage_in_bytes": "4096\n",
+	})
+	if got, err := c.KernelMemoryUsage(); err != nil || got != 65536 {
+		t.Errorf("KernelMemoryUsage() got: %d, %v, want: 65536, nil", got, err)
+	}
+	if got, err := c.KernelMemoryTCPUsage(); err != nil || got != 4096 {
+		t.Errorf("KernelMemoryTCPUsage() got: %d, %v, want: 4096, nil", got, err)
+	}
+
+	_, cleanup2 := setupRoot(t, true)
+	defer cleanup2()
+	if _, err := c.KernelMemoryUsage(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("KernelMemoryUsage() on cgroup v2 got: %v, want: %v", err, ErrNotSupported)
+	}
+	if _, err := c.KernelMemoryTCPUsage(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("KernelMemoryTCPUsage() on cgroup v2 got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestRT(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := &Cgroup{Name: "test"}
+	runtime := int64(950000)
+	period := uint64(1000000)
+	spec := &specs.LinuxResources{CPU: &specs.LinuxCPU{RealtimeRuntime: &runtime, RealtimePeriod: &period}}
+	writeFiles(t, root, map[string]string{"cpu/test/cpu.shares": "1024"})
+	if _, err := c.RTRuntime(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("RTRuntime() without cpu.rt_runtime_us got: %v, want: %v", err, ErrNotSupported)
+	}
+	// Installing a cgroup doesn't fail because of realtime bandwidth.
+	if err := (&cpu{}).set(LocalWriter{}, spec, filepath.Join(root, "cpu", "test")); err != nil {
+		t.Errorf("set() without cpu.rt_runtime_us got: %v, want: nil", err)
+	}
+	if err := c.SetRTRuntime(runtime); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetRTRuntime() without cpu.rt_runtime_us got: %v, want: %v", err, ErrNotSupported)
+	}
+
+	writeFiles(t, root, map[string]string{
+		"cpu/test/cpu.rt_runtime_us": "0\n",
+		"cpu/test/cpu.rt_period_us":  "1000000\n",
+	})
+	// The fake tree changed under the cached features, which a kernel never
+	// does, so they must be probed again.
+	resetFeatures()
+	if err := (&cpu{}).set(LocalWriter{}, spec, filepath.Join(root, "cpu", "test")); err != nil {
+		t.Fatalf("set(): %v", err)
+	}
+	if got, err := c.RTRuntime(); err != nil || got != runtime {
+		t.Errorf("RTRuntime() got: %d, %v, want: %d, nil", got, err, runtime)
+	}
+	if err := c.SetRTPeriod(500000); err != nil {
+		t.Fatalf("SetRTPeriod(): %v", err)
+	}
+	if err := c.SetRTRuntime(-1); err != nil {
+		t.Fatalf("SetRTRuntime(): %v", err)
+	}
+	if got, err := c.RTPeriod(); err != nil || got != 500000 {
+		t.Errorf("RTPeriod() got: %d, %v, want: 500000, nil", got, err)
+	}
+	if got, err := c.RTRuntime(); err != nil || got != -1 {
+		t.Errorf("RTRuntime() got: %d, %v, want: -1, nil", got, err)
+	}
+
+	// The kernel rejects a runtime that the parent doesn't have, which
+	// doesn't fail the installation either.
+	oldWrite := writeFile
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if filepath.Base(path) == "cpu.rt_runtime_us" {
+			return &os.PathError{Op: "write", Path: path, Err: syscall.EINVAL}
+		}
+		return oldWrite(path, data, perm)
+	}
+	if err := (&cpu{}).set(LocalWriter{}, spec, filepath.Join(root, "cpu", "test")); err != nil {
+		t.Errorf("set() with EINVAL from cpu.rt_runtime_us got: %v, want: nil", err)
+	}
+	writeFile = oldWrite
+
+	_, cleanup2 := setupRoot(t, true)
+	defer cleanup2()
+	if err := c.SetRTRuntime(0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetRTRuntime() on cgroup v2 got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestUseHierarchy(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	var emitter captureEmitter
+	SetLogger(&log.BasicLogger{Level: log.Debug, Emitter: &emitter})
+	defer SetLogger(nil)
+
+	c := &Cgroup{Name: "parent/test"}
+	if _, err := c.UseHierarchy(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("UseHierarchy() without memory.use_hierarchy got: %v, want: %v", err, ErrNotSupported)
+	}
+	for _, tc := range []struct {
+		useHierarchy string
+		warn         bool
+	}{
+		{useHierarchy: "1", warn: false},
+		{useHierarchy: "0", warn: true},
+	} {
+		emitter.lines = nil
+		writeFiles(t, root, map[string]string{
+			"memory/parent/memory.use_hierarchy":  tc.useHierarchy,
+			"memory/parent/memory.limit_in_bytes": "1073741824",
+		})
+		// Install leaves existing cgroups alone, so each case uses a new one.
+		cg := &Cgroup{Name: filepath.Join("parent", "test"+tc.useHierarchy)}
+		if err := cg.Install(nil); err != nil {
+			t.Fatalf("Install(): %v", err)
+		}
+		writeFiles(t, root, map[string]string{"memory/" + cg.Name + "/memory.use_hierarchy": tc.useHierarchy})
+		if got, err := cg.UseHierarchy(); err != nil || got != (tc.useHierarchy == "1") {
+			t.Errorf("UseHierarchy() got: %t, %v, want: %t, nil", got, err, tc.useHierarchy == "1")
+		}
+		warned := false
+		for _, line := range emitter.lines {
+			if strings.Contains(line, "memory.use_hierarchy is disabled") {
+				warned = true
+			}
+		}
+		if warned != tc.warn {
+			t.Errorf("Install() with use_hierarchy=%s warned: %t, want: %t, logs: %v", tc.useHierarchy, warned, tc.warn, emitter.lines)
+		}
+	}
+
+	_, cleanup2 := setupRoot(t, true)
+	defer cleanup2()
+	if got, err := c.UseHierarchy(); err != nil || !got {
+		t.Errorf("UseHierarchy() on cgroup v2 got: %t, %v, want: true, nil", got, err)
+	}
+}
+
+func TestSetNilResources(t *testing.T) {
+	zero := uint64(0)
+	limit := int64(1 << 30)
+	weight := uint16(500)
+	for _, tc := range []struct {
+		name  string
+		ctrl  controller
+		spec  specs.LinuxResources
+		files []string
+		want  map[string]string
+	}{
+		{
+			name:  "pids nil",
+			ctrl:  &pids{},
+			files: []string{"pids.max"},
+		},
+		{
+			name:  "pids zero",
+			ctrl:  &pids{},
+			spec:  specs.LinuxResources{Pids: &specs.LinuxPids{}},
+			files: []string{"pids.max"},
+			want:  map[string]string{"pids.max": "0"},
+		},
+		{
+			name:  "pids unlimited",
+			ctrl:  &pids{},
+			spec:  specs.LinuxResources{Pids: &specs.LinuxPids{Limit: -1}},
+			files: []string{"pids.max"},
+			want:  map[string]string{"pids.max": "max"},
+		},
+		{
+			name:  "memory nil",
+			ctrl:  &memory{},
+			files: []string{"memory.limit_in_bytes", "memory.swappiness", "memory.oom_control"},
+		},
+		{
+			name:  "memory swappiness nil",
+			ctrl:  &memory{},
+			spec:  specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &limit}},
+			files: []string{"memory.limit_in_bytes", "memory.swappiness"},
+			want:  map[string]string{"memory.limit_in_bytes": "1073741824"},
+		},
+		{
+			name:  "memory swappiness zero",
+			ctrl:  &memory{},
+			spec:  specs.LinuxResources{Memory: &specs.LinuxMemory{Swappiness: &zero}},
+			files: []string{"memory.limit_in_bytes", "memory.swappiness"},
+			want:  map[string]string{"memory.swappiness": "0"},
+		},
+		{
+			name: "memory unlimited",
+			ctrl: &memory{},
+			spec: specs.LinuxResources{Memory: &specs.LinuxMemory{
+				Limit:       int64Ptr(Unlimited),
+				Reservation: int64Ptr(-1),
+			}},
+			files: []string{"memory.limit_in_bytes", "memory.soft_limit_in_bytes"},
+			want: map[string]string{
+				"memory.limit_in_bytes":      "-1",
+				"memory.soft_limit_in_bytes": "-1",
+			},
+		},
+		{
+			name:  "memory2 nil",
+			ctrl:  &memory2{},
+			files: []string{"memory.max", "memory.low", "memory.swap.max"},
+		},
+		{
+			name:  "cpu nil",
+			ctrl:  &cpu{},
+			files: []string{"cpu.shares", "cpu.cfs_quota_us", "cpu.cfs_period_us"},
+		},
+		{
+			name:  "cpu2 nil",
+			ctrl:  &cpu2{},
+			files: []string{"cpu.weight", "cpu.max"},
+		},
+		{
+			name:  "cpu2 nil fields",
+			ctrl:  &cpu2{},
+			spec:  specs.LinuxResources{CPU: &specs.LinuxCPU{}},
+			files: []string{"cpu.weight", "cpu.max"},
+		},
+		{
+			name:  "blkio nil",
+			ctrl:  &blockIO{},
+			files: []string{"blkio.weight", "blkio.weight_device"},
+		},
+		{
+			name: "blkio weight device without leaf weight",
+			ctrl: &blockIO{},
+			spec: specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{
+				WeightDevice: []specs.LinuxWeightDevice{{Weight: &weight}},
+			}},
+			files: []string{"blkio.weight", "blkio.weight_device", "blkio.leaf_weight_device"},
+			want:  map[string]string{"blkio.weight_device": "0:0 500"},
+		},
+		{
+			name:  "net_cls nil",
+			ctrl:  &networkClass{},
+			files: []string{"net_cls.classid"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cgroup-test")
+			if err != nil {
+				t.Fatalf("ioutil.TempDir(): %v", err)
+			}
+			defer os.RemoveAll(dir)
+			const untouched = "untouched"
+			files := make(map[string]string)
+			for _, name := range tc.files {
+				files[name] = untouched
+			}
+			writeFiles(t, dir, files)
+
+			if err := tc.ctrl.set(LocalWriter{}, &tc.spec, dir); err != nil {
+				t.Fatalf("set(): %v", err)
+			}
+			for _, name := range tc.files {
+				want, ok := tc.want[name]
+				if !ok {
+					want = untouched
+				}
+				if got := readFile(t, dir, name); got != want {
+					t.Errorf("%s got: %q, want: %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallContextCancel(t *testing.T) {
+	_, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	// The context is cancelled by the first write, and no write may follow.
+	// Files aren't written, so that directories can be removed like in
+	// cgroupfs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var writes []string
+	oldWrite := writeFile
+	defer func() { writeFile = oldWrite }()
+	writeFile = func(path string, _ []byte, _ os.FileMode) error {
+		writes = append(writes, path)
+		cancel()
+		return nil
+	}
+
+	// Steps write more than one file, e.g. when enabling controllers, and each
+	// write checks the context.
+	c := Cgroup{Name: "test-cancel"}
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Reservation: int64Ptr(1 << 20)},
+		CPU:    &specs.LinuxCPU{Shares: uint64Ptr(1024), Quota: int64Ptr(50000)},
+	}
+	if err := c.InstallContext(ctx, res); !errors.Is(err, context.Canceled) {
+		t.Fatalf("InstallContext() got: %v, want: %v", err, context.Canceled)
+	}
+	if len(writes) != 1 {
+		t.Errorf("InstallContext() wrote after the context was cancelled: %v", writes)
+	}
+	if _, err := os.Stat(c.makePath("")); !os.IsNotExist(err) {
+		t.Errorf("cgroup was not rolled back, stat: %v", err)
+	}
+}
+
+func TestCPUSetPartition(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	c := Cgroup{Name: "test-partition"}
+	writeFiles(t, root, map[string]string{"test-partition/cpuset.cpus.partition": "member\n"})
+
+	if got, err := c.CPUSetPartition(); err != nil || got != "member" {
+		t.Errorf("CPUSetPartition() got: %q, %v, want: %q, nil", got, err, "member")
+	}
+	for _, mode := range []string{"root", "isolated", "member"} {
+		if err := c.SetCPUSetPartition(mode); err != nil {
+			t.Fatalf("SetCPUSetPartition(%q): %v", mode, err)
+		}
+		if got, err := c.CPUSetPartition(); err != nil || got != mode {
+			t.Errorf("CPUSetPartition() got: %q, %v, want: %q, nil", got, err, mode)
+		}
+	}
+	if err := c.SetCPUSetPartition("invalid"); err == nil {
+		t.Errorf("SetCPUSetPartition(%q) should have failed", "invalid")
+	}
+}
+
+func TestWaitPopulated(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		unified   bool
+		file      string
+		empty     string
+		populated string
+	}{
+		{
+			name:      "v1",
+			file:      "memory/test/cgroup.procs",
+			empty:     "",
+			populated: "123\n",
+		},
+		{
+			name:      "v2",
+			unified:   true,
+			file:      "test/cgroup.events",
+			empty:     "populated 0\nfrozen 0\n",
+			populated: "populated 1\nfrozen 0\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, map[string]string{tc.file: tc.empty})
+			c := Cgroup{Name: "test"}
+
+			// Times out while the cgroup is empty.
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := c.WaitPopulated(ctx); err != context.DeadlineExceeded {
+				t.Fatalf("WaitPopulated() got: %v, want: %v", err, context.DeadlineExceeded)
+			}
+
+			// Returns once a task joins.
+			errCh := make(chan error, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				errCh <- overwriteFile(filepath.Join(root, tc.file), tc.populated)
+			}()
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := c.WaitPopulated(ctx); err != nil {
+				t.Errorf("WaitPopulated(): %v", err)
+			}
+			if err := <-errCh; err != nil {
+				t.Errorf("overwriteFile(): %v", err)
+			}
+		})
+	}
+}
+
+func TestCPUSetExclusive(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"cpuset/cpuset.cpu_exclusive":              "1\n",
+		"cpuset/cpuset.mem_exclusive":              "1\n",
+		"cpuset/parent/cpuset.cpu_exclusive":       "0\n",
+		"cpuset/parent/cpuset.mem_exclusive":       "0\n",
+		"cpuset/parent/child/cpuset.cpu_exclusive": "0\n",
+		"cpuset/parent/child/cpuset.mem_exclusive": "0\n",
+	})
+	parent := Cgroup{Name: "parent"}
+	child := Cgroup{Name: "parent/child"}
+
+	for _, tc := range []struct {
+		name string
+		get  func(*Cgroup) (bool, error)
+		set  func(*Cgroup, bool) error
+	}{
+		{name: "cpu", get: (*Cgroup).CPUSetExclusive, set: (*Cgroup).SetCPUSetExclusive},
+		{name: "mem", get: (*Cgroup).CPUSetMemExclusive, set: (*Cgroup).SetCPUSetMemExclusive},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Child can't be exclusive until the parent is.
+			if err := tc.set(&child, true); !errors.Is(err, syscall.EINVAL) {
+				t.Errorf("set(child, true) got: %v, want: %v", err, syscall.EINVAL)
+			}
+			if err := tc.set(&parent, true); err != nil {
+				t.Fatalf("set(parent, true): %v", err)
+			}
+			if err := tc.set(&child, true); err != nil {
+				t.Fatalf("set(child, true): %v", err)
+			}
+			if got, err := tc.get(&child); err != nil || !got {
+				t.Errorf("get(child) got: %t, %v, want: true, nil", got, err)
+			}
+			if err := tc.set(&child, false); err != nil {
+				t.Fatalf("set(child, false): %v", err)
+			}
+			if got, err := tc.get(&child); err != nil || got {
+				t.Errorf("get(child) got: %t, %v, want: false, nil", got, err)
+			}
+		})
+	}
+}
+
+func TestAge(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unified=%t", unified), func(t *testing.T) {
+			_, cleanup := setupRoot(t, unified)
+			defer cleanup()
+
+			c := Cgroup{Name: "test-age"}
+			if _, err := c.Age(); err == nil {
+				t.Errorf("Age() on missing cgroup should have failed")
+			}
+			if err := os.MkdirAll(c.makePath("memory"), 0755); err != nil {
+				t.Fatalf("os.MkdirAll(): %v", err)
+			}
+			age, err := c.Age()
+			if err != nil {
+				t.Fatalf("Age(): %v", err)
+			}
+			if age < 0 || age > time.Minute {
+				t.Errorf("Age() got: %v, want: [0, %v]", age, time.Minute)
+			}
+		})
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	for _, tc := range []struct {
+		str   string
+		want  int64
+		error bool
+	}{
+		{str: "max", want: Unlimited},
+		{str: "-1", want: Unlimited},
+		{str: "-1\n", want: Unlimited},
+		{str: "9223372036854771712", want: Unlimited},
+		{str: "9223372036854710272", want: Unlimited},
+		{str: "9223372036854775807", want: Unlimited},
+		{str: "0", want: 0},
+		{str: "1073741824\n", want: 1 << 30},
+		{str: "9223372036854644736", want: 9223372036854644736},
+		{str: "-2", error: true},
+		{str: "", error: true},
+		{str: "unlimited", error: true},
+	} {
+		t.Run(tc.str, func(t *testing.T) {
+			got, err := parseLimit(tc.str)
+			if tc.error {
+				if err == nil {
+					t.Errorf("parseLimit(%q) should have failed, got: %d", tc.str, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLimit(%q): %v", tc.str, err)
+			}
+			if got != tc.want {
+				t.Errorf("parseLimit(%q) got: %d, want: %d", tc.str, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatLimit(t *testing.T) {
+	for _, tc := range []struct {
+		val    int64
+		want   string
+		wantV2 string
+	}{
+		{val: Unlimited, want: "-1", wantV2: "max"},
+		{val: -1, want: "-1", wantV2: "max"},
+		{val: 0, want: "0", wantV2: "0"},
+		{val: 1 << 30, want: "1073741824", wantV2: "1073741824"},
+	} {
+		if got := formatLimit(tc.val, false); got != tc.want {
+			t.Errorf("formatLimit(%d, false) got: %q, want: %q", tc.val, got, tc.want)
+		}
+		if got := formatLimit(tc.val, true); got != tc.wantV2 {
+			t.Errorf("formatLimit(%d, true) got: %q, want: %q", tc.val, got, tc.wantV2)
+		}
+		// Formatted values are parsed back to the same limit.
+		if tc.val >= 0 {
+			if got, err := parseLimit(formatLimit(tc.val, true)); err != nil || got != tc.val {
+				t.Errorf("parseLimit(formatLimit(%d)) got: %d, %v", tc.val, got, err)
+			}
+		}
+	}
+}
+
+func TestExists(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unified=%t", unified), func(t *testing.T) {
+			_, cleanup := setupRoot(t, unified)
+			defer cleanup()
+
+			c := Cgroup{Name: "test-exists"}
+			if got, err := c.Exists(); err != nil || got {
+				t.Errorf("Exists() before Install got: %t, %v, want: false, nil", got, err)
+			}
+			if err := c.Install(nil); err != nil {
+				t.Fatalf("Install(): %v", err)
+			}
+			if got, err := c.Exists(); err != nil || !got {
+				t.Errorf("Exists() after Install got: %t, %v, want: true, nil", got, err)
+			}
+			if err := c.Uninstall(); err != nil {
+				t.Fatalf("Uninstall(): %v", err)
+			}
+			if got, err := c.Exists(); err != nil || got {
+				t.Errorf("Exists() after Uninstall got: %t, %v, want: false, nil", got, err)
+			}
+		})
+	}
+}
+
+func TestInstallBestEffort(t *testing.T) {
+	pidsLimit := specs.LinuxPids{Limit: 10}
+	for _, tc := range []struct {
+		name    string
+		res     *specs.LinuxResources
+		opts    InstallOpts
+		wantErr bool
+	}{
+		{
+			name:    "strict",
+			res:     &specs.LinuxResources{},
+			wantErr: true,
+		},
+		{
+			name: "best-effort",
+			res:  &specs.LinuxResources{},
+			opts: InstallOpts{BestEffort: true},
+		},
+		{
+			name:    "best-effort-required",
+			res:     &specs.LinuxResources{Pids: &pidsLimit},
+			opts:    InstallOpts{BestEffort: true},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, false)
+			defer cleanup()
+			// cpuset files are inherited from the parent, which requires
+			// writing to them even if 'res' doesn't set them.
+			writeFiles(t, root, map[string]string{
+				"cpuset/cpuset.cpus":      "0-3",
+				"cpuset/cpuset.mems":      "0",
+				"cpuset/test/cpuset.cpus": "",
+				"cpuset/test/cpuset.mems": "",
+			})
+			oldWrite := writeFile
+			defer func() { writeFile = oldWrite }()
+			writeFile = func(path string, _ []byte, _ os.FileMode) error {
+				return &os.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+			}
+
+			c := Cgroup{Name: "test"}
+			err := c.InstallWithOpts(context.Background(), tc.res, tc.opts)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("InstallWithOpts() got error: %v, want error: %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer c.Uninstall()
+			if _, err := os.Stat(c.makePath("memory")); err != nil {
+				t.Errorf("memory cgroup was not created: %v", err)
+			}
+		})
+	}
+}
+
+func TestSetCPUSetFromCount(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		file    string
+	}{
+		{name: "v1", file: "cpuset/parent/cpuset.effective_cpus"},
+		{name: "v2", unified: true, file: "parent/cpuset.cpus.effective"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			c := Cgroup{Name: "parent/test"}
+			writeFiles(t, root, map[string]string{tc.file: "2-3,6,8-11\n"})
+			if err := os.MkdirAll(c.makePath("cpuset"), 0755); err != nil {
+				t.Fatalf("os.MkdirAll(): %v", err)
+			}
+
+			for _, step := range []struct {
+				n    int
+				want string
+			}{
+				{n: 1, want: "2"},
+				{n: 3, want: "2-3,6"},
+				{n: 4, want: "2-3,6,8"},
+				{n: 7, want: "2-3,6,8-11"},
+			} {
+				if err := c.SetCPUSetFromCount(step.n); err != nil {
+					t.Fatalf("SetCPUSetFromCount(%d): %v", step.n, err)
+				}
+				if got := readFile(t, c.makePath("cpuset"), "cpuset.cpus"); got != step.want {
+					t.Errorf("SetCPUSetFromCount(%d) got: %q, want: %q", step.n, got, step.want)
+				}
+			}
+			for _, n := range []int{0, 8} {
+				if err := c.SetCPUSetFromCount(n); err == nil {
+					t.Errorf("SetCPUSetFromCount(%d) should have failed", n)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCpuset(t *testing.T) {
+	for _, tc := range []struct {
+		str  string
+		want []int
+	}{
+		{str: "0", want: []int{0}},
+		{str: "0-3", want: []int{0, 1, 2, 3}},
+		{str: "1,3,5", want: []int{1, 3, 5}},
+		{str: "0-1,4,6-7", want: []int{0, 1, 4, 6, 7}},
+	} {
+		t.Run(tc.str, func(t *testing.T) {
+			got, err := parseCpuset(tc.str)
+			if err != nil {
+				t.Fatalf("parseCpuset(%q): %v", tc.str, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseCpuset(%q) got: %v, want: %v", tc.str, got, tc.want)
+			}
+			if str := formatCpuset(got); str != tc.str {
+				t.Errorf("formatCpuset(%v) got: %q, want: %q", got, str, tc.str)
+			}
+		})
+	}
+}
+
+func TestEffectiveCPUSet(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		unified  bool
+		files    map[string]string
+		wantCPUs []int
+		wantMems []int
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"cpuset/test/cpuset.cpus":           "0-7\n",
+				"cpuset/test/cpuset.effective_cpus": "2-3\n",
+				"cpuset/test/cpuset.mems":           "0-1\n",
+				"cpuset/test/cpuset.effective_mems": "0\n",
+			},
+			wantCPUs: []int{2, 3},
+			wantMems: []int{0},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/cpuset.cpus":           "",
+				"test/cpuset.cpus.effective": "0-1,6\n",
+				"test/cpuset.mems":           "",
+				"test/cpuset.mems.effective": "0\n",
+			},
+			wantCPUs: []int{0, 1, 6},
+			wantMems: []int{0},
+		},
+		{
+			name: "fallback",
+			files: map[string]string{
+				"cpuset/test/cpuset.cpus": "4-5\n",
+				"cpuset/test/cpuset.mems": "1\n",
+			},
+			wantCPUs: []int{4, 5},
+			wantMems: []int{1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := Cgroup{Name: "test"}
+			cpus, err := c.EffectiveCPUSetCPUs()
+			if err != nil {
+				t.Fatalf("EffectiveCPUSetCPUs(): %v", err)
+			}
+			if !reflect.DeepEqual(cpus, tc.wantCPUs) {
+				t.Errorf("EffectiveCPUSetCPUs() got: %v, want: %v", cpus, tc.wantCPUs)
+			}
+			mems, err := c.EffectiveCPUSetMems()
+			if err != nil {
+				t.Fatalf("EffectiveCPUSetMems(): %v", err)
+			}
+			if !reflect.DeepEqual(mems, tc.wantMems) {
+				t.Errorf("EffectiveCPUSetMems() got: %v, want: %v", mems, tc.wantMems)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	// The cgroup was created on a cgroup v1 host, which is now cgroup v2.
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	proc, err := ioutil.TempDir("", "cgroup-proc")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(proc)
+	oldProc := procRoot
+	procRoot = proc
+	defer func() { procRoot = oldProc }()
+	writeFiles(t, proc, map[string]string{
+		"123/cgroup": "0::/system.slice/test\n",
+		"456/cgroup": "0::/user.slice/other\n",
+	})
+	if err := os.MkdirAll(filepath.Join(root, "system.slice", "test"), 0755); err != nil {
+		t.Fatalf("os.MkdirAll(): %v", err)
+	}
+
+	stale := map[string]string{"memory": "/system.slice", "cpu,cpuacct": "/system.slice"}
+	c := Cgroup{Name: "test", Parents: stale}
+	if ok, err := c.Exists(); err != nil || ok {
+		t.Fatalf("Exists() got: %t, %v, want: false, nil", ok, err)
+	}
+	if err := c.Resolve(456); err == nil {
+		t.Errorf("Resolve() should have failed for a process in another cgroup")
+	}
+	if !reflect.DeepEqual(c.Parents, stale) {
+		t.Errorf("Resolve() failed but changed parents to: %v", c.Parents)
+	}
+
+	if err := c.Resolve(123); err != nil {
+		t.Fatalf("Resolve(): %v", err)
+	}
+	if want := filepath.Join(root, "system.slice", "test"); c.makePath("memory") != want {
+		t.Errorf("makePath(memory) got: %q, want: %q", c.makePath("memory"), want)
+	}
+
+	// Paths that resolve are kept as is.
+	parents := map[string]string{"": "/system.slice"}
+	c = Cgroup{Name: "test", Parents: parents}
+	if err := c.Resolve(456); err != nil {
+		t.Fatalf("Resolve(): %v", err)
+	}
+	if !reflect.DeepEqual(c.Parents, parents) {
+		t.Errorf("Resolve() got parents: %v, want: %v", c.Parents, parents)
+	}
+}
+
+func TestInstallDoesNotJoin(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unified=%t", unified), func(t *testing.T) {
+			_, cleanup := setupRoot(t, unified)
+			defer cleanup()
+
+			// Files aren't written, so that directories can be removed like in
+			// cgroupfs.
+			var writes []string
+			oldWrite := writeFile
+			defer func() { writeFile = oldWrite }()
+			writeFile = func(path string, _ []byte, _ os.FileMode) error {
+				writes = append(writes, path)
+				return nil
+			}
+
+			limit := int64(1 << 30)
+			c := Cgroup{Name: "test"}
+			if err := c.Install(&specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: &limit},
+				CPU:    &specs.LinuxCPU{Cpus: "0", Mems: "0"},
+			}); err != nil {
+				t.Fatalf("Install(): %v", err)
+			}
+			defer c.Uninstall()
+
+			if len(writes) == 0 {
+				t.Fatalf("Install() didn't write anything")
+			}
+			for _, path := range writes {
+				if filepath.Base(path) == "cgroup.procs" {
+					t.Errorf("Install() wrote to %q", path)
+				}
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	proc, err := ioutil.TempDir("", "cgroup-proc")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(proc)
+	oldProc := procRoot
+	procRoot = proc
+	defer func() { procRoot = oldProc }()
+	writeFiles(t, proc, map[string]string{
+		"self/cgroup": "1:memory:/user.slice\n2:pids:/user.slice\n3:cpuset:/\n",
+	})
+	writeFiles(t, root, map[string]string{
+		"cpuset/cpuset.cpus":      "0-3",
+		"cpuset/cpuset.mems":      "0",
+		"cpuset/test/cpuset.cpus": "",
+		"cpuset/test/cpuset.mems": "",
+	})
+
+	var procs []string
+	oldWrite := writeFile
+	defer func() { writeFile = oldWrite }()
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if filepath.Base(path) == "cgroup.procs" {
+			procs = append(procs, filepath.Dir(path))
+			return nil
+		}
+		if strings.HasPrefix(path, filepath.Join(root, "cpuset")) {
+			return &os.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+		}
+		return oldWrite(path, data, perm)
+	}
+
+	// Nothing is joined if the cgroup wasn't installed.
+	c := Cgroup{Name: "test"}
+	undo, err := c.Join()
+	if err != nil {
+		t.Fatalf("Join(): %v", err)
+	}
+	undo()
+	if len(procs) > 0 {
+		t.Errorf("Join() of a cgroup that wasn't installed wrote to: %v", procs)
+	}
+
+	// The cpuset controller is skipped, since it can't be configured.
+	if err := c.InstallWithOpts(context.Background(), &specs.LinuxResources{}, InstallOpts{BestEffort: true}); err != nil {
+		t.Fatalf("InstallWithOpts(): %v", err)
+	}
+	defer c.Uninstall()
+	for _, key := range c.Controllers {
+		if key == "cpuset" {
+			t.Errorf("Controllers got: %v, want without cpuset", c.Controllers)
+		}
+	}
+	undo, err = c.Join()
+	if err != nil {
+		t.Fatalf("Join(): %v", err)
+	}
+	joined := make(map[string]bool)
+	for _, path := range procs {
+		joined[path] = true
+	}
+	for _, key := range []string{"memory", "pids"} {
+		if path := c.makePath(key); !joined[path] {
+			t.Errorf("Join() didn't join %q, joined: %v", path, procs)
+		}
+	}
+	if path := c.makePath("cpuset"); joined[path] {
+		t.Errorf("Join() joined skipped controller at %q", path)
+	}
+
+	// All the original cgroups of the joined controllers are restored.
+	procs = nil
+	undo()
+	want := []string{
+		filepath.Join(root, "memory", "user.slice"),
+		filepath.Join(root, "pids", "user.slice"),
+	}
+	sort.Strings(procs)
+	if !reflect.DeepEqual(procs, want) {
+		t.Errorf("undo() restored: %v, want: %v", procs, want)
+	}
+}
+
+func TestInstallReadOnly(t *testing.T) {
+	t.Run("mount", func(t *testing.T) {
+		root, cleanup := setupRoot(t, false)
+		defer cleanup()
+		var mounts []string
+		for name := range controllers {
+			opt := name
+			if name == "systemd" {
+				opt = "name=systemd"
+			}
+			mounts = append(mounts, fmt.Sprintf("%s cgroup ro,%s", name, opt))
+		}
+		writeMountinfo(t, root, mounts...)
+
+		c := Cgroup{Name: "test"}
+		if err := c.Install(nil); !errors.Is(err, ErrReadOnlyCgroupfs) {
+			t.Errorf("Install() got: %v, want: %v", err, ErrReadOnlyCgroupfs)
+		}
+		if err := c.InstallWithOpts(context.Background(), nil, InstallOpts{BestEffort: true}); err != nil {
+			t.Errorf("InstallWithOpts(BestEffort) got: %v, want: nil", err)
+		}
+		if c.Own {
+			t.Errorf("cgroup should not be owned if it wasn't created")
+		}
+		if len(c.Controllers) > 0 {
+			t.Errorf("Controllers got: %v, want: none", c.Controllers)
+		}
+		if _, err := os.Stat(c.makePath("memory")); !os.IsNotExist(err) {
+			t.Errorf("cgroup was created on a read-only cgroupfs, stat: %v", err)
+		}
+	})
+
+	t.Run("EROFS", func(t *testing.T) {
+		_, cleanup := setupRoot(t, true)
+		defer cleanup()
+		oldWrite := writeFile
+		defer func() { writeFile = oldWrite }()
+		writeFile = func(path string, _ []byte, _ os.FileMode) error {
+			return &os.PathError{Op: "open", Path: path, Err: syscall.EROFS}
+		}
+
+		limit := int64(1 << 30)
+		res := &specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &limit}}
+		c := Cgroup{Name: "test"}
+		if err := c.Install(res); !errors.Is(err, ErrReadOnlyCgroupfs) {
+			t.Errorf("Install() got: %v, want: %v", err, ErrReadOnlyCgroupfs)
+		}
+		c = Cgroup{Name: "test"}
+		if err := c.InstallWithOpts(context.Background(), res, InstallOpts{BestEffort: true}); err != nil {
+			t.Errorf("InstallWithOpts(BestEffort) got: %v, want: nil", err)
+		}
+		if c.Own {
+			t.Errorf("cgroup should not be owned if it wasn't created")
+		}
+	})
+}
+
+func TestSummary(t *testing.T) {
+	t.Run("unified", func(t *testing.T) {
+		root, cleanup := setupRoot(t, true)
+		defer cleanup()
+
+		writeFiles(t, root, map[string]string{
+			"kubepods/pod123/cgroup.controllers": "cpu memory pids",
+			"kubepods/pod123/memory.max":         "1073741824\n",
+			"kubepods/pod123/cpu.max":            "200000 100000\n",
+			"kubepods/pod123/pids.max":           "1024\n",
+		})
+		c := Cgroup{Name: "pod123", Parents: map[string]string{"": "/kubepods"}}
+		if got, want := c.Summary(), "cgroup v2 /kubepods/pod123 mem=1Gi cpu=2.0 pids=1024 controllers=cpu,memory,pids"; got != want {
+			t.Errorf("Summary() got: %q, want: %q", got, want)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		root, cleanup := setupRoot(t, false)
+		defer cleanup()
+
+		// pids.max is unreadable and the other controllers are missing.
+		writeFiles(t, root, map[string]string{
+			"memory/test/memory.limit_in_bytes": "9223372036854771712\n",
+			"cpu/test/cpu.cfs_quota_us":         "150000\n",
+			"cpu/test/cpu.cfs_period_us":        "100000\n",
+		})
+		c := Cgroup{Name: "test"}
+		if got, want := c.Summary(), "cgroup v1 /test mem=max cpu=1.5 pids=? controllers=cpu,memory"; got != want {
+			t.Errorf("Summary() got: %q, want: %q", got, want)
+		}
+	})
+
+	t.Run("stringer", func(t *testing.T) {
+		// No cgroupfs is set up: nothing is read from the host.
+		c := Cgroup{Name: "pod123", Parents: map[string]string{"": "/kubepods"}, Own: true}
+		if got, want := c.String(), `cgroup "pod123" parents=map[:/kubepods] own=true`; got != want {
+			t.Errorf("String() got: %q, want: %q", got, want)
+		}
+	})
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, tc := range []struct {
+		val  int64
+		want string
+	}{
+		{val: 0, want: "0"},
+		{val: 1000, want: "1000"},
+		{val: 1536 << 10, want: "1536Ki"},
+		{val: 512 << 20, want: "512Mi"},
+		{val: 1 << 30, want: "1Gi"},
+		{val: Unlimited, want: "max"},
+	} {
+		if got := formatBytes(tc.val); got != tc.want {
+			t.Errorf("formatBytes(%d) got: %q, want: %q", tc.val, got, tc.want)
+		}
+	}
+}
+
+// TestConcurrentAccess runs readers concurrently with changes to the cgroup,
+// including its fields. Run with -race to detect unsynchronized accesses.
+func TestConcurrentAccess(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	proc, err := ioutil.TempDir("", "cgroup-proc")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(proc)
+	oldProc := procRoot
+	procRoot = proc
+	defer func() { procRoot = oldProc }()
+	writeFiles(t, proc, map[string]string{"123/cgroup": "0::/system.slice/test\n"})
+	writeFiles(t, root, map[string]string{
+		"system.slice/test/memory.current": "4096\n",
+		"system.slice/test/cpu.stat":       "usage_usec 3\n",
+		"system.slice/test/pids.current":   "3\n",
+		"system.slice/test/cpu.weight":     "100\n",
+	})
+
+	// The parents are stale until Resolve is called.
+	c := &Cgroup{Name: "test", Parents: map[string]string{"memory": "/system.slice"}}
+	const (
+		readers    = 4
+		iterations = 200
+	)
+	var wg, started sync.WaitGroup
+	started.Add(readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if _, err := c.Stat(); err != nil && !os.IsNotExist(err) {
+					t.Errorf("Stat(): %v", err)
+				}
+				_ = c.String()
+				_ = c.Summary()
+				if j == 0 {
+					started.Done()
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Change the parents while readers are running.
+		started.Wait()
+		if err := c.Resolve(123); err != nil {
+			t.Errorf("Resolve(): %v", err)
+			return
+		}
+		for j := 0; j < iterations; j++ {
+			if err := c.SetCPUWeight(uint64(j%100 + 1)); err != nil {
+				t.Errorf("SetCPUWeight(): %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	want := Stats{MemoryUsage: 4096, CPUUsage: 3 * time.Microsecond, Pids: 3}
+	if got, err := c.Stat(); err != nil || *got != want {
+		t.Errorf("Stat() got: %+v, %v, want: %+v, nil", got, err, want)
+	}
+}
+
+func TestSetCPUSetMems(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+		mems    string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "v1",
+			files: map[string]string{"cpuset/cpuset.effective_mems": "0-1\n"},
+			mems:  "1",
+			want:  "1",
+		},
+		{
+			name:    "v1-invalid",
+			files:   map[string]string{"cpuset/cpuset.effective_mems": "0-1\n"},
+			mems:    "0-3",
+			wantErr: "invalid memory nodes 2-3",
+		},
+		{
+			name:  "v1-inherit",
+			files: map[string]string{"cpuset/cpuset.mems": "0-1\n"},
+			want:  "0-1",
+		},
+		{
+			name:    "v2-invalid",
+			unified: true,
+			files:   map[string]string{"cpuset.mems.effective": "0\n"},
+			mems:    "0,1",
+			wantErr: "invalid memory nodes 1",
+		},
+		{
+			// Without the parent's nodes, the host's online nodes are used.
+			name:    "v2-online",
+			unified: true,
+			mems:    "2",
+			wantErr: "invalid memory nodes 2 in cpuset.mems \"2\", available: 0-1",
+		},
+		{
+			name:    "v2-inherit",
+			unified: true,
+			want:    "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			oldNode := nodeRoot
+			nodeRoot = filepath.Join(root, "node")
+			defer func() { nodeRoot = oldNode }()
+			writeFiles(t, root, map[string]string{"node/online": "0-1\n"})
+			writeFiles(t, root, tc.files)
+			dir := "test"
+			if !tc.unified {
+				dir = "cpuset/test"
+			}
+			writeFiles(t, root, map[string]string{dir + "/cpuset.mems": "\n"})
+
+			c := Cgroup{Name: "test"}
+			err := c.SetCPUSetMems(tc.mems)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("SetCPUSetMems(%q) got: %v, want: %q", tc.mems, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetCPUSetMems(%q): %v", tc.mems, err)
+			}
+			if got := readFile(t, root, dir+"/cpuset.mems"); got != tc.want {
+				t.Errorf("cpuset.mems got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChild(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+	}{
+		{name: "v1"},
+		{name: "v2", unified: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+
+			parent := &Cgroup{Name: "pod"}
+			if err := parent.Install(nil); err != nil {
+				t.Fatalf("Install(): %v", err)
+			}
+			if tc.unified {
+				writeFiles(t, root, map[string]string{"pod/cgroup.controllers": "cpuset cpu memory pids"})
+			}
+			limits := map[string]int64{"a": 1 << 30, "b": 2 << 30}
+			for name, limit := range limits {
+				child, err := parent.Child(name, &specs.LinuxResources{
+					Memory: &specs.LinuxMemory{Limit: int64Ptr(limit)},
+					CPU:    &specs.LinuxCPU{Cpus: "0", Mems: "0"},
+				})
+				if err != nil {
+					t.Fatalf("Child(%q): %v", name, err)
+				}
+				if want := filepath.Join("pod", name); child.Name != want {
+					t.Errorf("Child(%q) name got: %q, want: %q", name, child.Name, want)
+				}
+				if !child.Own {
+					t.Errorf("Child(%q) should own the cgroup", name)
+				}
+				got, err := child.MemoryLimit()
+				if err != nil {
+					t.Fatalf("MemoryLimit(): %v", err)
+				}
+				if got != limit {
+					t.Errorf("MemoryLimit() of child %q got: %d, want: %d", name, got, limit)
+				}
+			}
+			if tc.unified {
+				if got := readFile(t, root, "pod/cgroup.subtree_control"); !strings.HasPrefix(got, "+") {
+					t.Errorf("pod/cgroup.subtree_control got: %q, want controllers enabled", got)
+				}
+			}
+
+			for _, name := range []string{"", ".", "..", "a/b"} {
+				if _, err := parent.Child(name, nil); err == nil {
+					t.Errorf("Child(%q) should have failed", name)
+				}
+			}
+			missing := &Cgroup{Name: "missing"}
+			if _, err := missing.Child("a", nil); err == nil {
+				t.Errorf("Child() of a missing cgroup should have failed")
+			}
+		})
+	}
+}
+
+func TestUninstallChildren(t *testing.T) {
+	_, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	parent := &Cgroup{Name: "pod"}
+	if err := parent.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	child, err := parent.Child("a", nil)
+	if err != nil {
+		t.Fatalf("Child(): %v", err)
+	}
+	if _, err := child.Child("nested", nil); err != nil {
+		t.Fatalf("Child(): %v", err)
+	}
+
+	if err := parent.Uninstall(); !errors.Is(err, ErrHasChildren) {
+		t.Fatalf("Uninstall() with children got: %v, want: %v", err, ErrHasChildren)
+	}
+	if exists, err := parent.Exists(); err != nil || !exists {
+		t.Fatalf("Exists() after failed Uninstall() got: %t, %v, want: true, nil", exists, err)
+	}
+
+	if err := parent.UninstallWithOpts(UninstallOpts{Cascade: true}); err != nil {
+		t.Fatalf("UninstallWithOpts(Cascade): %v", err)
+	}
+	for _, cg := range []*Cgroup{parent, child} {
+		if exists, err := cg.Exists(); err != nil || exists {
+			t.Errorf("Exists() of %q after cascading Uninstall() got: %t, %v, want: false, nil", cg.Name, exists, err)
+		}
+	}
+}
+
+func TestUninstallContext(t *testing.T) {
+	_, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	pod := &Cgroup{Name: "pod"}
+	if err := pod.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	child, err := pod.Child("a", nil)
+	if err != nil {
+		t.Fatalf("Child(): %v", err)
+	}
+	if _, err := child.Child("b", nil); err != nil {
+		t.Fatalf("Child(): %v", err)
+	}
+
+	// Cancel the context once a few directories have been removed.
+	const cancelAfter = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	oldRmdir := rmdir
+	defer func() { rmdir = oldRmdir }()
+	count := 0
+	rmdir = func(path string) error {
+		if err := oldRmdir(path); err != nil {
+			return err
+		}
+		if count++; count == cancelAfter {
+			cancel()
+		}
+		return nil
+	}
+
+	err = pod.UninstallContext(ctx)
+	var uerr *UninstallError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("UninstallContext() got: %v, want: %T", err, uerr)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("UninstallContext() got: %v, want: %v", err, context.Canceled)
+	}
+	if len(uerr.Removed) != cancelAfter {
+		t.Errorf("UninstallContext() removed: %v, want %d directories", uerr.Removed, cancelAfter)
+	}
+	if len(uerr.Remaining) == 0 {
+		t.Errorf("UninstallContext() got no remaining directories")
+	}
+	for _, path := range uerr.Removed {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%q reported as removed, stat: %v", path, err)
+		}
+	}
+	for _, path := range uerr.Remaining {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%q reported as remaining, stat: %v", path, err)
+		}
+	}
+
+	// Children are removed before their parents, so the remaining hierarchy
+	// can be removed later.
+	if err := pod.UninstallContext(context.Background()); err != nil {
+		t.Fatalf("UninstallContext(): %v", err)
+	}
+	if exists, err := pod.Exists(); err != nil || exists {
+		t.Errorf("Exists() after UninstallContext() got: %t, %v, want: false, nil", exists, err)
+	}
+}
+
+func TestUninstallContextBusy(t *testing.T) {
+	_, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := &Cgroup{Name: "test"}
+	if err := c.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer c.Uninstall()
+
+	oldRmdir := rmdir
+	defer func() { rmdir = oldRmdir }()
+	rmdir = func(string) error { return syscall.EBUSY }
+	rmdirTimeout = 5 * time.Second
+
+	// The context stops EBUSY retries before their own timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := c.UninstallContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("UninstallContext() got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("UninstallContext() took %v, want it to stop with the context", elapsed)
+	}
+}
@@ -0,0 +1,723 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// defaultPeriod is the default 'cpu.max' period, in microseconds.
+	defaultPeriod = 100000
+
+	// Range of values accepted by 'cpu.weight' and 'io.weight'.
+	minWeight = 1
+	maxWeight = 10000
+
+	// Range of values accepted by 'cpu.weight.nice'.
+	minNice = -20
+	maxNice = 19
+
+	// Range of values accepted by v1 'cpu.shares'.
+	minShares = 2
+	maxShares = 262144
+)
+
+// controllers2 are the controllers configured in the cgroup v2 unified
+// hierarchy. They all share the same directory.
+var controllers2 = map[string]controller{
+	"cpu":    &cpu2{},
+	"cpuset": &cpuSet2{},
+	"memory": &memory2{},
+	"pids":   &pids{},
+}
+
+// enableControllers enables, for every ancestor of 'path' below 'root', all
+// controllers that are available to it in 'cgroup.subtree_control'. This is
+// required for the controller files to show up in 'path'. Writes are done
+// with 'w'. Failures are logged and otherwise ignored, in which case writing to
+// the controller files fails later with a more specific error.
+func enableControllers(w Writer, root, path string) {
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		logger().Warningf("Cgroup %q is not under %q: %v", path, root, err)
+		return
+	}
+	dirs := []string{root}
+	if rel != "." {
+		dir := root
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, elem)
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		avail, err := getValue(dir, "cgroup.controllers")
+		if err != nil {
+			logger().Debugf("Reading available controllers in %q: %v", dir, err)
+			continue
+		}
+		for _, ctrl := range strings.Fields(avail) {
+			if _, ok := controllers2[ctrl]; !ok {
+				continue
+			}
+			if err := writeValue(w, dir, "cgroup.subtree_control", "+"+ctrl); err != nil {
+				logger().Warningf("Enabling controller %q in %q: %v", ctrl, dir, err)
+			}
+		}
+	}
+}
+
+// enableMissingController is called when the file 'name' of the cgroup v2
+// directory 'path' is missing. If the file belongs to a controller that is
+// available on the host but not enabled for the cgroup, it enables the
+// controller in 'cgroup.subtree_control' of every ancestor with 'w', and
+// returns true if the write should be retried. It returns false for cgroup
+// v1, core files like 'cgroup.procs', cgroups that don't exist, and when the
+// controller is already enabled, i.e. the file is missing for another reason.
+func enableMissingController(w Writer, path, name string) bool {
+	dot := strings.Index(name, ".")
+	if dot <= 0 || name[:dot] == "cgroup" {
+		return false
+	}
+	ctrl := name[:dot]
+	h := getHierarchies()
+	if h.unified == "" || !h.isV2(ctrl) {
+		return false
+	}
+	rel, err := filepath.Rel(h.unified, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	if avail, err := getValue(path, "cgroup.controllers"); err != nil || containsField(avail, ctrl) {
+		return false
+	}
+
+	dirs := []string{h.unified}
+	if parent := filepath.Dir(rel); parent != "." {
+		dir := h.unified
+		for _, elem := range strings.Split(parent, string(filepath.Separator)) {
+			dir = filepath.Join(dir, elem)
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		avail, err := getValue(dir, "cgroup.controllers")
+		if err != nil || !containsField(avail, ctrl) {
+			logger().Debugf("Controller %q is not available in %q to write %q", ctrl, dir, name)
+			return false
+		}
+	}
+	for _, dir := range dirs {
+		if err := w.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), "+"+ctrl); err != nil {
+			logger().Warningf("Enabling controller %q in %q: %v", ctrl, dir, err)
+			return false
+		}
+	}
+	logger().Infof("Enabled controller %q for cgroup %q, %q was missing", ctrl, path, name)
+	return true
+}
+
+// sharesToWeight converts v1 'cpu.shares' to v2 'cpu.weight', mapping the
+// shares range [2, 262144] to the weight range [1, 10000]. Zero is returned
+// for zero shares, meaning that no value is set.
+func sharesToWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	if shares < minShares {
+		shares = minShares
+	}
+	if shares > maxShares {
+		shares = maxShares
+	}
+	return minWeight + ((shares-minShares)*(maxWeight-minWeight))/(maxShares-minShares)
+}
+
+// CPUWeight returns the value of 'cpu.weight'. Requires cgroup v2.
+func (c *Cgroup) CPUWeight() (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("cpu") {
+		return 0, fmt.Errorf("cpu.weight: %w", ErrNotSupported)
+	}
+	return getUint(c.makePath("cpu"), "cpu.weight")
+}
+
+// SetCPUWeight sets 'cpu.weight', which must be in the range [1, 10000]. It
+// fails if the cgroup is idle, see CPUSpec.Idle. Requires cgroup v2.
+func (c *Cgroup) SetCPUWeight(weight uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isV2("cpu") {
+		return fmt.Errorf("cpu.weight: %w", ErrNotSupported)
+	}
+	if weight < minWeight || weight > maxWeight {
+		return fmt.Errorf("invalid cpu.weight %d, must be in the range [%d, %d]", weight, minWeight, maxWeight)
+	}
+	path := c.makePath("cpu")
+	if err := checkNotIdle(path); err != nil {
+		return err
+	}
+	return setValue(path, "cpu.weight", strconv.FormatUint(weight, 10))
+}
+
+// checkNotIdle returns an error if 'cpu.idle' is set in 'path', in which case
+// the kernel rejects weight changes with EINVAL. Kernels without 'cpu.idle'
+// have no idle cgroups.
+func checkNotIdle(path string) error {
+	idle, err := getValue(path, "cpu.idle")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if strings.TrimSpace(idle) == "1" {
+		return fmt.Errorf("cpu weight can't be set while cpu.idle is set in %q", path)
+	}
+	return nil
+}
+
+// CPUWeightNice returns the value of 'cpu.weight.nice', the CPU weight
+// expressed as a nice value in the range [-20, 19]. Requires cgroup v2.
+func (c *Cgroup) CPUWeightNice() (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("cpu") {
+		return 0, fmt.Errorf("cpu.weight.nice: %w", ErrNotSupported)
+	}
+	nice, err := getInt(c.makePath("cpu"), "cpu.weight.nice")
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("cpu.weight.nice: %w", ErrNotSupported)
+	}
+	return nice, err
+}
+
+// SetCPUWeightNice sets 'cpu.weight.nice', which must be in the range
+// [-20, 19]. It's an alternative view of the same weight set by SetCPUWeight,
+// so setting one changes the value reported by the other, e.g. a nice value
+// of 0 is a weight of 100. Like SetCPUWeight, it fails if the cgroup is idle.
+// Requires cgroup v2.
+func (c *Cgroup) SetCPUWeightNice(nice int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isV2("cpu") {
+		return fmt.Errorf("cpu.weight.nice: %w", ErrNotSupported)
+	}
+	if nice < minNice || nice > maxNice {
+		return fmt.Errorf("invalid cpu.weight.nice %d, must be in the range [%d, %d]", nice, minNice, maxNice)
+	}
+	path := c.makePath("cpu")
+	if !hostFeatures("cpu", path, true).CPUWeightNice {
+		return fmt.Errorf("cpu.weight.nice: %w", ErrNotSupported)
+	}
+	if err := checkNotIdle(path); err != nil {
+		return err
+	}
+	return setValue(path, "cpu.weight.nice", strconv.Itoa(nice))
+}
+
+// CPUBurst returns the CPU burst in microseconds, i.e. how much unused quota
+// can be accumulated and used beyond the quota in later periods.
+//
+// cgroup v2 kernels either have a separate 'cpu.max.burst' file, or report the
+// burst as a third field in 'cpu.max'. Both layouts are supported; zero is
+// returned if the kernel reports no burst at all. cgroup v1 kernels need
+// 'cpu.cfs_burst_us', otherwise ErrNotSupported is returned.
+func (c *Cgroup) CPUBurst() (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path := c.makePath("cpu")
+	if !isV2("cpu") {
+		if !hostFeatures("cpu", path, false).CPUBurstFile {
+			return 0, fmt.Errorf("cpu.cfs_burst_us: %w", ErrNotSupported)
+		}
+		val, err := getValue(path, "cpu.cfs_burst_us")
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	}
+	if hostFeatures("cpu", path, true).CPUBurstFile {
+		val, err := getValue(path, "cpu.max.burst")
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	}
+	val, err := getValue(path, "cpu.max")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(val)
+	if len(fields) < 3 {
+		return 0, nil
+	}
+	return strconv.ParseInt(fields[2], 10, 64)
+}
+
+// SetCPUBurst sets the CPU burst in microseconds. See CPUBurst for the
+// supported layouts. With the 'cpu.max' layout, the current quota and period
+// are preserved.
+func (c *Cgroup) SetCPUBurst(burst int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if burst < 0 {
+		return fmt.Errorf("invalid cpu burst %d, must not be negative", burst)
+	}
+	path := c.makePath("cpu")
+	if !isV2("cpu") {
+		if !hostFeatures("cpu", path, false).CPUBurstFile {
+			return fmt.Errorf("cpu.cfs_burst_us: %w", ErrNotSupported)
+		}
+		return setValue(path, "cpu.cfs_burst_us", strconv.FormatInt(burst, 10))
+	}
+	if hostFeatures("cpu", path, true).CPUBurstFile {
+		return setValue(path, "cpu.max.burst", strconv.FormatInt(burst, 10))
+	}
+	val, err := getValue(path, "cpu.max")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(val)
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid cpu.max: %q", val)
+	}
+	return setValue(path, "cpu.max", fmt.Sprintf("%s %s %d", fields[0], fields[1], burst))
+}
+
+// IOWeight returns the content of 'io.weight': the default weight and the
+// per-device overrides, keyed by block device in the form "major:minor".
+// Requires cgroup v2.
+func (c *Cgroup) IOWeight() (uint64, map[string]uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("io") {
+		return 0, nil, fmt.Errorf("io.weight: %w", ErrNotSupported)
+	}
+	val, err := getValue(c.makePath("io"), "io.weight")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil, fmt.Errorf("io.weight: %w", ErrNotSupported)
+		}
+		return 0, nil, err
+	}
+	return parseIOWeight(val)
+}
+
+// SetIOWeightDevice sets the 'io.weight' override of the block device
+// 'major:minor', which must be in the range [1, 10000]. The default weight and
+// other devices are not changed. Requires cgroup v2.
+func (c *Cgroup) SetIOWeightDevice(major, minor int64, weight uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isV2("io") {
+		return fmt.Errorf("io.weight: %w", ErrNotSupported)
+	}
+	if weight < minWeight || weight > maxWeight {
+		return fmt.Errorf("invalid io.weight %d, must be in the range [%d, %d]", weight, minWeight, maxWeight)
+	}
+	path := c.makePath("io")
+	if _, err := os.Stat(filepath.Join(path, "io.weight")); os.IsNotExist(err) {
+		return fmt.Errorf("io.weight: %w", ErrNotSupported)
+	}
+	return setValue(path, "io.weight", fmt.Sprintf("%d:%d %d", major, minor, weight))
+}
+
+// parseIOWeight parses 'io.weight', formatted like:
+//
+//	default 100
+//	8:0 200
+//
+// The device lines are optional.
+func parseIOWeight(s string) (uint64, map[string]uint64, error) {
+	var def uint64
+	foundDefault := false
+	devices := make(map[string]uint64)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return 0, nil, fmt.Errorf("invalid io.weight line: %q", line)
+		}
+		weight, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid io.weight line %q: %v", line, err)
+		}
+		if fields[0] == "default" {
+			def = weight
+			foundDefault = true
+			continue
+		}
+		var major, minor uint64
+		if n, err := fmt.Sscanf(fields[0], "%d:%d", &major, &minor); err != nil || n != 2 {
+			return 0, nil, fmt.Errorf("invalid io.weight device: %q", line)
+		}
+		devices[fields[0]] = weight
+	}
+	if !foundDefault {
+		return 0, nil, fmt.Errorf("default weight not found in io.weight: %q", s)
+	}
+	return def, devices, nil
+}
+
+// DescendantStats returns the number of live and dying descendants of the
+// cgroup, from 'cgroup.stat'. Dying cgroups have been removed, but are still
+// pinned by resources charged to them, e.g. page cache, until the kernel
+// reclaims them. A number of dying descendants that doesn't go down over time
+// hints at a cleanup stall. Requires cgroup v2.
+func (c *Cgroup) DescendantStats() (live, dying int, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("memory") {
+		return 0, 0, fmt.Errorf("cgroup.stat: %w", ErrNotSupported)
+	}
+	stat, err := getKeyValues(c.makePath("memory"), "cgroup.stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseDescendantStats(stat)
+}
+
+// parseDescendantStats extracts the descendant counts from 'cgroup.stat',
+// formatted like:
+//
+//	nr_descendants 3
+//	nr_dying_descendants 1
+func parseDescendantStats(stat map[string]uint64) (live, dying int, err error) {
+	nrLive, ok := stat["nr_descendants"]
+	if !ok {
+		return 0, 0, fmt.Errorf("nr_descendants not found in cgroup.stat")
+	}
+	nrDying, ok := stat["nr_dying_descendants"]
+	if !ok {
+		return 0, 0, fmt.Errorf("nr_dying_descendants not found in cgroup.stat")
+	}
+	return int(nrLive), int(nrDying), nil
+}
+
+// IOCostQoS returns the content of 'io.cost.qos', the iocost QoS parameters
+// of each block device configured for it, keyed by device in the form
+// "major:minor". Values are the remaining fields, e.g. "enable=1 ctrl=auto
+// rpct=95.00 rlat=10000 wpct=95.00 wlat=20000 min=50.00 max=150.00". The file
+// only exists in the root of the cgroup v2 hierarchy. Returns ErrNotSupported
+// if the iocost controller is not available.
+func IOCostQoS() (map[string]string, error) {
+	return readIOCost("io.cost.qos")
+}
+
+// SetIOCostQoS sets the iocost QoS parameters of the block device 'dev', its
+// path or in the form "major:minor". 'spec' is passed to the kernel as is, e.g.
+// "enable=1 ctrl=user rpct=95 rlat=5000", and it validates it. Returns
+// ErrNotSupported if the iocost controller is not available.
+func SetIOCostQoS(dev, spec string) error {
+	return writeIOCost("io.cost.qos", dev, spec)
+}
+
+// IOCostModel returns the content of 'io.cost.model', the iocost cost model
+// of each block device configured for it, keyed by device in the form
+// "major:minor". Values are the remaining fields, e.g. "ctrl=auto
+// model=linear rbps=... rseqiops=... rrandiops=... wbps=... wseqiops=...
+// wrandiops=...". The file only exists in the root of the cgroup v2 hierarchy.
+// Returns ErrNotSupported if the iocost controller is not available.
+func IOCostModel() (map[string]string, error) {
+	return readIOCost("io.cost.model")
+}
+
+// SetIOCostModel sets the iocost cost model of the block device 'dev', its
+// path or in the form "major:minor". 'spec' is passed to the kernel as is, e.g.
+// "ctrl=user model=linear rbps=2706339840", and it validates it. Returns
+// ErrNotSupported if the iocost controller is not available.
+func SetIOCostModel(dev, spec string) error {
+	return writeIOCost("io.cost.model", dev, spec)
+}
+
+// ioCostPath returns the directory where the iocost file 'name' is located,
+// i.e. the root of the cgroup v2 hierarchy.
+func ioCostPath(name string) (string, error) {
+	h := getHierarchies()
+	if h.unified == "" {
+		return "", fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	if _, err := os.Stat(filepath.Join(h.unified, name)); os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", name, ErrNotSupported)
+	}
+	return h.unified, nil
+}
+
+// readIOCost parses the iocost file 'name', formatted as one line per device:
+//
+//	8:16 enable=1 ctrl=auto rpct=0.00 rlat=250000
+func readIOCost(name string) (map[string]string, error) {
+	path, err := ioCostPath(name)
+	if err != nil {
+		return nil, err
+	}
+	val, err := getValue(path, name)
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for _, line := range strings.Split(val, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		devices[fields[0]] = strings.Join(fields[1:], " ")
+	}
+	return devices, nil
+}
+
+// writeIOCost writes 'spec' for the block device 'dev', a device path or
+// "major:minor", to the iocost file 'name'. Only the device is validated, the
+// kernel validates 'spec'.
+func writeIOCost(name, dev, spec string) error {
+	var major, minor uint64
+	if filepath.IsAbs(dev) {
+		maj, min, kind, err := DeviceNumber(dev)
+		if err != nil {
+			return err
+		}
+		if kind != 'b' {
+			return fmt.Errorf("invalid device %q, must be a block device", dev)
+		}
+		major, minor = uint64(maj), uint64(min)
+	} else if n, err := fmt.Sscanf(dev, "%d:%d", &major, &minor); err != nil || n != 2 {
+		return fmt.Errorf("invalid device %q, must be a path or in the form major:minor", dev)
+	}
+	if strings.ContainsRune(spec, '\n') {
+		return fmt.Errorf("invalid %s spec %q, must be a single line", name, spec)
+	}
+	path, err := ioCostPath(name)
+	if err != nil {
+		return err
+	}
+	return setValue(path, name, strings.TrimSpace(fmt.Sprintf("%d:%d %s", major, minor, spec)))
+}
+
+// cpuQuota2 parses 'cpu.max', formatted as "$MAX $PERIOD" or, on kernels that
+// report the burst in it, "$MAX $PERIOD $BURST". It returns the quota as a
+// fraction of the period, or -1 if no quota is set.
+func cpuQuota2(path string) (float64, error) {
+	val, err := getValue(path, "cpu.max")
+	if err != nil {
+		return -1, err
+	}
+	fields := strings.Fields(val)
+	if len(fields) != 2 && len(fields) != 3 {
+		return -1, fmt.Errorf("invalid cpu.max: %q", val)
+	}
+	quota, err := parseLimit(fields[0])
+	if err != nil {
+		return -1, fmt.Errorf("invalid cpu.max %q: %v", val, err)
+	}
+	if quota == Unlimited {
+		return -1, nil
+	}
+	period, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid cpu.max %q: %v", val, err)
+	}
+	if quota <= 0 || period <= 0 {
+		return -1, nil
+	}
+	return float64(quota) / float64(period), nil
+}
+
+// memoryKnobs are the cgroup v2 memory files that bound each other, from the
+// innermost protection to the outermost limit. They are expected to satisfy
+// min <= low <= high <= max.
+var memoryKnobs = []string{"memory.min", "memory.low", "memory.high", "memory.max"}
+
+// memoryWrite is a value to be written to one of memoryKnobs.
+type memoryWrite struct {
+	name string
+	val  int64
+}
+
+// orderMemoryWrites returns the writes that change memoryKnobs from 'cur' to
+// 'want', ordered so that min <= low <= high <= max holds after every write,
+// provided that it holds for both 'cur' and 'want'. Knobs missing from 'want'
+// are left unchanged. "max" is represented as Unlimited.
+//
+// Values that increase are written first, from the outermost limit inward, so
+// that a limit is always raised before the knobs it bounds. Then values that
+// decrease are written from the innermost protection outward, so that a
+// protection is always lowered before the limits bounding it.
+func orderMemoryWrites(cur, want map[string]int64) []memoryWrite {
+	var writes []memoryWrite
+	for i := len(memoryKnobs) - 1; i >= 0; i-- {
+		name := memoryKnobs[i]
+		if val, ok := want[name]; ok && val > cur[name] {
+			writes = append(writes, memoryWrite{name: name, val: val})
+		}
+	}
+	for _, name := range memoryKnobs {
+		if val, ok := want[name]; ok && val < cur[name] {
+			writes = append(writes, memoryWrite{name: name, val: val})
+		}
+	}
+	return writes
+}
+
+// readMemoryKnobs returns the current value of memoryKnobs in 'path'. Files
+// that can't be read are assumed to have the kernel's default value.
+func readMemoryKnobs(path string) map[string]int64 {
+	vals := map[string]int64{
+		"memory.min":  0,
+		"memory.low":  0,
+		"memory.high": Unlimited,
+		"memory.max":  Unlimited,
+	}
+	for _, name := range memoryKnobs {
+		str, err := getValue(path, name)
+		if err != nil {
+			continue
+		}
+		if val, err := parseLimit(str); err == nil {
+			vals[name] = val
+		}
+	}
+	return vals
+}
+
+type memory2 struct {
+	controllerCommon
+}
+
+func (*memory2) set(w Writer, spec *specs.LinuxResources, path string) error {
+	if spec.Memory == nil {
+		return nil
+	}
+	// The swap limit is checked before anything is written, so that an
+	// unsupported limit doesn't leave the others half applied.
+	f := hostFeatures("memory", path, true)
+	if err := checkSwap(f, spec.Memory.Swap); err != nil {
+		return err
+	}
+	// The spec's swap is memory+swap, while 'memory.swap.max' is swap only.
+	var swap int64
+	setSwap := f.Swap && spec.Memory.Swap != nil && *spec.Memory.Swap != 0
+	if setSwap {
+		swap = *spec.Memory.Swap
+		if swap > 0 {
+			if spec.Memory.Limit == nil || *spec.Memory.Limit <= 0 {
+				return fmt.Errorf("memory swap limit requires a memory limit")
+			}
+			if swap < *spec.Memory.Limit {
+				return fmt.Errorf("memory+swap limit (%d) is smaller than memory limit (%d)", swap, *spec.Memory.Limit)
+			}
+			swap -= *spec.Memory.Limit
+		}
+	}
+
+	want := make(map[string]int64)
+	if spec.Memory.Reservation != nil && *spec.Memory.Reservation != 0 {
+		want["memory.low"] = *spec.Memory.Reservation
+	}
+	if spec.Memory.Limit != nil && *spec.Memory.Limit != 0 {
+		want["memory.max"] = *spec.Memory.Limit
+	}
+	for name, val := range want {
+		if val < 0 {
+			want[name] = Unlimited
+		}
+	}
+	// Knobs are written in an order that never leaves them inconsistent with
+	// each other, regardless of the cgroup's previous configuration.
+	for _, m := range orderMemoryWrites(readMemoryKnobs(path), want) {
+		if err := writeValue(w, path, m.name, formatLimit(m.val, true)); err != nil {
+			return fmt.Errorf("setting %s to %q: %w", m.name, formatLimit(m.val, true), err)
+		}
+	}
+	if setSwap {
+		if err := writeValue(w, path, "memory.swap.max", formatLimit(swap, true)); err != nil {
+			return err
+		}
+	}
+	if spec.Memory.DisableOOMKiller != nil && *spec.Memory.DisableOOMKiller {
+		logger().Warningf("Disabling the OOM killer is not supported with cgroup v2, ignoring")
+	}
+	return nil
+}
+
+type cpu2 struct {
+	controllerCommon
+}
+
+func (*cpu2) set(w Writer, spec *specs.LinuxResources, path string) error {
+	if spec.CPU == nil {
+		return nil
+	}
+	if spec.CPU.Shares != nil {
+		if weight := sharesToWeight(*spec.CPU.Shares); weight != 0 {
+			// The spec has no idle setting, but the cgroup may already be
+			// idle, e.g. when reused.
+			if err := checkNotIdle(path); err != nil {
+				return err
+			}
+			if err := writeValue(w, path, "cpu.weight", strconv.FormatUint(weight, 10)); err != nil {
+				return err
+			}
+		}
+	}
+	quotaSet := spec.CPU.Quota != nil && *spec.CPU.Quota != 0
+	periodSet := spec.CPU.Period != nil && *spec.CPU.Period != 0
+	if !quotaSet && !periodSet {
+		return nil
+	}
+	quota := "max"
+	if quotaSet {
+		quota = formatLimit(*spec.CPU.Quota, true)
+	}
+	period := uint64(defaultPeriod)
+	if periodSet {
+		period = *spec.CPU.Period
+	}
+	return writeValue(w, path, "cpu.max", fmt.Sprintf("%s %d", quota, period))
+}
+
+type cpuSet2 struct {
+	controllerCommon
+}
+
+func (*cpuSet2) set(w Writer, spec *specs.LinuxResources, path string) error {
+	// Unlike cgroup v1, empty cpuset files are valid and mean that the parent's
+	// effective values are used.
+	if spec.CPU == nil {
+		return nil
+	}
+	if spec.CPU.Cpus != "" {
+		if err := writeValue(w, path, "cpuset.cpus", spec.CPU.Cpus); err != nil {
+			return err
+		}
+	}
+	if spec.CPU.Mems != "" {
+		if err := validateMems(filepath.Dir(path), spec.CPU.Mems); err != nil {
+			return err
+		}
+		return writeValue(w, path, "cpuset.mems", spec.CPU.Mems)
+	}
+	return nil
+}
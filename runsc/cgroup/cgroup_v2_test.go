@@ -0,0 +1,557 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func uint64Ptr(v uint64) *uint64 {
+	return &v
+}
+
+func TestSharesToWeight(t *testing.T) {
+	for _, tc := range []struct {
+		shares uint64
+		want   uint64
+	}{
+		{shares: 0, want: 0},
+		{shares: 1, want: 1},
+		{shares: 2, want: 1},
+		{shares: 100, want: 4},
+		{shares: 1000, want: 39},
+		{shares: 1024, want: 39},
+		{shares: 10000, want: 382},
+		{shares: 262144, want: 10000},
+		{shares: 1000000, want: 10000},
+	} {
+		if got := sharesToWeight(tc.shares); got != tc.want {
+			t.Errorf("sharesToWeight(%d) got: %d, want: %d", tc.shares, got, tc.want)
+		}
+	}
+}
+
+// readFile returns the trimmed contents of the file, relative to root.
+func readFile(t testing.TB, root, name string) string {
+	out, err := ioutil.ReadFile(filepath.Join(root, name))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): %v", err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestInstallV2(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	defer fakeFeatures(Features{Swap: true})()
+
+	res := &specs.LinuxResources{
+		CPU: &specs.LinuxCPU{
+			Shares: uint64Ptr(1024),
+			Quota:  int64Ptr(50000),
+			Cpus:   "0-1",
+		},
+		Memory: &specs.LinuxMemory{
+			Limit:       int64Ptr(1 << 30),
+			Reservation: int64Ptr(512 << 20),
+			Swap:        int64Ptr(3 << 30),
+		},
+		Pids: &specs.LinuxPids{Limit: 1000},
+	}
+	c := Cgroup{Name: "test"}
+	if err := c.Install(res); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"test/cpu.weight":      "39",
+		"test/cpu.max":         "50000 100000",
+		"test/cpuset.cpus":     "0-1",
+		"test/memory.max":      "1073741824",
+		"test/memory.low":      "536870912",
+		"test/memory.swap.max": "2147483648",
+		"test/pids.max":        "1000",
+	} {
+		if got := readFile(t, root, name); got != want {
+			t.Errorf("%s got: %q, want: %q", name, got, want)
+		}
+	}
+	if got := readFile(t, root, "cgroup.subtree_control"); !strings.HasPrefix(got, "+") {
+		t.Errorf("cgroup.subtree_control got: %q, want controllers enabled", got)
+	}
+
+	weight, err := c.CPUWeight()
+	if err != nil {
+		t.Fatalf("CPUWeight(): %v", err)
+	}
+	if weight != 39 {
+		t.Errorf("CPUWeight() got: %d, want: %d", weight, 39)
+	}
+	if err := c.SetCPUWeight(500); err != nil {
+		t.Fatalf("SetCPUWeight(500): %v", err)
+	}
+	if got := readFile(t, root, "test/cpu.weight"); got != "500" {
+		t.Errorf("cpu.weight got: %q, want: %q", got, "500")
+	}
+	for _, invalid := range []uint64{0, 10001} {
+		if err := c.SetCPUWeight(invalid); err == nil {
+			t.Errorf("SetCPUWeight(%d) should have failed", invalid)
+		}
+	}
+
+	// The weight of an idle cgroup can't be changed.
+	writeFiles(t, root, map[string]string{"test/cpu.idle": "1\n"})
+	if err := c.SetCPUWeight(100); err == nil {
+		t.Errorf("SetCPUWeight() on idle cgroup should have failed")
+	}
+	if err := (&cpu2{}).set(LocalWriter{}, res, filepath.Join(root, "test")); err == nil {
+		t.Errorf("set() with shares on idle cgroup should have failed")
+	}
+	if got := readFile(t, root, "test/cpu.weight"); got != "500" {
+		t.Errorf("cpu.weight of idle cgroup got: %q, want: %q", got, "500")
+	}
+}
+
+func TestCPUWeightNice(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	c := &Cgroup{Name: "test"}
+
+	if _, err := c.CPUWeightNice(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("CPUWeightNice() without cpu.weight.nice got: %v, want: %v", err, ErrNotSupported)
+	}
+	if err := c.SetCPUWeightNice(0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetCPUWeightNice() without cpu.weight.nice got: %v, want: %v", err, ErrNotSupported)
+	}
+
+	writeFiles(t, root, map[string]string{"test/cpu.weight.nice": "0\n"})
+	if err := c.SetCPUWeightNice(-5); err != nil {
+		t.Fatalf("SetCPUWeightNice(-5): %v", err)
+	}
+	nice, err := c.CPUWeightNice()
+	if err != nil {
+		t.Fatalf("CPUWeightNice(): %v", err)
+	}
+	if nice != -5 {
+		t.Errorf("CPUWeightNice() got: %d, want: %d", nice, -5)
+	}
+	for _, invalid := range []int{-21, 20} {
+		if err := c.SetCPUWeightNice(invalid); err == nil {
+			t.Errorf("SetCPUWeightNice(%d) should have failed", invalid)
+		}
+	}
+}
+
+func TestReadersV2(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"test/cpu.max":               "150000 100000\n",
+		"test/cpuset.cpus":           "\n",
+		"test/cpuset.cpus.effective": "0-3\n",
+		"test/memory.max":            "max\n",
+	})
+
+	c := Cgroup{Name: "test"}
+	if got, err := c.CPUQuota(); err != nil || got != 1.5 {
+		t.Errorf("CPUQuota() got: %v, %v, want: 1.5, nil", got, err)
+	}
+	if got, err := c.NumCPU(); err != nil || got != 4 {
+		t.Errorf("NumCPU() got: %v, %v, want: 4, nil", got, err)
+	}
+	if got, err := c.MemoryLimit(); err != nil || got != Unlimited {
+		t.Errorf("MemoryLimit() got: %v, %v, want: %d, nil", got, err, Unlimited)
+	}
+
+	writeFiles(t, root, map[string]string{"test/cpu.max": "max 100000\n"})
+	if got, err := c.CPUQuota(); err != nil || got != -1 {
+		t.Errorf("CPUQuota() got: %v, %v, want: -1, nil", got, err)
+	}
+}
+
+// validMemoryKnobs returns all assignments of 'vals' to memoryKnobs that
+// satisfy min <= low <= high <= max.
+func validMemoryKnobs(vals []int64) []map[string]int64 {
+	var all []map[string]int64
+	var gen func(i int, m map[string]int64)
+	gen = func(i int, m map[string]int64) {
+		if i == len(memoryKnobs) {
+			c := make(map[string]int64)
+			for k, v := range m {
+				c[k] = v
+			}
+			all = append(all, c)
+			return
+		}
+		for _, v := range vals {
+			if i > 0 && v < m[memoryKnobs[i-1]] {
+				continue
+			}
+			m[memoryKnobs[i]] = v
+			gen(i+1, m)
+		}
+	}
+	gen(0, make(map[string]int64))
+	return all
+}
+
+func TestOrderMemoryWrites(t *testing.T) {
+	states := validMemoryKnobs([]int64{0, 1 << 30, 2 << 30, 4 << 30, math.MaxInt64})
+	for _, cur := range states {
+		for _, want := range states {
+			state := make(map[string]int64)
+			for k, v := range cur {
+				state[k] = v
+			}
+			for _, w := range orderMemoryWrites(cur, want) {
+				state[w.name] = w.val
+				for i := 1; i < len(memoryKnobs); i++ {
+					if lo, hi := memoryKnobs[i-1], memoryKnobs[i]; state[lo] > state[hi] {
+						t.Fatalf("from %v to %v: writing %s=%d leaves %s (%d) > %s (%d)", cur, want, w.name, w.val, lo, state[lo], hi, state[hi])
+					}
+				}
+			}
+			if !reflect.DeepEqual(state, want) {
+				t.Errorf("from %v to %v: got %v", cur, want, state)
+			}
+		}
+	}
+}
+
+func TestInstallV2MemoryOrder(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	// Start from protections that are larger than the new limit.
+	writeFiles(t, root, map[string]string{
+		"test/memory.min":  "0\n",
+		"test/memory.low":  "4294967296\n",
+		"test/memory.high": "max\n",
+		"test/memory.max":  "max\n",
+	})
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{
+			Limit:       int64Ptr(1 << 30),
+			Reservation: int64Ptr(512 << 20),
+		},
+	}
+	if err := (&memory2{}).set(LocalWriter{}, res, filepath.Join(root, "test")); err != nil {
+		t.Fatalf("set(): %v", err)
+	}
+	for name, want := range map[string]string{
+		"test/memory.low": "536870912",
+		"test/memory.max": "1073741824",
+	} {
+		if got := readFile(t, root, name); got != want {
+			t.Errorf("%s got: %q, want: %q", name, got, want)
+		}
+	}
+}
+
+func TestCPUBurst(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		file  string
+		want  string
+	}{
+		{
+			name: "separate-file",
+			files: map[string]string{
+				"test/cpu.max":       "50000 100000\n",
+				"test/cpu.max.burst": "0\n",
+			},
+			file: "test/cpu.max.burst",
+			want: "20000",
+		},
+		{
+			name:  "cpu.max",
+			files: map[string]string{"test/cpu.max": "50000 100000\n"},
+			file:  "test/cpu.max",
+			want:  "50000 100000 20000",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, true)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := Cgroup{Name: "test"}
+			if got, err := c.CPUBurst(); err != nil || got != 0 {
+				t.Errorf("CPUBurst() got: %d, %v, want: 0, nil", got, err)
+			}
+			if err := c.SetCPUBurst(20000); err != nil {
+				t.Fatalf("SetCPUBurst(): %v", err)
+			}
+			if got := readFile(t, root, tc.file); got != tc.want {
+				t.Errorf("%s got: %q, want: %q", tc.file, got, tc.want)
+			}
+			if got, err := c.CPUBurst(); err != nil || got != 20000 {
+				t.Errorf("CPUBurst() got: %d, %v, want: 20000, nil", got, err)
+			}
+			// The quota is not affected by the burst.
+			if got, err := c.CPUQuota(); err != nil || got != 0.5 {
+				t.Errorf("CPUQuota() got: %v, %v, want: 0.5, nil", got, err)
+			}
+		})
+	}
+}
+
+func TestParseIOWeight(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		val     string
+		def     uint64
+		devices map[string]uint64
+		err     bool
+	}{
+		{
+			name:    "default only",
+			val:     "default 100\n",
+			def:     100,
+			devices: map[string]uint64{},
+		},
+		{
+			name:    "per-device",
+			val:     "default 100\n8:0 200\n259:0 50\n",
+			def:     100,
+			devices: map[string]uint64{"8:0": 200, "259:0": 50},
+		},
+		{
+			name: "missing default",
+			val:  "8:0 200\n",
+			err:  true,
+		},
+		{
+			name: "invalid device",
+			val:  "default 100\nsda 200\n",
+			err:  true,
+		},
+		{
+			name: "invalid weight",
+			val:  "default 100\n8:0 max\n",
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			def, devices, err := parseIOWeight(tc.val)
+			if tc.err {
+				if err == nil {
+					t.Errorf("parseIOWeight(%q) should have failed", tc.val)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIOWeight(%q): %v", tc.val, err)
+			}
+			if def != tc.def {
+				t.Errorf("parseIOWeight(%q) default got: %d, want: %d", tc.val, def, tc.def)
+			}
+			if !reflect.DeepEqual(devices, tc.devices) {
+				t.Errorf("parseIOWeight(%q) devices got: %v, want: %v", tc.val, devices, tc.devices)
+			}
+		})
+	}
+}
+
+func TestSetIOWeightDevice(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	c := &Cgroup{Name: "test"}
+
+	if _, _, err := c.IOWeight(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("IOWeight() without io.weight got: %v, want: %v", err, ErrNotSupported)
+	}
+	if err := c.SetIOWeightDevice(8, 0, 200); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetIOWeightDevice() without io.weight got: %v, want: %v", err, ErrNotSupported)
+	}
+
+	writeFiles(t, root, map[string]string{"test/io.weight": "default 100\n"})
+	if err := c.SetIOWeightDevice(8, 16, 200); err != nil {
+		t.Fatalf("SetIOWeightDevice(8, 16, 200): %v", err)
+	}
+	if got := readFile(t, root, "test/io.weight"); got != "8:16 200" {
+		t.Errorf("io.weight got: %q, want: %q", got, "8:16 200")
+	}
+	for _, invalid := range []uint64{0, 10001} {
+		if err := c.SetIOWeightDevice(8, 16, invalid); err == nil {
+			t.Errorf("SetIOWeightDevice(8, 16, %d) should have failed", invalid)
+		}
+	}
+}
+
+func TestDescendantStats(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	c := &Cgroup{Name: "test"}
+	writeFiles(t, root, map[string]string{"test/cgroup.stat": "nr_descendants 3\nnr_dying_descendants 1\n"})
+	live, dying, err := c.DescendantStats()
+	if err != nil {
+		t.Fatalf("DescendantStats(): %v", err)
+	}
+	if live != 3 || dying != 1 {
+		t.Errorf("DescendantStats() got: %d, %d, want: 3, 1", live, dying)
+	}
+
+	writeFiles(t, root, map[string]string{"test/cgroup.stat": "nr_descendants 3\n"})
+	if _, _, err := c.DescendantStats(); err == nil {
+		t.Errorf("DescendantStats() without nr_dying_descendants should have failed")
+	}
+
+	_, cleanup2 := setupRoot(t, false)
+	defer cleanup2()
+	if _, _, err := c.DescendantStats(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("DescendantStats() on cgroup v1 got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestIOCost(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	if _, err := IOCostQoS(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("IOCostQoS() without io.cost.qos got: %v, want: %v", err, ErrNotSupported)
+	}
+	if err := SetIOCostModel("8:0", "ctrl=auto"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetIOCostModel() without io.cost.model got: %v, want: %v", err, ErrNotSupported)
+	}
+
+	writeFiles(t, root, map[string]string{
+		"io.cost.qos":   "8:0 enable=1 ctrl=auto rpct=0.00 rlat=250000\n259:0 enable=0 ctrl=auto rpct=0.00 rlat=25000\n",
+		"io.cost.model": "8:0 ctrl=auto model=linear rbps=488636629 rseqiops=8932 rrandiops=8518\n",
+	})
+	qos, err := IOCostQoS()
+	if err != nil {
+		t.Fatalf("IOCostQoS(): %v", err)
+	}
+	if want := map[string]string{
+		"8:0":   "enable=1 ctrl=auto rpct=0.00 rlat=250000",
+		"259:0": "enable=0 ctrl=auto rpct=0.00 rlat=25000",
+	}; !reflect.DeepEqual(qos, want) {
+		t.Errorf("IOCostQoS() got: %v, want: %v", qos, want)
+	}
+	model, err := IOCostModel()
+	if err != nil {
+		t.Fatalf("IOCostModel(): %v", err)
+	}
+	if want := "ctrl=auto model=linear rbps=488636629 rseqiops=8932 rrandiops=8518"; model["8:0"] != want {
+		t.Errorf("IOCostModel() got: %v, want 8:0: %q", model, want)
+	}
+
+	if err := SetIOCostQoS("8:0", "enable=1 ctrl=user rpct=95 rlat=5000"); err != nil {
+		t.Fatalf("SetIOCostQoS(): %v", err)
+	}
+	if got, want := readFile(t, root, "io.cost.qos"), "8:0 enable=1 ctrl=user rpct=95 rlat=5000"; got != want {
+		t.Errorf("io.cost.qos got: %q, want: %q", got, want)
+	}
+	if err := SetIOCostModel("8:0", "ctrl=user model=linear rbps=2706339840"); err != nil {
+		t.Fatalf("SetIOCostModel(): %v", err)
+	}
+	if got, want := readFile(t, root, "io.cost.model"), "8:0 ctrl=user model=linear rbps=2706339840"; got != want {
+		t.Errorf("io.cost.model got: %q, want: %q", got, want)
+	}
+
+	for _, tc := range []struct{ dev, spec string }{
+		{dev: "sda", spec: "enable=1"},
+		{dev: "8", spec: "enable=1"},
+		{dev: "8:0", spec: "enable=1\n9:0 enable=1"},
+		// Not a block device.
+		{dev: "/dev/null", spec: "enable=1"},
+	} {
+		if err := SetIOCostQoS(tc.dev, tc.spec); err == nil {
+			t.Errorf("SetIOCostQoS(%q, %q) should have failed", tc.dev, tc.spec)
+		}
+	}
+}
+
+func TestSetValueEnablesController(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"pod/cgroup.controllers":      "cpu memory",
+		"pod/test/cgroup.controllers": "cpu",
+	})
+
+	// memory.swap.max shows up once memory is enabled in all ancestors.
+	oldWrite := writeFile
+	defer func() { writeFile = oldWrite }()
+	var enabled []string
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		rel, _ := filepath.Rel(root, path)
+		switch filepath.Base(path) {
+		case "cgroup.subtree_control":
+			enabled = append(enabled, rel+" "+string(data))
+		case "memory.swap.max":
+			if len(enabled) < 2 {
+				return &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+			}
+		}
+		return oldWrite(path, data, perm)
+	}
+
+	path := filepath.Join(root, "pod", "test")
+	if err := setValue(path, "memory.swap.max", "0"); err != nil {
+		t.Fatalf("setValue(memory.swap.max): %v", err)
+	}
+	if want := []string{"cgroup.subtree_control +memory", "pod/cgroup.subtree_control +memory"}; !reflect.DeepEqual(enabled, want) {
+		t.Errorf("enabled controllers got: %v, want: %v", enabled, want)
+	}
+	if got := readFile(t, root, "pod/test/memory.swap.max"); got != "0" {
+		t.Errorf("memory.swap.max got: %q, want: %q", got, "0")
+	}
+
+	// Files of enabled controllers, core files and controllers that are not
+	// available aren't retried.
+	enabled = nil
+	for _, name := range []string{"cpu.missing", "cgroup.missing", "pids.max"} {
+		if err := setValue(filepath.Join(path, "missing"), name, "0"); !os.IsNotExist(err) {
+			t.Errorf("setValue(%q) in missing cgroup got: %v, want: not exist", name, err)
+		}
+	}
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if filepath.Base(path) == "cgroup.subtree_control" {
+			enabled = append(enabled, path)
+			return nil
+		}
+		return &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+	for _, name := range []string{"cpu.missing", "cgroup.missing"} {
+		if err := setValue(path, name, "0"); !os.IsNotExist(err) {
+			t.Errorf("setValue(%q) got: %v, want: not exist", name, err)
+		}
+	}
+	writeFiles(t, root, map[string]string{"pod/cgroup.controllers": "cpu"})
+	if err := setValue(path, "pids.max", "0"); !os.IsNotExist(err) {
+		t.Errorf("setValue(pids.max) with pids unavailable got: %v, want: not exist", err)
+	}
+	if len(enabled) != 0 {
+		t.Errorf("enabled controllers got: %v, want none", enabled)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CPUSpec holds the CPU settings applied by ApplyCPU. Settings that are nil or
+// empty are left unchanged.
+type CPUSpec struct {
+	// Shares is the relative CPU weight using the cgroup v1 'cpu.shares'
+	// scale. On cgroup v2, it's converted to 'cpu.weight'.
+	Shares *uint64
+
+	// Weight is the relative CPU weight using the cgroup v2 'cpu.weight'
+	// scale, in the range [1, 10000]. Mutually exclusive with Shares.
+	// Requires cgroup v2.
+	Weight *uint64
+
+	// Quota is the CPU time in microseconds that tasks may use in each
+	// period, or a negative value to remove the quota.
+	Quota *int64
+
+	// Period is the length of a quota period in microseconds.
+	Period *uint64
+
+	// Burst is the unused quota in microseconds that may be accumulated and
+	// used beyond Quota in later periods. It can't exceed Quota. Requires
+	// cgroup v2.
+	Burst *int64
+
+	// Idle makes the cgroup's tasks run only when no other task wants to
+	// run, using 'cpu.idle'. An idle cgroup has the minimum weight, which
+	// can't be changed, so setting Idle to true is mutually exclusive with
+	// Shares and Weight.
+	Idle *bool
+
+	// Cpus and Mems are the CPUs and memory nodes tasks may use, e.g. "0-3".
+	Cpus string
+	Mems string
+}
+
+// validate checks that the settings are consistent with each other and with
+// the hierarchy the cpu controller is mounted on.
+func (s *CPUSpec) validate(v2 bool) error {
+	if s.Shares != nil && s.Weight != nil {
+		return fmt.Errorf("cpu shares and weight are mutually exclusive")
+	}
+	if s.Idle != nil && *s.Idle && (s.Shares != nil || s.Weight != nil) {
+		return fmt.Errorf("cpu idle and weight are mutually exclusive, the kernel ignores the weight of an idle cgroup")
+	}
+	if s.Weight != nil && (*s.Weight < minWeight || *s.Weight > maxWeight) {
+		return fmt.Errorf("invalid cpu weight %d, must be in the range [%d, %d]", *s.Weight, minWeight, maxWeight)
+	}
+	if s.Quota != nil && *s.Quota == 0 {
+		return fmt.Errorf("invalid cpu quota 0, use a negative value for no quota")
+	}
+	if s.Period != nil && *s.Period == 0 {
+		return fmt.Errorf("invalid cpu period 0")
+	}
+	if s.Burst != nil {
+		if *s.Burst < 0 {
+			return fmt.Errorf("invalid cpu burst %d, must not be negative", *s.Burst)
+		}
+		if s.Quota != nil && (*s.Quota < 0 || *s.Burst > *s.Quota) {
+			return fmt.Errorf("cpu burst %d exceeds quota %d", *s.Burst, *s.Quota)
+		}
+	}
+	if !v2 {
+		if s.Weight != nil {
+			return fmt.Errorf("cpu.weight: %w", ErrNotSupported)
+		}
+		if s.Burst != nil {
+			return fmt.Errorf("cpu.max.burst: %w", ErrNotSupported)
+		}
+	}
+	return nil
+}
+
+// ApplyCPU writes all the CPU settings that are set in 'spec', on either
+// cgroup v1 or v2. The spec is validated before anything is written, e.g. a
+// burst larger than the quota is rejected. Settings are written in an order
+// that keeps the cgroup valid in between, e.g. the period before the quota.
+func (c *Cgroup) ApplyCPU(spec CPUSpec) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v2 := isV2("cpu")
+	if err := spec.validate(v2); err != nil {
+		return err
+	}
+	path := c.makePath("cpu")
+
+	// The kernel rejects weights while the cgroup is idle, so a cgroup that
+	// stops being idle does so before its weight is set.
+	if spec.Idle != nil {
+		idle := "0"
+		if *spec.Idle {
+			idle = "1"
+		}
+		if err := setValue(path, "cpu.idle", idle); err != nil {
+			return err
+		}
+	}
+	weightFile, weight := "cpu.shares", spec.Shares
+	if v2 {
+		weightFile = "cpu.weight"
+		if spec.Shares != nil {
+			w := sharesToWeight(*spec.Shares)
+			weight = &w
+		} else {
+			weight = spec.Weight
+		}
+	}
+	if weight != nil {
+		if err := setValue(path, weightFile, strconv.FormatUint(*weight, 10)); err != nil {
+			return err
+		}
+	}
+
+	if v2 {
+		if err := applyBandwidth2(path, &spec); err != nil {
+			return err
+		}
+	} else {
+		if spec.Period != nil {
+			if err := setValue(path, "cpu.cfs_period_us", strconv.FormatUint(*spec.Period, 10)); err != nil {
+				return err
+			}
+		}
+		if spec.Quota != nil {
+			if err := setValue(path, "cpu.cfs_quota_us", formatLimit(*spec.Quota, false)); err != nil {
+				return err
+			}
+		}
+	}
+
+	cpusetPath := c.makePath("cpuset")
+	if spec.Cpus != "" {
+		if err := setValue(cpusetPath, "cpuset.cpus", spec.Cpus); err != nil {
+			return err
+		}
+	}
+	if spec.Mems != "" {
+		if err := setValue(cpusetPath, "cpuset.mems", spec.Mems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBandwidth2 writes the quota, period and burst to 'cpu.max' and, if the
+// kernel has it, 'cpu.max.burst'. Unset values are preserved.
+func applyBandwidth2(path string, spec *CPUSpec) error {
+	if spec.Quota == nil && spec.Period == nil && spec.Burst == nil {
+		return nil
+	}
+	val, err := getValue(path, "cpu.max")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(val)
+	if len(fields) != 2 && len(fields) != 3 {
+		return fmt.Errorf("invalid cpu.max: %q", val)
+	}
+	if spec.Quota != nil {
+		fields[0] = formatLimit(*spec.Quota, true)
+	}
+	if spec.Period != nil {
+		fields[1] = strconv.FormatUint(*spec.Period, 10)
+	}
+
+	if !hostFeatures("cpu", path, true).CPUBurstFile {
+		if spec.Burst != nil {
+			fields = append(fields[:2], strconv.FormatInt(*spec.Burst, 10))
+		}
+		return setValue(path, "cpu.max", strings.Join(fields, " "))
+	}
+
+	// The kernel rejects a burst larger than the quota. Reducing the burst
+	// first, and increasing it last, keeps the burst within both the current
+	// and the new quota.
+	writeMax := func() error {
+		if spec.Quota == nil && spec.Period == nil {
+			return nil
+		}
+		return setValue(path, "cpu.max", strings.Join(fields, " "))
+	}
+	if spec.Burst == nil {
+		return writeMax()
+	}
+	burst := strconv.FormatInt(*spec.Burst, 10)
+	cur, err := getValue(path, "cpu.max.burst")
+	if err != nil {
+		return err
+	}
+	if curBurst, err := strconv.ParseInt(strings.TrimSpace(cur), 10, 64); err == nil && *spec.Burst < curBurst {
+		if err := setValue(path, "cpu.max.burst", burst); err != nil {
+			return err
+		}
+		return writeMax()
+	}
+	if err := writeMax(); err != nil {
+		return err
+	}
+	return setValue(path, "cpu.max.burst", burst)
+}
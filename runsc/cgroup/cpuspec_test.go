@@ -0,0 +1,226 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyCPU(t *testing.T) {
+	u64 := func(v uint64) *uint64 { return &v }
+	i64 := func(v int64) *int64 { return &v }
+	yes, no := true, false
+
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+		spec    CPUSpec
+		want    map[string]string
+	}{
+		{
+			name: "v1",
+			spec: CPUSpec{
+				Shares: u64(512),
+				Quota:  i64(50000),
+				Period: u64(200000),
+				Idle:   &no,
+				Cpus:   "0-1",
+				Mems:   "0",
+			},
+			want: map[string]string{
+				"cpu/test/cpu.shares":        "512",
+				"cpu/test/cpu.cfs_quota_us":  "50000",
+				"cpu/test/cpu.cfs_period_us": "200000",
+				"cpu/test/cpu.idle":          "0",
+				"cpuset/test/cpuset.cpus":    "0-1",
+				"cpuset/test/cpuset.mems":    "0",
+			},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/cpu.max":       "max 100000\n",
+				"test/cpu.max.burst": "0\n",
+			},
+			spec: CPUSpec{
+				Weight: u64(200),
+				Quota:  i64(50000),
+				Period: u64(200000),
+				Burst:  i64(10000),
+				Idle:   &no,
+				Cpus:   "0-1",
+				Mems:   "0",
+			},
+			want: map[string]string{
+				"test/cpu.weight":    "200",
+				"test/cpu.max":       "50000 200000",
+				"test/cpu.max.burst": "10000",
+				"test/cpu.idle":      "0",
+				"test/cpuset.cpus":   "0-1",
+				"test/cpuset.mems":   "0",
+			},
+		},
+		{
+			name:    "v2-burst-in-cpu.max",
+			unified: true,
+			files:   map[string]string{"test/cpu.max": "max 100000 0\n"},
+			spec: CPUSpec{
+				Shares: u64(1024),
+				Quota:  i64(50000),
+				Burst:  i64(10000),
+			},
+			want: map[string]string{
+				"test/cpu.weight": "39",
+				"test/cpu.max":    "50000 100000 10000",
+			},
+		},
+		{
+			name:    "v2-idle",
+			unified: true,
+			files:   map[string]string{"test/cpu.max": "max 100000\n"},
+			spec:    CPUSpec{Idle: &yes, Quota: i64(50000)},
+			want: map[string]string{
+				"test/cpu.idle": "1",
+				"test/cpu.max":  "50000 100000",
+			},
+		},
+		{
+			name:    "v2-unlimited",
+			unified: true,
+			files:   map[string]string{"test/cpu.max": "50000 100000\n"},
+			spec:    CPUSpec{Quota: i64(-1)},
+			want:    map[string]string{"test/cpu.max": "max 100000"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+			c := Cgroup{Name: "test"}
+			for _, ctrl := range []string{"cpu", "cpuset"} {
+				if err := os.MkdirAll(c.makePath(ctrl), 0755); err != nil {
+					t.Fatalf("os.MkdirAll(): %v", err)
+				}
+			}
+
+			if err := c.ApplyCPU(tc.spec); err != nil {
+				t.Fatalf("ApplyCPU(): %v", err)
+			}
+			for file, want := range tc.want {
+				if got := readFile(t, root, file); got != want {
+					t.Errorf("%s got: %q, want: %q", file, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyCPUInvalid(t *testing.T) {
+	u64 := func(v uint64) *uint64 { return &v }
+	i64 := func(v int64) *int64 { return &v }
+	yes := true
+
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		spec    CPUSpec
+		wantErr error
+	}{
+		{name: "shares-and-weight", unified: true, spec: CPUSpec{Shares: u64(1024), Weight: u64(100)}},
+		{name: "weight-range", unified: true, spec: CPUSpec{Weight: u64(10001)}},
+		{name: "idle-and-weight", unified: true, spec: CPUSpec{Idle: &yes, Weight: u64(100)}},
+		{name: "idle-and-shares", unified: true, spec: CPUSpec{Idle: &yes, Shares: u64(1024)}},
+		{name: "idle-and-shares-v1", spec: CPUSpec{Idle: &yes, Shares: u64(1024)}},
+		{name: "zero-quota", spec: CPUSpec{Quota: i64(0), Shares: u64(1024)}},
+		{name: "zero-period", spec: CPUSpec{Period: u64(0), Shares: u64(1024)}},
+		{name: "burst-over-quota", unified: true, spec: CPUSpec{Quota: i64(1000), Burst: i64(2000)}},
+		{name: "burst-unlimited", unified: true, spec: CPUSpec{Quota: i64(-1), Burst: i64(2000)}},
+		{name: "burst-v1", spec: CPUSpec{Burst: i64(1000)}, wantErr: ErrNotSupported},
+		{name: "weight-v1", spec: CPUSpec{Weight: u64(100)}, wantErr: ErrNotSupported},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			c := Cgroup{Name: "test"}
+			if err := os.MkdirAll(c.makePath("cpu"), 0755); err != nil {
+				t.Fatalf("os.MkdirAll(): %v", err)
+			}
+
+			err := c.ApplyCPU(tc.spec)
+			if err == nil {
+				t.Fatalf("ApplyCPU() should have failed")
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("ApplyCPU() got: %v, want: %v", err, tc.wantErr)
+			}
+			// Nothing is written if the spec is invalid.
+			files, err := filepath.Glob(filepath.Join(c.makePath("cpu"), "*"))
+			if err != nil || len(files) != 0 {
+				t.Errorf("ApplyCPU() wrote files: %v, %v", files, err)
+			}
+		})
+	}
+}
+
+func TestApplyCPUBurstOrder(t *testing.T) {
+	i64 := func(v int64) *int64 { return &v }
+
+	for _, tc := range []struct {
+		name string
+		spec CPUSpec
+		want []string
+	}{
+		{
+			name: "increase",
+			spec: CPUSpec{Quota: i64(80000), Burst: i64(40000)},
+			want: []string{"cpu.max", "cpu.max.burst"},
+		},
+		{
+			name: "decrease",
+			spec: CPUSpec{Quota: i64(10000), Burst: i64(5000)},
+			want: []string{"cpu.max.burst", "cpu.max"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, true)
+			defer cleanup()
+			writeFiles(t, root, map[string]string{
+				"test/cpu.max":       "50000 100000\n",
+				"test/cpu.max.burst": "20000\n",
+			})
+			oldWrite := writeFile
+			defer func() { writeFile = oldWrite }()
+			var got []string
+			writeFile = func(path string, data []byte, perm os.FileMode) error {
+				got = append(got, filepath.Base(path))
+				return oldWrite(path, data, perm)
+			}
+
+			c := Cgroup{Name: "test"}
+			if err := c.ApplyCPU(tc.spec); err != nil {
+				t.Fatalf("ApplyCPU(): %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ApplyCPU() wrote: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
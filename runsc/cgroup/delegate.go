@@ -0,0 +1,92 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// canWrite returns true if the current user may write to 'path'. It's a
+// variable so that tests can simulate cgroups owned by other users.
+var canWrite = func(path string) bool {
+	return unix.Access(path, unix.W_OK) == nil
+}
+
+// DelegatedRoot returns the highest cgroup v2 cgroup, relative to the root of
+// the hierarchy, that the current user may manage, e.g.
+// "/user.slice/user-1000.slice/user@1000.service" when systemd delegated it to
+// the user. It's found by walking up from the cgroup of the current process
+// while the cgroup directory and its 'cgroup.procs' are writable, which is
+// what delegation grants. Rootless sandboxes must be created within it, see
+// InstallOpts.Delegated.
+//
+// An error is returned if not even the current cgroup is writable, i.e. no
+// subtree was delegated. ErrNotSupported is returned if the cgroup v2
+// hierarchy is not mounted, since cgroup v1 can't be delegated safely.
+func DelegatedRoot() (string, error) {
+	return getHierarchies().delegatedRoot()
+}
+
+func (h *hierarchies) delegatedRoot() (string, error) {
+	if h.unified == "" {
+		return "", fmt.Errorf("cgroup delegation requires cgroup v2: %w", ErrNotSupported)
+	}
+	paths, err := LoadPaths("self")
+	if err != nil {
+		return "", fmt.Errorf("finding current cgroups: %v", err)
+	}
+	cur, ok := paths[""]
+	if !ok {
+		return "", fmt.Errorf("current process is not in a cgroup v2 cgroup, paths: %v", paths)
+	}
+	writable := func(dir string) bool {
+		path := filepath.Join(h.unified, dir)
+		return canWrite(path) && canWrite(filepath.Join(path, "cgroup.procs"))
+	}
+	dir := filepath.Clean(cur)
+	if !writable(dir) {
+		return "", fmt.Errorf("no delegated cgroup subtree is writable, current cgroup %q is not writable by uid %d", dir, unix.Getuid())
+	}
+	for dir != "/" && writable(filepath.Dir(dir)) {
+		dir = filepath.Dir(dir)
+	}
+	return dir, nil
+}
+
+// delegate moves the cgroup within the delegated subtree if it's outside of
+// it, by making the delegated root its cgroup v2 parent. Parents of cgroup v1
+// controllers, e.g. on hybrid hosts, are kept.
+func (c *Cgroup) delegate(h *hierarchies) error {
+	root, err := h.delegatedRoot()
+	if err != nil {
+		return err
+	}
+	rel := strings.TrimPrefix(c.makePath(""), h.unified)
+	if rel == root || strings.HasPrefix(rel, strings.TrimSuffix(root, "/")+"/") {
+		return nil
+	}
+	logger().Infof("Cgroup %q is outside of the delegated subtree %q, creating it there", c.Name, root)
+	parents := make(map[string]string, len(c.Parents)+1)
+	for ctrl, parent := range c.Parents {
+		parents[ctrl] = parent
+	}
+	parents[""] = root
+	c.Parents = parents
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupDelegation makes the current process be in 'cgroup', with only the
+// subtree under 'delegated' writable. It returns a function that restores the
+// defaults.
+func setupDelegation(t *testing.T, root, cgroup, delegated string) func() {
+	t.Helper()
+	proc, err := ioutil.TempDir("", "cgroup-proc")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	writeFiles(t, proc, map[string]string{"self/cgroup": "0::" + cgroup + "\n"})
+	oldProc, oldCanWrite := procRoot, canWrite
+	procRoot = proc
+	canWrite = func(path string) bool {
+		if delegated == "" {
+			return false
+		}
+		dir := filepath.Join(root, delegated)
+		return path == dir || strings.HasPrefix(path, dir+"/")
+	}
+	return func() {
+		procRoot, canWrite = oldProc, oldCanWrite
+		os.RemoveAll(proc)
+	}
+}
+
+func TestDelegatedRoot(t *testing.T) {
+	const (
+		cgroup    = "/user.slice/user-1000.slice/user@1000.service/app.slice/term.scope"
+		delegated = "/user.slice/user-1000.slice/user@1000.service"
+	)
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	restore := setupDelegation(t, root, cgroup, delegated)
+	defer restore()
+
+	got, err := DelegatedRoot()
+	if err != nil {
+		t.Fatalf("DelegatedRoot(): %v", err)
+	}
+	if got != delegated {
+		t.Errorf("DelegatedRoot() got: %q, want: %q", got, delegated)
+	}
+
+	// Cgroups outside of the delegated subtree are moved in it, and the ones
+	// already in it are left alone.
+	for _, tc := range []struct {
+		cg   *Cgroup
+		want string
+	}{
+		{cg: &Cgroup{Name: "/runsc/sandbox"}, want: delegated + "/runsc/sandbox"},
+		{cg: &Cgroup{Name: "sandbox", Parents: map[string]string{"": delegated + "/app.slice"}}, want: delegated + "/app.slice/sandbox"},
+	} {
+		if err := tc.cg.InstallWithOpts(context.Background(), nil, InstallOpts{Delegated: true}); err != nil {
+			t.Fatalf("InstallWithOpts(%q): %v", tc.cg.Name, err)
+		}
+		if got, want := tc.cg.makePath(""), filepath.Join(root, tc.want); got != want {
+			t.Errorf("cgroup %q got path: %q, want: %q", tc.cg.Name, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(root, tc.want)); err != nil {
+			t.Errorf("cgroup %q was not created: %v", tc.cg.Name, err)
+		}
+	}
+
+	// Parents of cgroup v1 controllers are kept.
+	c := &Cgroup{Name: "/runsc/sandbox", Parents: map[string]string{"memory": "/machine"}}
+	if err := c.InstallWithOpts(context.Background(), nil, InstallOpts{Delegated: true}); err != nil {
+		t.Fatalf("InstallWithOpts(%q): %v", c.Name, err)
+	}
+	want := map[string]string{"": delegated, "memory": "/machine"}
+	if !reflect.DeepEqual(c.Parents, want) {
+		t.Errorf("cgroup %q got parents: %v, want: %v", c.Name, c.Parents, want)
+	}
+}
+
+func TestDelegatedRootNotWritable(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	restore := setupDelegation(t, root, "/user.slice/user-1000.slice/session-1.scope", "")
+	defer restore()
+
+	if got, err := DelegatedRoot(); err == nil {
+		t.Errorf("DelegatedRoot() got: %q, want error", got)
+	}
+	c := &Cgroup{Name: "/runsc/sandbox"}
+	if err := c.InstallWithOpts(context.Background(), nil, InstallOpts{Delegated: true}); err == nil {
+		t.Errorf("InstallWithOpts() should have failed without a delegated subtree")
+	}
+
+	_, cleanup2 := setupRoot(t, false)
+	defer cleanup2()
+	if _, err := DelegatedRoot(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("DelegatedRoot() on cgroup v1 got: %v, want: %v", err, ErrNotSupported)
+	}
+}
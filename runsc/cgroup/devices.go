@@ -0,0 +1,138 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeviceWildcard is the major or minor number of a DeviceRule that matches
+// any number, "*" in 'devices.list'.
+const DeviceWildcard int64 = -1
+
+// DeviceRule is an entry of the devices controller allow list.
+type DeviceRule struct {
+	// Type is the device type: 'a' for all devices, 'c' for character
+	// devices or 'b' for block devices.
+	Type byte
+
+	// Major and Minor are the device numbers, or DeviceWildcard.
+	Major int64
+	Minor int64
+
+	// Access is a combination of 'r' (read), 'w' (write) and 'm' (mknod).
+	Access string
+}
+
+// String implements fmt.Stringer, using the 'devices.list' format.
+func (r DeviceRule) String() string {
+	return fmt.Sprintf("%c %s:%s %s", r.Type, formatDeviceNumber(r.Major), formatDeviceNumber(r.Minor), r.Access)
+}
+
+// DeviceNumber returns the major and minor numbers of the device file at
+// 'path', and its kind: 'b' for block devices or 'c' for character devices.
+// It's meant for controller rules that identify devices by number, when only
+// the device path is known, e.g. from the OCI spec. The numbers are decoded
+// with the kernel's dev_t layout, which splits them in high and low bits.
+func DeviceNumber(path string) (major, minor uint32, kind rune, err error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, 0, fmt.Errorf("stat(%q): %v", path, err)
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		kind = 'b'
+	case unix.S_IFCHR:
+		kind = 'c'
+	default:
+		return 0, 0, 0, fmt.Errorf("%q is not a device", path)
+	}
+	dev := uint64(st.Rdev)
+	return unix.Major(dev), unix.Minor(dev), kind, nil
+}
+
+// DeviceRules returns the devices the cgroup is allowed to access, from
+// 'devices.list'. Requires cgroup v1: on cgroup v2, device access is controlled
+// by an eBPF program attached to the cgroup, which can't be read back.
+func (c *Cgroup) DeviceRules() ([]DeviceRule, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("devices") {
+		return nil, fmt.Errorf("devices.list, device access is controlled by eBPF on cgroup v2: %w", ErrNotSupported)
+	}
+	s, err := getValue(c.makePath("devices"), "devices.list")
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceRules(s)
+}
+
+// parseDeviceRules parses 'devices.list', formatted like:
+//
+//	c 1:3 rwm
+//	b 8:* r
+//	a *:* rwm
+func parseDeviceRules(s string) ([]DeviceRule, error) {
+	var rules []DeviceRule
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || len(fields[0]) != 1 {
+			return nil, fmt.Errorf("invalid device rule: %q", line)
+		}
+		rule := DeviceRule{Type: fields[0][0], Access: fields[2]}
+		switch rule.Type {
+		case 'a', 'b', 'c':
+		default:
+			return nil, fmt.Errorf("invalid device type in rule: %q", line)
+		}
+		nums := strings.Split(fields[1], ":")
+		if len(nums) != 2 {
+			return nil, fmt.Errorf("invalid device numbers in rule: %q", line)
+		}
+		var err error
+		if rule.Major, err = parseDeviceNumber(nums[0]); err != nil {
+			return nil, fmt.Errorf("invalid major in rule %q: %v", line, err)
+		}
+		if rule.Minor, err = parseDeviceNumber(nums[1]); err != nil {
+			return nil, fmt.Errorf("invalid minor in rule %q: %v", line, err)
+		}
+		if strings.Trim(rule.Access, "rwm") != "" {
+			return nil, fmt.Errorf("invalid access in rule: %q", line)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseDeviceNumber(s string) (int64, error) {
+	if s == "*" {
+		return DeviceWildcard, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func formatDeviceNumber(n int64) string {
+	if n == DeviceWildcard {
+		return "*"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceRules(t *testing.T) {
+	const list = `c 1:3 rwm
+c 1:5 rw
+b 8:* r
+c *:* m
+a *:* rwm
+`
+	got, err := parseDeviceRules(list)
+	if err != nil {
+		t.Fatalf("parseDeviceRules(): %v", err)
+	}
+	want := []DeviceRule{
+		{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},
+		{Type: 'c', Major: 1, Minor: 5, Access: "rw"},
+		{Type: 'b', Major: 8, Minor: DeviceWildcard, Access: "r"},
+		{Type: 'c', Major: DeviceWildcard, Minor: DeviceWildcard, Access: "m"},
+		{Type: 'a', Major: DeviceWildcard, Minor: DeviceWildcard, Access: "rwm"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDeviceRules() got: %+v, want: %+v", got, want)
+	}
+	if str := got[2].String(); str != "b 8:* r" {
+		t.Errorf("String() got: %q, want: %q", str, "b 8:* r")
+	}
+
+	for _, line := range []string{
+		"c 1:3",
+		"x 1:3 rwm",
+		"cc 1:3 rwm",
+		"c 1 rwm",
+		"c a:3 rwm",
+		"c 1:? rwm",
+		"c 1:3 rwx",
+	} {
+		if _, err := parseDeviceRules(line); err == nil {
+			t.Errorf("parseDeviceRules(%q) should have failed", line)
+		}
+	}
+}
+
+func TestDeviceRules(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{"devices/test/devices.list": "c 1:3 rwm\n"})
+
+	c := Cgroup{Name: "test"}
+	got, err := c.DeviceRules()
+	if err != nil {
+		t.Fatalf("DeviceRules(): %v", err)
+	}
+	if want := []DeviceRule{{Type: 'c', Major: 1, Minor: 3, Access: "rwm"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DeviceRules() got: %+v, want: %+v", got, want)
+	}
+}
+
+func TestDeviceRulesV2(t *testing.T) {
+	_, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	c := Cgroup{Name: "test"}
+	if _, err := c.DeviceRules(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("DeviceRules() got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestDeviceNumber(t *testing.T) {
+	major, minor, kind, err := DeviceNumber("/dev/null")
+	if err != nil {
+		t.Fatalf("DeviceNumber(/dev/null): %v", err)
+	}
+	if major != 1 || minor != 3 || kind != 'c' {
+		t.Errorf("DeviceNumber(/dev/null) got: %d:%d %c, want: 1:3 c", major, minor, kind)
+	}
+
+	if _, _, _, err := DeviceNumber("/dev"); err == nil {
+		t.Errorf("DeviceNumber(/dev) should have failed")
+	}
+	if _, _, _, err := DeviceNumber("/dev/does-not-exist"); err == nil {
+		t.Errorf("DeviceNumber(/dev/does-not-exist) should have failed")
+	}
+}
+
+func TestDeviceNumberLoop(t *testing.T) {
+	const path = "/dev/loop0"
+	if _, err := os.Stat(path); err != nil {
+		t.Skipf("loop device is not available: %v", err)
+	}
+	major, minor, kind, err := DeviceNumber(path)
+	if err != nil {
+		t.Fatalf("DeviceNumber(%q): %v", path, err)
+	}
+	// Loop devices have a fixed major number, see
+	// Documentation/admin-guide/devices.txt.
+	if major != 7 || minor != 0 || kind != 'b' {
+		t.Errorf("DeviceNumber(%q) got: %d:%d %c, want: 7:0 b", path, major, minor, kind)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dumpFiles lists, per cgroup v1 controller, the files configured by Install.
+var dumpFiles = map[string][]string{
+	"blkio": {
+		"blkio.weight",
+		"blkio.leaf_weight",
+		"blkio.weight_device",
+		"blkio.leaf_weight_device",
+		"blkio.throttle.read_bps_device",
+		"blkio.throttle.write_bps_device",
+		"blkio.throttle.read_iops_device",
+		"blkio.throttle.write_iops_device",
+	},
+	"cpu": {
+		"cpu.shares",
+		"cpu.cfs_quota_us",
+		"cpu.cfs_period_us",
+	},
+	"cpuset": {
+		"cpuset.cpus",
+		"cpuset.mems",
+	},
+	"memory": {
+		"memory.limit_in_bytes",
+		"memory.soft_limit_in_bytes",
+		"memory.memsw.limit_in_bytes",
+		"memory.kmem.limit_in_bytes",
+		"memory.kmem.tcp.limit_in_bytes",
+		"memory.swappiness",
+		"memory.oom_control",
+	},
+	"net_cls": {
+		"net_cls.classid",
+	},
+	"net_prio": {
+		"net_prio.ifpriomap",
+	},
+	"pids": {
+		"pids.max",
+	},
+}
+
+// dumpFiles2 lists, per cgroup v2 controller, the files configured by Install.
+var dumpFiles2 = map[string][]string{
+	"cpu": {
+		"cpu.weight",
+		"cpu.max",
+	},
+	"cpuset": {
+		"cpuset.cpus",
+		"cpuset.mems",
+	},
+	"memory": {
+		"memory.min",
+		"memory.low",
+		"memory.max",
+		"memory.swap.max",
+	},
+	"pids": {
+		"pids.max",
+	},
+}
+
+// DumpEntry is the content of a single cgroup file. Exactly one of the fields
+// is set.
+type DumpEntry struct {
+	// Value is the file content, with surrounding whitespace removed.
+	Value string `json:"value,omitempty"`
+
+	// Error is set if the file couldn't be read.
+	Error string `json:"error,omitempty"`
+}
+
+// Dump reads all files configured by Install across all controllers. Keys are
+// in the form "<controller>/<file>". Files that can't be read are recorded with
+// the error, instead of failing the entire dump.
+func (c *Cgroup) Dump() map[string]DumpEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := getHierarchies()
+	files := make(map[string][]string)
+	for ctrl := range h.controllers() {
+		files[ctrl] = controllerDumpFiles(h, ctrl)
+	}
+	dump := make(map[string]DumpEntry)
+	for ctrl, names := range files {
+		path := c.makePath(ctrl)
+		for _, name := range names {
+			key := filepath.Join(ctrl, name)
+			val, err := getValue(path, name)
+			if err != nil {
+				dump[key] = DumpEntry{Error: err.Error()}
+				continue
+			}
+			dump[key] = DumpEntry{Value: strings.TrimSpace(val)}
+		}
+	}
+	return dump
+}
+
+// DumpJSON returns Dump() serialized as JSON. It's meant to be attached to bug
+// reports.
+func (c *Cgroup) DumpJSON() ([]byte, error) {
+	return json.MarshalIndent(c.Dump(), "", "  ")
+}
+
+// ReadAll reads all files in the cgroup directory of the given controller,
+// without relying on a list of known files. It returns the trimmed content of
+// each regular file, keyed by name. Files that are write-only, e.g.
+// 'cgroup.event_control', and directories, i.e. child cgroups, are skipped.
+func (c *Cgroup) ReadAll(controllerName string) (map[string]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path, err := c.path(controllerName)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || e.Mode().Perm()&0444 == 0 {
+			continue
+		}
+		val, err := getValue(path, e.Name())
+		if err != nil {
+			if os.IsPermission(err) {
+				continue
+			}
+			return nil, fmt.Errorf("reading %q: %v", filepath.Join(path, e.Name()), err)
+		}
+		files[e.Name()] = strings.TrimSpace(val)
+	}
+	return files, nil
+}
+
+// Apply writes the values in 'dump', keyed as returned by Dump, to the cgroup.
+// All keys are validated before anything is written: the controller must be
+// configured on the host and the file must be one that Install configures for
+// it. Entries recorded with an error and empty values are skipped. Files are
+// written per controller in the order Install configures them.
+func (c *Cgroup) Apply(dump map[string]DumpEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := getHierarchies()
+	ctrls := h.controllers()
+	entries := make(map[string]map[string]string)
+	var unknown []string
+	for key, e := range dump {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			unknown = append(unknown, key)
+			continue
+		}
+		ctrl, name := parts[0], parts[1]
+		if _, ok := ctrls[ctrl]; !ok || !isDumpFile(h, ctrl, name) {
+			unknown = append(unknown, key)
+			continue
+		}
+		if e.Error != "" || e.Value == "" {
+			continue
+		}
+		if entries[ctrl] == nil {
+			entries[ctrl] = make(map[string]string)
+		}
+		entries[ctrl][name] = e.Value
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown cgroup files: %s", strings.Join(unknown, ", "))
+	}
+
+	names := make([]string, 0, len(entries))
+	for ctrl := range entries {
+		names = append(names, ctrl)
+	}
+	sort.Strings(names)
+	for _, ctrl := range names {
+		path := c.makePath(ctrl)
+		for _, name := range controllerDumpFiles(h, ctrl) {
+			val, ok := entries[ctrl][name]
+			if !ok {
+				continue
+			}
+			if err := applyDumpValue(path, name, val); err != nil {
+				return fmt.Errorf("applying %q: %v", filepath.Join(ctrl, name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyJSON is like Apply, with the values serialized as returned by DumpJSON.
+func (c *Cgroup) ApplyJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var dump map[string]DumpEntry
+	if err := dec.Decode(&dump); err != nil {
+		return fmt.Errorf("parsing cgroup dump: %v", err)
+	}
+	return c.Apply(dump)
+}
+
+// controllerDumpFiles returns the files dumped for the controller, based on the
+// hierarchy it's mounted on.
+func controllerDumpFiles(h *hierarchies, ctrl string) []string {
+	if h.isV2(ctrl) {
+		return dumpFiles2[ctrl]
+	}
+	return dumpFiles[ctrl]
+}
+
+// isDumpFile returns true if 'name' is dumped for the controller.
+func isDumpFile(h *hierarchies, ctrl, name string) bool {
+	for _, f := range controllerDumpFiles(h, ctrl) {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDumpValue writes a value read by Dump back to the file. Files that list
+// one setting per line, e.g. 'blkio.throttle.read_bps_device', are written one
+// line at a time, and 'memory.oom_control' only accepts the oom_kill_disable
+// setting.
+func applyDumpValue(path, name, val string) error {
+	if name == "memory.oom_control" {
+		kv, err := parseKeyValues(val)
+		if err != nil {
+			return err
+		}
+		disable, ok := kv["oom_kill_disable"]
+		if !ok {
+			return fmt.Errorf("oom_kill_disable not found in %q", val)
+		}
+		return setValue(path, name, strconv.FormatUint(disable, 10))
+	}
+	for _, line := range strings.Split(val, "\n") {
+		if err := setValue(path, name, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
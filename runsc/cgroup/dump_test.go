@@ -0,0 +1,206 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDumpJSON(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"memory/test/memory.limit_in_bytes": "1073741824\n",
+		"cpu/test/cpu.shares":               "1024\n",
+		"net_prio/test/net_prio.ifpriomap":  "lo 0\neth0 1\n",
+	})
+
+	c := Cgroup{Name: "test"}
+	out, err := c.DumpJSON()
+	if err != nil {
+		t.Fatalf("DumpJSON(): %v", err)
+	}
+	var got map[string]DumpEntry
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", out, err)
+	}
+
+	total := 0
+	for _, names := range dumpFiles {
+		total += len(names)
+	}
+	if len(got) != total {
+		t.Errorf("got %d entries, want: %d", len(got), total)
+	}
+	for key, want := range map[string]string{
+		"memory/memory.limit_in_bytes": "1073741824",
+		"cpu/cpu.shares":               "1024",
+		"net_prio/net_prio.ifpriomap":  "lo 0\neth0 1",
+	} {
+		if e := got[key]; e.Value != want || e.Error != "" {
+			t.Errorf("%s got: %+v, want value: %q", key, e, want)
+		}
+	}
+	// Files that don't exist are reported with an error.
+	if e := got["pids/pids.max"]; e.Value != "" || e.Error == "" {
+		t.Errorf("pids/pids.max got: %+v, want error", e)
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"memory/test/memory.limit_in_bytes":       "1073741824\n",
+		"memory/test/memory.stat":                 "cache 0\nrss 4096\n",
+		"memory/test/cgroup.event_control":        "",
+		"memory/test/child/memory.usage_in_bytes": "0\n",
+	})
+	if err := os.Chmod(filepath.Join(root, "memory/test/cgroup.event_control"), 0200); err != nil {
+		t.Fatalf("os.Chmod(): %v", err)
+	}
+
+	c := Cgroup{Name: "test"}
+	got, err := c.ReadAll("memory")
+	if err != nil {
+		t.Fatalf("ReadAll(): %v", err)
+	}
+	want := map[string]string{
+		"memory.limit_in_bytes": "1073741824",
+		"memory.stat":           "cache 0\nrss 4096",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadAll() got: %v, want: %v", got, want)
+	}
+
+	if _, err := c.ReadAll("invalid"); err == nil {
+		t.Errorf("ReadAll(%q) should have failed", "invalid")
+	}
+}
+
+func TestApplyJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/memory.limit_in_bytes": "1073741824",
+				"memory/memory.oom_control":    "oom_kill_disable 1\nunder_oom 0",
+				"cpu/cpu.shares":               "512",
+				"net_prio/net_prio.ifpriomap":  "lo 0\neth0 1",
+			},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"memory/memory.max": "max",
+				"cpu/cpu.max":       "50000 100000",
+				"pids/pids.max":     "100",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			// diskPath returns where the file of a key is located for the cgroup.
+			diskPath := func(cg, key string) string {
+				parts := strings.SplitN(key, "/", 2)
+				if tc.unified {
+					return filepath.Join(cg, parts[1])
+				}
+				return filepath.Join(parts[0], cg, parts[1])
+			}
+			src := make(map[string]string)
+			for key, val := range tc.files {
+				src[diskPath("src", key)] = val + "\n"
+			}
+			writeFiles(t, root, src)
+
+			// Record every write, appending to the file so that multi-line values
+			// can be compared.
+			oldWrite := writeFile
+			defer func() { writeFile = oldWrite }()
+			writeFile = func(path string, data []byte, perm os.FileMode) error {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return err
+				}
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = f.Write(append(data, '\n'))
+				return err
+			}
+
+			out, err := (&Cgroup{Name: "src"}).DumpJSON()
+			if err != nil {
+				t.Fatalf("DumpJSON(): %v", err)
+			}
+			if err := (&Cgroup{Name: "dst"}).ApplyJSON(out); err != nil {
+				t.Fatalf("ApplyJSON(%s): %v", out, err)
+			}
+			for key, want := range tc.files {
+				if key == "memory/memory.oom_control" {
+					want = "1"
+				}
+				if got := readFile(t, root, diskPath("dst", key)); got != want {
+					t.Errorf("%s got: %q, want: %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyUnknown(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	if err := os.Mkdir(filepath.Join(root, "test"), 0755); err != nil {
+		t.Fatalf("os.Mkdir(): %v", err)
+	}
+	c := &Cgroup{Name: "test"}
+	for _, key := range []string{
+		"memory.max",
+		"bogus/bogus.max",
+		"memory/memory.bogus",
+		// cgroup v1 files are rejected on a cgroup v2 host.
+		"memory/memory.limit_in_bytes",
+	} {
+		dump := map[string]DumpEntry{
+			"pids/pids.max": {Value: "100"},
+			key:             {Value: "1"},
+		}
+		if err := c.Apply(dump); err == nil {
+			t.Errorf("Apply(%q) should have failed", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "test", "pids.max")); !os.IsNotExist(err) {
+		t.Errorf("Apply() wrote to the cgroup before validating it, stat: %v", err)
+	}
+
+	if err := c.ApplyJSON([]byte(`{"pids/pids.max": {"val": "100"}}`)); err == nil {
+		t.Errorf("ApplyJSON() should have failed with unknown field")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// Features are the optional cgroup files supported by the host. Which files
+// exist depends on the kernel version and configuration, e.g. swap accounting
+// may be disabled and newer kernels removed the kernel memory limits. Install
+// and the readers consult them to pick the files to use.
+type Features struct {
+	// Swap is true if the memory+swap usage can be limited, i.e.
+	// 'memory.memsw.limit_in_bytes' or 'memory.swap.max' exist.
+	Swap bool
+
+	// KernelMemory is true if 'memory.kmem.limit_in_bytes' exists. It's only
+	// supported by cgroup v1.
+	KernelMemory bool
+
+	// KernelMemoryTCP is true if 'memory.kmem.tcp.limit_in_bytes' exists. It's
+	// only supported by cgroup v1.
+	KernelMemoryTCP bool
+
+	// CPUBurstFile is true if the CPU burst has its own file, 'cpu.max.burst'
+	// with cgroup v2 or 'cpu.cfs_burst_us' with cgroup v1. Otherwise, cgroup v2
+	// kernels may report the burst as a third field in 'cpu.max'.
+	CPUBurstFile bool
+
+	// CPUWeightNice is true if 'cpu.weight.nice' exists. It's only supported
+	// by cgroup v2.
+	CPUWeightNice bool
+
+	// RealtimeGroupSched is true if 'cpu.rt_runtime_us' exists. It's only
+	// supported by cgroup v1.
+	RealtimeGroupSched bool
+}
+
+// featureProbe describes how to probe the features of a controller.
+type featureProbe struct {
+	// marker and marker2 are the cgroup v1 and v2 files that every cgroup of
+	// the controller has. The probe is only cached if the marker exists,
+	// otherwise the controller files are not populated, e.g. the controller is
+	// not enabled in the cgroup v2 parent.
+	marker  string
+	marker2 string
+
+	// probe sets the controller's features. 'has' returns true if the file
+	// exists in the probed cgroup.
+	probe func(f *Features, has func(string) bool, v2 bool)
+}
+
+var featureProbes = map[string]featureProbe{
+	"memory": {
+		marker:  "memory.limit_in_bytes",
+		marker2: "memory.max",
+		probe: func(f *Features, has func(string) bool, v2 bool) {
+			if v2 {
+				f.Swap = has("memory.swap.max")
+				return
+			}
+			f.Swap = has("memory.memsw.limit_in_bytes")
+			f.KernelMemory = has("memory.kmem.limit_in_bytes")
+			f.KernelMemoryTCP = has("memory.kmem.tcp.limit_in_bytes")
+		},
+	},
+	"cpu": {
+		marker:  "cpu.shares",
+		marker2: "cpu.weight",
+		probe: func(f *Features, has func(string) bool, v2 bool) {
+			if v2 {
+				f.CPUBurstFile = has("cpu.max.burst")
+				f.CPUWeightNice = has("cpu.weight.nice")
+				return
+			}
+			f.CPUBurstFile = has("cpu.cfs_burst_us")
+			f.RealtimeGroupSched = has("cpu.rt_runtime_us")
+		},
+	},
+}
+
+// probeFeatures returns the features of the controller, based on the files in
+// its cgroup 'path', and whether the result can be cached. It's a variable so
+// that tests can inject a fake feature set.
+var probeFeatures = func(ctrl, path string, v2 bool) (Features, bool) {
+	var f Features
+	p, ok := featureProbes[ctrl]
+	if !ok {
+		return f, false
+	}
+	has := func(name string) bool {
+		_, err := os.Stat(filepath.Join(path, name))
+		return err == nil
+	}
+	p.probe(&f, has, v2)
+	marker := p.marker
+	if v2 {
+		marker = p.marker2
+	}
+	return f, has(marker)
+}
+
+// featureCache holds the features probed for each controller. Kernel files
+// don't come and go, so they are probed once per controller.
+var featureCache struct {
+	mu     sync.Mutex
+	probed map[string]Features
+}
+
+// hostFeatures returns the features of the controller, probing them in the
+// cgroup 'path' if they are not cached yet.
+func hostFeatures(ctrl, path string, v2 bool) Features {
+	featureCache.mu.Lock()
+	defer featureCache.mu.Unlock()
+	if f, ok := featureCache.probed[ctrl]; ok {
+		return f
+	}
+	f, ok := probeFeatures(ctrl, path, v2)
+	if ok {
+		if featureCache.probed == nil {
+			featureCache.probed = make(map[string]Features)
+		}
+		featureCache.probed[ctrl] = f
+	}
+	return f
+}
+
+// resetFeatures drops the cached features, so that they are probed again.
+func resetFeatures() {
+	featureCache.mu.Lock()
+	defer featureCache.mu.Unlock()
+	featureCache.probed = nil
+}
+
+// Features returns the optional files supported by the host, probed in the
+// cgroup's memory and cpu controllers. Features of a controller that can't be
+// probed yet, e.g. because the cgroup doesn't exist, are reported as missing.
+func (c *Cgroup) Features() Features {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	mem := hostFeatures("memory", c.makePath("memory"), isV2("memory"))
+	cpu := hostFeatures("cpu", c.makePath("cpu"), isV2("cpu"))
+	return Features{
+		Swap:               mem.Swap,
+		KernelMemory:       mem.KernelMemory,
+		KernelMemoryTCP:    mem.KernelMemoryTCP,
+		CPUBurstFile:       cpu.CPUBurstFile,
+		CPUWeightNice:      cpu.CPUWeightNice,
+		RealtimeGroupSched: cpu.RealtimeGroupSched,
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeFeatures makes every controller report the features 'f' instead of
+// probing the synthetic tree. The returned function restores the probe.
+func fakeFeatures(f Features) func() {
+	oldProbe := probeFeatures
+	probeFeatures = func(string, string, bool) (Features, bool) {
+		return f, true
+	}
+	resetFeatures()
+	return func() {
+		probeFeatures = oldProbe
+		resetFeatures()
+	}
+}
+
+func TestProbeFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+		want    Features
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/test/memory.limit_in_bytes":       "0",
+				"memory/test/memory.memsw.limit_in_bytes": "0",
+				"memory/test/memory.kmem.limit_in_bytes":  "0",
+				"cpu/test/cpu.shares":                     "1024",
+				"cpu/test/cpu.cfs_burst_us":               "0",
+			},
+			want: Features{Swap: true, KernelMemory: true, CPUBurstFile: true},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/memory.max":        "max",
+				"test/memory.swap.max":   "max",
+				"test/cpu.weight":        "100",
+				"test/cpu.weight.nice":   "0",
+				"test/cpu.rt_runtime_us": "0",
+			},
+			want: Features{Swap: true, CPUWeightNice: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+
+			c := &Cgroup{Name: "test"}
+			if got := c.Features(); got != (Features{}) {
+				t.Errorf("Features() without cgroup got: %+v, want: %+v", got, Features{})
+			}
+			writeFiles(t, root, tc.files)
+			if got := c.Features(); got != tc.want {
+				t.Errorf("Features() got: %+v, want: %+v", got, tc.want)
+			}
+
+			// Features are cached once probed.
+			for name := range tc.files {
+				if err := os.Remove(filepath.Join(root, name)); err != nil && !os.IsNotExist(err) {
+					t.Fatalf("os.Remove(): %v", err)
+				}
+			}
+			if got := c.Features(); got != tc.want {
+				t.Errorf("Features() after removing the files got: %+v, want: %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstallFeatures(t *testing.T) {
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{
+			Limit:     int64Ptr(1 << 30),
+			Swap:      int64Ptr(-1),
+			Kernel:    int64Ptr(64 << 20),
+			KernelTCP: int64Ptr(16 << 20),
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		features Features
+		want     map[string]string
+		absent   []string
+	}{
+		{
+			name:     "all",
+			features: Features{Swap: true, KernelMemory: true, KernelMemoryTCP: true},
+			want: map[string]string{
+				"memory.limit_in_bytes":          "1073741824",
+				"memory.memsw.limit_in_bytes":    "-1",
+				"memory.kmem.limit_in_bytes":     "67108864",
+				"memory.kmem.tcp.limit_in_bytes": "16777216",
+			},
+		},
+		{
+			name: "none",
+			want: map[string]string{"memory.limit_in_bytes": "1073741824"},
+			absent: []string{
+				"memory.memsw.limit_in_bytes",
+				"memory.kmem.limit_in_bytes",
+				"memory.kmem.tcp.limit_in_bytes",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, false)
+			defer cleanup()
+			defer fakeFeatures(tc.features)()
+			// cpuset files are inherited from the parent.
+			writeFiles(t, root, map[string]string{
+				"cpuset/cpuset.cpus":      "0",
+				"cpuset/cpuset.mems":      "0",
+				"cpuset/test/cpuset.cpus": "",
+				"cpuset/test/cpuset.mems": "",
+			})
+
+			c := &Cgroup{Name: "test"}
+			if err := c.Install(res); err != nil {
+				t.Fatalf("Install(): %v", err)
+			}
+			for name, want := range tc.want {
+				if got := readFile(t, root, filepath.Join("memory", "test", name)); got != want {
+					t.Errorf("%s got: %q, want: %q", name, got, want)
+				}
+			}
+			for _, name := range tc.absent {
+				if _, err := os.Stat(filepath.Join(root, "memory", "test", name)); !os.IsNotExist(err) {
+					t.Errorf("%s should not be written, stat: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallSwapNotSupported(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		root, cleanup := setupRoot(t, unified)
+		restore := fakeFeatures(Features{})
+		// cpuset files are inherited from the parent.
+		writeFiles(t, root, map[string]string{
+			"cpuset/cpuset.cpus":      "0",
+			"cpuset/cpuset.mems":      "0",
+			"cpuset/test/cpuset.cpus": "",
+			"cpuset/test/cpuset.mems": "",
+		})
+
+		c := &Cgroup{Name: "test"}
+		res := &specs.LinuxResources{
+			Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Swap: int64Ptr(2 << 30)},
+		}
+		if err := c.Install(res); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("Install() with unified: %t got: %v, want: %v", unified, err, ErrNotSupported)
+		}
+		restore()
+		cleanup()
+	}
+}
+
+// TestSetSwapNotSupported checks that an unsupported swap limit is rejected
+// before the memory limit is written.
+func TestSetSwapNotSupported(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	defer fakeFeatures(Features{})()
+
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Swap: int64Ptr(2 << 30)},
+	}
+	for _, tc := range []struct {
+		ctrl  controller
+		limit string
+	}{
+		{ctrl: &memory{}, limit: "memory.limit_in_bytes"},
+		{ctrl: &memory2{}, limit: "memory.max"},
+	} {
+		path := filepath.Join(root, "test")
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("os.MkdirAll(): %v", err)
+		}
+		if err := tc.ctrl.set(LocalWriter{}, res, path); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("%T.set() got: %v, want: %v", tc.ctrl, err, ErrNotSupported)
+		}
+		if _, err := os.Stat(filepath.Join(path, tc.limit)); !os.IsNotExist(err) {
+			t.Errorf("%s should not be written, stat: %v", tc.limit, err)
+		}
+		os.RemoveAll(path)
+	}
+}
+
+func TestCPUBurstV1(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := &Cgroup{Name: "test"}
+	writeFiles(t, root, map[string]string{"cpu/test/cpu.shares": "1024"})
+	if _, err := c.CPUBurst(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("CPUBurst() without cpu.cfs_burst_us got: %v, want: %v", err, ErrNotSupported)
+	}
+
+	resetFeatures()
+	writeFiles(t, root, map[string]string{"cpu/test/cpu.cfs_burst_us": "0\n"})
+	if err := c.SetCPUBurst(20000); err != nil {
+		t.Fatalf("SetCPUBurst(): %v", err)
+	}
+	if got, err := c.CPUBurst(); err != nil || got != 20000 {
+		t.Errorf("CPUBurst() got: %d, %v, want: 20000, nil", got, err)
+	}
+}
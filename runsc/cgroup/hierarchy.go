@@ -0,0 +1,348 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// mountinfoPath is parsed to find where cgroup hierarchies are mounted. It's a
+// variable so that tests can provide a synthetic mount table.
+var mountinfoPath = "/proc/self/mountinfo"
+
+// HierarchyMode describes how cgroup hierarchies are mounted on the host.
+type HierarchyMode int
+
+const (
+	// Legacy means that only cgroup v1 hierarchies are mounted.
+	Legacy HierarchyMode = iota
+
+	// Unified means that only the cgroup v2 unified hierarchy is mounted.
+	Unified
+
+	// Hybrid means that cgroup v1 hierarchies are mounted together with the
+	// cgroup v2 hierarchy, e.g. systemd's "hybrid" layout. Each controller is
+	// bound to either a v1 hierarchy or the v2 one, never both.
+	Hybrid
+)
+
+// String implements fmt.Stringer.
+func (m HierarchyMode) String() string {
+	switch m {
+	case Legacy:
+		return "legacy"
+	case Unified:
+		return "unified"
+	case Hybrid:
+		return "hybrid"
+	default:
+		return fmt.Sprintf("HierarchyMode(%d)", int(m))
+	}
+}
+
+// Mode returns how cgroup hierarchies are mounted on the host, based on
+// /proc/self/mountinfo.
+func Mode() (HierarchyMode, error) {
+	h, err := loadHierarchies()
+	if err != nil {
+		return Legacy, err
+	}
+	return h.mode(), nil
+}
+
+// ExpectedControllers returns the sorted names of the controllers runsc manages
+// on this host, i.e. the ones a sandbox cgroup is expected to be in. cgroup v1
+// controllers must have a mounted hierarchy, and cgroup v2 controllers must be
+// available in the unified hierarchy. Controllers runsc doesn't know about are
+// never included.
+func ExpectedControllers() ([]string, error) {
+	h, err := loadHierarchies()
+	if err != nil {
+		return nil, err
+	}
+	return h.expected()
+}
+
+// hierarchies describes where cgroup controllers are mounted.
+type hierarchies struct {
+	// v1 maps controller names to the mount point of their cgroup v1
+	// hierarchy. Co-mounted controllers, e.g. cpu and cpuacct, share the same
+	// mount point. Named hierarchies are keyed by their name, e.g. "systemd".
+	v1 map[string]string
+
+	// unified is the mount point of the cgroup v2 hierarchy, or empty if it's
+	// not mounted.
+	unified string
+
+	// available contains the controllers listed in cgroup.controllers at the
+	// root of the cgroup v2 hierarchy. It's nil if the hierarchy is not mounted.
+	available map[string]bool
+
+	// readOnly contains the mount points above that are mounted read-only. It's
+	// nil if there are none.
+	readOnly map[string]bool
+}
+
+func (h *hierarchies) mode() HierarchyMode {
+	switch {
+	case h.unified == "":
+		return Legacy
+	case len(h.v1) == 0:
+		return Unified
+	default:
+		return Hybrid
+	}
+}
+
+// isV2 returns true if the controller is configured through the cgroup v2
+// hierarchy. On hybrid hosts, that's the case for controllers that are not
+// bound to a v1 hierarchy and are available in the v2 one.
+func (h *hierarchies) isV2(controllerName string) bool {
+	switch h.mode() {
+	case Unified:
+		return true
+	case Legacy:
+		return false
+	}
+	if _, ok := h.v1[controllerName]; ok {
+		return false
+	}
+	return h.available[controllerName]
+}
+
+// v1Mount returns the mount point of the controller's cgroup v1 hierarchy. If
+// the controller is not mounted, the conventional location under cgroupRoot is
+// returned.
+func (h *hierarchies) v1Mount(controllerName string) string {
+	if mount, ok := h.v1[controllerName]; ok {
+		return mount
+	}
+	return filepath.Join(cgroupRoot, controllerName)
+}
+
+// controllers returns the controllers to configure, each one with the backend
+// matching the hierarchy it's mounted on.
+func (h *hierarchies) controllers() map[string]controller {
+	switch h.mode() {
+	case Unified:
+		return controllers2
+	case Legacy:
+		return controllers
+	}
+	ctrls := make(map[string]controller)
+	for name, ctrl := range controllers {
+		if !h.isV2(name) {
+			ctrls[name] = ctrl
+		}
+	}
+	for name, ctrl := range controllers2 {
+		if h.isV2(name) {
+			ctrls[name] = ctrl
+		}
+	}
+	return ctrls
+}
+
+// expected implements ExpectedControllers.
+func (h *hierarchies) expected() ([]string, error) {
+	var names []string
+	for name := range h.controllers() {
+		if !h.isV2(name) {
+			if _, ok := h.v1[name]; ok {
+				names = append(names, name)
+			}
+			continue
+		}
+		if h.available[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hasV2 returns true if at least one controller is configured through the
+// cgroup v2 hierarchy.
+func (h *hierarchies) hasV2() bool {
+	for name := range controllers2 {
+		if h.isV2(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnlyMount returns the mount point of a hierarchy used by one of the
+// controllers that is mounted read-only, or empty if all of them are writable.
+func (h *hierarchies) readOnlyMount() string {
+	for name := range h.controllers() {
+		mount, ok := h.v1[name]
+		if h.isV2(name) {
+			mount, ok = h.unified, true
+		}
+		if ok && h.readOnly[mount] {
+			return mount
+		}
+	}
+	return ""
+}
+
+// loadHierarchies reads the cgroup mounts from mountinfoPath, and the
+// controllers available in the cgroup v2 hierarchy if it's mounted.
+func loadHierarchies() (*hierarchies, error) {
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := parseMountinfo(f)
+	if err != nil {
+		return nil, err
+	}
+	if h.unified != "" {
+		avail, err := getValue(h.unified, "cgroup.controllers")
+		if err != nil {
+			return nil, fmt.Errorf("reading available controllers: %v", err)
+		}
+		h.available = make(map[string]bool)
+		for _, ctrl := range strings.Fields(avail) {
+			h.available[ctrl] = true
+		}
+	}
+	return h, nil
+}
+
+// hierarchyCache holds the hierarchies loaded by getHierarchies. Cgroup mounts
+// don't change while runsc runs, so mountinfo is parsed once.
+var hierarchyCache struct {
+	mu     sync.Mutex
+	loaded *hierarchies
+}
+
+// getHierarchies is like loadHierarchies, but falls back to cgroup v1
+// hierarchies under cgroupRoot if mountinfo can't be read. The result is
+// cached, and must not be changed.
+func getHierarchies() *hierarchies {
+	hierarchyCache.mu.Lock()
+	defer hierarchyCache.mu.Unlock()
+	if hierarchyCache.loaded != nil {
+		return hierarchyCache.loaded
+	}
+	h, err := loadHierarchies()
+	if err != nil {
+		logger().Warningf("Reading cgroup mounts, assuming cgroup v1 under %q: %v", cgroupRoot, err)
+		return &hierarchies{}
+	}
+	hierarchyCache.loaded = h
+	return h
+}
+
+// resetHierarchies drops the cached hierarchies, so that mountinfo is parsed
+// again.
+func resetHierarchies() {
+	hierarchyCache.mu.Lock()
+	defer hierarchyCache.mu.Unlock()
+	hierarchyCache.loaded = nil
+}
+
+// parseMountinfo parses the cgroup mounts in mountinfo, formatted as described
+// in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - cgroup cgroup rw,cpu,cpuacct
+//
+// If a hierarchy is mounted more than once, the first mount point is used.
+func parseMountinfo(r io.Reader) (*hierarchies, error) {
+	h := &hierarchies{v1: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		// Optional fields are terminated by a single hyphen.
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || len(fields) < sep+4 {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", line)
+		}
+		mount := fields[4]
+		if fstype := fields[sep+1]; (fstype == "cgroup" || fstype == "cgroup2") &&
+			(hasOption(fields[5], "ro") || hasOption(fields[sep+3], "ro")) {
+			if h.readOnly == nil {
+				h.readOnly = make(map[string]bool)
+			}
+			h.readOnly[mount] = true
+		}
+		switch fields[sep+1] {
+		case "cgroup2":
+			if h.unified == "" {
+				h.unified = mount
+			}
+		case "cgroup":
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				name := v1ControllerName(opt)
+				if name == "" {
+					continue
+				}
+				if _, ok := h.v1[name]; !ok {
+					h.v1[name] = mount
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// hasOption returns true if the comma separated list of mount options contains
+// 'opt'.
+func hasOption(opts, opt string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// v1ControllerName returns the controller name for a cgroup v1 super block
+// option, or empty if the option is not a controller.
+func v1ControllerName(opt string) string {
+	if strings.HasPrefix(opt, "name=") {
+		return strings.TrimPrefix(opt, "name=")
+	}
+	if strings.Contains(opt, "=") {
+		// e.g. release_agent=/path.
+		return ""
+	}
+	switch opt {
+	case "rw", "ro", "all", "none", "noprefix", "clone_children", "xattr", "cpuset_v2_mode":
+		return ""
+	}
+	return opt
+}
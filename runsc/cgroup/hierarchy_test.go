@@ -0,0 +1,301 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// hybridMountinfo is the mount table of a systemd host in hybrid mode.
+const hybridMountinfo = `24 30 0:22 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+30 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+33 24 0:27 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+34 33 0:28 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw,nsdelegate
+35 33 0:29 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,xattr,name=systemd
+38 33 0:32 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:15 - cgroup cgroup rw,cpu,cpuacct
+39 33 0:33 / /sys/fs/cgroup/pids rw,nosuid,nodev,noexec,relatime shared:16 - cgroup cgroup rw,pids
+40 33 0:34 / /sys/fs/cgroup/cpuset rw,nosuid,nodev,noexec,relatime shared:17 - cgroup cgroup rw,cpuset,clone_children
+41 24 0:32 / /sys/fs/cgroup/cpu rw,nosuid,nodev,noexec,relatime shared:15 - cgroup cgroup rw,cpu,cpuacct
+`
+
+func TestParseMountinfo(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		mountinfo string
+		want      hierarchies
+		mode      HierarchyMode
+	}{
+		{
+			name:      "hybrid",
+			mountinfo: hybridMountinfo,
+			want: hierarchies{
+				v1: map[string]string{
+					"systemd": "/sys/fs/cgroup/systemd",
+					"cpu":     "/sys/fs/cgroup/cpu,cpuacct",
+					"cpuacct": "/sys/fs/cgroup/cpu,cpuacct",
+					"pids":    "/sys/fs/cgroup/pids",
+					"cpuset":  "/sys/fs/cgroup/cpuset",
+				},
+				unified: "/sys/fs/cgroup/unified",
+			},
+			mode: Hybrid,
+		},
+		{
+			name:      "unified",
+			mountinfo: "33 24 0:27 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:9 - cgroup2 cgroup2 rw,nsdelegate\n",
+			want:      hierarchies{v1: map[string]string{}, unified: "/sys/fs/cgroup"},
+			mode:      Unified,
+		},
+		{
+			name:      "legacy",
+			mountinfo: "39 33 0:33 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:16 - cgroup cgroup rw,memory\n",
+			want:      hierarchies{v1: map[string]string{"memory": "/sys/fs/cgroup/memory"}},
+			mode:      Legacy,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMountinfo(strings.NewReader(tc.mountinfo))
+			if err != nil {
+				t.Fatalf("parseMountinfo(): %v", err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("parseMountinfo() got: %+v, want: %+v", *got, tc.want)
+			}
+			if mode := got.mode(); mode != tc.mode {
+				t.Errorf("mode() got: %v, want: %v", mode, tc.mode)
+			}
+		})
+	}
+
+	if _, err := parseMountinfo(strings.NewReader("33 24 0:27 / /sys/fs/cgroup rw\n")); err == nil {
+		t.Errorf("parseMountinfo() should have failed without separator")
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	// memory is only available in the v2 hierarchy, everything else is v1.
+	var mounts []string
+	for name := range controllers {
+		if name != "memory" {
+			mounts = append(mounts, name+" cgroup rw,"+name)
+		}
+	}
+	mounts = append(mounts, "unified cgroup2 rw")
+	writeMountinfo(t, root, mounts...)
+	writeFiles(t, root, map[string]string{"unified/cgroup.controllers": "memory"})
+
+	if mode, err := Mode(); err != nil || mode != Hybrid {
+		t.Fatalf("Mode() got: %v, %v, want: %v, nil", mode, err, Hybrid)
+	}
+	ctrls := getHierarchies().controllers()
+	if _, ok := ctrls["memory"].(*memory2); !ok {
+		t.Errorf("memory controller got: %T, want: %T", ctrls["memory"], &memory2{})
+	}
+	if _, ok := ctrls["cpu"].(*cpu); !ok {
+		t.Errorf("cpu controller got: %T, want: %T", ctrls["cpu"], &cpu{})
+	}
+
+	// Available controllers are read once, when the hierarchies are loaded.
+	if err := os.Remove(filepath.Join(root, "unified", "cgroup.controllers")); err != nil {
+		t.Fatalf("os.Remove(): %v", err)
+	}
+	if !getHierarchies().isV2("memory") {
+		t.Errorf("isV2(memory) got: false, want: true")
+	}
+	writeFiles(t, root, map[string]string{"unified/cgroup.controllers": "memory"})
+
+	limit := int64(1 << 30)
+	shares := uint64(512)
+	c := Cgroup{Name: "test"}
+	if err := c.Install(&specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+		CPU:    &specs.LinuxCPU{Shares: &shares, Cpus: "0-3", Mems: "0"},
+	}); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer c.Uninstall()
+
+	if path := c.makePath("memory"); path != filepath.Join(root, "unified", "test") {
+		t.Errorf("makePath(memory) got: %q, want: %q", path, filepath.Join(root, "unified", "test"))
+	}
+	for file, want := range map[string]string{
+		"unified/test/memory.max":        "1073741824",
+		"unified/cgroup.subtree_control": "+memory",
+		"cpu/test/cpu.shares":            "512",
+		"cpuset/test/cpuset.cpus":        "0-3",
+	} {
+		if got := readFile(t, root, file); got != want {
+			t.Errorf("%s got: %q, want: %q", file, got, want)
+		}
+	}
+}
+
+func TestCoMounted(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	mounts := []string{
+		"cpu,cpuacct cgroup rw,cpu,cpuacct",
+		"net_cls,net_prio cgroup rw,net_cls,net_prio",
+	}
+	for name := range controllers {
+		switch name {
+		case "cpu", "cpuacct", "net_cls", "net_prio":
+		default:
+			mounts = append(mounts, name+" cgroup rw,"+name)
+		}
+	}
+	writeMountinfo(t, root, mounts...)
+
+	c := Cgroup{
+		Name:    "test",
+		Parents: map[string]string{"cpu,cpuacct": "/user.slice"},
+	}
+	for _, tc := range []struct {
+		ctrls []string
+		want  string
+	}{
+		{ctrls: []string{"cpu", "cpuacct"}, want: "cpu,cpuacct/user.slice/test"},
+		{ctrls: []string{"net_cls", "net_prio"}, want: "net_cls,net_prio/test"},
+	} {
+		for _, ctrl := range tc.ctrls {
+			got, err := c.Path(ctrl)
+			if err != nil {
+				t.Fatalf("Path(%q): %v", ctrl, err)
+			}
+			if want := filepath.Join(root, tc.want); got != want {
+				t.Errorf("Path(%q) got: %q, want: %q", ctrl, got, want)
+			}
+		}
+	}
+
+	// Co-mounted controllers are created and removed once.
+	if err := c.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	if err := c.Uninstall(); err != nil {
+		t.Fatalf("Uninstall(): %v", err)
+	}
+	path, _ := c.Path("cpuacct")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%q was not removed, stat: %v", path, err)
+	}
+}
+
+func TestReadOnlyMount(t *testing.T) {
+	const mountinfo = `34 33 0:28 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw,nsdelegate
+38 33 0:32 / /sys/fs/cgroup/cpu,cpuacct ro,nosuid,nodev,noexec,relatime shared:15 - cgroup cgroup rw,cpu,cpuacct
+39 33 0:33 / /sys/fs/cgroup/pids rw,nosuid,nodev,noexec,relatime shared:16 - cgroup cgroup rw,pids
+`
+	h, err := parseMountinfo(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatalf("parseMountinfo(): %v", err)
+	}
+	if want := map[string]bool{"/sys/fs/cgroup/cpu,cpuacct": true}; !reflect.DeepEqual(h.readOnly, want) {
+		t.Errorf("parseMountinfo() got read-only mounts: %v, want: %v", h.readOnly, want)
+	}
+	if got := h.readOnlyMount(); got != "/sys/fs/cgroup/cpu,cpuacct" {
+		t.Errorf("readOnlyMount() got: %q, want: %q", got, "/sys/fs/cgroup/cpu,cpuacct")
+	}
+}
+
+func TestGetHierarchiesCached(t *testing.T) {
+	_, cleanup := setupRoot(t, true)
+	defer cleanup()
+	if !getHierarchies().hasV2() {
+		t.Fatalf("getHierarchies() should find the cgroup v2 hierarchy")
+	}
+
+	// Changes to mountinfo are only seen once the cache is dropped.
+	if err := ioutil.WriteFile(mountinfoPath, nil, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+	if !getHierarchies().hasV2() {
+		t.Errorf("getHierarchies() reloaded mountinfo")
+	}
+	resetHierarchies()
+	if getHierarchies().hasV2() {
+		t.Errorf("getHierarchies() didn't reload mountinfo after resetHierarchies()")
+	}
+}
+
+func TestExpectedControllers(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		mounts  []string
+		avail   string
+		want    []string
+	}{
+		{
+			name: "v1",
+			mounts: []string{
+				"cpu,cpuacct cgroup rw,cpu,cpuacct",
+				"memory cgroup rw,memory",
+				"pids cgroup rw,pids",
+				"systemd cgroup rw,name=systemd",
+				// Unknown controllers are ignored.
+				"hugetlb cgroup rw,hugetlb",
+			},
+			want: []string{"cpu", "cpuacct", "memory", "pids", "systemd"},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			avail:   "cpu io memory",
+			want:    []string{"cpu", "memory"},
+		},
+		{
+			name: "hybrid",
+			mounts: []string{
+				"cpuset cgroup rw,cpuset",
+				"unified cgroup2 rw",
+			},
+			avail: "memory pids",
+			want:  []string{"cpuset", "memory", "pids"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			if tc.unified {
+				writeFiles(t, root, map[string]string{"cgroup.controllers": tc.avail})
+			} else {
+				writeMountinfo(t, root, tc.mounts...)
+				if tc.avail != "" {
+					writeFiles(t, root, map[string]string{"unified/cgroup.controllers": tc.avail})
+				}
+			}
+
+			got, err := ExpectedControllers()
+			if err != nil {
+				t.Fatalf("ExpectedControllers(): %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ExpectedControllers() got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// freezeTimeout is how long Kill waits for the cgroup to be frozen.
+const freezeTimeout = 5 * time.Second
+
+// Kill sends SIGKILL to all tasks in the cgroup and its descendants.
+//
+// With cgroup v2 on Linux 5.14+, it writes to 'cgroup.kill', which kills the
+// whole subtree atomically. Otherwise, the cgroup is frozen so that tasks can't
+// fork while they are enumerated and killed, and then thawed for the signals to
+// be delivered. ErrNotSupported is returned if neither 'cgroup.kill' nor the
+// freezer are available.
+//
+// Kill doesn't wait for tasks to exit, use WaitPopulated for that.
+func (c *Cgroup) Kill() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v2 := isV2("memory")
+	path := c.makePath("memory")
+	if v2 {
+		if _, err := os.Stat(filepath.Join(path, "cgroup.kill")); err == nil {
+			logger().Debugf("Killing cgroup %q using cgroup.kill", path)
+			return setValue(path, "cgroup.kill", "1")
+		}
+	} else {
+		path = c.makePath("freezer")
+	}
+
+	file := freezerFile(v2)
+	if _, err := os.Stat(filepath.Join(path, file)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("killing cgroup %q: neither cgroup.kill nor %s are available: %w", path, file, ErrNotSupported)
+		}
+		return fmt.Errorf("killing cgroup %q: %v", path, err)
+	}
+
+	logger().Debugf("Killing cgroup %q using the freezer", path)
+	if err := freeze(path, v2, true); err != nil {
+		// Kill the tasks anyway, some of them may escape if they are forking.
+		logger().Warningf("Freezing cgroup %q: %v", path, err)
+	}
+	killErr := killAll(path)
+	if err := freeze(path, v2, false); err != nil {
+		return fmt.Errorf("thawing cgroup %q: %v", path, err)
+	}
+	return killErr
+}
+
+// freezerFile returns the name of the file used to freeze a cgroup.
+func freezerFile(v2 bool) string {
+	if v2 {
+		return "cgroup.freeze"
+	}
+	return "freezer.state"
+}
+
+// freeze freezes or thaws the cgroup in 'path' and waits for the change to
+// take effect, if freezing.
+func freeze(path string, v2, frozen bool) error {
+	val := "THAWED"
+	if frozen {
+		val = "FROZEN"
+	}
+	if v2 {
+		val = "0"
+		if frozen {
+			val = "1"
+		}
+	}
+	if err := setValue(path, freezerFile(v2), val); err != nil {
+		return err
+	}
+	if !frozen {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), freezeTimeout)
+	defer cancel()
+	b := backoff.WithContext(backoff.NewConstantBackOff(10*time.Millisecond), ctx)
+	return backoff.Retry(func() error {
+		done, err := isFrozen(path, v2)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		if !done {
+			return fmt.Errorf("cgroup %q is not frozen yet", path)
+		}
+		return nil
+	}, b)
+}
+
+// isFrozen returns true if the freeze of the cgroup in 'path' has taken effect,
+// i.e. all of its tasks are frozen. With cgroup v2, that's the "frozen" key of
+// 'cgroup.events', since 'cgroup.freeze' only holds the requested state. With
+// cgroup v1, 'freezer.state' is "FREEZING" until it's done.
+func isFrozen(path string, v2 bool) (bool, error) {
+	if v2 {
+		events, err := getKeyValues(path, "cgroup.events")
+		if err != nil {
+			return false, err
+		}
+		return events["frozen"] == 1, nil
+	}
+	state, err := getValue(path, "freezer.state")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(state) == "FROZEN", nil
+}
+
+// freezerPath returns the directory of the cgroup that has the freezer file,
+// and whether it's cgroup v2. ErrNotSupported is returned if the freezer is
+// not available.
+func (c *Cgroup) freezerPath() (string, bool, error) {
+	v2 := isV2("memory")
+	path := c.makePath("freezer")
+	if v2 {
+		path = c.makePath("memory")
+	}
+	file := freezerFile(v2)
+	if _, err := os.Stat(filepath.Join(path, file)); err != nil {
+		if os.IsNotExist(err) {
+			return "", false, fmt.Errorf("%s: %w", file, ErrNotSupported)
+		}
+		return "", false, err
+	}
+	return path, v2, nil
+}
+
+// Freeze freezes all tasks in the cgroup and its descendants. It waits until
+// the freeze has taken effect, i.e. Frozen returns true, for up to 5 seconds.
+// Returns ErrNotSupported if the freezer is not available.
+func (c *Cgroup) Freeze() error {
+	// Don't hold the lock while waiting, so that Frozen can be called
+	// meanwhile.
+	c.mu.RLock()
+	path, v2, err := c.freezerPath()
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := freeze(path, v2, true); err != nil {
+		return fmt.Errorf("freezing cgroup %q: %v", path, err)
+	}
+	return nil
+}
+
+// Thaw resumes the tasks in the cgroup frozen by Freeze. Returns
+// ErrNotSupported if the freezer is not available.
+func (c *Cgroup) Thaw() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path, v2, err := c.freezerPath()
+	if err != nil {
+		return err
+	}
+	return freeze(path, v2, false)
+}
+
+// Frozen returns true if all tasks in the cgroup are frozen. While a freeze
+// is in progress, it returns false even though the freeze was requested, so
+// that callers don't act on tasks that are still running. Returns
+// ErrNotSupported if the freezer is not available.
+func (c *Cgroup) Frozen() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path, v2, err := c.freezerPath()
+	if err != nil {
+		return false, err
+	}
+	return isFrozen(path, v2)
+}
+
+// killAll sends SIGKILL to all processes in the cgroup in 'path' and its
+// descendants. Processes that have already exited are ignored.
+func killAll(path string) error {
+	return filepath.Walk(path, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Descendant removed while walking.
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		var killErr error
+		if err := forEachPID(dir, func(pid int) bool {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				killErr = fmt.Errorf("killing PID %d in %q: %v", pid, dir, err)
+				return false
+			}
+			return true
+		}); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return killErr
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startSleep starts a process to be killed by the test.
+func startSleep(t *testing.T) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sleep", "10000")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %q: %v", cmd.Args, err)
+	}
+	return cmd
+}
+
+// checkKilled checks that 'cmd' was terminated by SIGKILL.
+func checkKilled(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Wait() got: %v, want: killed", err)
+	}
+	if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		t.Errorf("Wait() got: %v, want: killed by SIGKILL", err)
+	}
+}
+
+func TestKillCgroupKill(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"test/cgroup.kill":   "",
+		"test/cgroup.freeze": "0",
+	})
+
+	c := Cgroup{Name: "test"}
+	if err := c.Kill(); err != nil {
+		t.Fatalf("Kill(): %v", err)
+	}
+	if got := readFile(t, root, "test/cgroup.kill"); got != "1" {
+		t.Errorf("cgroup.kill got: %q, want: %q", got, "1")
+	}
+	if got := readFile(t, root, "test/cgroup.freeze"); got != "0" {
+		t.Errorf("cgroup.freeze got: %q, want: %q", got, "0")
+	}
+}
+
+func TestKillFreezer(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unified=%t", unified), func(t *testing.T) {
+			root, cleanup := setupRoot(t, unified)
+			defer cleanup()
+
+			parent, child := startSleep(t), startSleep(t)
+			defer parent.Process.Kill()
+			defer child.Process.Kill()
+
+			dir, file, thawed := "freezer/test", "freezer.state", "THAWED"
+			if unified {
+				dir, file, thawed = "test", "cgroup.freeze", "0"
+				// cgroup.kill is not available prior to Linux 5.14.
+				writeFiles(t, root, map[string]string{"test/cgroup.events": "populated 1\nfrozen 1\n"})
+			}
+			writeFiles(t, root, map[string]string{
+				dir + "/" + file:             thawed,
+				dir + "/cgroup.procs":        fmt.Sprintf("%d\n", parent.Process.Pid),
+				dir + "/child/cgroup.procs":  fmt.Sprintf("%d\n", child.Process.Pid),
+				dir + "/exited/cgroup.procs": "2147483647\n",
+			})
+
+			c := Cgroup{Name: "test"}
+			if err := c.Kill(); err != nil {
+				t.Fatalf("Kill(): %v", err)
+			}
+			checkKilled(t, parent)
+			checkKilled(t, child)
+			if got := readFile(t, root, dir+"/"+file); got != thawed {
+				t.Errorf("%s got: %q, want: %q", file, got, thawed)
+			}
+		})
+	}
+}
+
+func TestKillNotSupported(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unified=%t", unified), func(t *testing.T) {
+			root, cleanup := setupRoot(t, unified)
+			defer cleanup()
+			writeFiles(t, root, map[string]string{"test/cgroup.procs": ""})
+
+			c := Cgroup{Name: "test"}
+			if err := c.Kill(); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("Kill() got: %v, want: %v", err, ErrNotSupported)
+			}
+		})
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	c := &Cgroup{Name: "test"}
+	if err := c.Freeze(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Freeze() without cgroup.freeze got: %v, want: %v", err, ErrNotSupported)
+	}
+	writeFiles(t, root, map[string]string{
+		"test/cgroup.freeze": "0",
+		"test/cgroup.events": "populated 1\nfrozen 0\n",
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- c.Freeze() }()
+
+	// Wait for the freeze to be requested: it's not in effect until
+	// cgroup.events says so.
+	for start := time.Now(); readFile(t, root, "test/cgroup.freeze") != "1"; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Freeze() didn't write cgroup.freeze")
+		}
+	}
+	if got, err := c.Frozen(); err != nil || got {
+		t.Errorf("Frozen() while freezing got: %t, %v, want: false, nil", got, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Freeze() returned before the freeze took effect: %v", err)
+	default:
+	}
+
+	tmp := filepath.Join(root, "test", "cgroup.events.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("populated 1\nfrozen 1\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(root, "test", "cgroup.events")); err != nil {
+		t.Fatalf("os.Rename(): %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Freeze(): %v", err)
+	}
+	if got, err := c.Frozen(); err != nil || !got {
+		t.Errorf("Frozen() got: %t, %v, want: true, nil", got, err)
+	}
+
+	if err := c.Thaw(); err != nil {
+		t.Fatalf("Thaw(): %v", err)
+	}
+	if got := readFile(t, root, "test/cgroup.freeze"); got != "0" {
+		t.Errorf("cgroup.freeze got: %q, want: %q", got, "0")
+	}
+}
+
+func TestFrozenV1(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	c := &Cgroup{Name: "test"}
+	for state, want := range map[string]bool{"THAWED": false, "FREEZING": false, "FROZEN": true} {
+		writeFiles(t, root, map[string]string{"freezer/test/freezer.state": state + "\n"})
+		if got, err := c.Frozen(); err != nil || got != want {
+			t.Errorf("Frozen() with %s got: %t, %v, want: %t, nil", state, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// knob describes the files that implement a setting, and why they may be
+// missing on a host.
+type knob struct {
+	// ctrl is the controller that owns the files.
+	ctrl string
+
+	// ctrl2 is the cgroup v2 controller that owns file2, if it's named
+	// differently than ctrl, e.g. "io" for "blkio".
+	ctrl2 string
+
+	// file is the cgroup v1 file, and reason explains why it may be missing.
+	file   string
+	reason string
+
+	// file2 is the cgroup v2 file, and reason2 explains why it may be missing.
+	// If file2 is empty, the setting is not supported by cgroup v2 and reason2
+	// says why.
+	file2   string
+	reason2 string
+}
+
+// knobs are the settings checked by CanSet, named after the fields of
+// specs.LinuxResources that configure them.
+var knobs = map[string]knob{
+	"memory.limit": {
+		ctrl:  "memory",
+		file:  "memory.limit_in_bytes",
+		file2: "memory.max",
+	},
+	"memory.reservation": {
+		ctrl:  "memory",
+		file:  "memory.soft_limit_in_bytes",
+		file2: "memory.low",
+	},
+	"memory.swap": {
+		ctrl:    "memory",
+		file:    "memory.memsw.limit_in_bytes",
+		reason:  "swap accounting is disabled, it requires CONFIG_MEMCG_SWAP and booting with swapaccount=1",
+		file2:   "memory.swap.max",
+		reason2: "swap accounting is disabled, it requires CONFIG_MEMCG_SWAP and booting with swapaccount=1",
+	},
+	"memory.kernel": {
+		ctrl:    "memory",
+		file:    "memory.kmem.limit_in_bytes",
+		reason:  "kernel memory accounting is disabled, it requires CONFIG_MEMCG_KMEM and not booting with cgroup.memory=nokmem, or the kernel removed it",
+		reason2: "kernel memory is accounted in memory.max by cgroup v2 and can't be limited separately",
+	},
+	"memory.kernelTCP": {
+		ctrl:    "memory",
+		file:    "memory.kmem.tcp.limit_in_bytes",
+		reason:  "kernel memory accounting is disabled, it requires CONFIG_MEMCG_KMEM and not booting with cgroup.memory=nokmem",
+		reason2: "TCP buffer memory is accounted in memory.max by cgroup v2 and can't be limited separately",
+	},
+	"memory.swappiness": {
+		ctrl:    "memory",
+		file:    "memory.swappiness",
+		reason2: "cgroup v2 has no per-cgroup swappiness",
+	},
+	"cpu.shares": {
+		ctrl:  "cpu",
+		file:  "cpu.shares",
+		file2: "cpu.weight",
+	},
+	"cpu.quota": {
+		ctrl:    "cpu",
+		file:    "cpu.cfs_quota_us",
+		reason:  "CPU bandwidth control requires CONFIG_CFS_BANDWIDTH",
+		file2:   "cpu.max",
+		reason2: "CPU bandwidth control requires CONFIG_CFS_BANDWIDTH",
+	},
+	"cpu.realtimeRuntime": {
+		ctrl:    "cpu",
+		file:    "cpu.rt_runtime_us",
+		reason:  "realtime group scheduling requires CONFIG_RT_GROUP_SCHED",
+		reason2: "realtime group scheduling is not supported by cgroup v2",
+	},
+	"cpu.realtimePeriod": {
+		ctrl:    "cpu",
+		file:    "cpu.rt_period_us",
+		reason:  "realtime group scheduling requires CONFIG_RT_GROUP_SCHED",
+		reason2: "realtime group scheduling is not supported by cgroup v2",
+	},
+	"cpu.cpus": {
+		ctrl:  "cpuset",
+		file:  "cpuset.cpus",
+		file2: "cpuset.cpus",
+	},
+	"blockIO.weight": {
+		ctrl:    "blkio",
+		ctrl2:   "io",
+		file:    "blkio.weight",
+		reason:  "IO weights require the CFQ or BFQ IO scheduler",
+		file2:   "io.weight",
+		reason2: "IO weights require the BFQ IO scheduler or io.cost",
+	},
+	"network.classID": {
+		ctrl:    "net_cls",
+		file:    "net_cls.classid",
+		reason2: "net_cls is not supported by cgroup v2",
+	},
+	"pids.limit": {
+		ctrl:  "pids",
+		file:  "pids.max",
+		file2: "pids.max",
+	},
+}
+
+// CanSet returns whether the host supports the given setting for the cgroup,
+// and a human readable reason if it doesn't. Settings are named after the
+// fields of specs.LinuxResources, e.g. "memory.swap" or "cpu.quota". It's
+// meant as a pre-flight check, so that unsatisfiable specs can be rejected
+// before Install is called.
+//
+// The controller must be available and the setting's file must be present. If
+// the cgroup doesn't exist yet, its closest existing ancestor is checked
+// instead. The cgroup v2 root has no controller files, in which case only the
+// controller availability is checked.
+func (c *Cgroup) CanSet(name string) (bool, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	k, ok := knobs[name]
+	if !ok {
+		return false, fmt.Sprintf("unknown setting %q", name)
+	}
+	h := getHierarchies()
+	ctrl := k.ctrl
+	v2 := h.isV2(ctrl)
+	if k.ctrl2 != "" && h.isV2(k.ctrl2) {
+		ctrl, v2 = k.ctrl2, true
+	}
+	file, reason, root := k.file, k.reason, h.unified
+	if v2 {
+		if k.file2 == "" {
+			return false, k.reason2
+		}
+		file, reason = k.file2, k.reason2
+	} else {
+		mount, ok := h.v1[k.ctrl]
+		if !ok {
+			return false, fmt.Sprintf("%s controller is not mounted", k.ctrl)
+		}
+		root = mount
+	}
+
+	path := c.makePath(ctrl)
+	for path != root && path != filepath.Dir(path) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	if v2 {
+		avail, err := getValue(path, "cgroup.controllers")
+		if err != nil {
+			return false, fmt.Sprintf("reading available controllers: %v", err)
+		}
+		if !containsField(avail, ctrl) {
+			return false, fmt.Sprintf("%s controller is not available in %q", ctrl, path)
+		}
+		if path == root {
+			return true, ""
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, file)); err != nil {
+		if !os.IsNotExist(err) {
+			return false, err.Error()
+		}
+		if reason == "" {
+			return false, fmt.Sprintf("%s not found in %q", file, path)
+		}
+		return false, fmt.Sprintf("%s not found in %q: %s", file, path, reason)
+	}
+	return true, ""
+}
+
+// containsField returns true if 'field' is one of the whitespace separated
+// fields of 's'.
+func containsField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanSet(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		cgroup  string
+		files   map[string]string
+		knob    string
+		want    bool
+		reason  string
+	}{
+		{
+			name:   "v1 memory limit",
+			cgroup: "test",
+			files:  map[string]string{"memory/test/memory.limit_in_bytes": "0"},
+			knob:   "memory.limit",
+			want:   true,
+		},
+		{
+			name:   "v1 swap accounting disabled",
+			cgroup: "test",
+			files:  map[string]string{"memory/test/memory.limit_in_bytes": "0"},
+			knob:   "memory.swap",
+			reason: "swapaccount=1",
+		},
+		{
+			name:   "v1 kernel memory",
+			cgroup: "test",
+			files:  map[string]string{"memory/test/memory.kmem.limit_in_bytes": "0"},
+			knob:   "memory.kernel",
+			want:   true,
+		},
+		{
+			name:   "v1 missing cgroup checks ancestor",
+			cgroup: "parent/missing",
+			files:  map[string]string{"cpu/cpu.rt_runtime_us": "0"},
+			knob:   "cpu.realtimeRuntime",
+			want:   true,
+		},
+		{
+			name:   "unknown",
+			cgroup: "test",
+			knob:   "memory.bogus",
+			reason: "unknown setting",
+		},
+		{
+			name:    "v2 swap",
+			unified: true,
+			cgroup:  "test",
+			files: map[string]string{
+				"test/cgroup.controllers": "cpu memory pids",
+				"test/memory.swap.max":    "max",
+			},
+			knob: "memory.swap",
+			want: true,
+		},
+		{
+			name:    "v2 kernel memory",
+			unified: true,
+			cgroup:  "test",
+			files:   map[string]string{"test/cgroup.controllers": "cpu memory pids"},
+			knob:    "memory.kernel",
+			reason:  "memory.max",
+		},
+		{
+			name:    "v2 controller not available",
+			unified: true,
+			cgroup:  "test",
+			files: map[string]string{
+				"test/cgroup.controllers": "cpu memory",
+				"test/pids.max":           "max",
+			},
+			knob:   "pids.limit",
+			reason: "pids controller is not available",
+		},
+		{
+			name:    "v2 io weight",
+			unified: true,
+			cgroup:  "test",
+			files: map[string]string{
+				"test/cgroup.controllers": "cpu io memory",
+				"test/io.weight":          "default 100",
+			},
+			knob: "blockIO.weight",
+			want: true,
+		},
+		{
+			name:    "v2 io controller not available",
+			unified: true,
+			cgroup:  "test",
+			files:   map[string]string{"test/cgroup.controllers": "cpu memory"},
+			knob:    "blockIO.weight",
+			reason:  "io controller is not available",
+		},
+		{
+			name:    "v2 root only checks controllers",
+			unified: true,
+			cgroup:  "missing",
+			knob:    "cpu.quota",
+			want:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := &Cgroup{Name: tc.cgroup}
+			got, reason := c.CanSet(tc.knob)
+			if got != tc.want {
+				t.Errorf("CanSet(%q) got: %t, %q, want: %t", tc.knob, got, reason, tc.want)
+			}
+			if got && reason != "" {
+				t.Errorf("CanSet(%q) got reason %q for a supported setting", tc.knob, reason)
+			}
+			if !strings.Contains(reason, tc.reason) {
+				t.Errorf("CanSet(%q) got reason: %q, want it to contain: %q", tc.knob, reason, tc.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// maxMoveRounds bounds the number of times MoveTasks rescans a cgroup for
+// tasks that were forked while the previous ones were being moved.
+const maxMoveRounds = 100
+
+// MoveTasks moves all processes in the cgroup to 'dst', in every controller.
+// Processes forked while others are being moved are picked up by rescanning
+// 'cgroup.procs' until it's empty, at most maxMoveRounds times. Processes that
+// exit in the meantime are skipped.
+func (c *Cgroup) MoveTasks(dst *Cgroup) error {
+	if c == dst {
+		return fmt.Errorf("moving tasks of cgroup %q to itself", c.Name)
+	}
+	h := getHierarchies()
+	dstPaths := make(map[string]string)
+	dst.mu.RLock()
+	for key, ctrl := range h.controllers() {
+		if !skipController(key, ctrl) {
+			dstPaths[key] = dst.makePath(key)
+		}
+	}
+	dst.mu.RUnlock()
+	keys := make([]string, 0, len(dstPaths))
+	for key := range dstPaths {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Co-mounted controllers share directories, which are moved once.
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		src := c.makePath(key)
+		if seen[src] {
+			continue
+		}
+		seen[src] = true
+		if err := moveProcs(src, dstPaths[key]); err != nil {
+			return fmt.Errorf("moving tasks from %q to %q: %w", src, dstPaths[key], err)
+		}
+	}
+	return nil
+}
+
+// moveProcs moves all processes in the cgroup directory 'src' to 'dst', as
+// described in MoveTasks. It's not an error if 'src' doesn't exist.
+func moveProcs(src, dst string) error {
+	for i := 0; i < maxMoveRounds; i++ {
+		var pids []int
+		if err := forEachPID(src, func(pid int) bool {
+			pids = append(pids, pid)
+			return true
+		}); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			if err := setValue(dst, "cgroup.procs", strconv.Itoa(pid)); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return fmt.Errorf("moving pid %d: %w", pid, err)
+			}
+		}
+	}
+	return fmt.Errorf("tasks still being created after %d rounds", maxMoveRounds)
+}
+
+// Migrate moves the sandbox in cgroup 'old' to a new cgroup named 'newPath',
+// e.g. to re-parent it when its QoS class changes. cgroupfs doesn't support
+// renaming cgroups, so the new cgroup is installed with 'res', all tasks are
+// moved to it with MoveTasks, and 'old' is uninstalled, which retries while
+// it's busy. 'newPath' is relative to the same parents as 'old', like Name.
+//
+// If the tasks can't be moved, the ones already moved are moved back and the
+// new cgroup is uninstalled. If 'old' can't be removed once the tasks are
+// moved, the new cgroup is returned along with the error, since the sandbox
+// now runs in it.
+func Migrate(old *Cgroup, newPath string, res *specs.LinuxResources) (*Cgroup, error) {
+	old.mu.RLock()
+	name := old.Name
+	c := &Cgroup{Name: newPath}
+	if old.Parents != nil {
+		c.Parents = make(map[string]string, len(old.Parents))
+		for key, parent := range old.Parents {
+			c.Parents[key] = parent
+		}
+	}
+	old.mu.RUnlock()
+	if newPath == name {
+		return nil, fmt.Errorf("migrating cgroup %q to itself", name)
+	}
+
+	if err := c.Install(res); err != nil {
+		return nil, fmt.Errorf("installing cgroup %q: %w", newPath, err)
+	}
+	if err := old.MoveTasks(c); err != nil {
+		if err := c.MoveTasks(old); err != nil {
+			logger().Warningf("Moving tasks back to cgroup %q: %v", name, err)
+		}
+		if err := c.Uninstall(); err != nil {
+			logger().Warningf("Removing cgroup %q: %v", newPath, err)
+		}
+		return nil, fmt.Errorf("migrating cgroup %q to %q: %w", name, newPath, err)
+	}
+	if err := old.Uninstall(); err != nil {
+		return c, fmt.Errorf("removing cgroup %q after migrating to %q: %w", name, newPath, err)
+	}
+	return c, nil
+}
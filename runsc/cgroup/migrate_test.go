@@ -0,0 +1,184 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeProcs emulates the kernel moving processes between the cgroups in
+// 'root': writing a pid to 'cgroup.procs' removes it from all other cgroups.
+// 'onMove' is called before a pid is added to its new cgroup. If it returns an
+// error, the pid is not added and the error is returned to the writer.
+func fakeProcs(t *testing.T, root string, onMove func(pid int, dst string) error) func() {
+	oldWrite, oldRmdir := writeFile, rmdir
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if filepath.Base(path) != "cgroup.procs" {
+			return oldWrite(path, data, perm)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		if err := onMove(pid, filepath.Dir(path)); err != nil {
+			return &os.PathError{Op: "write", Path: path, Err: err}
+		}
+		if err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.Name() != "cgroup.procs" {
+				return err
+			}
+			pids := readPids(t, p)
+			for i, other := range pids {
+				if other == pid {
+					pids = append(pids[:i], pids[i+1:]...)
+					break
+				}
+			}
+			return writePids(t, p, pids)
+		}); err != nil {
+			return err
+		}
+		return writePids(t, path, append(readPids(t, path), pid))
+	}
+	// Directories are not empty with the fake kernel.
+	rmdir = os.RemoveAll
+	return func() {
+		writeFile, rmdir = oldWrite, oldRmdir
+	}
+}
+
+func readPids(t *testing.T, path string) []int {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): %v", err)
+	}
+	var pids []int
+	for _, s := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			t.Fatalf("invalid pid %q in %q", s, path)
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func writePids(t *testing.T, path string, pids []int) error {
+	t.Helper()
+	var lines []string
+	for _, pid := range pids {
+		lines = append(lines, strconv.Itoa(pid)+"\n")
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+}
+
+func TestMigrate(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	old := &Cgroup{Name: "burstable/sandbox"}
+	if err := old.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	oldProcs := filepath.Join(root, "burstable", "sandbox", "cgroup.procs")
+	if err := writePids(t, oldProcs, []int{100, 102}); err != nil {
+		t.Fatalf("writePids(): %v", err)
+	}
+
+	// 100 forks 101 while it's being moved, and 102 exits before it's moved.
+	forked := false
+	defer fakeProcs(t, root, func(pid int, dst string) error {
+		switch {
+		case pid == 100 && !forked:
+			forked = true
+			return writePids(t, oldProcs, append(readPids(t, oldProcs), 101))
+		case pid == 102:
+			pids := readPids(t, oldProcs)
+			for i, other := range pids {
+				if other == pid {
+					pids = append(pids[:i], pids[i+1:]...)
+				}
+			}
+			if err := writePids(t, oldProcs, pids); err != nil {
+				return err
+			}
+			return syscall.ESRCH
+		}
+		return nil
+	})()
+
+	res := &specs.LinuxResources{Pids: &specs.LinuxPids{Limit: 50}}
+	c, err := Migrate(old, "guaranteed/sandbox", res)
+	if err != nil {
+		t.Fatalf("Migrate(): %v", err)
+	}
+	if c.Name != "guaranteed/sandbox" || !c.Own {
+		t.Errorf("Migrate() got: %+v, want an owned cgroup named %q", c, "guaranteed/sandbox")
+	}
+	if got, want := readPids(t, filepath.Join(root, "guaranteed", "sandbox", "cgroup.procs")), []int{100, 101}; !reflect.DeepEqual(got, want) {
+		t.Errorf("new cgroup got pids: %v, want: %v", got, want)
+	}
+	if got := readFile(t, root, "guaranteed/sandbox/pids.max"); got != "50" {
+		t.Errorf("pids.max got: %q, want: %q", got, "50")
+	}
+	if _, err := os.Stat(filepath.Dir(oldProcs)); !os.IsNotExist(err) {
+		t.Errorf("old cgroup was not removed, stat: %v", err)
+	}
+}
+
+func TestMigrateMoveFailure(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	old := &Cgroup{Name: "sandbox"}
+	if err := old.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	oldProcs := filepath.Join(root, "sandbox", "cgroup.procs")
+	if err := writePids(t, oldProcs, []int{100, 101}); err != nil {
+		t.Fatalf("writePids(): %v", err)
+	}
+
+	newDir := filepath.Join(root, "new")
+	defer fakeProcs(t, root, func(pid int, dst string) error {
+		if pid == 101 && dst == newDir {
+			return syscall.EACCES
+		}
+		return nil
+	})()
+
+	if _, err := Migrate(old, "new", nil); err == nil {
+		t.Fatalf("Migrate() should have failed")
+	}
+	if got, want := readPids(t, oldProcs), []int{101, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("old cgroup got pids: %v, want: %v", got, want)
+	}
+	if _, err := os.Stat(newDir); !os.IsNotExist(err) {
+		t.Errorf("new cgroup was not removed, stat: %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Traffic classified by net_cls is counted with an iptables rule in the
+// OUTPUT chain of the mangle table, which matches the cgroup's classid and
+// has no target, so packets continue unaffected. The host needs:
+//
+//   - the iptables binary in PATH, and running as root.
+//   - the xt_cgroup match, CONFIG_NETFILTER_XT_MATCH_CGROUP, and the
+//     xt_comment match, CONFIG_NETFILTER_XT_MATCH_COMMENT.
+//   - the net_cls controller mounted as a cgroup v1 hierarchy.
+//
+// Only traffic sent through host sockets is classified, i.e. when the sandbox
+// uses host networking. With netstack, packets are written to the host as raw
+// frames, which skip the host's OUTPUT chain. Like all iptables counters, the
+// rule only counts egress packets after it's added.
+//
+// With tc, the same classid can be matched by a cgroup filter, e.g.
+// 'tc filter add dev eth0 parent 1: handle 1: cgroup', whose class counters are
+// read with 'tc -s class show dev eth0'. It needs a classful qdisc on every
+// device, so it's not set up here.
+
+const (
+	// netClassTable and netClassChain are where the accounting rules are.
+	netClassTable = "mangle"
+	netClassChain = "OUTPUT"
+)
+
+// runIptables runs iptables with 'args', waiting for the xtables lock. It's a
+// variable so that tests can fake iptables.
+var runIptables = func(args ...string) ([]byte, error) {
+	return exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+}
+
+// NetClassStats are the packets and bytes sent by the processes of a net_cls
+// cgroup, as counted by its accounting rule.
+type NetClassStats struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// AddNetClassAccounting adds the iptables rule that counts the traffic
+// classified with the cgroup's 'net_cls.classid'. It does nothing if the rule
+// already exists. Returns ErrNotSupported if the host lacks the prerequisites
+// documented above.
+func (c *Cgroup) AddNetClassAccounting() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, err := c.netClassID()
+	if err != nil {
+		return err
+	}
+	if ok, err := hasNetClassRule(id); err != nil || ok {
+		return err
+	}
+	return iptables(netClassRule("-A", id)...)
+}
+
+// RemoveNetClassAccounting removes the rule added by AddNetClassAccounting, if
+// any. It's not removed with the cgroup, so it must be called before
+// Uninstall, while the classid can still be read.
+func (c *Cgroup) RemoveNetClassAccounting() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, err := c.netClassID()
+	if err != nil {
+		return err
+	}
+	if ok, err := hasNetClassRule(id); err != nil || !ok {
+		return err
+	}
+	return iptables(netClassRule("-D", id)...)
+}
+
+// NetClassStats returns the traffic counted by the cgroup's accounting rule.
+// Returns ErrNotSupported if the rule doesn't exist, see
+// AddNetClassAccounting.
+func (c *Cgroup) NetClassStats() (NetClassStats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, err := c.netClassID()
+	if err != nil {
+		return NetClassStats{}, err
+	}
+	args := []string{"-t", netClassTable, "-L", netClassChain, "-v", "-x", "-n"}
+	out, err := runIptables(args...)
+	if err != nil {
+		return NetClassStats{}, iptablesError(args, out, err)
+	}
+	return parseNetClassStats(out, netClassComment(id))
+}
+
+// netClassID returns the cgroup's classid, which must be set.
+func (c *Cgroup) netClassID() (uint32, error) {
+	if isV2("net_cls") {
+		return 0, fmt.Errorf("net_cls.classid: %w: %s", ErrNotSupported, knobs["network.classID"].reason2)
+	}
+	id, err := getUint(c.makePath("net_cls"), "net_cls.classid")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("net_cls.classid: %w", ErrNotSupported)
+		}
+		return 0, err
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("net_cls.classid is not set")
+	}
+	return uint32(id), nil
+}
+
+// netClassComment identifies the accounting rule of the classid.
+func netClassComment(id uint32) string {
+	return fmt.Sprintf("runsc-net_cls-%#x", id)
+}
+
+// netClassRule returns the iptables arguments to apply 'op', e.g. "-A", to the
+// accounting rule of the classid.
+func netClassRule(op string, id uint32) []string {
+	return []string{
+		"-t", netClassTable, op, netClassChain,
+		"-m", "cgroup", "--cgroup", strconv.FormatUint(uint64(id), 10),
+		"-m", "comment", "--comment", netClassComment(id),
+	}
+}
+
+// hasNetClassRule returns true if the accounting rule of the classid exists.
+func hasNetClassRule(id uint32) (bool, error) {
+	args := netClassRule("-C", id)
+	out, err := runIptables(args...)
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	// iptables exits with 1 if the rule doesn't exist, after checking that
+	// the matches are supported.
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && !unsupportedMatch(out) {
+		return false, nil
+	}
+	return false, iptablesError(args, out, err)
+}
+
+// iptables runs iptables with 'args' and converts failures with iptablesError.
+func iptables(args ...string) error {
+	if out, err := runIptables(args...); err != nil {
+		return iptablesError(args, out, err)
+	}
+	return nil
+}
+
+// iptablesError returns the error of an iptables invocation, wrapping
+// ErrNotSupported if iptables or the matches it needs are missing.
+func iptablesError(args []string, out []byte, err error) error {
+	if errors.Is(err, exec.ErrNotFound) || unsupportedMatch(out) {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), ErrNotSupported, bytes.TrimSpace(out))
+	}
+	return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+}
+
+// unsupportedMatch returns true if the iptables output reports that a match
+// or table isn't available in the kernel.
+func unsupportedMatch(out []byte) bool {
+	for _, msg := range []string{"Couldn't load match", "No chain/target/match by that name", "can't initialize iptables table"} {
+		if bytes.Contains(out, []byte(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetClassStats sums the counters of the rules with 'comment' in the
+// output of 'iptables -L -v -x -n', whose rule lines start with the packet and
+// byte counters, e.g.:
+//
+//	Chain OUTPUT (policy ACCEPT 10 packets, 1000 bytes)
+//	    pkts      bytes target     prot opt in     out     source               destination
+//	       2      168            all  --  *      *       0.0.0.0/0            0.0.0.0/0            cgroup 1048577 /* runsc-net_cls-0x100001 */
+func parseNetClassStats(out []byte, comment string) (NetClassStats, error) {
+	var stats NetClassStats
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "/* "+comment+" */") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return NetClassStats{}, fmt.Errorf("invalid iptables rule: %q", line)
+		}
+		pkts, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return NetClassStats{}, fmt.Errorf("invalid iptables rule: %q: %v", line, err)
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return NetClassStats{}, fmt.Errorf("invalid iptables rule: %q: %v", line, err)
+		}
+		stats.Packets += pkts
+		stats.Bytes += n
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return NetClassStats{}, err
+	}
+	if !found {
+		return NetClassStats{}, fmt.Errorf("no accounting rule %q: %w", comment, ErrNotSupported)
+	}
+	return stats, nil
+}
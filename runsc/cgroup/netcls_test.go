@@ -0,0 +1,192 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeIptables replaces runIptables with a fake that keeps the rules added and
+// deleted, and reports 'list' as the output of 'iptables -L'. It returns a
+// pointer to the invocations, and a function that restores runIptables.
+func fakeIptables(t *testing.T, list string) (*[]string, func()) {
+	t.Helper()
+	// hasNetClassRule needs a real exit status.
+	notFound := exec.Command("sh", "-c", "exit 1").Run()
+	if notFound == nil {
+		t.Fatalf("'exit 1' succeeded")
+	}
+	oldRun := runIptables
+	var calls []string
+	rules := make(map[string]bool)
+	runIptables = func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		rule := strings.Join(args[3:], " ")
+		switch args[2] {
+		case "-A":
+			rules[rule] = true
+		case "-D":
+			delete(rules, rule)
+		case "-C":
+			if !rules[rule] {
+				return []byte("iptables: Bad rule (does a matching rule exist in that chain?).\n"), notFound
+			}
+		case "-L":
+			return []byte(list), nil
+		}
+		return nil, nil
+	}
+	return &calls, func() { runIptables = oldRun }
+}
+
+func TestNetClassAccounting(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{"net_cls/test/net_cls.classid": "1048577\n"})
+
+	const list = `Chain OUTPUT (policy ACCEPT 10 packets, 1000 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+       2      168            all  --  *      *       0.0.0.0/0            0.0.0.0/0            cgroup 1048577 /* runsc-net_cls-0x100001 */
+       5      500            all  --  *      *       0.0.0.0/0            0.0.0.0/0            cgroup 2 /* runsc-net_cls-0x2 */
+`
+	calls, restore := fakeIptables(t, list)
+	defer restore()
+
+	c := &Cgroup{Name: "test"}
+	for i := 0; i < 2; i++ {
+		if err := c.AddNetClassAccounting(); err != nil {
+			t.Fatalf("AddNetClassAccounting(): %v", err)
+		}
+	}
+	const rule = "OUTPUT -m cgroup --cgroup 1048577 -m comment --comment runsc-net_cls-0x100001"
+	want := []string{
+		"-t mangle -C " + rule,
+		"-t mangle -A " + rule,
+		"-t mangle -C " + rule,
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("AddNetClassAccounting() twice got: %q, want: %q", *calls, want)
+	}
+
+	stats, err := c.NetClassStats()
+	if err != nil {
+		t.Fatalf("NetClassStats(): %v", err)
+	}
+	if want := (NetClassStats{Packets: 2, Bytes: 168}); stats != want {
+		t.Errorf("NetClassStats() got: %+v, want: %+v", stats, want)
+	}
+
+	*calls = nil
+	for i := 0; i < 2; i++ {
+		if err := c.RemoveNetClassAccounting(); err != nil {
+			t.Fatalf("RemoveNetClassAccounting(): %v", err)
+		}
+	}
+	want = []string{
+		"-t mangle -C " + rule,
+		"-t mangle -D " + rule,
+		"-t mangle -C " + rule,
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("RemoveNetClassAccounting() twice got: %q, want: %q", *calls, want)
+	}
+}
+
+func TestNetClassNotSupported(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		classID string
+		out     string
+		err     error
+	}{
+		{
+			name:    "cgroup v2",
+			unified: true,
+		},
+		{
+			name: "no net_cls",
+		},
+		{
+			name:    "no iptables",
+			classID: "1",
+			err:     exec.ErrNotFound,
+		},
+		{
+			name:    "no cgroup match",
+			classID: "1",
+			out:     "iptables v1.8.4 (legacy): Couldn't load match `cgroup':No such file or directory\n",
+			err:     errors.New("exit status 2"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			if tc.classID != "" {
+				writeFiles(t, root, map[string]string{"net_cls/test/net_cls.classid": tc.classID})
+			}
+			oldRun := runIptables
+			defer func() { runIptables = oldRun }()
+			runIptables = func(...string) ([]byte, error) {
+				return []byte(tc.out), tc.err
+			}
+
+			c := &Cgroup{Name: "test"}
+			if err := c.AddNetClassAccounting(); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("AddNetClassAccounting() got: %v, want: %v", err, ErrNotSupported)
+			}
+			if _, err := c.NetClassStats(); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("NetClassStats() got: %v, want: %v", err, ErrNotSupported)
+			}
+		})
+	}
+}
+
+func TestNetClassUnset(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{"net_cls/test/net_cls.classid": "0\n"})
+
+	c := &Cgroup{Name: "test"}
+	if err := c.AddNetClassAccounting(); err == nil || errors.Is(err, ErrNotSupported) {
+		t.Errorf("AddNetClassAccounting() without classid got: %v, want error", err)
+	}
+}
+
+func TestParseNetClassStats(t *testing.T) {
+	// Counters of rules with the same comment are summed.
+	out := []byte(`Chain OUTPUT (policy ACCEPT 0 packets, 0 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+       1      100            all  --  *      *       0.0.0.0/0            0.0.0.0/0            cgroup 3 /* runsc-net_cls-0x3 */
+       2      200            all  --  *      *       0.0.0.0/0            0.0.0.0/0            cgroup 3 /* runsc-net_cls-0x3 */
+`)
+	got, err := parseNetClassStats(out, "runsc-net_cls-0x3")
+	if err != nil {
+		t.Fatalf("parseNetClassStats(): %v", err)
+	}
+	if want := (NetClassStats{Packets: 3, Bytes: 300}); got != want {
+		t.Errorf("parseNetClassStats() got: %+v, want: %+v", got, want)
+	}
+	if _, err := parseNetClassStats(out, "runsc-net_cls-0x4"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("parseNetClassStats() without rule got: %v, want: %v", err, ErrNotSupported)
+	}
+	if _, err := parseNetClassStats([]byte("x y /* c */\n"), "c"); err == nil {
+		t.Errorf("parseNetClassStats() with invalid counters succeeded")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Range of values accepted by /proc/[pid]/oom_score_adj.
+const (
+	minOOMScoreAdj = -1000
+	maxOOMScoreAdj = 1000
+)
+
+// OOMGroup returns the value of 'memory.oom.group'. Requires cgroup v2.
+func (c *Cgroup) OOMGroup() (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("memory") {
+		return false, fmt.Errorf("memory.oom.group: %w", ErrNotSupported)
+	}
+	val, err := getInt(c.makePath("memory"), "memory.oom.group")
+	if err != nil {
+		return false, err
+	}
+	return val != 0, nil
+}
+
+// SetOOMGroup sets 'memory.oom.group'. When set, the OOM killer treats the
+// cgroup as a single unit: if it selects a task in the cgroup, all tasks in it
+// are killed together, instead of leaving the sandbox partially alive.
+// Requires cgroup v2.
+//
+// Cgroups have no knob to bias which cgroup the OOM killer selects, that is
+// done per process with SetOOMScoreAdj.
+func (c *Cgroup) SetOOMGroup(group bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isV2("memory") {
+		return fmt.Errorf("memory.oom.group: %w", ErrNotSupported)
+	}
+	val := "0"
+	if group {
+		val = "1"
+	}
+	return setValue(c.makePath("memory"), "memory.oom.group", val)
+}
+
+// MemoryEvents contains the counters of memory events, as reported by
+// 'memory.events' and 'memory.events.local'.
+type MemoryEvents struct {
+	// Low is the number of times the cgroup was reclaimed below its low
+	// boundary, i.e. memory.low.
+	Low uint64 `json:"low"`
+
+	// High is the number of times the cgroup was throttled because it went
+	// over memory.high.
+	High uint64 `json:"high"`
+
+	// Max is the number of times the cgroup was about to go over memory.max.
+	Max uint64 `json:"max"`
+
+	// OOM is the number of times the cgroup reached memory.max and
+	// allocations failed.
+	OOM uint64 `json:"oom"`
+
+	// OOMKill is the number of processes killed by the OOM killer.
+	OOMKill uint64 `json:"oomKill"`
+}
+
+// MemoryEventsLocal returns the memory events of the cgroup itself, excluding
+// its descendants, from 'memory.events.local'. When the kernel doesn't provide
+// it (before Linux 5.2), 'memory.events' is used instead, which includes the
+// events of descendants. Requires cgroup v2.
+func (c *Cgroup) MemoryEventsLocal() (*MemoryEvents, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !isV2("memory") {
+		return nil, fmt.Errorf("memory.events.local: %w", ErrNotSupported)
+	}
+	path := c.makePath("memory")
+	val, err := getValue(path, "memory.events.local")
+	if os.IsNotExist(err) {
+		logger().Debugf("memory.events.local not found in %q, falling back to memory.events", path)
+		val, err = getValue(path, "memory.events")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseMemoryEvents(val)
+}
+
+// parseMemoryEvents parses the content of 'memory.events'. Unknown events are
+// ignored.
+func parseMemoryEvents(s string) (*MemoryEvents, error) {
+	vals, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryEvents{
+		Low:     vals["low"],
+		High:    vals["high"],
+		Max:     vals["max"],
+		OOM:     vals["oom"],
+		OOMKill: vals["oom_kill"],
+	}, nil
+}
+
+// MemoryFailcnt returns the number of times the cgroup's memory usage hit its
+// limit, from 'memory.failcnt' with cgroup v1. With cgroup v2, the "max" event
+// from 'memory.events' is used, which counts the same condition. A count that
+// keeps rising without OOM kills means the cgroup is under reclaim pressure.
+func (c *Cgroup) MemoryFailcnt() (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.failcnt("memory.failcnt", "memory.events")
+}
+
+// SwapFailcnt returns the number of times the cgroup's memory+swap usage hit
+// its limit, from 'memory.memsw.failcnt' with cgroup v1. With cgroup v2, the
+// "max" event from 'memory.swap.events' is used, which counts the times swap
+// usage hit 'memory.swap.max'. Returns ErrNotSupported if swap accounting is
+// disabled.
+func (c *Cgroup) SwapFailcnt() (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.failcnt("memory.memsw.failcnt", "memory.swap.events")
+}
+
+// failcnt reads the cgroup v1 counter 'name1', or the "max" event from the
+// cgroup v2 events file 'name2'.
+func (c *Cgroup) failcnt(name1, name2 string) (uint64, error) {
+	path := c.makePath("memory")
+	if !isV2("memory") {
+		val, err := getUint(path, name1)
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%s: %w", name1, ErrNotSupported)
+		}
+		return val, err
+	}
+	events, err := getKeyValues(path, name2)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%s: %w", name2, ErrNotSupported)
+		}
+		return 0, err
+	}
+	max, ok := events["max"]
+	if !ok {
+		return 0, fmt.Errorf("%s max: %w", name2, ErrNotSupported)
+	}
+	return max, nil
+}
+
+// SetOOMScoreAdj sets /proc/[pid]/oom_score_adj, which biases the OOM killer
+// for or against the process, from -1000 (never killed) to 1000 (killed
+// first). This is not a cgroup setting: it only applies to the given process
+// and is inherited by children that it creates afterwards, so it's meant to be
+// called on the sandbox process before it starts other processes.
+//
+// Lowering the value below the one set at startup requires CAP_SYS_RESOURCE.
+func SetOOMScoreAdj(pid, adj int) error {
+	if adj < minOOMScoreAdj || adj > maxOOMScoreAdj {
+		return fmt.Errorf("invalid oom_score_adj %d, must be in the range [%d, %d]", adj, minOOMScoreAdj, maxOOMScoreAdj)
+	}
+	path := filepath.Join(procRoot, strconv.Itoa(pid))
+	if err := setValue(path, "oom_score_adj", strconv.Itoa(adj)); err != nil {
+		return fmt.Errorf("setting oom_score_adj of PID %d: %v", pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestSetOOMScoreAdj(t *testing.T) {
+	cmd := exec.Command("sleep", "1000")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting sleep: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// Raising the value doesn't require privileges.
+	const want = 500
+	if err := SetOOMScoreAdj(cmd.Process.Pid, want); err != nil {
+		t.Fatalf("SetOOMScoreAdj(%d): %v", want, err)
+	}
+	if got := readFile(t, "/proc", fmt.Sprintf("%d/oom_score_adj", cmd.Process.Pid)); got != "500" {
+		t.Errorf("oom_score_adj got: %q, want: %q", got, "500")
+	}
+	for _, invalid := range []int{-1001, 1001} {
+		if err := SetOOMScoreAdj(cmd.Process.Pid, invalid); err == nil {
+			t.Errorf("SetOOMScoreAdj(%d) should have failed", invalid)
+		}
+	}
+}
+
+func TestOOMGroup(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{"test/memory.oom.group": "0\n"})
+
+	c := Cgroup{Name: "test"}
+	if err := c.SetOOMGroup(true); err != nil {
+		t.Fatalf("SetOOMGroup(true): %v", err)
+	}
+	if got, err := c.OOMGroup(); err != nil || !got {
+		t.Errorf("OOMGroup() got: %t, %v, want: true, nil", got, err)
+	}
+}
+
+func TestOOMGroupV1(t *testing.T) {
+	_, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	c := Cgroup{Name: "test"}
+	if err := c.SetOOMGroup(true); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SetOOMGroup() got: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func TestParseMemoryEvents(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      string
+		want    MemoryEvents
+		wantErr bool
+	}{
+		{
+			name: "all",
+			in:   "low 1\nhigh 2\nmax 3\noom 4\noom_kill 5\n",
+			want: MemoryEvents{Low: 1, High: 2, Max: 3, OOM: 4, OOMKill: 5},
+		},
+		{
+			// oom_group_kill was added in Linux 5.17.
+			name: "unknown",
+			in:   "low 0\nhigh 0\nmax 7\noom 1\noom_kill 1\noom_group_kill 1\n",
+			want: MemoryEvents{Max: 7, OOM: 1, OOMKill: 1},
+		},
+		{
+			name: "empty",
+		},
+		{
+			name:    "invalid",
+			in:      "oom_kill abc\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMemoryEvents(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parseMemoryEvents(%q) should have failed", tc.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMemoryEvents(%q): %v", tc.in, err)
+			}
+			if *got != tc.want {
+				t.Errorf("parseMemoryEvents(%q) got: %+v, want: %+v", tc.in, *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryEventsLocal(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"local/memory.events":       "oom 2\noom_kill 2\n",
+		"local/memory.events.local": "oom 1\noom_kill 1\n",
+		"old/memory.events":         "oom 2\noom_kill 2\n",
+	})
+
+	for _, tc := range []struct {
+		name string
+		want MemoryEvents
+	}{
+		{name: "local", want: MemoryEvents{OOM: 1, OOMKill: 1}},
+		{name: "old", want: MemoryEvents{OOM: 2, OOMKill: 2}},
+	} {
+		c := Cgroup{Name: tc.name}
+		got, err := c.MemoryEventsLocal()
+		if err != nil {
+			t.Fatalf("MemoryEventsLocal(%q): %v", tc.name, err)
+		}
+		if *got != tc.want {
+			t.Errorf("MemoryEventsLocal(%q) got: %+v, want: %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestFailcnt(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+		memory  uint64
+		swap    uint64
+		noSwap  bool
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/test/memory.failcnt":       "12\n",
+				"memory/test/memory.memsw.failcnt": "3\n",
+			},
+			memory: 12,
+			swap:   3,
+		},
+		{
+			name:   "v1 without swap accounting",
+			files:  map[string]string{"memory/test/memory.failcnt": "12\n"},
+			memory: 12,
+			noSwap: true,
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/memory.events":      "low 0\nhigh 0\nmax 7\noom 0\noom_kill 0\n",
+				"test/memory.swap.events": "high 0\nmax 2\nfail 1\n",
+			},
+			memory: 7,
+			swap:   2,
+		},
+		{
+			name:    "v2 without swap accounting",
+			unified: true,
+			files:   map[string]string{"test/memory.events": "low 0\nhigh 0\nmax 7\noom 0\noom_kill 0\n"},
+			memory:  7,
+			noSwap:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := &Cgroup{Name: "test"}
+			if got, err := c.MemoryFailcnt(); err != nil || got != tc.memory {
+				t.Errorf("MemoryFailcnt() got: %d, %v, want: %d, nil", got, err, tc.memory)
+			}
+			got, err := c.SwapFailcnt()
+			if tc.noSwap {
+				if !errors.Is(err, ErrNotSupported) {
+					t.Errorf("SwapFailcnt() got: %d, %v, want: %v", got, err, ErrNotSupported)
+				}
+				return
+			}
+			if err != nil || got != tc.swap {
+				t.Errorf("SwapFailcnt() got: %d, %v, want: %d, nil", got, err, tc.swap)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// WatchPressure registers a PSI trigger on the '<resource>.pressure' file of
+// the cgroup, e.g. "memory.pressure", and returns a channel that receives a
+// value every time the threshold is crossed. 'spec' has the format described
+// in the kernel's Documentation/accounting/psi.rst, i.e. "<some|full>
+// <threshold us> <window us>", e.g. "some 150000 1000000" for 150ms of stall
+// within a 1s window. Notifications within the same window are coalesced.
+// Without CAP_SYS_RESOURCE, recent kernels only accept windows that are
+// multiples of 2s.
+//
+// The trigger is removed and the channel closed when the returned cancel
+// function is called. Requires cgroup v2 and a kernel with PSI enabled,
+// otherwise ErrNotSupported is returned.
+func (c *Cgroup) WatchPressure(resource, spec string) (<-chan struct{}, func(), error) {
+	if !isV2(resource) {
+		return nil, nil, fmt.Errorf("%s.pressure: %w", resource, ErrNotSupported)
+	}
+	if err := validatePressureSpec(spec); err != nil {
+		return nil, nil, err
+	}
+	p, err := getPoller()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.RLock()
+	path := filepath.Join(c.makePath(resource), resource+".pressure")
+	c.mu.RUnlock()
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil, nil, fmt.Errorf("opening %q: %w", path, ErrNotSupported)
+		}
+		return nil, nil, fmt.Errorf("opening %q: %v", path, err)
+	}
+	// The trigger must be NUL terminated, the kernel replaces the last byte
+	// written with it.
+	if _, err := syscall.Write(fd, append([]byte(spec), 0)); err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("writing trigger %q to %q: %v", spec, path, err)
+	}
+	ch, cancel, err := p.add(fd, syscall.EPOLLPRI, false)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("watching %q: %v", path, err)
+	}
+	logger().Debugf("Watching %q with trigger %q", path, spec)
+	return ch, cancel, nil
+}
+
+// validatePressureSpec checks the format of a PSI trigger. Limits on the
+// threshold and window are left to the kernel.
+func validatePressureSpec(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) != 3 || (fields[0] != "some" && fields[0] != "full") {
+		return fmt.Errorf("invalid pressure trigger %q, want: \"<some|full> <threshold us> <window us>\"", spec)
+	}
+	threshold, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid threshold in pressure trigger %q: %v", spec, err)
+	}
+	window, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid window in pressure trigger %q: %v", spec, err)
+	}
+	if threshold == 0 || threshold > window {
+		return fmt.Errorf("invalid pressure trigger %q, threshold must be in the range (0, window]", spec)
+	}
+	return nil
+}
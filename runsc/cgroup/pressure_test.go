@@ -0,0 +1,52 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidatePressureSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "some 150000 1000000"},
+		{spec: "full 1000000 1000000"},
+		{spec: "some 150000", wantErr: true},
+		{spec: "avg10 150000 1000000", wantErr: true},
+		{spec: "some abc 1000000", wantErr: true},
+		{spec: "some 150000 -1", wantErr: true},
+		{spec: "some 0 1000000", wantErr: true},
+		{spec: "full 2000000 1000000", wantErr: true},
+	} {
+		if err := validatePressureSpec(tc.spec); (err != nil) != tc.wantErr {
+			t.Errorf("validatePressureSpec(%q) got: %v, want error: %t", tc.spec, err, tc.wantErr)
+		}
+	}
+}
+
+func TestWatchPressureNotSupported(t *testing.T) {
+	for _, unified := range []bool{false, true} {
+		_, cleanup := setupRoot(t, unified)
+		// With cgroup v2, the pressure file is missing without PSI.
+		c := Cgroup{Name: "test"}
+		if _, _, err := c.WatchPressure("memory", "some 150000 1000000"); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("WatchPressure(unified=%t) got: %v, want: %v", unified, err, ErrNotSupported)
+		}
+		cleanup()
+	}
+}
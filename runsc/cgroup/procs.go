@@ -0,0 +1,155 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// procsBufferSize is the initial size of the buffer used to read
+	// 'cgroup.procs', which holds many lines at once.
+	procsBufferSize = 64 << 10
+
+	// maxProcsLine is the maximum length of a line in 'cgroup.procs'. Lines
+	// are short, but the limit must fit the whole file if it's not
+	// newline-terminated, e.g. as produced by tools writing it by hand.
+	maxProcsLine = 1 << 20
+)
+
+// Tasks returns the pids of all processes in the cgroup, from 'cgroup.procs' in
+// the memory controller (or the cgroup v2 directory). Use ContainsPID to check
+// for a single process, which doesn't need to load all of them.
+func (c *Cgroup) Tasks() ([]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var pids []int
+	err := c.forEachTask(func(pid int) bool {
+		pids = append(pids, pid)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pids, nil
+}
+
+// ContainsPID returns true if the process 'pid' is in the cgroup. It stops
+// reading 'cgroup.procs' as soon as the pid is found.
+func (c *Cgroup) ContainsPID(pid int) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	found := false
+	err := c.forEachTask(func(p int) bool {
+		found = p == pid
+		return !found
+	})
+	return found, err
+}
+
+// ProcessCount returns the number of processes in the cgroup, i.e. distinct
+// thread group IDs in 'cgroup.procs'. See ThreadCount for the number of
+// threads.
+func (c *Cgroup) ProcessCount() (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("memory") {
+		n := 0
+		err := c.forEachTask(func(int) bool {
+			n++
+			return true
+		})
+		return n, err
+	}
+	// cgroup v1 doesn't guarantee that 'cgroup.procs' is free of duplicates.
+	seen := make(map[int]struct{})
+	err := c.forEachTask(func(pid int) bool {
+		seen[pid] = struct{}{}
+		return true
+	})
+	return len(seen), err
+}
+
+// ThreadCount returns the number of threads in the cgroup, from
+// 'cgroup.threads' with cgroup v2 or 'tasks' with cgroup v1. If the file is not
+// available, 'pids.current' is used instead, which also counts threads.
+func (c *Cgroup) ThreadCount() (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name := "tasks"
+	if isV2("memory") {
+		name = "cgroup.threads"
+	}
+	n := 0
+	err := forEachID(c.makePath("memory"), name, func(int) bool {
+		n++
+		return true
+	})
+	if os.IsNotExist(err) {
+		logger().Debugf("%s not found for cgroup %q, falling back to pids.current", name, c.Name)
+		pids, err := getUint(c.makePath("pids"), "pids.current")
+		return int(pids), err
+	}
+	return n, err
+}
+
+// forEachTask streams 'cgroup.procs' and calls 'fn' for each pid, until 'fn'
+// returns false or the file ends.
+func (c *Cgroup) forEachTask(fn func(pid int) bool) error {
+	return forEachPID(c.makePath("memory"), fn)
+}
+
+// forEachPID is like forEachTask, for the cgroup directory 'dir' of any
+// controller.
+func forEachPID(dir string, fn func(pid int) bool) error {
+	return forEachID(dir, "cgroup.procs", fn)
+}
+
+// forEachID streams a file with one pid or tid per line, e.g. 'cgroup.procs'
+// or 'tasks', and calls 'fn' for each one, until 'fn' returns false or the
+// file ends.
+func forEachID(dir, name string, fn func(id int) bool) error {
+	path := filepath.Join(dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, procsBufferSize), maxProcsLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("invalid id %q in %q: %v", line, path, err)
+		}
+		if !fn(id) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %q: %v", path, err)
+	}
+	return nil
+}
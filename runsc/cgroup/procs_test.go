@@ -0,0 +1,163 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeProcs creates a 'cgroup.procs' file for cgroup 'name' in a cgroup v1
+// memory hierarchy with pids from 1 to n.
+func writeProcs(t testing.TB, root, name string, n int) {
+	var b strings.Builder
+	for pid := 1; pid <= n; pid++ {
+		fmt.Fprintf(&b, "%d\n", pid)
+	}
+	writeFiles(t, root, map[string]string{filepath.Join("memory", name, "cgroup.procs"): b.String()})
+}
+
+func TestTasks(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	const n = 100000
+	writeProcs(t, root, "huge", n)
+
+	c := Cgroup{Name: "huge"}
+	pids, err := c.Tasks()
+	if err != nil {
+		t.Fatalf("Tasks(): %v", err)
+	}
+	if len(pids) != n || pids[0] != 1 || pids[n-1] != n {
+		t.Errorf("Tasks() got %d pids, want: %d", len(pids), n)
+	}
+	for _, tc := range []struct {
+		pid  int
+		want bool
+	}{
+		{pid: 1, want: true},
+		{pid: n, want: true},
+		{pid: n + 1, want: false},
+	} {
+		if got, err := c.ContainsPID(tc.pid); err != nil || got != tc.want {
+			t.Errorf("ContainsPID(%d) got: %t, %v, want: %t, nil", tc.pid, got, err, tc.want)
+		}
+	}
+}
+
+func TestTasksEdgeCases(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"memory/empty/cgroup.procs":     "",
+		"memory/nonewline/cgroup.procs": "10\n20",
+		"memory/invalid/cgroup.procs":   "10\nabc\n",
+	})
+
+	c := Cgroup{Name: "empty"}
+	if pids, err := c.Tasks(); err != nil || len(pids) != 0 {
+		t.Errorf("Tasks(empty) got: %v, %v, want: [], nil", pids, err)
+	}
+	if populated, err := c.Populated(); err != nil || populated {
+		t.Errorf("Populated(empty) got: %t, %v, want: false, nil", populated, err)
+	}
+
+	c = Cgroup{Name: "nonewline"}
+	if found, err := c.ContainsPID(20); err != nil || !found {
+		t.Errorf("ContainsPID(20) got: %t, %v, want: true, nil", found, err)
+	}
+	if populated, err := c.Populated(); err != nil || !populated {
+		t.Errorf("Populated(nonewline) got: %t, %v, want: true, nil", populated, err)
+	}
+
+	c = Cgroup{Name: "invalid"}
+	if _, err := c.Tasks(); err == nil {
+		t.Errorf("Tasks(invalid) should have failed")
+	}
+	// The invalid line is never reached.
+	if found, err := c.ContainsPID(10); err != nil || !found {
+		t.Errorf("ContainsPID(10) got: %t, %v, want: true, nil", found, err)
+	}
+}
+
+func TestProcessThreadCount(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		unified   bool
+		files     map[string]string
+		processes int
+		threads   int
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/test/cgroup.procs": "10\n20\n10\n",
+				"memory/test/tasks":        "10\n11\n12\n20\n",
+			},
+			processes: 2,
+			threads:   4,
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/cgroup.procs":   "10\n20\n",
+				"test/cgroup.threads": "10\n11\n20\n",
+			},
+			processes: 2,
+			threads:   3,
+		},
+		{
+			name: "pids.current",
+			files: map[string]string{
+				"memory/test/cgroup.procs": "10\n",
+				"pids/test/pids.current":   "5\n",
+			},
+			processes: 1,
+			threads:   5,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := &Cgroup{Name: "test"}
+			if got, err := c.ProcessCount(); err != nil || got != tc.processes {
+				t.Errorf("ProcessCount() got: %d, %v, want: %d, nil", got, err, tc.processes)
+			}
+			if got, err := c.ThreadCount(); err != nil || got != tc.threads {
+				t.Errorf("ThreadCount() got: %d, %v, want: %d, nil", got, err, tc.threads)
+			}
+		})
+	}
+}
+
+func BenchmarkContainsPID(b *testing.B) {
+	root, cleanup := setupRoot(b, false)
+	defer cleanup()
+	const n = 100000
+	writeProcs(b, root, "huge", n)
+	c := Cgroup{Name: "huge"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if found, err := c.ContainsPID(n); err != nil || !found {
+			b.Fatalf("ContainsPID(%d) got: %t, %v, want: true, nil", n, found, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ToLinuxResources reads the live cgroup configuration and converts it back to
+// the OCI resources that Install would need to produce it. Only the memory
+// limits, CPU shares, quota and period, cpuset and pids limit are read. Fields
+// are left nil when the cgroup has no limit or the file doesn't exist, e.g.
+// when swap accounting is disabled.
+//
+// With cgroup v2, the CPU shares are converted from 'cpu.weight', which has a
+// coarser range. The conversion is lossy, but the returned shares map back to
+// the same weight.
+func (c *Cgroup) ToLinuxResources() (*specs.LinuxResources, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := getHierarchies()
+	ctrls := h.controllers()
+	res := &specs.LinuxResources{}
+	if _, ok := ctrls["memory"]; ok {
+		mem, err := readMemoryResources(c.makePath("memory"), h.isV2("memory"))
+		if err != nil {
+			return nil, err
+		}
+		res.Memory = mem
+	}
+	if _, ok := ctrls["cpu"]; ok {
+		cpu, err := readCPUResources(c.makePath("cpu"), h.isV2("cpu"))
+		if err != nil {
+			return nil, err
+		}
+		res.CPU = cpu
+	}
+	if _, ok := ctrls["cpuset"]; ok {
+		path := c.makePath("cpuset")
+		if res.CPU == nil {
+			res.CPU = &specs.LinuxCPU{}
+		}
+		var err error
+		if res.CPU.Cpus, err = readString(path, "cpuset.cpus"); err != nil {
+			return nil, err
+		}
+		if res.CPU.Mems, err = readString(path, "cpuset.mems"); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := ctrls["pids"]; ok {
+		limit, err := readLimit(c.makePath("pids"), "pids.max")
+		if err != nil {
+			return nil, err
+		}
+		if limit != nil {
+			res.Pids = &specs.LinuxPids{Limit: *limit}
+		}
+	}
+	return res, nil
+}
+
+func readMemoryResources(path string, v2 bool) (*specs.LinuxMemory, error) {
+	var (
+		mem specs.LinuxMemory
+		err error
+	)
+	if !v2 {
+		if mem.Limit, err = readLimit(path, "memory.limit_in_bytes"); err != nil {
+			return nil, err
+		}
+		if mem.Reservation, err = readLimit(path, "memory.soft_limit_in_bytes"); err != nil {
+			return nil, err
+		}
+		if mem.Swap, err = readLimit(path, "memory.memsw.limit_in_bytes"); err != nil {
+			return nil, err
+		}
+		return &mem, nil
+	}
+
+	if mem.Limit, err = readLimit(path, "memory.max"); err != nil {
+		return nil, err
+	}
+	if mem.Reservation, err = readLimit(path, "memory.low"); err != nil {
+		return nil, err
+	}
+	if mem.Reservation != nil && *mem.Reservation == 0 {
+		mem.Reservation = nil
+	}
+	// 'memory.swap.max' is swap only, while the spec's swap is memory+swap.
+	swap, err := readLimit(path, "memory.swap.max")
+	if err != nil {
+		return nil, err
+	}
+	if swap != nil && mem.Limit != nil {
+		total := *swap + *mem.Limit
+		mem.Swap = &total
+	}
+	return &mem, nil
+}
+
+func readCPUResources(path string, v2 bool) (*specs.LinuxCPU, error) {
+	var (
+		cpu specs.LinuxCPU
+		err error
+	)
+	if !v2 {
+		if cpu.Shares, err = readUint(path, "cpu.shares"); err != nil {
+			return nil, err
+		}
+		if cpu.Quota, err = readLimit(path, "cpu.cfs_quota_us"); err != nil {
+			return nil, err
+		}
+		if cpu.Period, err = readUint(path, "cpu.cfs_period_us"); err != nil {
+			return nil, err
+		}
+		return &cpu, nil
+	}
+
+	weight, err := readUint(path, "cpu.weight")
+	if err != nil {
+		return nil, err
+	}
+	if weight != nil {
+		shares := weightToShares(*weight)
+		cpu.Shares = &shares
+	}
+	val, err := getValue(path, "cpu.max")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cpu, nil
+		}
+		return nil, err
+	}
+	fields := strings.Fields(val)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid cpu.max: %q", val)
+	}
+	quota, err := parseLimit(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if quota != Unlimited {
+		cpu.Quota = &quota
+	}
+	period, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cpu.max: %q: %v", val, err)
+	}
+	cpu.Period = &period
+	return &cpu, nil
+}
+
+// weightToShares converts a cgroup v2 'cpu.weight' to cgroup v1 'cpu.shares'.
+// It returns the smallest shares that sharesToWeight maps to the weight.
+func weightToShares(weight uint64) uint64 {
+	if weight < minWeight {
+		weight = minWeight
+	}
+	if weight > maxWeight {
+		weight = maxWeight
+	}
+	// Round up to make up for the truncation in sharesToWeight.
+	return minShares + ((weight-minWeight)*(maxShares-minShares)+maxWeight-minWeight-1)/(maxWeight-minWeight)
+}
+
+// readLimit reads a limit file, returning nil if there is no limit or the file
+// doesn't exist.
+func readLimit(path, name string) (*int64, error) {
+	val, err := getValue(path, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	limit, err := parseLimit(val)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if limit == Unlimited {
+		return nil, nil
+	}
+	return &limit, nil
+}
+
+// readUint reads a file with an unsigned integer, returning nil if it doesn't
+// exist.
+func readUint(path, name string) (*uint64, error) {
+	val, err := getUint(path, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &val, nil
+}
+
+// readString reads a file with surrounding whitespace removed, returning an
+// empty string if it doesn't exist.
+func readString(path, name string) (string, error) {
+	val, err := getValue(path, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(val), nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// formatResources formats resources as JSON, so that pointer fields are
+// printed by value.
+func formatResources(res *specs.LinuxResources) string {
+	out, err := json.Marshal(res)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+func TestToLinuxResources(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		res     *specs.LinuxResources
+		want    *specs.LinuxResources
+	}{
+		{
+			name: "v1",
+			res: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{
+					Limit:       int64Ptr(1 << 30),
+					Reservation: int64Ptr(512 << 20),
+					Swap:        int64Ptr(2 << 30),
+				},
+				CPU: &specs.LinuxCPU{
+					Shares: uint64Ptr(1024),
+					Quota:  int64Ptr(50000),
+					Period: uint64Ptr(100000),
+					Cpus:   "0-1",
+					Mems:   "0",
+				},
+				Pids: &specs.LinuxPids{Limit: 1000},
+			},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			res: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{
+					Limit:       int64Ptr(1 << 30),
+					Reservation: int64Ptr(512 << 20),
+					Swap:        int64Ptr(3 << 30),
+				},
+				CPU: &specs.LinuxCPU{
+					Shares: uint64Ptr(1024),
+					Quota:  int64Ptr(50000),
+					Period: uint64Ptr(100000),
+					Cpus:   "0-1",
+					Mems:   "0",
+				},
+				Pids: &specs.LinuxPids{Limit: 1000},
+			},
+			// Shares are converted to cpu.weight 39, and back to the smallest
+			// shares with that weight.
+			want: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{
+					Limit:       int64Ptr(1 << 30),
+					Reservation: int64Ptr(512 << 20),
+					Swap:        int64Ptr(3 << 30),
+				},
+				CPU: &specs.LinuxCPU{
+					Shares: uint64Ptr(999),
+					Quota:  int64Ptr(50000),
+					Period: uint64Ptr(100000),
+					Cpus:   "0-1",
+					Mems:   "0",
+				},
+				Pids: &specs.LinuxPids{Limit: 1000},
+			},
+		},
+		{
+			name:    "v2 unlimited",
+			unified: true,
+			res: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: int64Ptr(-1)},
+				CPU:    &specs.LinuxCPU{Quota: int64Ptr(-1), Period: uint64Ptr(100000)},
+				Pids:   &specs.LinuxPids{Limit: -1},
+			},
+			want: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{},
+				CPU:    &specs.LinuxCPU{Period: uint64Ptr(100000)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			defer fakeFeatures(Features{Swap: true})()
+
+			c := &Cgroup{Name: "test"}
+			if err := c.Install(tc.res); err != nil {
+				t.Fatalf("Install(): %v", err)
+			}
+			got, err := c.ToLinuxResources()
+			if err != nil {
+				t.Fatalf("ToLinuxResources(): %v", err)
+			}
+			want := tc.want
+			if want == nil {
+				want = tc.res
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ToLinuxResources() got: %s, want: %s", formatResources(got), formatResources(want))
+			}
+		})
+	}
+}
+
+func TestWeightToShares(t *testing.T) {
+	for _, weight := range []uint64{minWeight, 39, 100, 5000, maxWeight} {
+		shares := weightToShares(weight)
+		if got := sharesToWeight(shares); got != weight {
+			t.Errorf("sharesToWeight(weightToShares(%d)) got: %d, want: %d", weight, got, weight)
+		}
+		if shares > minShares && sharesToWeight(shares-1) == weight {
+			t.Errorf("weightToShares(%d) = %d is not the smallest shares for the weight", weight, shares)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// maxConcurrentStats limits the number of cgroups read concurrently by
+// StatAll, which bounds the number of open file descriptors.
+const maxConcurrentStats = 16
+
+// Stats contains resource usage of a cgroup.
+type Stats struct {
+	// MemoryUsage is the current memory usage in bytes.
+	MemoryUsage uint64 `json:"memoryUsage"`
+
+	// CPUUsage is the total CPU time consumed by all tasks.
+	CPUUsage time.Duration `json:"cpuUsage"`
+
+	// Pids is the number of tasks.
+	Pids uint64 `json:"pids"`
+}
+
+// Stat returns the current resource usage of the cgroup.
+func (c *Cgroup) Stat() (*Stats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var (
+		stats Stats
+		err   error
+	)
+	if stats.MemoryUsage, err = readMemoryUsage(c.makePath("memory")); err != nil {
+		return nil, err
+	}
+	if stats.CPUUsage, err = readCPUUsage(c.makePath(cpuUsageController())); err != nil {
+		return nil, err
+	}
+	if stats.Pids, err = getUint(c.makePath("pids"), "pids.current"); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// readMemoryUsage reads the memory usage of the cgroup in 'path'.
+func readMemoryUsage(path string) (uint64, error) {
+	if isV2("memory") {
+		return getUint(path, "memory.current")
+	}
+	return getUint(path, "memory.usage_in_bytes")
+}
+
+// cpuUsageController returns the controller that accounts CPU usage.
+func cpuUsageController() string {
+	if isV2("cpu") {
+		return "cpu"
+	}
+	return "cpuacct"
+}
+
+// readCPUUsage reads the CPU usage of the cgroup in 'path', which belongs to
+// the controller returned by cpuUsageController.
+func readCPUUsage(path string) (time.Duration, error) {
+	if isV2("cpu") {
+		cpuStat, err := getKeyValues(path, "cpu.stat")
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(cpuStat["usage_usec"]) * time.Microsecond, nil
+	}
+	usage, err := getUint(path, "cpuacct.usage")
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(usage), nil
+}
+
+// StatAll returns the resource usage of all given cgroups. Cgroups are read
+// concurrently, with at most maxConcurrentStats at a time. Failure to read one
+// cgroup doesn't affect the others: stats[i] and errs[i] hold the result for
+// cgroups[i], and exactly one of them is nil.
+func StatAll(cgroups []*Cgroup) ([]*Stats, []error) {
+	stats := make([]*Stats, len(cgroups))
+	errs := make([]error, len(cgroups))
+
+	sem := make(chan struct{}, maxConcurrentStats)
+	var wg sync.WaitGroup
+	for i := range cgroups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			stats[i], errs[i] = cgroups[i].Stat()
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("cgroup %q: %v", cgroups[i].Name, errs[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+	return stats, errs
+}
+
+// AggregateStats returns the total resource usage of the given cgroups, e.g. a
+// pod's sandbox cgroup and its containers' child cgroups, without counting any
+// usage twice.
+//
+// Memory usage, CPU usage and the number of tasks are hierarchical: a cgroup's
+// counters already include all of its descendants, with both cgroup v1 and
+// v2. So cgroups that are descendants of another cgroup in the list are
+// skipped, and so are duplicates. For example, a pod cgroup and its children
+// add up to the pod cgroup alone, while children without their parent add up
+// to the sum of the children. Ancestry is checked for each controller
+// separately, since cgroup v1 hierarchies may be laid out differently.
+//
+// The only exception is cgroup v1 memory with 'memory.use_hierarchy' disabled
+// in the ancestor, where the ancestor's usage excludes its children and they
+// are counted on their own.
+func AggregateStats(cgroups []*Cgroup) (*Stats, error) {
+	memPaths := make([]string, len(cgroups))
+	cpuPaths := make([]string, len(cgroups))
+	pidsPaths := make([]string, len(cgroups))
+	cpuCtrl := cpuUsageController()
+	for i := range cgroups {
+		cgroups[i].mu.RLock()
+		memPaths[i] = cgroups[i].makePath("memory")
+		cpuPaths[i] = cgroups[i].makePath(cpuCtrl)
+		pidsPaths[i] = cgroups[i].makePath("pids")
+		cgroups[i].mu.RUnlock()
+	}
+
+	var stats Stats
+	memV1 := !isV2("memory")
+	for _, i := range topmost(memPaths, func(ancestor string) bool {
+		return !memV1 || memoryUseHierarchy(ancestor)
+	}) {
+		usage, err := readMemoryUsage(memPaths[i])
+		if err != nil {
+			return nil, fmt.Errorf("cgroup %q: %v", cgroups[i].Name, err)
+		}
+		stats.MemoryUsage += usage
+	}
+	for _, i := range topmost(cpuPaths, nil) {
+		usage, err := readCPUUsage(cpuPaths[i])
+		if err != nil {
+			return nil, fmt.Errorf("cgroup %q: %v", cgroups[i].Name, err)
+		}
+		stats.CPUUsage += usage
+	}
+	for _, i := range topmost(pidsPaths, nil) {
+		pids, err := getUint(pidsPaths[i], "pids.current")
+		if err != nil {
+			return nil, fmt.Errorf("cgroup %q: %v", cgroups[i].Name, err)
+		}
+		stats.Pids += pids
+	}
+	return &stats, nil
+}
+
+// topmost returns the indexes of the cgroup directories in 'paths' that must
+// be counted to aggregate a hierarchical counter: those that aren't a
+// descendant of another path in the list, keeping the first of duplicates.
+// If 'hierarchical' is not nil, only ancestors for which it returns true
+// include their descendants.
+func topmost(paths []string, hierarchical func(ancestor string) bool) []int {
+	var idxs []int
+	for i, path := range paths {
+		covered := false
+		for j, other := range paths {
+			if !(other == path && j < i) && !strings.HasPrefix(path, other+string(filepath.Separator)) {
+				continue
+			}
+			if other == path || hierarchical == nil || hierarchical(other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// memoryUseHierarchy returns true if the cgroup v1 memory usage in 'path'
+// includes its descendants, which is always the case on kernels without
+// 'memory.use_hierarchy'.
+func memoryUseHierarchy(path string) bool {
+	val, err := getUint(path, "memory.use_hierarchy")
+	return err != nil || val != 0
+}
+
+// MeasureCPUFraction samples the CPU usage of the cgroup at the beginning and
+// at the end of a 'd' long window, and returns the CPU time consumed as a
+// fraction of the wall time, e.g. 0.5 if its tasks ran half of the time on a
+// single CPU, or 2 if they kept 2 CPUs busy. The cgroup's tasks are expected
+// to be running, e.g. a busy loop started by the caller.
+func MeasureCPUFraction(c *Cgroup, d time.Duration) (float64, error) {
+	before, err := c.Stat()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	time.Sleep(d)
+	after, err := c.Stat()
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	return float64(after.CPUUsage-before.CPUUsage) / float64(elapsed), nil
+}
+
+// VerifyCPUQuota checks that the cgroup is throttled at its CPU quota, i.e. the
+// CPU fraction measured over 'd' by MeasureCPUFraction is within 'tolerance'
+// of the quota, relative to it, e.g. 0.1 accepts 10% of scheduling jitter. The
+// cgroup's tasks must try to use more CPU than the quota allows for the
+// measurement to be meaningful.
+func VerifyCPUQuota(c *Cgroup, d time.Duration, tolerance float64) error {
+	quota, err := c.CPUQuota()
+	if err != nil {
+		return err
+	}
+	if quota <= 0 {
+		return fmt.Errorf("cgroup %q has no CPU quota", c.Name)
+	}
+	got, err := MeasureCPUFraction(c, d)
+	if err != nil {
+		return err
+	}
+	if got < quota*(1-tolerance) || got > quota*(1+tolerance) {
+		return fmt.Errorf("cgroup %q used %.3f CPUs, want: %.3f (±%.0f%%)", c.Name, got, quota, tolerance*100)
+	}
+	return nil
+}
+
+// resettableCounters are the cgroup v1 memory counters that are reset by
+// writing 0 to them.
+var resettableCounters = []string{
+	"memory.max_usage_in_bytes",
+	"memory.failcnt",
+	"memory.memsw.max_usage_in_bytes",
+	"memory.memsw.failcnt",
+	"memory.kmem.max_usage_in_bytes",
+	"memory.kmem.failcnt",
+	"memory.kmem.tcp.max_usage_in_bytes",
+	"memory.kmem.tcp.failcnt",
+}
+
+// ResetStats resets the cgroup counters that support it, i.e. the peak usage
+// and failure counts of the cgroup v1 memory controller, and returns the names
+// of the files that were reset. Counters that the kernel doesn't provide, e.g.
+// swap accounting when it's disabled, are skipped.
+//
+// Most counters can't be reset: CPU and pids usage are always cumulative and,
+// with cgroup v2, memory counters can't be reset either. In that case, nothing
+// is reset and an empty list is returned.
+func (c *Cgroup) ResetStats() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isV2("memory") {
+		return nil, nil
+	}
+	path := c.makePath("memory")
+	var reset []string
+	for _, name := range resettableCounters {
+		if _, err := os.Stat(filepath.Join(path, name)); os.IsNotExist(err) {
+			continue
+		}
+		if err := setValue(path, name, "0"); err != nil {
+			return reset, fmt.Errorf("resetting %s: %v", name, err)
+		}
+		reset = append(reset, name)
+	}
+	return reset, nil
+}
+
+func getUint(path, name string) (uint64, error) {
+	s, err := getValue(path, name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+}
+
+// DirtyWritebackStat returns the amount of memory, in bytes, that is dirty and
+// waiting to be written back, and that is being written back, as reported by
+// 'memory.stat'. Large values point to IO stalls, e.g. workloads that dirty
+// page cache faster than the device can write it. Counters include the
+// cgroup's descendants. Returns ErrNotSupported if the kernel doesn't report
+// them.
+func (c *Cgroup) DirtyWritebackStat() (dirty, writeback uint64, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v2 := isV2("memory")
+	s, err := getValue(c.makePath("memory"), "memory.stat")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, fmt.Errorf("memory.stat: %w", ErrNotSupported)
+		}
+		return 0, 0, err
+	}
+	return parseDirtyWriteback(s, v2)
+}
+
+// parseDirtyWriteback extracts the dirty and writeback counters from
+// 'memory.stat'. cgroup v2 reports them as "file_dirty" and "file_writeback".
+// cgroup v1 reports them as "dirty" and "writeback" for the cgroup itself, and
+// as "total_dirty" and "total_writeback" including descendants, which are
+// preferred when present.
+func parseDirtyWriteback(s string, v2 bool) (dirty, writeback uint64, err error) {
+	vals, err := parseKeyValues(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	keys := [][]string{{"total_dirty", "dirty"}, {"total_writeback", "writeback"}}
+	if v2 {
+		keys = [][]string{{"file_dirty"}, {"file_writeback"}}
+	}
+	var res [2]uint64
+	for i, names := range keys {
+		found := false
+		for _, name := range names {
+			if val, ok := vals[name]; ok {
+				res[i], found = val, true
+				break
+			}
+		}
+		if !found {
+			return 0, 0, fmt.Errorf("memory.stat %s: %w", names[0], ErrNotSupported)
+		}
+	}
+	return res[0], res[1], nil
+}
+
+// KernelMemory breaks down the kernel memory charged to a cgroup, in bytes,
+// as reported by cgroup v2 'memory.stat'.
+type KernelMemory struct {
+	// Slab is the memory used by in-kernel data structures, i.e. the sum of
+	// SlabReclaimable and SlabUnreclaimable.
+	Slab uint64 `json:"slab"`
+
+	// SlabReclaimable is the part of Slab that might be reclaimed, e.g.
+	// dentries and inodes.
+	SlabReclaimable uint64 `json:"slabReclaimable"`
+
+	// SlabUnreclaimable is the part of Slab that can't be reclaimed under
+	// memory pressure.
+	SlabUnreclaimable uint64 `json:"slabUnreclaimable"`
+
+	// KernelStack is the memory allocated to kernel stacks.
+	KernelStack uint64 `json:"kernelStack"`
+
+	// Percpu is the memory used by per-cpu kernel data structures.
+	Percpu uint64 `json:"percpu"`
+}
+
+// MemoryStat contains the counters of 'memory.stat'.
+type MemoryStat struct {
+	// Raw contains all counters, keyed by their names in 'memory.stat', which
+	// differ between cgroup v1 and v2.
+	Raw map[string]uint64 `json:"raw"`
+
+	// KernelMemory is only populated with cgroup v2. cgroup v1 doesn't break
+	// kernel memory down in 'memory.stat', so its fields are zero.
+	KernelMemory
+}
+
+// MemoryStat returns the counters in 'memory.stat'. Returns ErrNotSupported if
+// the file doesn't exist.
+func (c *Cgroup) MemoryStat() (*MemoryStat, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v2 := isV2("memory")
+	s, err := getValue(c.makePath("memory"), "memory.stat")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("memory.stat: %w", ErrNotSupported)
+		}
+		return nil, err
+	}
+	return parseMemoryStat(s, v2)
+}
+
+// KernelMemoryBreakdown returns the kernel memory charged to the cgroup, by
+// kind of kernel object, which helps diagnosing workloads with a heavy kernel
+// footprint, e.g. many open files or threads. It's only supported on cgroup
+// v2, otherwise ErrNotSupported is returned; see KernelMemoryUsage for cgroup
+// v1. Counters not reported by the kernel, e.g. percpu before Linux 5.7, are
+// zero.
+func (c *Cgroup) KernelMemoryBreakdown() (*KernelMemory, error) {
+	if !isV2("memory") {
+		return nil, fmt.Errorf("memory.stat kernel memory breakdown: %w", ErrNotSupported)
+	}
+	stat, err := c.MemoryStat()
+	if err != nil {
+		return nil, err
+	}
+	return &stat.KernelMemory, nil
+}
+
+// parseMemoryStat parses 'memory.stat'. With cgroup v2, the kernel memory
+// counters are populated too. Kernels prior to Linux 5.9 don't report "slab",
+// in which case it's computed from the reclaimable and unreclaimable parts.
+func parseMemoryStat(s string, v2 bool) (*MemoryStat, error) {
+	vals, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	stat := &MemoryStat{Raw: vals}
+	if !v2 {
+		return stat, nil
+	}
+	stat.SlabReclaimable = vals["slab_reclaimable"]
+	stat.SlabUnreclaimable = vals["slab_unreclaimable"]
+	stat.KernelStack = vals["kernel_stack"]
+	stat.Percpu = vals["percpu"]
+	if slab, ok := vals["slab"]; ok {
+		stat.Slab = slab
+	} else {
+		stat.Slab = stat.SlabReclaimable + stat.SlabUnreclaimable
+	}
+	return stat, nil
+}
+
+// IOBreakdown splits a cgroup v1 blkio counter by operation type. Operations
+// are counted once as either Read or Write, and once as either Sync or Async.
+type IOBreakdown struct {
+	Read  uint64 `json:"read"`
+	Write uint64 `json:"write"`
+	Sync  uint64 `json:"sync"`
+	Async uint64 `json:"async"`
+}
+
+// IOServiceTime contains the IO activity of a cgroup on a block device.
+type IOServiceTime struct {
+	// Serviced is the number of IO operations, from 'blkio.throttle.io_serviced'
+	// (or 'rios' and 'wios' in 'io.stat' on cgroup v2).
+	Serviced IOBreakdown `json:"serviced"`
+
+	// ServiceTime is the time spent servicing IO operations in nanoseconds,
+	// from 'blkio.io_service_time'. It's only reported by cgroup v1 with the
+	// CFQ scheduler, and is zero otherwise.
+	ServiceTime IOBreakdown `json:"serviceTime"`
+}
+
+// IOServiceTime returns the IO activity of the cgroup, keyed by block device
+// in the form "major:minor". cgroup v2 doesn't provide Sync, Async or service
+// times, which are left as zero. Returns ErrNotSupported if the IO controller
+// is not available for the cgroup.
+func (c *Cgroup) IOServiceTime() (map[string]IOServiceTime, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if isV2("io") {
+		path := c.makePath("io")
+		s, err := getValue(path, "io.stat")
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("io.stat: %w", ErrNotSupported)
+			}
+			return nil, err
+		}
+		return parseIOStat(s)
+	}
+
+	path := c.makePath("blkio")
+	s, err := getValue(path, "blkio.throttle.io_serviced")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blkio.throttle.io_serviced: %w", ErrNotSupported)
+		}
+		return nil, err
+	}
+	serviced, err := parseBlkioStat(s)
+	if err != nil {
+		return nil, fmt.Errorf("parsing blkio.throttle.io_serviced: %v", err)
+	}
+	var times map[string]IOBreakdown
+	if s, err := getValue(path, "blkio.io_service_time"); err == nil {
+		if times, err = parseBlkioStat(s); err != nil {
+			return nil, fmt.Errorf("parsing blkio.io_service_time: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	stats := make(map[string]IOServiceTime)
+	for dev, s := range serviced {
+		stats[dev] = IOServiceTime{Serviced: s, ServiceTime: times[dev]}
+	}
+	for dev, t := range times {
+		if _, ok := stats[dev]; !ok {
+			stats[dev] = IOServiceTime{ServiceTime: t}
+		}
+	}
+	return stats, nil
+}
+
+// parseBlkioStat parses cgroup v1 blkio files that are broken down by
+// operation, formatted like:
+//
+//	8:0 Read 1024
+//	8:0 Write 2048
+//	8:0 Sync 3072
+//	8:0 Async 0
+//	8:0 Total 3072
+//	Total 3072
+func parseBlkioStat(s string) (map[string]IOBreakdown, error) {
+	stats := make(map[string]IOBreakdown)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "Total" {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+		val, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q: %v", line, err)
+		}
+		dev := fields[0]
+		b := stats[dev]
+		switch fields[1] {
+		case "Read":
+			b.Read = val
+		case "Write":
+			b.Write = val
+		case "Sync":
+			b.Sync = val
+		case "Async":
+			b.Async = val
+		default:
+			// e.g. "Total" and "Discard".
+		}
+		stats[dev] = b
+	}
+	return stats, nil
+}
+
+// parseIOStat parses 'io.stat' from cgroup v2, formatted like:
+//
+//	8:0 rbytes=1024 wbytes=2048 rios=1 wios=2 dbytes=0 dios=0
+func parseIOStat(s string) (map[string]IOServiceTime, error) {
+	stats := make(map[string]IOServiceTime)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var st IOServiceTime
+		for _, kv := range fields[1:] {
+			tokens := strings.SplitN(kv, "=", 2)
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("invalid line: %q", line)
+			}
+			val, err := strconv.ParseUint(tokens[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid line %q: %v", line, err)
+			}
+			switch tokens[0] {
+			case "rios":
+				st.Serviced.Read = val
+			case "wios":
+				st.Serviced.Write = val
+			}
+		}
+		stats[fields[0]] = st
+	}
+	return stats, nil
+}
@@ -0,0 +1,575 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the given files, relative to root, creating directories
+// as needed.
+func writeFiles(t testing.TB, root string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+	}
+}
+
+// makeStatCgroups creates n cgroups with stat files in a cgroup v1 hierarchy.
+func makeStatCgroups(t testing.TB, root string, n int) []*Cgroup {
+	var cgs []*Cgroup
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("cg%d", i)
+		writeFiles(t, root, map[string]string{
+			filepath.Join("memory", name, "memory.usage_in_bytes"): fmt.Sprintf("%d\n", 1000+i),
+			filepath.Join("cpuacct", name, "cpuacct.usage"):        fmt.Sprintf("%d\n", 2000+i),
+			filepath.Join("pids", name, "pids.current"):            fmt.Sprintf("%d\n", i),
+		})
+		cgs = append(cgs, &Cgroup{Name: name})
+	}
+	return cgs
+}
+
+func TestStat(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+		want    Stats
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/test/memory.usage_in_bytes": "4096\n",
+				"cpuacct/test/cpuacct.usage":        "3000\n",
+				"pids/test/pids.current":            "3\n",
+			},
+			want: Stats{MemoryUsage: 4096, CPUUsage: 3000 * time.Nanosecond, Pids: 3},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/memory.current": "4096\n",
+				"test/cpu.stat":       "usage_usec 3\nuser_usec 2\nsystem_usec 1\n",
+				"test/pids.current":   "3\n",
+			},
+			want: Stats{MemoryUsage: 4096, CPUUsage: 3 * time.Microsecond, Pids: 3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := Cgroup{Name: "test"}
+			got, err := c.Stat()
+			if err != nil {
+				t.Fatalf("Stat(): %v", err)
+			}
+			if *got != tc.want {
+				t.Errorf("Stat() got: %+v, want: %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStatAll(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+
+	cgs := makeStatCgroups(t, root, 3*maxConcurrentStats)
+	// Add a cgroup that doesn't exist.
+	cgs = append(cgs, &Cgroup{Name: "missing"})
+
+	stats, errs := StatAll(cgs)
+	if len(stats) != len(cgs) || len(errs) != len(cgs) {
+		t.Fatalf("StatAll() returned %d stats and %d errors, want: %d", len(stats), len(errs), len(cgs))
+	}
+	for i := 0; i < len(cgs)-1; i++ {
+		if errs[i] != nil {
+			t.Errorf("cgroup %q: %v", cgs[i].Name, errs[i])
+			continue
+		}
+		if want := uint64(1000 + i); stats[i].MemoryUsage != want {
+			t.Errorf("cgroup %q memory usage got: %d, want: %d", cgs[i].Name, stats[i].MemoryUsage, want)
+		}
+	}
+	last := len(cgs) - 1
+	if errs[last] == nil || stats[last] != nil {
+		t.Errorf("cgroup %q should have failed, got: %+v, %v", cgs[last].Name, stats[last], errs[last])
+	}
+}
+
+func benchmarkStat(b *testing.B, stat func([]*Cgroup)) {
+	root, cleanup := setupRoot(b, false)
+	defer cleanup()
+	cgs := makeStatCgroups(b, root, 256)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stat(cgs)
+	}
+}
+
+func BenchmarkStatSerial(b *testing.B) {
+	benchmarkStat(b, func(cgs []*Cgroup) {
+		for i := range cgs {
+			if _, err := cgs[i].Stat(); err != nil {
+				b.Fatalf("Stat(): %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkStatAll(b *testing.B) {
+	benchmarkStat(b, func(cgs []*Cgroup) {
+		_, errs := StatAll(cgs)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatalf("StatAll(): %v", err)
+			}
+		}
+	})
+}
+
+func TestResetStats(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{
+		"memory/test/memory.failcnt":            "5\n",
+		"memory/test/memory.max_usage_in_bytes": "1048576\n",
+		"memory/test/memory.usage_in_bytes":     "4096\n",
+	})
+
+	c := Cgroup{Name: "test"}
+	reset, err := c.ResetStats()
+	if err != nil {
+		t.Fatalf("ResetStats(): %v", err)
+	}
+	if want := []string{"memory.max_usage_in_bytes", "memory.failcnt"}; !reflect.DeepEqual(reset, want) {
+		t.Errorf("ResetStats() got: %v, want: %v", reset, want)
+	}
+	for name, want := range map[string]string{
+		"memory/test/memory.failcnt":            "0",
+		"memory/test/memory.max_usage_in_bytes": "0",
+		"memory/test/memory.usage_in_bytes":     "4096",
+	} {
+		if got := readFile(t, root, name); got != want {
+			t.Errorf("%s got: %q, want: %q", name, got, want)
+		}
+	}
+}
+
+func TestResetStatsV2(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{"test/memory.peak": "1048576\n"})
+
+	c := Cgroup{Name: "test"}
+	reset, err := c.ResetStats()
+	if err != nil || len(reset) != 0 {
+		t.Errorf("ResetStats() got: %v, %v, want: [], nil", reset, err)
+	}
+	if got := readFile(t, root, "test/memory.peak"); got != "1048576" {
+		t.Errorf("memory.peak got: %q, want: %q", got, "1048576")
+	}
+}
+
+func TestParseBlkioStat(t *testing.T) {
+	const serviced = `8:16 Read 120
+8:16 Write 30
+8:16 Sync 100
+8:16 Async 50
+8:16 Discard 0
+8:16 Total 150
+8:0 Read 7
+8:0 Write 0
+8:0 Sync 7
+8:0 Async 0
+8:0 Total 7
+Total 157
+`
+	got, err := parseBlkioStat(serviced)
+	if err != nil {
+		t.Fatalf("parseBlkioStat(): %v", err)
+	}
+	want := map[string]IOBreakdown{
+		"8:16": {Read: 120, Write: 30, Sync: 100, Async: 50},
+		"8:0":  {Read: 7, Sync: 7},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBlkioStat() got: %+v, want: %+v", got, want)
+	}
+
+	for _, s := range []string{"8:0 Read", "8:0 Read abc", "8:0 Read 1 2"} {
+		if _, err := parseBlkioStat(s); err == nil {
+			t.Errorf("parseBlkioStat(%q) should have failed", s)
+		}
+	}
+}
+
+func TestParseDirtyWriteback(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		stat      string
+		v2        bool
+		dirty     uint64
+		writeback uint64
+		supported bool
+	}{
+		{
+			name:      "v1",
+			stat:      "cache 8192\nrss 4096\ndirty 4096\nwriteback 0\ntotal_cache 16384\ntotal_dirty 12288\ntotal_writeback 8192\n",
+			dirty:     12288,
+			writeback: 8192,
+			supported: true,
+		},
+		{
+			name:      "v1 without hierarchy",
+			stat:      "cache 8192\nrss 4096\ndirty 4096\nwriteback 1024\n",
+			dirty:     4096,
+			writeback: 1024,
+			supported: true,
+		},
+		{
+			name:      "v2",
+			stat:      "anon 4096\nfile 8192\nfile_mapped 0\nfile_dirty 2048\nfile_writeback 1024\n",
+			v2:        true,
+			dirty:     2048,
+			writeback: 1024,
+			supported: true,
+		},
+		{
+			name: "v2 with v1 keys",
+			stat: "dirty 4096\nwriteback 1024\n",
+			v2:   true,
+		},
+		{
+			name: "missing writeback",
+			stat: "cache 8192\ndirty 4096\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dirty, writeback, err := parseDirtyWriteback(tc.stat, tc.v2)
+			if !tc.supported {
+				if !errors.Is(err, ErrNotSupported) {
+					t.Errorf("parseDirtyWriteback() got: %v, want: %v", err, ErrNotSupported)
+				}
+				if dirty != 0 || writeback != 0 {
+					t.Errorf("parseDirtyWriteback() got: %d, %d, want zeroes", dirty, writeback)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDirtyWriteback(): %v", err)
+			}
+			if dirty != tc.dirty || writeback != tc.writeback {
+				t.Errorf("parseDirtyWriteback() got: %d, %d, want: %d, %d", dirty, writeback, tc.dirty, tc.writeback)
+			}
+		})
+	}
+
+	if _, _, err := parseDirtyWriteback("dirty abc\n", false); err == nil || errors.Is(err, ErrNotSupported) {
+		t.Errorf("parseDirtyWriteback() with an invalid value got: %v, want parse error", err)
+	}
+}
+
+func TestParseMemoryStat(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stat string
+		v2   bool
+		want KernelMemory
+	}{
+		{
+			name: "v2",
+			stat: "anon 4096\nfile 8192\nkernel_stack 16384\npercpu 2048\nslab_reclaimable 40960\nslab_unreclaimable 8192\nslab 49152\n",
+			v2:   true,
+			want: KernelMemory{
+				Slab:              49152,
+				SlabReclaimable:   40960,
+				SlabUnreclaimable: 8192,
+				KernelStack:       16384,
+				Percpu:            2048,
+			},
+		},
+		{
+			name: "v2 without slab and percpu",
+			stat: "anon 4096\nkernel_stack 16384\nslab_reclaimable 40960\nslab_unreclaimable 8192\n",
+			v2:   true,
+			want: KernelMemory{
+				Slab:              49152,
+				SlabReclaimable:   40960,
+				SlabUnreclaimable: 8192,
+				KernelStack:       16384,
+			},
+		},
+		{
+			name: "v1",
+			stat: "cache 8192\nrss 4096\ntotal_cache 16384\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMemoryStat(tc.stat, tc.v2)
+			if err != nil {
+				t.Fatalf("parseMemoryStat(): %v", err)
+			}
+			if got.KernelMemory != tc.want {
+				t.Errorf("parseMemoryStat() got: %+v, want: %+v", got.KernelMemory, tc.want)
+			}
+			if want, err := parseKeyValues(tc.stat); err != nil || !reflect.DeepEqual(got.Raw, want) {
+				t.Errorf("parseMemoryStat() got raw: %v, want: %v", got.Raw, want)
+			}
+		})
+	}
+
+	if _, err := parseMemoryStat("slab abc\n", true); err == nil {
+		t.Errorf("parseMemoryStat() with an invalid value should have failed")
+	}
+}
+
+func TestKernelMemoryBreakdown(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	writeFiles(t, root, map[string]string{"test/memory.stat": "anon 4096\nkernel_stack 8192\npercpu 1024\nslab 4096\n"})
+
+	c := &Cgroup{Name: "test"}
+	got, err := c.KernelMemoryBreakdown()
+	if err != nil {
+		t.Fatalf("KernelMemoryBreakdown(): %v", err)
+	}
+	if want := (KernelMemory{Slab: 4096, KernelStack: 8192, Percpu: 1024}); *got != want {
+		t.Errorf("KernelMemoryBreakdown() got: %+v, want: %+v", *got, want)
+	}
+
+	v1Root, v1Cleanup := setupRoot(t, false)
+	defer v1Cleanup()
+	writeFiles(t, v1Root, map[string]string{"memory/test/memory.stat": "cache 8192\n"})
+	if _, err := c.KernelMemoryBreakdown(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("KernelMemoryBreakdown() on cgroup v1 got: %v, want: %v", err, ErrNotSupported)
+	}
+	stat, err := c.MemoryStat()
+	if err != nil {
+		t.Fatalf("MemoryStat(): %v", err)
+	}
+	if stat.Raw["cache"] != 8192 {
+		t.Errorf("MemoryStat() got: %+v, want cache: 8192", stat)
+	}
+}
+
+func TestIOServiceTime(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		unified bool
+		files   map[string]string
+		want    map[string]IOServiceTime
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"blkio/test/blkio.throttle.io_serviced": "8:0 Read 10\n8:0 Write 5\n8:0 Sync 12\n8:0 Async 3\n8:0 Total 15\nTotal 15\n",
+				"blkio/test/blkio.io_service_time":      "8:0 Read 1000\n8:0 Write 500\n8:0 Sync 1200\n8:0 Async 300\n8:0 Total 1500\nTotal 1500\n",
+			},
+			want: map[string]IOServiceTime{
+				"8:0": {
+					Serviced:    IOBreakdown{Read: 10, Write: 5, Sync: 12, Async: 3},
+					ServiceTime: IOBreakdown{Read: 1000, Write: 500, Sync: 1200, Async: 300},
+				},
+			},
+		},
+		{
+			name: "v1-no-service-time",
+			files: map[string]string{
+				"blkio/test/blkio.throttle.io_serviced": "8:0 Read 10\n8:0 Write 5\n8:0 Total 15\nTotal 15\n",
+			},
+			want: map[string]IOServiceTime{
+				"8:0": {Serviced: IOBreakdown{Read: 10, Write: 5}},
+			},
+		},
+		{
+			name:    "v2",
+			unified: true,
+			files: map[string]string{
+				"test/io.stat": "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n259:0 rbytes=0 wbytes=0 rios=0 wios=7 dbytes=0 dios=0\n",
+			},
+			want: map[string]IOServiceTime{
+				"8:0":   {Serviced: IOBreakdown{Read: 1, Write: 2}},
+				"259:0": {Serviced: IOBreakdown{Write: 7}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			writeFiles(t, root, tc.files)
+
+			c := Cgroup{Name: "test"}
+			got, err := c.IOServiceTime()
+			if err != nil {
+				t.Fatalf("IOServiceTime(): %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("IOServiceTime() got: %+v, want: %+v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("not-supported", func(t *testing.T) {
+		_, cleanup := setupRoot(t, false)
+		defer cleanup()
+		c := Cgroup{Name: "test"}
+		if _, err := c.IOServiceTime(); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("IOServiceTime() got: %v, want: %v", err, ErrNotSupported)
+		}
+	})
+}
+
+func TestMeasureCPUFraction(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	cgs := makeStatCgroups(t, root, 1)
+	writeFiles(t, root, map[string]string{
+		"cpu/cg0/cpu.cfs_quota_us":  "50000\n",
+		"cpu/cg0/cpu.cfs_period_us": "100000\n",
+	})
+
+	// Simulate tasks consuming 100ms of CPU time in the first half of the
+	// window.
+	const window = 200 * time.Millisecond
+	usage := filepath.Join(root, "cpuacct", "cg0", "cpuacct.usage")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(window / 2)
+		if err := ioutil.WriteFile(usage, []byte(fmt.Sprintf("%d\n", 2000+window/2)), 0644); err != nil {
+			t.Errorf("ioutil.WriteFile(): %v", err)
+		}
+	}()
+	got, err := MeasureCPUFraction(cgs[0], window)
+	<-done
+	if err != nil {
+		t.Fatalf("MeasureCPUFraction(): %v", err)
+	}
+	if got < 0.4 || got > 0.5 {
+		t.Errorf("MeasureCPUFraction() got: %f, want: ~0.5", got)
+	}
+
+	// Usage is now stable, i.e. no CPU was used.
+	if err := VerifyCPUQuota(cgs[0], 10*time.Millisecond, 0.1); err == nil {
+		t.Errorf("VerifyCPUQuota() should have failed without CPU usage")
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	// Usage of each cgroup, which includes its descendants. CPU usage is
+	// written in the unit of the cgroup file, i.e. nanoseconds with cgroup v1
+	// and microseconds with cgroup v2.
+	usage := map[string]Stats{
+		"pod":   {MemoryUsage: 1000, CPUUsage: 5000, Pids: 3},
+		"pod/a": {MemoryUsage: 400, CPUUsage: 2000, Pids: 1},
+		"pod/b": {MemoryUsage: 500, CPUUsage: 2500, Pids: 1},
+		"other": {MemoryUsage: 100, CPUUsage: 700, Pids: 2},
+	}
+	for _, tc := range []struct {
+		name        string
+		unified     bool
+		noHierarchy bool
+		cgroups     []string
+		want        Stats
+	}{
+		{
+			name:    "v1 pod and children",
+			cgroups: []string{"pod/a", "pod", "pod/b", "other"},
+			want:    Stats{MemoryUsage: 1100, CPUUsage: 5700, Pids: 5},
+		},
+		{
+			name:    "v1 children only",
+			cgroups: []string{"pod/a", "pod/b"},
+			want:    Stats{MemoryUsage: 900, CPUUsage: 4500, Pids: 2},
+		},
+		{
+			name:        "v1 memory without hierarchy",
+			noHierarchy: true,
+			cgroups:     []string{"pod", "pod/a", "pod/b"},
+			want:        Stats{MemoryUsage: 1900, CPUUsage: 5000, Pids: 3},
+		},
+		{
+			name:    "v2 pod and children",
+			unified: true,
+			cgroups: []string{"pod", "pod/a", "pod/b", "other"},
+			want:    Stats{MemoryUsage: 1100, CPUUsage: 5700, Pids: 5},
+		},
+		{
+			name:    "v2 duplicates",
+			unified: true,
+			cgroups: []string{"pod/a", "pod/a", "other"},
+			want:    Stats{MemoryUsage: 500, CPUUsage: 2700, Pids: 3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, cleanup := setupRoot(t, tc.unified)
+			defer cleanup()
+			files := make(map[string]string)
+			for name, st := range usage {
+				if tc.unified {
+					files[filepath.Join(name, "memory.current")] = fmt.Sprintf("%d\n", st.MemoryUsage)
+					files[filepath.Join(name, "cpu.stat")] = fmt.Sprintf("usage_usec %d\n", int64(st.CPUUsage))
+					files[filepath.Join(name, "pids.current")] = fmt.Sprintf("%d\n", st.Pids)
+					continue
+				}
+				files[filepath.Join("memory", name, "memory.usage_in_bytes")] = fmt.Sprintf("%d\n", st.MemoryUsage)
+				files[filepath.Join("cpuacct", name, "cpuacct.usage")] = fmt.Sprintf("%d\n", st.CPUUsage)
+				files[filepath.Join("pids", name, "pids.current")] = fmt.Sprintf("%d\n", st.Pids)
+				if tc.noHierarchy {
+					files[filepath.Join("memory", name, "memory.use_hierarchy")] = "0\n"
+				}
+			}
+			writeFiles(t, root, files)
+
+			var cgs []*Cgroup
+			for _, name := range tc.cgroups {
+				cgs = append(cgs, &Cgroup{Name: name})
+			}
+			got, err := AggregateStats(cgs)
+			if err != nil {
+				t.Fatalf("AggregateStats(): %v", err)
+			}
+			want := tc.want
+			if tc.unified {
+				want.CPUUsage *= time.Microsecond
+			}
+			if *got != want {
+				t.Errorf("AggregateStats(%v) got: %+v, want: %+v", tc.cgroups, *got, want)
+			}
+		})
+	}
+
+	if _, err := AggregateStats([]*Cgroup{{Name: "missing"}}); err == nil {
+		t.Errorf("AggregateStats() should have failed for a missing cgroup")
+	}
+}
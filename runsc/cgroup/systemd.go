@@ -0,0 +1,197 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// setUnitProperties sets properties of the systemd unit for the lifetime of
+// the unit with 'systemctl set-property --runtime', which calls
+// SetUnitProperties over D-Bus. The user's service manager is used when not
+// running as root. It's a variable so that tests can fake systemd.
+var setUnitProperties = func(ctx context.Context, unit string, props []string) error {
+	args := []string{"set-property", "--runtime"}
+	if os.Geteuid() != 0 {
+		args = append(args, "--user")
+	}
+	args = append(append(args, unit), props...)
+	out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// installSystemd implements InstallWithOpts for a cgroup owned by the systemd
+// unit opts.SystemdUnit. Resources that systemd models are set as properties
+// of the unit, and the others are written directly to the unit's cgroup.
+func (c *Cgroup) installSystemd(ctx context.Context, h *hierarchies, res *specs.LinuxResources, opts InstallOpts) error {
+	if res == nil {
+		return nil
+	}
+	props, rest := systemdProperties(res, h.isV2)
+	if len(props) > 0 {
+		logger().Debugf("Setting properties of systemd unit %q: %v", opts.SystemdUnit, props)
+		if err := setUnitProperties(ctx, opts.SystemdUnit, props); err != nil {
+			return fmt.Errorf("setting properties of systemd unit %q: %w", opts.SystemdUnit, err)
+		}
+	}
+	w := opts.writer()
+	for key, ctrl := range h.controllers() {
+		if skipController(key, ctrl) || !hasResources(key, rest) {
+			continue
+		}
+		path := c.makePath(key)
+		if _, err := os.Stat(path); err != nil {
+			// systemd only creates the cgroup in the controllers that the
+			// unit uses.
+			logger().Warningf("Skipping cgroup controller %q of systemd unit %q: %v", key, opts.SystemdUnit, err)
+			continue
+		}
+		if err := ctrl.set(w, rest, path); err != nil {
+			return fmt.Errorf("configuring cgroup controller %q of systemd unit %q: %w", key, opts.SystemdUnit, err)
+		}
+	}
+	return nil
+}
+
+// hasResources returns true if 'res' has anything for the given controller to
+// write. Unlike configured, it includes the realtime CPU fields.
+func hasResources(controllerName string, res *specs.LinuxResources) bool {
+	if controllerName == "cpu" && res.CPU != nil && (res.CPU.RealtimeRuntime != nil || res.CPU.RealtimePeriod != nil) {
+		return true
+	}
+	return configured(controllerName, res)
+}
+
+// systemdProperties translates 'res' into systemd unit properties, e.g.
+// "MemoryMax=1073741824", and returns them along with the resources systemd
+// doesn't model, which must be written directly. 'v2' reports whether a
+// controller uses the cgroup v2 hierarchy, since property names differ.
+//
+// The memory limit is also kept in the remaining resources if a swap limit is
+// set, since the swap limit is relative to it. CPU quotas that can't be
+// expressed as a whole percentage of the period are written directly.
+func systemdProperties(res *specs.LinuxResources, v2 func(string) bool) ([]string, *specs.LinuxResources) {
+	var props []string
+	rest := *res
+	if res.Memory != nil {
+		m := *res.Memory
+		rest.Memory = &m
+		name := "MemoryLimit"
+		if v2("memory") {
+			name = "MemoryMax"
+			if m.Reservation != nil && *m.Reservation != 0 {
+				props = append(props, "MemoryLow="+systemdLimit(*m.Reservation))
+				m.Reservation = nil
+			}
+		}
+		if m.Limit != nil && *m.Limit != 0 {
+			props = append(props, name+"="+systemdLimit(*m.Limit))
+			if m.Swap == nil || *m.Swap == 0 {
+				m.Limit = nil
+			}
+		}
+	}
+	if res.CPU != nil {
+		cpu := *res.CPU
+		rest.CPU = &cpu
+		if cpu.Shares != nil && *cpu.Shares != 0 {
+			if v2("cpu") {
+				if weight := sharesToWeight(*cpu.Shares); weight != 0 {
+					props = append(props, "CPUWeight="+strconv.FormatUint(weight, 10))
+				}
+			} else {
+				props = append(props, "CPUShares="+strconv.FormatUint(*cpu.Shares, 10))
+			}
+			cpu.Shares = nil
+		}
+		if quota, ok := systemdCPUQuota(cpu.Quota, cpu.Period); ok {
+			props = append(props, quota...)
+			cpu.Quota, cpu.Period = nil, nil
+		}
+		// systemd only supports cpusets with cgroup v2.
+		if v2("cpuset") {
+			if cpu.Cpus != "" {
+				props = append(props, "AllowedCPUs="+cpu.Cpus)
+				cpu.Cpus = ""
+			}
+			if cpu.Mems != "" {
+				props = append(props, "AllowedMemoryNodes="+cpu.Mems)
+				cpu.Mems = ""
+			}
+		}
+	}
+	if res.Pids != nil {
+		props = append(props, "TasksMax="+systemdLimit(res.Pids.Limit))
+		rest.Pids = nil
+	}
+	// Drop what was entirely translated into properties, so that controllers
+	// with nothing left aren't configured.
+	if rest.Memory != nil && *rest.Memory == (specs.LinuxMemory{}) {
+		rest.Memory = nil
+	}
+	if rest.CPU != nil && *rest.CPU == (specs.LinuxCPU{}) {
+		rest.CPU = nil
+	}
+	return props, &rest
+}
+
+// systemdLimit formats a limit as a systemd property value, where negative
+// values mean no limit.
+func systemdLimit(val int64) string {
+	if val < 0 {
+		return "infinity"
+	}
+	return strconv.FormatInt(val, 10)
+}
+
+// systemdCPUQuota translates a CFS quota and period, in microseconds, into the
+// CPUQuota and CPUQuotaPeriodSec properties. It returns false if neither is
+// set, or if the quota isn't a whole percentage of the period.
+func systemdCPUQuota(quota *int64, period *uint64) ([]string, bool) {
+	quotaSet := quota != nil && *quota != 0
+	periodSet := period != nil && *period != 0
+	if !quotaSet && !periodSet {
+		return nil, false
+	}
+	p := uint64(defaultPeriod)
+	if periodSet {
+		p = *period
+	}
+	var props []string
+	if p != defaultPeriod {
+		props = append(props, fmt.Sprintf("CPUQuotaPeriodSec=%dus", p))
+	}
+	switch {
+	case !quotaSet || *quota < 0:
+		// An empty quota removes it.
+		props = append(props, "CPUQuota=")
+	case uint64(*quota)*100%p == 0:
+		props = append(props, fmt.Sprintf("CPUQuota=%d%%", uint64(*quota)*100/p))
+	default:
+		return nil, false
+	}
+	return props, true
+}
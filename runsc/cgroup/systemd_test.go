@@ -0,0 +1,191 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func uint16Ptr(v uint16) *uint16 {
+	return &v
+}
+
+func TestSystemdProperties(t *testing.T) {
+	v1 := func(string) bool { return false }
+	v2 := func(string) bool { return true }
+	for _, tc := range []struct {
+		name  string
+		res   specs.LinuxResources
+		v2    func(string) bool
+		props []string
+		rest  specs.LinuxResources
+	}{
+		{
+			name: "v2",
+			res: specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Reservation: int64Ptr(1 << 20)},
+				CPU:    &specs.LinuxCPU{Shares: uint64Ptr(1024), Quota: int64Ptr(150000), Cpus: "0-1", Mems: "0"},
+				Pids:   &specs.LinuxPids{Limit: 100},
+			},
+			v2: v2,
+			props: []string{
+				"MemoryLow=1048576",
+				"MemoryMax=1073741824",
+				"CPUWeight=39",
+				"CPUQuota=150%",
+				"AllowedCPUs=0-1",
+				"AllowedMemoryNodes=0",
+				"TasksMax=100",
+			},
+			// Nothing is left to write directly.
+			rest: specs.LinuxResources{},
+		},
+		{
+			name: "v1",
+			res: specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Reservation: int64Ptr(1 << 20)},
+				CPU:    &specs.LinuxCPU{Shares: uint64Ptr(512), Quota: int64Ptr(25000), Period: uint64Ptr(50000), Cpus: "0-1"},
+			},
+			v2: v1,
+			props: []string{
+				"MemoryLimit=1073741824",
+				"CPUShares=512",
+				"CPUQuotaPeriodSec=50000us",
+				"CPUQuota=50%",
+			},
+			rest: specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Reservation: int64Ptr(1 << 20)},
+				CPU:    &specs.LinuxCPU{Cpus: "0-1"},
+			},
+		},
+		{
+			name: "unlimited",
+			res: specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: int64Ptr(-1)},
+				CPU:    &specs.LinuxCPU{Quota: int64Ptr(-1)},
+				Pids:   &specs.LinuxPids{Limit: -1},
+			},
+			v2:    v2,
+			props: []string{"MemoryMax=infinity", "CPUQuota=", "TasksMax=infinity"},
+			rest:  specs.LinuxResources{},
+		},
+		{
+			// Swap is written directly, relative to the memory limit, and
+			// quotas that aren't a whole percentage are too.
+			name: "not modeled",
+			res: specs.LinuxResources{
+				Memory:  &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Swap: int64Ptr(2 << 30)},
+				CPU:     &specs.LinuxCPU{Quota: int64Ptr(33333)},
+				BlockIO: &specs.LinuxBlockIO{Weight: uint16Ptr(100)},
+			},
+			v2:    v2,
+			props: []string{"MemoryMax=1073741824"},
+			rest: specs.LinuxResources{
+				Memory:  &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Swap: int64Ptr(2 << 30)},
+				CPU:     &specs.LinuxCPU{Quota: int64Ptr(33333)},
+				BlockIO: &specs.LinuxBlockIO{Weight: uint16Ptr(100)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			props, rest := systemdProperties(&tc.res, tc.v2)
+			if !reflect.DeepEqual(props, tc.props) {
+				t.Errorf("systemdProperties() got props: %q, want: %q", props, tc.props)
+			}
+			if !reflect.DeepEqual(*rest, tc.rest) {
+				t.Errorf("systemdProperties() got rest: %+v, want: %+v", *rest, tc.rest)
+			}
+		})
+	}
+}
+
+func TestInstallSystemd(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	defer fakeFeatures(Features{Swap: true})()
+
+	// The scope's cgroup is created by systemd.
+	c := &Cgroup{Name: "system.slice/runsc-test.scope"}
+	if err := os.MkdirAll(filepath.Join(root, c.Name), 0755); err != nil {
+		t.Fatalf("os.MkdirAll(): %v", err)
+	}
+	oldSet := setUnitProperties
+	defer func() { setUnitProperties = oldSet }()
+	var gotUnit string
+	var gotProps []string
+	setUnitProperties = func(_ context.Context, unit string, props []string) error {
+		gotUnit, gotProps = unit, props
+		return nil
+	}
+
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Swap: int64Ptr(2 << 30)},
+		Pids:   &specs.LinuxPids{Limit: 100},
+	}
+	if err := c.InstallWithOpts(context.Background(), res, InstallOpts{SystemdUnit: "runsc-test.scope"}); err != nil {
+		t.Fatalf("InstallWithOpts(): %v", err)
+	}
+	if want := []string{"MemoryMax=1073741824", "TasksMax=100"}; gotUnit != "runsc-test.scope" || !reflect.DeepEqual(gotProps, want) {
+		t.Errorf("setUnitProperties() got: %q, %q, want: %q, %q", gotUnit, gotProps, "runsc-test.scope", want)
+	}
+	// Only the swap limit is written directly.
+	if got := readFile(t, root, c.Name+"/memory.swap.max"); got != "1073741824" {
+		t.Errorf("memory.swap.max got: %q, want: %q", got, "1073741824")
+	}
+	if _, err := os.Stat(filepath.Join(root, c.Name, "pids.max")); !os.IsNotExist(err) {
+		t.Errorf("pids.max should not be written, stat: %v", err)
+	}
+	if c.Own {
+		t.Errorf("cgroup of a systemd unit should not be owned")
+	}
+}
+
+func TestInstallSystemdV1(t *testing.T) {
+	root, cleanup := setupRoot(t, false)
+	defer cleanup()
+	defer fakeFeatures(Features{Swap: true})()
+
+	// systemd only creates the scope's cgroup in the controllers it uses, e.g.
+	// not in cpuset, whose files are inherited from the parent.
+	c := &Cgroup{Name: "system.slice/runsc-test.scope"}
+	for _, ctrl := range []string{"memory", "pids", "systemd"} {
+		if err := os.MkdirAll(filepath.Join(root, ctrl, c.Name), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(): %v", err)
+		}
+	}
+	oldSet := setUnitProperties
+	defer func() { setUnitProperties = oldSet }()
+	setUnitProperties = func(context.Context, string, []string) error { return nil }
+
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30), Swap: int64Ptr(2 << 30)},
+		Pids:   &specs.LinuxPids{Limit: 100},
+	}
+	if err := c.InstallWithOpts(context.Background(), res, InstallOpts{SystemdUnit: "runsc-test.scope"}); err != nil {
+		t.Fatalf("InstallWithOpts(): %v", err)
+	}
+	if got := readFile(t, root, "memory/"+c.Name+"/memory.memsw.limit_in_bytes"); got != "2147483648" {
+		t.Errorf("memory.memsw.limit_in_bytes got: %q, want: %q", got, "2147483648")
+	}
+	if _, err := os.Stat(filepath.Join(root, "cpuset", c.Name)); !os.IsNotExist(err) {
+		t.Errorf("cpuset cgroup should not be created, stat: %v", err)
+	}
+}
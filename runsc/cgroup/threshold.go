@@ -0,0 +1,171 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// thresholdPollInterval is how often 'memory.current' is polled to watch
+// memory thresholds with cgroup v2. It's a variable so that tests can make it
+// shorter.
+var thresholdPollInterval = 100 * time.Millisecond
+
+// WatchMemoryThreshold returns a channel that receives a value every time the
+// memory usage of the cgroup crosses 'threshold' bytes upward. Notifications
+// that arrive while a previous one is still pending are coalesced. If usage is
+// already above the threshold, the first notification comes after it drops
+// below and crosses it again.
+//
+// With cgroup v1, the kernel notifies the threshold through an eventfd
+// registered in 'cgroup.event_control' for 'memory.usage_in_bytes'. cgroup v2
+// has no threshold notifications, so 'memory.current' is polled instead.
+//
+// The watch is removed and the channel closed when the returned cancel
+// function is called.
+func (c *Cgroup) WatchMemoryThreshold(threshold int64) (<-chan struct{}, func(), error) {
+	if threshold <= 0 {
+		return nil, nil, fmt.Errorf("invalid memory threshold %d, must be positive", threshold)
+	}
+	c.mu.RLock()
+	path := c.makePath("memory")
+	c.mu.RUnlock()
+
+	usageFile := "memory.usage_in_bytes"
+	var events <-chan struct{}
+	var stop func()
+	if isV2("memory") {
+		usageFile = "memory.current"
+		if _, err := getInt(path, usageFile); err != nil {
+			return nil, nil, err
+		}
+		ticker := time.NewTicker(thresholdPollInterval)
+		ch := make(chan struct{}, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(ch)
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case ch <- struct{}{}:
+					default:
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		events = ch
+		stop = func() {
+			ticker.Stop()
+			close(done)
+		}
+	} else {
+		var err error
+		events, stop, err = registerThreshold(path, usageFile, threshold)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// cgroup v1 notifies crossings in both directions, and polling notifies
+	// periodically. Only forward upward crossings, based on the last usage.
+	above := false
+	if usage, err := getInt(path, usageFile); err == nil {
+		above = int64(usage) >= threshold
+	}
+	ch := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			case <-done:
+				return
+			}
+			usage, err := getInt(path, usageFile)
+			if err != nil {
+				logger().Warningf("Reading memory usage of cgroup %q: %v", path, err)
+				return
+			}
+			wasAbove := above
+			above = int64(usage) >= threshold
+			if above && !wasAbove {
+				select {
+				case ch <- struct{}{}:
+				default:
+					// A notification is already pending.
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+			stop()
+		})
+	}
+	return ch, cancel, nil
+}
+
+// registerThreshold registers an eventfd for 'threshold' on the cgroup v1
+// usage file 'usageFile' with 'cgroup.event_control', and watches it with the
+// poller. The kernel removes the threshold once the eventfd is closed, which
+// the returned function does.
+func registerThreshold(path, usageFile string, threshold int64) (<-chan struct{}, func(), error) {
+	p, err := getPoller()
+	if err != nil {
+		return nil, nil, err
+	}
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("eventfd: %v", err)
+	}
+	usagePath := filepath.Join(path, usageFile)
+	ufd, err := syscall.Open(usagePath, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		syscall.Close(efd)
+		return nil, nil, fmt.Errorf("opening %q: %v", usagePath, err)
+	}
+	// The kernel doesn't keep a reference to the usage file once the event is
+	// registered.
+	defer syscall.Close(ufd)
+	event := fmt.Sprintf("%d %d %s", efd, ufd, strconv.FormatInt(threshold, 10))
+	if err := setValue(path, "cgroup.event_control", event); err != nil {
+		syscall.Close(efd)
+		return nil, nil, fmt.Errorf("registering memory threshold on %q: %v", usagePath, err)
+	}
+	ch, cancel, err := p.add(efd, syscall.EPOLLIN, true)
+	if err != nil {
+		syscall.Close(efd)
+		return nil, nil, fmt.Errorf("watching %q: %v", usagePath, err)
+	}
+	logger().Debugf("Watching %q with threshold %d", usagePath, threshold)
+	return ch, cancel, nil
+}
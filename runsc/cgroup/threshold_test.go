@@ -0,0 +1,88 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchMemoryThresholdV2(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	oldInterval := thresholdPollInterval
+	defer func() { thresholdPollInterval = oldInterval }()
+	thresholdPollInterval = 5 * time.Millisecond
+
+	c := &Cgroup{Name: "test"}
+	if _, _, err := c.WatchMemoryThreshold(1000); err == nil {
+		t.Errorf("WatchMemoryThreshold() should have failed without memory.current")
+	}
+	if _, _, err := c.WatchMemoryThreshold(0); err == nil {
+		t.Errorf("WatchMemoryThreshold(0) should have failed")
+	}
+
+	// The file is replaced atomically, so that it's never read empty.
+	setUsage := func(usage string) {
+		tmp := filepath.Join(root, "test", "memory.current.tmp")
+		if err := ioutil.WriteFile(tmp, []byte(usage+"\n"), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(root, "test", "memory.current")); err != nil {
+			t.Fatalf("os.Rename(): %v", err)
+		}
+	}
+	writeFiles(t, root, map[string]string{"test/memory.current": "100\n"})
+	ch, cancel, err := c.WatchMemoryThreshold(1000)
+	if err != nil {
+		t.Fatalf("WatchMemoryThreshold(): %v", err)
+	}
+	defer cancel()
+
+	expectNotification := func(want bool) {
+		t.Helper()
+		timeout := 20 * thresholdPollInterval
+		if want {
+			timeout = 5 * time.Second
+		}
+		select {
+		case <-ch:
+			if !want {
+				t.Errorf("WatchMemoryThreshold() notified without crossing the threshold")
+			}
+		case <-time.After(timeout):
+			if want {
+				t.Fatalf("WatchMemoryThreshold() didn't notify after crossing the threshold")
+			}
+		}
+	}
+	expectNotification(false)
+	setUsage("2000")
+	expectNotification(true)
+	// Staying above or dropping below the threshold doesn't notify.
+	setUsage("3000")
+	expectNotification(false)
+	setUsage("500")
+	expectNotification(false)
+	setUsage("1000")
+	expectNotification(true)
+
+	cancel()
+	for range ch {
+	}
+}
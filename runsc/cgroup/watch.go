@@ -0,0 +1,199 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// eventType is how a watched cgroup file notifies changes.
+type eventType int
+
+const (
+	// eventModify is notified when the file is modified, e.g. 'cgroup.events'
+	// or 'memory.events'. It relies on inotify.
+	eventModify eventType = iota
+
+	// eventPriority is notified when the file is ready with POLLPRI, e.g. PSI
+	// files with a trigger registered.
+	eventPriority
+)
+
+// watchEntry is a file registered with the poller.
+type watchEntry struct {
+	ch chan struct{}
+
+	// drain is true if pending data must be read from the fd after each
+	// notification, e.g. inotify events.
+	drain bool
+}
+
+// poller waits for notifications on all watched files with a single epoll
+// instance and goroutine.
+type poller struct {
+	// epFD is the epoll file descriptor used to wait for notifications.
+	epFD int
+
+	// mu protects watches.
+	mu sync.Mutex
+
+	// watches maps file descriptors to their watch.
+	watches map[int32]*watchEntry
+}
+
+var shared struct {
+	poller  *poller
+	once    sync.Once
+	initErr error
+}
+
+// getPoller returns the poller shared by all watches, creating it on first use.
+func getPoller() (*poller, error) {
+	shared.once.Do(func() {
+		shared.poller, shared.initErr = newPoller()
+	})
+	return shared.poller, shared.initErr
+}
+
+// newPoller creates a poller and starts waiting for notifications.
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1: %v", err)
+	}
+	p := &poller{
+		epFD:    epfd,
+		watches: make(map[int32]*watchEntry),
+	}
+	go p.waitAndNotify()
+	return p, nil
+}
+
+// watch returns a channel that receives a value every time the file in 'path'
+// notifies 'interest'. Notifications that arrive while a previous one is still
+// pending are coalesced, so receivers must re-read the file state. The returned
+// function stops the watch and closes the channel.
+func watch(path string, interest eventType) (<-chan struct{}, func(), error) {
+	p, err := getPoller()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		fd     int
+		events uint32 = syscall.EPOLLIN
+	)
+	switch interest {
+	case eventModify:
+		fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+		if err != nil {
+			return nil, nil, fmt.Errorf("inotify_init1: %v", err)
+		}
+		if _, err := syscall.InotifyAddWatch(fd, path, syscall.IN_MODIFY); err != nil {
+			syscall.Close(fd)
+			return nil, nil, fmt.Errorf("inotify_add_watch(%q): %v", path, err)
+		}
+	case eventPriority:
+		fd, err = syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening %q: %v", path, err)
+		}
+		events = syscall.EPOLLPRI
+	default:
+		return nil, nil, fmt.Errorf("invalid event type %d", interest)
+	}
+
+	ch, cancel, err := p.add(fd, events, interest == eventModify)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("watching %q: %v", path, err)
+	}
+	return ch, cancel, nil
+}
+
+// add registers 'fd' for 'events' and returns the channel notified for it,
+// and a function that unregisters and closes it. The poller owns 'fd' once add
+// succeeds.
+func (p *poller) add(fd int, events uint32, drain bool) (<-chan struct{}, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := syscall.EpollEvent{
+		// Edge-triggered, so that files that stay ready, e.g. cgroup.events until
+		// it's read again, notify only once per change.
+		Events: events | unix.EPOLLET,
+		Fd:     int32(fd),
+	}
+	if err := syscall.EpollCtl(p.epFD, syscall.EPOLL_CTL_ADD, fd, &e); err != nil {
+		return nil, nil, err
+	}
+	w := &watchEntry{ch: make(chan struct{}, 1), drain: drain}
+	p.watches[int32(fd)] = w
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			syscall.EpollCtl(p.epFD, syscall.EPOLL_CTL_DEL, fd, nil)
+			delete(p.watches, int32(fd))
+			syscall.Close(fd)
+			close(w.ch)
+		})
+	}, nil
+}
+
+// waitAndNotify runs in its own goroutine and loops waiting for notifications
+// from the epoll object, which are dispatched to the watches.
+func (p *poller) waitAndNotify() {
+	events := make([]syscall.EpollEvent, 100)
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.EpollWait(p.epFD, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logger().Warningf("Waiting for cgroup notifications: %v", err)
+			return
+		}
+
+		p.mu.Lock()
+		for i := 0; i < n; i++ {
+			w, ok := p.watches[events[i].Fd]
+			if !ok {
+				// Cancelled while the event was pending.
+				continue
+			}
+			if w.drain {
+				for {
+					if _, err := syscall.Read(int(events[i].Fd), buf); err != nil {
+						break
+					}
+				}
+			}
+			select {
+			case w.ch <- struct{}{}:
+			default:
+				// A notification is already pending.
+			}
+		}
+		p.mu.Unlock()
+	}
+}
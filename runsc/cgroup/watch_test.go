@@ -0,0 +1,78 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-watch")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cgroup.events")
+	if err := ioutil.WriteFile(path, []byte("populated 0\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+
+	ch, cancel, err := watch(path, eventModify)
+	if err != nil {
+		t.Fatalf("watch(%q): %v", path, err)
+	}
+	defer cancel()
+
+	select {
+	case <-ch:
+		t.Fatalf("watch(%q) notified before the file changed", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(path, []byte("populated 1\n"), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for notification #%d on %q", i, path)
+		}
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("channel should be closed after cancel")
+	}
+	shared.poller.mu.Lock()
+	n := len(shared.poller.watches)
+	shared.poller.mu.Unlock()
+	if n != 0 {
+		t.Errorf("poller has %d watches after cancel, want: 0", n)
+	}
+	// Cancelling again is harmless.
+	cancel()
+}
+
+func TestWatchMissing(t *testing.T) {
+	for _, interest := range []eventType{eventModify, eventPriority} {
+		if _, _, err := watch("/nonexistent/cgroup.events", interest); err == nil {
+			t.Errorf("watch(%d) should have failed for a missing file", interest)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// Writer performs the changes to cgroupfs made by Install and Uninstall. It
+// allows them to be delegated to a more privileged process, so that the
+// caller doesn't need the privileges to manage cgroups, see HelperWriter.
+type Writer interface {
+	// MkdirAll creates the cgroup directory 'path', along with any missing
+	// parents.
+	MkdirAll(path string) error
+
+	// WriteFile writes 'data' to the cgroup file 'path'.
+	WriteFile(path, data string) error
+
+	// Remove removes the empty cgroup directory 'path'.
+	Remove(path string) error
+}
+
+// LocalWriter is the default Writer, which changes cgroupfs from the current
+// process.
+type LocalWriter struct{}
+
+// MkdirAll implements Writer.MkdirAll.
+func (LocalWriter) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+// WriteFile implements Writer.WriteFile.
+func (LocalWriter) WriteFile(path, data string) error {
+	return writeFile(path, []byte(data), 0700)
+}
+
+// Remove implements Writer.Remove.
+func (LocalWriter) Remove(path string) error {
+	return rmdir(path)
+}
+
+// ctxWriter is a Writer that stops performing operations once 'ctx' is done,
+// returning ctx.Err() instead.
+type ctxWriter struct {
+	ctx context.Context
+	w   Writer
+}
+
+// MkdirAll implements Writer.MkdirAll.
+func (c ctxWriter) MkdirAll(path string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.w.MkdirAll(path)
+}
+
+// WriteFile implements Writer.WriteFile.
+func (c ctxWriter) WriteFile(path, data string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.w.WriteFile(path, data)
+}
+
+// Remove implements Writer.Remove.
+func (c ctxWriter) Remove(path string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.w.Remove(path)
+}
+
+// The helper protocol is a sequence of frames, each one a 4 byte big endian
+// length followed by a JSON message. The client sends a writerOp and waits for
+// the writerAck of the helper before sending the next one.
+const (
+	opMkdirAll  = "mkdir"
+	opWriteFile = "write"
+	opRemove    = "remove"
+
+	// maxFrameSize bounds the size of a frame, cgroup values are small.
+	maxFrameSize = 1 << 20
+)
+
+// writerOp is an operation requested from the helper.
+type writerOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Data string `json:"data,omitempty"`
+}
+
+// writerAck is the helper's acknowledgement of an operation. Errno is set if
+// the operation failed with an errno, so that the client can check the error,
+// e.g. with os.IsNotExist. Otherwise, Error describes the failure, if any.
+type writerAck struct {
+	Errno syscall.Errno `json:"errno,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// HelperWriter is a Writer that sends operations to a helper process running
+// ServeWriter, e.g. a setuid helper, over a pair of pipes. Each operation
+// waits for the helper's acknowledgement. It's safe for concurrent use.
+type HelperWriter struct {
+	// mu serializes operations, so that acknowledgements match them.
+	mu sync.Mutex
+	r  io.Reader
+	w  io.Writer
+}
+
+// NewHelperWriter returns a HelperWriter that sends operations to 'w' and
+// reads acknowledgements from 'r'.
+func NewHelperWriter(r io.Reader, w io.Writer) *HelperWriter {
+	return &HelperWriter{r: r, w: w}
+}
+
+// MkdirAll implements Writer.MkdirAll.
+func (h *HelperWriter) MkdirAll(path string) error {
+	return h.do(writerOp{Op: opMkdirAll, Path: path})
+}
+
+// WriteFile implements Writer.WriteFile.
+func (h *HelperWriter) WriteFile(path, data string) error {
+	return h.do(writerOp{Op: opWriteFile, Path: path, Data: data})
+}
+
+// Remove implements Writer.Remove.
+func (h *HelperWriter) Remove(path string) error {
+	return h.do(writerOp{Op: opRemove, Path: path})
+}
+
+func (h *HelperWriter) do(op writerOp) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := writeFrame(h.w, &op); err != nil {
+		return fmt.Errorf("sending %s %q to cgroup helper: %v", op.Op, op.Path, err)
+	}
+	var ack writerAck
+	if err := readFrame(h.r, &ack); err != nil {
+		return fmt.Errorf("reading cgroup helper acknowledgement of %s %q: %v", op.Op, op.Path, err)
+	}
+	if ack.Errno != 0 {
+		return &os.PathError{Op: op.Op, Path: op.Path, Err: ack.Errno}
+	}
+	if ack.Error != "" {
+		return fmt.Errorf("cgroup helper failed to %s %q: %s", op.Op, op.Path, ack.Error)
+	}
+	return nil
+}
+
+// ServeWriter runs the helper side of HelperWriter. It reads operations from
+// 'r', performs them with 'w', usually a LocalWriter, and acknowledges each one
+// to 'out'. It returns nil once 'r' is closed. Operations on paths outside of
+// the cgroup hierarchies are rejected, so that a privileged helper can't be
+// used to change other files.
+func ServeWriter(r io.Reader, out io.Writer, w Writer) error {
+	for {
+		var op writerOp
+		if err := readFrame(r, &op); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var ack writerAck
+		if err := serveOp(w, &op); err != nil {
+			var errno syscall.Errno
+			if errors.As(err, &errno) {
+				ack.Errno = errno
+			} else {
+				ack.Error = err.Error()
+			}
+		}
+		if err := writeFrame(out, &ack); err != nil {
+			return err
+		}
+	}
+}
+
+func serveOp(w Writer, op *writerOp) error {
+	if !inCgroupfs(op.Path) {
+		return fmt.Errorf("%q is not in a cgroup hierarchy", op.Path)
+	}
+	switch op.Op {
+	case opMkdirAll:
+		return w.MkdirAll(op.Path)
+	case opWriteFile:
+		return w.WriteFile(op.Path, op.Data)
+	case opRemove:
+		return w.Remove(op.Path)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// inCgroupfs returns true if 'path' is a clean absolute path strictly below
+// cgroupRoot or one of the cgroup mounts.
+func inCgroupfs(path string) bool {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return false
+	}
+	roots := []string{cgroupRoot}
+	if h, err := loadHierarchies(); err == nil {
+		if h.unified != "" {
+			roots = append(roots, h.unified)
+		}
+		for _, mount := range h.v1 {
+			roots = append(roots, mount)
+		}
+	}
+	for _, root := range roots {
+		if strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFrame(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	_, err = w.Write(append(frame, b...))
+	return err
+}
+
+// readFrame reads a frame into 'v'. It returns io.EOF if 'r' is closed before
+// the frame starts.
+func readFrame(r io.Reader, v interface{}) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", size, maxFrameSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
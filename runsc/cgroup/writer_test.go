@@ -0,0 +1,113 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// startHelper runs ServeWriter over a pipe pair and returns a HelperWriter
+// connected to it. The returned function stops the helper and returns the
+// result of ServeWriter.
+func startHelper(t *testing.T) (*HelperWriter, func() error) {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	ackR, ackW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeWriter(reqR, ackW, LocalWriter{})
+		ackW.Close()
+	}()
+	return NewHelperWriter(ackR, reqW), func() error {
+		reqW.Close()
+		return <-done
+	}
+}
+
+func TestHelperWriter(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	w, stop := startHelper(t)
+
+	dir := filepath.Join(root, "parent", "test")
+	if err := w.MkdirAll(dir); err != nil {
+		t.Fatalf("MkdirAll(%q): %v", dir, err)
+	}
+	if err := w.WriteFile(filepath.Join(dir, "pids.max"), "10"); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if got := readFile(t, root, "parent/test/pids.max"); got != "10" {
+		t.Errorf("pids.max got: %q, want: %q", got, "10")
+	}
+
+	// Errors are reported with their errno.
+	missing := filepath.Join(root, "missing", "pids.max")
+	if err := w.WriteFile(missing, "10"); !os.IsNotExist(err) {
+		t.Errorf("WriteFile(%q) got: %v, want: not exist", missing, err)
+	}
+
+	// Paths outside of cgroupfs are rejected.
+	outside := filepath.Join(filepath.Dir(root), "outside")
+	for _, path := range []string{outside, "relative/test", filepath.Join(root, "test", "..", "..", "outside")} {
+		if err := w.MkdirAll(path); err == nil {
+			t.Errorf("MkdirAll(%q) should have failed", path)
+			os.RemoveAll(path)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, "pids.max")); err != nil {
+		t.Fatalf("os.Remove(): %v", err)
+	}
+	if err := w.Remove(dir); err != nil {
+		t.Fatalf("Remove(%q): %v", dir, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%q was not removed, stat: %v", dir, err)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("ServeWriter(): %v", err)
+	}
+}
+
+func TestInstallHelperWriter(t *testing.T) {
+	root, cleanup := setupRoot(t, true)
+	defer cleanup()
+	w, stop := startHelper(t)
+	defer stop()
+
+	c := &Cgroup{Name: "test"}
+	res := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: int64Ptr(1 << 30)},
+		Pids:   &specs.LinuxPids{Limit: 100},
+	}
+	if err := c.InstallWithOpts(context.Background(), res, InstallOpts{Writer: w}); err != nil {
+		t.Fatalf("InstallWithOpts(): %v", err)
+	}
+	for file, want := range map[string]string{
+		"test/memory.max": "1073741824",
+		"test/pids.max":   "100",
+	} {
+		if got := readFile(t, root, file); got != want {
+			t.Errorf("%s got: %q, want: %q", file, got, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SetXattr sets the extended attribute 'name' on the cgroup directory of the
+// memory controller (or the cgroup v2 directory), e.g. to record the sandbox ID
+// for external tools. cgroupfs supports "user." attributes with cgroup v2 since
+// Linux 5.7, and "trusted." attributes on v1 hierarchies mounted with the
+// "xattr" option. ErrNotSupported is returned if the attribute can't be set.
+func (c *Cgroup) SetXattr(name, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := c.makePath("memory")
+	if err := syscall.Setxattr(path, name, []byte(value), 0); err != nil {
+		if err == syscall.ENOTSUP {
+			return fmt.Errorf("setting xattr %q on %q: %w", name, path, ErrNotSupported)
+		}
+		return fmt.Errorf("setting xattr %q on %q: %w", name, path, err)
+	}
+	return nil
+}
+
+// GetXattr returns the value of extended attribute 'name' set with SetXattr.
+// syscall.ENODATA is returned if the attribute isn't set.
+func (c *Cgroup) GetXattr(name string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	path := c.makePath("memory")
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err == nil {
+			buf := make([]byte, size)
+			size, err = syscall.Getxattr(path, name, buf)
+			if err == nil {
+				return string(buf[:size]), nil
+			}
+			if err == syscall.ERANGE {
+				// Value grew since its size was read, retry.
+				continue
+			}
+		}
+		if err == syscall.ENOTSUP {
+			return "", fmt.Errorf("getting xattr %q on %q: %w", name, path, ErrNotSupported)
+		}
+		return "", fmt.Errorf("getting xattr %q on %q: %w", name, path, err)
+	}
+}
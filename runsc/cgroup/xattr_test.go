@@ -0,0 +1,53 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestXattr(t *testing.T) {
+	_, cleanup := setupRoot(t, true)
+	defer cleanup()
+
+	c := Cgroup{Name: "test-xattr"}
+	if err := c.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer c.Uninstall()
+
+	if _, err := c.GetXattr("user.runsc.id"); !errors.Is(err, syscall.ENODATA) && !errors.Is(err, ErrNotSupported) {
+		t.Errorf("GetXattr() before SetXattr() got: %v, want: %v", err, syscall.ENODATA)
+	}
+	if err := c.SetXattr("user.runsc.id", "sandbox-123"); err != nil {
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("SetXattr(): %v", err)
+		}
+		t.Fatalf("SetXattr(): %v", err)
+	}
+	if got, err := c.GetXattr("user.runsc.id"); err != nil || got != "sandbox-123" {
+		t.Errorf("GetXattr() got: %q, %v, want: %q, nil", got, err, "sandbox-123")
+	}
+
+	// Empty values are valid.
+	if err := c.SetXattr("user.runsc.id", ""); err != nil {
+		t.Fatalf("SetXattr(): %v", err)
+	}
+	if got, err := c.GetXattr("user.runsc.id"); err != nil || got != "" {
+		t.Errorf("GetXattr() got: %q, %v, want: %q, nil", got, err, "")
+	}
+}
@@ -16,6 +16,7 @@ package cmd
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
@@ -46,6 +47,9 @@ type Debug struct {
 	logPackets       string
 	duration         time.Duration
 	ps               bool
+	cgroup           bool
+	cgroupDump       string
+	cgroupApply      string
 }
 
 // Name implements subcommands.Command.
@@ -79,6 +83,9 @@ func (d *Debug) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&d.logLevel, "log-level", "", "The log level to set: warning (0), info (1), or debug (2).")
 	f.StringVar(&d.logPackets, "log-packets", "", "A boolean value to enable or disable packet logging: true or false.")
 	f.BoolVar(&d.ps, "ps", false, "lists processes")
+	f.BoolVar(&d.cgroup, "cgroup", false, "logs a summary of the sandbox cgroup, with its limits.")
+	f.StringVar(&d.cgroupDump, "cgroup-dump", "", "writes the sandbox cgroup configuration to the given file as JSON.")
+	f.StringVar(&d.cgroupApply, "cgroup-apply", "", "applies the cgroup configuration in the given JSON file, in the format written by --cgroup-dump, to the sandbox cgroup.")
 }
 
 // Execute implements subcommands.Command.Execute.
@@ -141,6 +148,34 @@ func (d *Debug) Execute(_ context.Context, f *flag.FlagSet, args ...interface{})
 		}
 		log.Infof("     *** Stack dump ***\n%s", stacks)
 	}
+	if d.cgroup || d.cgroupDump != "" || d.cgroupApply != "" {
+		if c.Sandbox.Cgroup == nil {
+			return Errorf("sandbox %q has no cgroup", c.Sandbox.ID)
+		}
+	}
+	if d.cgroup {
+		log.Infof("Sandbox cgroup: %s", c.Sandbox.Cgroup.Summary())
+	}
+	if d.cgroupDump != "" {
+		out, err := c.Sandbox.Cgroup.DumpJSON()
+		if err != nil {
+			return Errorf(err.Error())
+		}
+		if err := ioutil.WriteFile(d.cgroupDump, out, 0644); err != nil {
+			return Errorf(err.Error())
+		}
+		log.Infof("Cgroup configuration written to %q", d.cgroupDump)
+	}
+	if d.cgroupApply != "" {
+		data, err := ioutil.ReadFile(d.cgroupApply)
+		if err != nil {
+			return Errorf(err.Error())
+		}
+		if err := c.Sandbox.Cgroup.ApplyJSON(data); err != nil {
+			return Errorf("applying cgroup configuration from %q: %v", d.cgroupApply, err)
+		}
+		log.Infof("Cgroup configuration applied from %q", d.cgroupApply)
+	}
 	if d.profileHeap != "" {
 		f, err := os.Create(d.profileHeap)
 		if err != nil {
@@ -201,6 +201,14 @@ func Load(rootDir, partialID string) (*Container, error) {
 		}
 	}
 
+	// The host cgroup configuration may have changed since the sandbox was
+	// created, in which case the recorded cgroup paths are stale.
+	if c.Status != Stopped && c.Sandbox != nil && c.Sandbox.Cgroup != nil {
+		if err := c.Sandbox.Cgroup.Resolve(c.Sandbox.Pid); err != nil {
+			log.Warningf("Resolving cgroup of sandbox %q: %v", c.Sandbox.ID, err)
+		}
+	}
+
 	return c, nil
 }
 
@@ -277,6 +285,9 @@ func New(conf *boot.Config, args Args) (*Container, error) {
 	if err := os.MkdirAll(conf.RootDir, 0711); err != nil {
 		return nil, fmt.Errorf("creating container root directory %q: %v", conf.RootDir, err)
 	}
+	if err := addTestOnlyHook(conf, args.Spec); err != nil {
+		return nil, err
+	}
 
 	c := &Container{
 		ID:            args.ID,
@@ -318,7 +329,16 @@ func New(conf *boot.Config, args Args) (*Container, error) {
 		}
 		if cg != nil {
 			// If there is cgroup config, install it before creating sandbox process.
-			if err := cg.Install(args.Spec.Linux.Resources); err != nil {
+			// Rootless sandboxes may not be allowed to configure all controllers,
+			// and on cgroup v2 can only create cgroups in the subtree delegated to
+			// the user.
+			opts := cgroup.InstallOpts{BestEffort: conf.Rootless}
+			if conf.Rootless {
+				if mode, err := cgroup.Mode(); err == nil && mode == cgroup.Unified {
+					opts.Delegated = true
+				}
+			}
+			if err := cg.InstallWithOpts(context.Background(), args.Spec.Linux.Resources, opts); err != nil {
 				return nil, fmt.Errorf("configuring cgroup: %v", err)
 			}
 		}
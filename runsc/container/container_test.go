@@ -2227,6 +2227,71 @@ func TestTTYField(t *testing.T) {
 	}
 }
 
+// TestTestOnlyHook checks that the test only hook is taken from the hook
+// directory only, and is removed from the container environment.
+func TestTestOnlyHook(t *testing.T) {
+	var dirs []string
+	for _, name := range []string{"hooks", "outside"} {
+		dir, err := ioutil.TempDir(testutil.TmpDir(), name)
+		if err != nil {
+			t.Fatalf("ioutil.TempDir(): %v", err)
+		}
+		defer os.RemoveAll(dir)
+		// Hooks are added with symlinks resolved.
+		if dir, err = filepath.EvalSymlinks(dir); err != nil {
+			t.Fatalf("filepath.EvalSymlinks(): %v", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	dir := dirs[0]
+	hook := filepath.Join(dir, "hook.sh")
+	outside := filepath.Join(dirs[1], "hook.sh")
+	link := filepath.Join(dir, "link.sh")
+	for _, path := range []string{hook, outside} {
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+	}
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatalf("os.Symlink(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "in dir", path: hook},
+		{name: "outside dir", path: outside, wantErr: true},
+		{name: "symlink outside dir", path: link, wantErr: true},
+		{name: "relative", path: "hook.sh", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := testutil.TestConfig(t)
+			conf.TestOnlyHookDir = dir
+			spec := testutil.NewSpecWithArgs("true")
+			spec.Process.Env = append(spec.Process.Env, testOnlyHookEnv+"="+tc.path)
+
+			err := addTestOnlyHook(conf, spec)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("addTestOnlyHook() got error: %v, want error: %t", err, tc.wantErr)
+			}
+			if _, ok := specutils.EnvVar(spec.Process.Env, testOnlyHookEnv); ok {
+				t.Errorf("%s was not removed from the environment: %v", testOnlyHookEnv, spec.Process.Env)
+			}
+			if tc.wantErr {
+				if spec.Hooks != nil && len(spec.Hooks.Prestart) > 0 {
+					t.Errorf("addTestOnlyHook() added hooks: %+v", spec.Hooks.Prestart)
+				}
+				return
+			}
+			if spec.Hooks == nil || len(spec.Hooks.Prestart) != 1 || spec.Hooks.Prestart[0].Path != hook {
+				t.Errorf("addTestOnlyHook() got hooks: %+v, want: %q", spec.Hooks, hook)
+			}
+		})
+	}
+}
+
 // executeSync synchronously executes a new process.
 func (cont *Container) executeSync(args *control.ExecArgs) (syscall.WaitStatus, error) {
 	pid, err := cont.Execute(args)
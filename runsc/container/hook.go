@@ -25,6 +25,8 @@ import (
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/runsc/boot"
+	"gvisor.dev/gvisor/runsc/specutils"
 )
 
 // This file implements hooks as defined in OCI spec:
@@ -59,6 +61,52 @@ func executeHooks(hooks []specs.Hook, s specs.State) error {
 	return nil
 }
 
+// testOnlyHookEnv is the container environment variable with the path of the
+// test only prestart hook, see boot.Config.TestOnlyHookDir.
+const testOnlyHookEnv = "RUNSC_TEST_HOOK"
+
+// addTestOnlyHook adds a prestart hook to the spec if the container
+// environment sets testOnlyHookEnv. The variable is removed from the
+// environment, and the hook must be in conf.TestOnlyHookDir, since it's
+// executed on the host by the runtime.
+func addTestOnlyHook(conf *boot.Config, spec *specs.Spec) error {
+	if len(conf.TestOnlyHookDir) == 0 || spec.Process == nil {
+		return nil
+	}
+	path, ok := specutils.EnvVar(spec.Process.Env, testOnlyHookEnv)
+	if !ok {
+		return nil
+	}
+	env := spec.Process.Env[:0]
+	for _, e := range spec.Process.Env {
+		if !strings.HasPrefix(e, testOnlyHookEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	spec.Process.Env = env
+	if path == "" {
+		return nil
+	}
+
+	dir, err := filepath.EvalSymlinks(conf.TestOnlyHookDir)
+	if err != nil {
+		return fmt.Errorf("resolving test only hook directory: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("resolving test only hook: %v", err)
+	}
+	if !strings.HasPrefix(resolved, filepath.Clean(dir)+"/") {
+		return fmt.Errorf("test only hook %q is not in %q", path, conf.TestOnlyHookDir)
+	}
+	log.Infof("Adding test only prestart hook %q", resolved)
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
+	}
+	spec.Hooks.Prestart = append(spec.Hooks.Prestart, specs.Hook{Path: resolved})
+	return nil
+}
+
 func executeHook(h specs.Hook, s specs.State) error {
 	log.Debugf("Executing hook %+v, state: %+v", h, s)
 
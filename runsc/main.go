@@ -89,6 +89,7 @@ var (
 	// Test flags, not to be used outside tests, ever.
 	testOnlyAllowRunAsCurrentUserWithoutChroot = flag.Bool("TESTONLY-unsafe-nonroot", false, "TEST ONLY; do not ever use! This skips many security measures that isolate the host from the sandbox.")
 	testOnlyTestNameEnv                        = flag.String("TESTONLY-test-name-env", "", "TEST ONLY; do not ever use! Used for automated tests to improve logging.")
+	testOnlyHookDir                            = flag.String("TESTONLY-hook-dir", "", "TEST ONLY; do not ever use! Used for automated tests to add a prestart hook from this directory, selected by the container environment.")
 )
 
 func main() {
@@ -235,6 +236,7 @@ func main() {
 
 		TestOnlyAllowRunAsCurrentUserWithoutChroot: *testOnlyAllowRunAsCurrentUserWithoutChroot,
 		TestOnlyTestNameEnv:                        *testOnlyTestNameEnv,
+		TestOnlyHookDir:                            *testOnlyHookDir,
 	}
 	if len(*straceSyscalls) != 0 {
 		conf.StraceSyscalls = strings.Split(*straceSyscalls, ",")
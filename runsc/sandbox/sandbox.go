@@ -685,10 +685,9 @@ func (s *Sandbox) createSandboxProcess(conf *boot.Config, args *Args, startSyncF
 		if err != nil {
 			return fmt.Errorf("getting memory limit from cgroups: %v", err)
 		}
-		// When memory limit is unset, a "large" number is returned. In that case,
-		// just stick with the default.
-		if mem < 0x7ffffffffffff000 {
-			cmd.Args = append(cmd.Args, "--total-memory", strconv.FormatUint(mem, 10))
+		// When memory limit is unset, just stick with the default.
+		if mem != cgroup.Unlimited {
+			cmd.Args = append(cmd.Args, "--total-memory", strconv.FormatInt(mem, 10))
 		}
 	}
 
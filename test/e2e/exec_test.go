@@ -22,6 +22,7 @@
 package integration
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
@@ -174,6 +175,69 @@ func TestExecJobControl(t *testing.T) {
 	}
 }
 
+// Test that input written to a streaming exec session is echoed back, and that
+// the session exits once its input is closed.
+func TestExecStream(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	// Start the container.
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	p, err := d.ExecStream(dockerutil.RunOpts{}, "cat")
+	if err != nil {
+		t.Fatalf("docker exec failed: %v", err)
+	}
+	stdout := bufio.NewReader(p.Stdout)
+	for _, want := range []string{"hello\n", "world\n"} {
+		if _, err := p.Stdin.Write([]byte(want)); err != nil {
+			t.Fatalf("error writing to stdin: %v", err)
+		}
+		got, err := stdout.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading from stdout: %v", err)
+		}
+		if got != want {
+			t.Errorf("cat got: %q, want: %q", got, want)
+		}
+	}
+	if err := p.Stdin.Close(); err != nil {
+		t.Fatalf("error closing stdin: %v", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Errorf("exec process failed: %v", err)
+	}
+}
+
+// Test that signals are delivered to a streaming exec session.
+func TestExecStreamSignal(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	// Start the container.
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	p, err := d.ExecStream(dockerutil.RunOpts{}, "sleep", "1000")
+	if err != nil {
+		t.Fatalf("docker exec failed: %v", err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal() failed: %v", err)
+	}
+	// The exit code is reported as 128 plus the signal number.
+	if got, want := dockerutil.ExitCode(p.Wait()), 128+int(syscall.SIGTERM); got != want {
+		t.Errorf("exec process exit code got: %d, want: %d", got, want)
+	}
+}
+
 // Test that failure to exec returns proper error message.
 func TestExecError(t *testing.T) {
 	d := dockerutil.MakeDocker(t)
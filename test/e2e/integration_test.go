@@ -24,10 +24,13 @@ package integration
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -36,6 +39,7 @@ import (
 
 	"gvisor.dev/gvisor/pkg/test/dockerutil"
 	"gvisor.dev/gvisor/pkg/test/testutil"
+	"gvisor.dev/gvisor/runsc/cgroup"
 )
 
 // httpRequestSucceeds sends a request to a given url and checks that the status is OK.
@@ -81,7 +85,7 @@ func TestLifeCycle(t *testing.T) {
 		t.Errorf("http request failed: %v", err)
 	}
 
-	if err := d.Stop(); err != nil {
+	if err := d.Stop(10 * time.Second); err != nil {
 		t.Fatalf("docker stop failed: %v", err)
 	}
 	if err := d.Remove(); err != nil {
@@ -153,6 +157,63 @@ func TestPauseResume(t *testing.T) {
 	}
 }
 
+// TestPauseHaltsCPU checks that a paused sandbox doesn't make progress.
+func TestPauseHaltsCPU(t *testing.T) {
+	if !testutil.IsCheckpointSupported() {
+		t.Skip("Pause/resume is not supported.")
+	}
+
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	// Start a container that keeps a CPU busy.
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+	}, "sh", "-c", "while true; do :; done"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	if err := d.Pause(); err != nil {
+		t.Fatalf("docker pause failed: %v", err)
+	}
+	// Pausing again is a noop.
+	if err := d.Pause(); err != nil {
+		t.Fatalf("docker pause on paused container failed: %v", err)
+	}
+	if paused, err := d.Paused(); err != nil || !paused {
+		t.Fatalf("Paused() got: %t, %v, want: true, nil", paused, err)
+	}
+
+	before, err := d.CPUUsage()
+	if err != nil {
+		t.Fatalf("CPUUsage() failed: %v", err)
+	}
+	time.Sleep(time.Second)
+	after, err := d.CPUUsage()
+	if err != nil {
+		t.Fatalf("CPUUsage() failed: %v", err)
+	}
+	if after != before {
+		t.Errorf("CPU usage changed while paused, before: %v, after: %v", before, after)
+	}
+
+	if err := d.Unpause(); err != nil {
+		t.Fatalf("docker unpause failed: %v", err)
+	}
+	// Unpausing a running container is a noop.
+	if err := d.Unpause(); err != nil {
+		t.Fatalf("docker unpause on running container failed: %v", err)
+	}
+	time.Sleep(time.Second)
+	resumed, err := d.CPUUsage()
+	if err != nil {
+		t.Fatalf("CPUUsage() failed: %v", err)
+	}
+	if resumed <= after {
+		t.Errorf("CPU usage didn't increase after unpause, paused: %v, resumed: %v", after, resumed)
+	}
+}
+
 func TestCheckpointRestore(t *testing.T) {
 	if !testutil.IsCheckpointSupported() {
 		t.Skip("Pause/resume is not supported.")
@@ -361,6 +422,564 @@ func TestTmpFile(t *testing.T) {
 	}
 }
 
+// TestReadOnlyRoot checks that writes to a read-only root filesystem fail with
+// EROFS, while writes to a tmpfs mount still succeed.
+func TestReadOnlyRoot(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:    "basic/alpine",
+		ReadOnly: true,
+		Extra:    []string{"--tmpfs=/scratch"},
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	out, err := d.Exec(dockerutil.RunOpts{}, "touch", "/foo")
+	if err == nil {
+		t.Fatalf("writing to read-only root succeeded")
+	}
+	if want := "Read-only file system"; !strings.Contains(out, want) {
+		t.Errorf("writing to read-only root got: %q, want: %q", out, want)
+	}
+	if _, err := d.Exec(dockerutil.RunOpts{}, "touch", "/scratch/foo"); err != nil {
+		t.Errorf("writing to tmpfs failed: %v", err)
+	}
+}
+
+// TestUser checks that the identity inside the sandbox is the one requested,
+// independently of the daemon's user namespace remapping.
+func TestUser(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	// Files created by the container are owned on the host by the container
+	// IDs, mapped by the daemon's userns-remap setting.
+	dir, err := ioutil.TempDir("", "user")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("os.Chmod() failed: %v", err)
+	}
+	d.Mount("/data", dir, dockerutil.ReadWrite)
+
+	got, err := d.Run(dockerutil.RunOpts{
+		Image: "basic/alpine",
+		User:  "1000:1000",
+	}, "/bin/sh", "-c", "touch /data/file && echo $(id -u):$(id -g)")
+	if err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	if got, want := strings.TrimSpace(got), "1000:1000"; got != want {
+		t.Errorf("id got: %q, want: %q", got, want)
+	}
+
+	wantUID, wantGID, err := dockerutil.RemappedIDs(1000, 1000)
+	if err != nil {
+		t.Fatalf("RemappedIDs() failed: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(dir, "file"), &st); err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if int(st.Uid) != wantUID || int(st.Gid) != wantGID {
+		t.Errorf("host file owner got: %d:%d, want: %d:%d", st.Uid, st.Gid, wantUID, wantGID)
+	}
+}
+
+// TestLabels checks that labels are set on the container.
+func TestLabels(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	want := map[string]string{
+		"dev.gvisor.test.foo": "bar",
+		"dev.gvisor.test.baz": "",
+	}
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:  "basic/alpine",
+		Labels: want,
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	got, err := d.Labels()
+	if err != nil {
+		t.Fatalf("docker.Labels() failed: %v", err)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("label %q got: %q, want: %q", k, got[k], v)
+		}
+	}
+}
+
+// TestShmSize checks that the requested /dev/shm size is honored.
+func TestShmSize(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	const want = 64 << 20
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:   "basic/alpine",
+		ShmSize: want,
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	got, err := d.ShmSize()
+	if err != nil {
+		t.Fatalf("docker.ShmSize() failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("/dev/shm size got: %d, want: %d", got, want)
+	}
+}
+
+// TestCPUSet checks that a container pinned to a CPU only sees that CPU.
+func TestCPUSet(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:      "basic/alpine",
+		CPUSetCPUs: "0",
+		CPUSetMems: "0",
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	// The sandbox sizes the number of CPUs based on the host cpuset.
+	out, err := d.Exec(dockerutil.RunOpts{}, "nproc")
+	if err != nil {
+		t.Fatalf("docker exec failed: %v", err)
+	}
+	if got := strings.TrimSpace(out); got != "1" {
+		t.Errorf("nproc got: %q, want: %q", got, "1")
+	}
+
+	cpus, err := d.CPUsAllowed()
+	if err != nil {
+		t.Fatalf("CPUsAllowed() failed: %v", err)
+	}
+	if len(cpus) != 1 || cpus[0] != 0 {
+		t.Errorf("CPUsAllowed() got: %v, want: [0]", cpus)
+	}
+}
+
+// TestSandboxCPUs checks that the sandbox exposes the number of CPUs it was given.
+func TestSandboxCPUs(t *testing.T) {
+	const want = 2
+	if n := runtime.NumCPU(); n < want {
+		t.Skipf("host has %d CPUs, need at least %d", n, want)
+	}
+
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+		CPUs:  want,
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	got, err := d.NumCPU()
+	if err != nil {
+		t.Fatalf("NumCPU() failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("NumCPU() got: %d, want: %d", got, want)
+	}
+}
+
+// TestInitProcess checks which process is PID 1 with and without docker's init
+// shim.
+func TestInitProcess(t *testing.T) {
+	for _, tc := range []struct {
+		init bool
+		want string
+	}{
+		{init: false, want: "sleep"},
+		{init: true, want: "docker-init"},
+	} {
+		t.Run(fmt.Sprintf("init=%t", tc.init), func(t *testing.T) {
+			d := dockerutil.MakeDocker(t)
+			defer d.CleanUp()
+
+			if err := d.Spawn(dockerutil.RunOpts{
+				Image: "basic/alpine",
+				Init:  tc.init,
+			}, "sleep", "1000"); err != nil {
+				t.Fatalf("docker run failed: %v", err)
+			}
+
+			got, err := d.InitComm()
+			if err != nil {
+				t.Fatalf("InitComm() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("InitComm() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDNS checks that names are resolved through the sandbox network stack
+// with the configured DNS server, and that they can't be without network.
+func TestDNS(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    dockerutil.RunOpts
+		resolve bool
+	}{
+		{
+			name:    "custom",
+			opts:    dockerutil.RunOpts{Image: "basic/alpine", DNS: []string{"8.8.8.8"}},
+			resolve: true,
+		},
+		{
+			name: "none",
+			opts: dockerutil.RunOpts{Image: "basic/alpine", Network: "none"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := dockerutil.MakeDocker(t)
+			defer d.CleanUp()
+
+			if err := d.Spawn(tc.opts, "sleep", "1000"); err != nil {
+				t.Fatalf("docker run failed: %v", err)
+			}
+			if len(tc.opts.DNS) > 0 {
+				conf, err := d.Exec(dockerutil.RunOpts{}, "cat", "/etc/resolv.conf")
+				if err != nil {
+					t.Fatalf("docker exec failed: %v", err)
+				}
+				if want := "nameserver " + tc.opts.DNS[0]; !strings.Contains(conf, want) {
+					t.Errorf("/etc/resolv.conf got: %q, want: %q", conf, want)
+				}
+			}
+
+			ips, err := d.Resolve("example.com")
+			if !tc.resolve {
+				if err == nil {
+					t.Errorf("Resolve() got: %v, want error", ips)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() failed: %v", err)
+			}
+			if len(ips) == 0 {
+				t.Errorf("Resolve() got no address")
+			}
+		})
+	}
+}
+
+// TestRunscState checks that the runtime's state can be collected for a
+// running container.
+func TestRunscState(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{Image: "basic/alpine"}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	state, err := d.RunscState()
+	if err != nil {
+		t.Fatalf("RunscState() failed: %v", err)
+	}
+	if len(state) == 0 {
+		t.Errorf("RunscState() got no state files")
+	}
+}
+
+// TestSandboxHook checks that the PID recorded by the sandbox hook at the
+// container start is the sandbox PID reported by docker.
+func TestSandboxHook(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{Image: "basic/alpine", SandboxHook: true}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	rec, err := d.SandboxHookRecord()
+	if err != nil {
+		t.Fatalf("SandboxHookRecord() failed: %v", err)
+	}
+	pid, err := d.SandboxPid()
+	if err != nil {
+		t.Fatalf("SandboxPid() failed: %v", err)
+	}
+	if rec.Pid != pid {
+		t.Errorf("sandbox hook got pid: %d, want: %d", rec.Pid, pid)
+	}
+	if id, err := d.ID(); err != nil || rec.ID != id {
+		t.Errorf("sandbox hook got ID: %q, want: %q, %v", rec.ID, id, err)
+	}
+	t.Logf("Runtime command line: %q", rec.Args)
+}
+
+// TestProbeSyscallUnsupported checks that a syscall the sandbox doesn't
+// implement fails with ENOSYS.
+func TestProbeSyscallUnsupported(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	errno, err := d.ProbeSyscall(syscall.SYS_NFSSERVCTL)
+	if err != nil {
+		t.Fatalf("ProbeSyscall() failed: %v", err)
+	}
+	if errno != syscall.ENOSYS {
+		t.Errorf("nfsservctl got errno: %v, want: %v", errno, syscall.ENOSYS)
+	}
+}
+
+// TestOOMKillDisable checks that a container exceeding its memory limit hangs,
+// rather than being killed, when the OOM killer is disabled.
+func TestOOMKillDisable(t *testing.T) {
+	mode, err := cgroup.Mode()
+	if err != nil {
+		t.Fatalf("cgroup.Mode() failed: %v", err)
+	}
+	if mode == cgroup.Unified {
+		t.Skip("--oom-kill-disable only applies to cgroup v1.")
+	}
+
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	// Allocate more than the limit, without swap to fall back to.
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:          "basic/python",
+		Memory:         64 * 1024, // 64MB.
+		OOMKillDisable: true,
+		Extra:          []string{"--memory-swap=64m"},
+	}, "python", "-c", "x = bytearray(256 << 20)"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	if ws, err := d.Wait(10 * time.Second); err == nil {
+		t.Fatalf("container exited with status %v, want it to hang", ws)
+	}
+	if killed, err := d.OOMKilled(); err != nil {
+		t.Fatalf("OOMKilled() failed: %v", err)
+	} else if killed {
+		t.Errorf("container was OOM killed with the OOM killer disabled")
+	}
+}
+
+// Test that Run returns the output and exit status of short-lived containers.
+func TestRun(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	out, err := d.Run(dockerutil.RunOpts{Image: "basic/alpine"}, "echo", "hello")
+	if err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	if want := "hello\n"; out != want {
+		t.Errorf("docker run got: %q, want: %q", out, want)
+	}
+	d.CleanUp()
+
+	_, err = d.Run(dockerutil.RunOpts{Image: "basic/alpine"}, "sh", "-c", "exit 3")
+	if got := dockerutil.ExitCode(err); got != 3 {
+		t.Errorf("docker run exit code got: %d (%v), want: 3", got, err)
+	}
+}
+
+// Test that containers can be attached to a user defined network.
+func TestNetwork(t *testing.T) {
+	network := testutil.RandomID("network")
+	if out, err := exec.Command("docker", "network", "create", network).CombinedOutput(); err != nil {
+		t.Fatalf("docker network create failed: %v, output: %s", err, out)
+	}
+	defer exec.Command("docker", "network", "rm", network).Run()
+
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:   "basic/alpine",
+		Network: network,
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	ips, err := d.NetworkSettings()
+	if err != nil {
+		t.Fatalf("NetworkSettings() failed: %v", err)
+	}
+	if _, ok := ips[network]; !ok {
+		t.Errorf("NetworkSettings() got: %v, want address on network %q", ips, network)
+	}
+	if ip, ok := ips["bridge"]; ok {
+		t.Errorf("NetworkSettings() got address %v on the default bridge, want none", ip)
+	}
+}
+
+// Test that WaitForFile waits for a file created after the container started.
+func TestWaitForFile(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{Image: "basic/alpine"}, "sh", "-c", "sleep 2 && touch /tmp/ready && sleep 1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	if err := d.WaitForFile("/tmp/missing", time.Second); err == nil {
+		t.Errorf("WaitForFile() should have timed out for a missing file")
+	}
+	if err := d.WaitForFile("/tmp/ready", 10*time.Second); err != nil {
+		t.Fatalf("WaitForFile() failed: %v", err)
+	}
+}
+
+// Test that environment variables are propagated to the sandbox verbatim.
+func TestEnv(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	want := map[string]string{
+		"GVISOR_SIMPLE": "value",
+		"GVISOR_QUOTED": `it's "quoted" $HOME`,
+		"GVISOR_EMPTY":  "",
+	}
+	var env []string
+	for k, v := range want {
+		env = append(env, k+"="+v)
+	}
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+		Env:   env,
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	got, err := d.Environ()
+	if err != nil {
+		t.Fatalf("Environ() failed: %v", err)
+	}
+	for k, v := range want {
+		if val, ok := got[k]; !ok || val != v {
+			t.Errorf("%s got: %q (present: %t), want: %q", k, val, ok, v)
+		}
+	}
+}
+
+// seccompProfile allows all syscalls, except for the ones used by mkdir.
+const seccompProfile = `{
+	"defaultAction": "SCMP_ACT_ALLOW",
+	"syscalls": [
+		{
+			"names": ["mkdir", "mkdirat"],
+			"action": "SCMP_ACT_ERRNO"
+		}
+	]
+}`
+
+// Test that a container seccomp profile is applied on top of the sandbox.
+func TestSeccompProfile(t *testing.T) {
+	profile, err := ioutil.TempFile(testutil.TmpDir(), "seccomp")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile(): %v", err)
+	}
+	defer os.Remove(profile.Name())
+	if _, err := profile.WriteString(seccompProfile); err != nil {
+		t.Fatalf("writing profile: %v", err)
+	}
+	profile.Close()
+
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image:          "basic/alpine",
+		SeccompProfile: profile.Name(),
+	}, "sleep", "1000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+
+	out, err := exec.Command("docker", "inspect", "-f", "{{.HostConfig.SecurityOpt}}", d.Name).CombinedOutput()
+	if err != nil {
+		t.Fatalf("docker inspect failed: %v, output: %s", err, out)
+	}
+	if !strings.Contains(string(out), "seccomp=") {
+		t.Errorf("container security options got: %q, want seccomp profile", out)
+	}
+
+	// TODO(gvisor.dev/issue/510): runsc ignores the container seccomp profile.
+	if strings.HasPrefix(d.Runtime, "runsc") {
+		t.Skip("Container seccomp profile is not applied by runsc.")
+	}
+	if err := d.ExecBlocked("Operation not permitted", "mkdir", "/tmp/blocked"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestStop checks that SIGTERM is forwarded to the container on 'docker stop',
+// and that it's killed once the grace period expires if it doesn't exit.
+func TestStop(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cmd  string
+		want dockerutil.ExitInfo
+	}{
+		{
+			name: "sigterm",
+			cmd:  "trap 'exit 0' TERM; echo ready; while true; do sleep 0.1; done",
+			want: dockerutil.ExitInfo{},
+		},
+		{
+			// PID 1 ignores SIGTERM unless it has a handler for it.
+			name: "sigkill",
+			cmd:  "echo ready; while true; do sleep 0.1; done",
+			want: dockerutil.ExitInfo{ExitCode: 137, Signal: syscall.SIGKILL},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := dockerutil.MakeDocker(t)
+			defer d.CleanUp()
+
+			if err := d.Spawn(dockerutil.RunOpts{Image: "basic/alpine"}, "sh", "-c", tc.cmd); err != nil {
+				t.Fatalf("docker run failed: %v", err)
+			}
+			if _, err := d.WaitForOutput("ready", 10*time.Second); err != nil {
+				t.Fatalf("WaitForOutput() failed: %v", err)
+			}
+			if err := d.Stop(time.Second); err != nil {
+				t.Fatalf("docker stop failed: %v", err)
+			}
+			got, err := d.WaitForExit(10 * time.Second)
+			if err != nil {
+				t.Fatalf("WaitForExit() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("WaitForExit() got: %+v, want: %+v", got, tc.want)
+			}
+
+			// Stopping again is harmless.
+			if err := d.Stop(time.Second); err != nil {
+				t.Errorf("docker stop on stopped container failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestRunBoth checks that runsc reports the same system name and architecture
+// as runc.
+func TestRunBoth(t *testing.T) {
+	runscOut, runcOut, err := dockerutil.RunBoth(t, dockerutil.RunOpts{Image: "basic/alpine"}, "uname", "-s", "-m")
+	if err != nil {
+		t.Fatalf("RunBoth() failed: %v, runsc output: %q, runc output: %q", err, runscOut, runcOut)
+	}
+	if runscOut != runcOut {
+		t.Errorf("uname got: %q under runsc, want: %q (runc)", runscOut, runcOut)
+	}
+}
+
 func TestMain(m *testing.M) {
 	dockerutil.EnsureSupportedDockerVersion()
 	flag.Parse()
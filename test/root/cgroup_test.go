@@ -16,6 +16,8 @@ package root
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -26,6 +28,7 @@ import (
 	"testing"
 	"time"
 
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"gvisor.dev/gvisor/pkg/test/dockerutil"
 	"gvisor.dev/gvisor/pkg/test/testutil"
 	"gvisor.dev/gvisor/runsc/cgroup"
@@ -56,6 +59,55 @@ func verifyPid(pid int, path string) error {
 	return fmt.Errorf("got: %v, want: %d", gots, pid)
 }
 
+// waitPopulated waits until the cgroup has tasks, e.g. once the sandbox of a
+// container has joined it.
+func waitPopulated(t *testing.T, cg *cgroup.Cgroup) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := cg.WaitPopulated(ctx); err != nil {
+		t.Fatalf("WaitPopulated(): %v", err)
+	}
+}
+
+// startInCgroup runs 'script' with sh after moving the shell to 'cg'. The pid
+// is written to cgroup.procs of each controller in 'ctrls', or only memory if
+// none is given. The caller must kill the returned command.
+func startInCgroup(t *testing.T, cg *cgroup.Cgroup, script string, ctrls ...string) *exec.Cmd {
+	t.Helper()
+	if len(ctrls) == 0 {
+		ctrls = []string{"memory"}
+	}
+
+	// The shell waits on stdin until it's moved to the cgroup, so that all its
+	// children are created inside of it.
+	cmd := exec.Command("sh", "-c", "read x; "+script)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe(): %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %q: %v", cmd.Args, err)
+	}
+	defer stdin.Close()
+	for _, ctrl := range ctrls {
+		procs, err := cg.FilePath(ctrl, "cgroup.procs")
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatalf("FilePath(%q, %q): %v", ctrl, "cgroup.procs", err)
+		}
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			cmd.Process.Kill()
+			t.Fatalf("moving pid %d to %q: %v", cmd.Process.Pid, procs, err)
+		}
+	}
+	if _, err := stdin.Write([]byte("\n")); err != nil {
+		cmd.Process.Kill()
+		t.Fatalf("resuming pid %d: %v", cmd.Process.Pid, err)
+	}
+	return cmd
+}
+
 func TestMemCGroup(t *testing.T) {
 	d := dockerutil.MakeDocker(t)
 	defer d.CleanUp()
@@ -70,54 +122,36 @@ func TestMemCGroup(t *testing.T) {
 		t.Fatalf("docker run failed: %v", err)
 	}
 
-	// Extract the ID to lookup the cgroup.
-	gid, err := d.ID()
+	// Lookup the container's cgroup.
+	cgPath, err := d.CgroupPath()
 	if err != nil {
-		t.Fatalf("Docker.ID() failed: %v", err)
+		t.Fatalf("Docker.CgroupPath() failed: %v", err)
 	}
-	t.Logf("cgroup ID: %s", gid)
+	t.Logf("cgroup path: %s", cgPath)
 
-	// Wait when the container will allocate memory.
-	memUsage := 0
-	start := time.Now()
-	for time.Since(start) < 30*time.Second {
-		// Sleep for a brief period of time after spawning the
-		// container (so that Docker can create the cgroup etc.
-		// or after looping below (so the application can start).
-		time.Sleep(100 * time.Millisecond)
-
-		// Read the cgroup memory limit.
-		path := filepath.Join("/sys/fs/cgroup/memory/docker", gid, "memory.limit_in_bytes")
-		outRaw, err := ioutil.ReadFile(path)
-		if err != nil {
-			// It's possible that the container does not exist yet.
-			continue
-		}
-		out := strings.TrimSpace(string(outRaw))
-		memLimit, err := strconv.Atoi(out)
-		if err != nil {
-			t.Fatalf("Atoi(%v): %v", out, err)
-		}
-		if memLimit != allocMemLimit {
-			// The group may not have had the correct limit set yet.
-			continue
-		}
+	// The limit is set before the sandbox joins the cgroup.
+	cg := cgroup.Cgroup{Name: cgPath}
+	waitPopulated(t, &cg)
+	memLimit, err := cg.MemoryLimit()
+	if err != nil {
+		t.Fatalf("MemoryLimit(): %v", err)
+	}
+	if memLimit != int64(allocMemLimit) {
+		t.Fatalf("MemoryLimit() got: %d, want: %d", memLimit, allocMemLimit)
+	}
 
+	// Wait when the container will allocate memory.
+	var memUsage int64
+	for start := time.Now(); time.Since(start) < 30*time.Second; time.Sleep(100 * time.Millisecond) {
 		// Read the cgroup memory usage.
-		path = filepath.Join("/sys/fs/cgroup/memory/docker", gid, "memory.max_usage_in_bytes")
-		outRaw, err = ioutil.ReadFile(path)
+		memUsage, err = cg.MemoryUsage()
 		if err != nil {
 			t.Fatalf("error reading usage: %v", err)
 		}
-		out = strings.TrimSpace(string(outRaw))
-		memUsage, err = strconv.Atoi(out)
-		if err != nil {
-			t.Fatalf("Atoi(%v): %v", out, err)
-		}
 		t.Logf("read usage: %v, wanted: %v", memUsage, allocMemSize)
 
 		// Are we done?
-		if memUsage >= allocMemSize {
+		if memUsage >= int64(allocMemSize) {
 			return
 		}
 	}
@@ -220,16 +254,20 @@ func TestCgroup(t *testing.T) {
 		t.Fatalf("docker run failed: %v", err)
 	}
 
-	// Lookup the relevant cgroup ID.
-	gid, err := d.ID()
+	// Lookup the container's cgroup.
+	cgPath, err := d.CgroupPath()
 	if err != nil {
-		t.Fatalf("Docker.ID() failed: %v", err)
+		t.Fatalf("Docker.CgroupPath() failed: %v", err)
 	}
-	t.Logf("cgroup ID: %s", gid)
+	t.Logf("cgroup path: %s", cgPath)
 
 	// Check list of attributes defined above.
+	cg := cgroup.Cgroup{Name: cgPath}
 	for _, attr := range attrs {
-		path := filepath.Join("/sys/fs/cgroup", attr.ctrl, "docker", gid, attr.file)
+		path, err := cg.FilePath(attr.ctrl, attr.file)
+		if err != nil {
+			t.Fatalf("FilePath(%q, %q): %v", attr.ctrl, attr.file, err)
+		}
 		out, err := ioutil.ReadFile(path)
 		if err != nil {
 			if os.IsNotExist(err) && attr.skipIfNotFound {
@@ -244,31 +282,72 @@ func TestCgroup(t *testing.T) {
 	}
 
 	// Check that sandbox is inside cgroup.
-	controllers := []string{
-		"blkio",
-		"cpu",
-		"cpuset",
-		"memory",
-		"net_cls",
-		"net_prio",
-		"devices",
-		"freezer",
-		"perf_event",
-		"pids",
-		"systemd",
+	controllers, err := cgroup.ExpectedControllers()
+	if err != nil {
+		t.Fatalf("cgroup.ExpectedControllers(): %v", err)
 	}
+	waitPopulated(t, &cg)
 	pid, err := d.SandboxPid()
 	if err != nil {
 		t.Fatalf("SandboxPid: %v", err)
 	}
 	for _, ctrl := range controllers {
-		path := filepath.Join("/sys/fs/cgroup", ctrl, "docker", gid, "cgroup.procs")
+		path, err := cg.FilePath(ctrl, "cgroup.procs")
+		if err != nil {
+			t.Fatalf("FilePath(%q, %q): %v", ctrl, "cgroup.procs", err)
+		}
 		if err := verifyPid(pid, path); err != nil {
 			t.Errorf("cgroup control %q processes: %v", ctrl, err)
 		}
 	}
 }
 
+// TestCgroupPath checks that the container's cgroup path is found for both the
+// default and '--cgroup-parent' layouts.
+func TestCgroupPath(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		extra []string
+	}{
+		{name: "default"},
+		{name: "cgroup-parent", extra: []string{fmt.Sprintf("--cgroup-parent=%s", testutil.RandomID("runsc-"))}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := dockerutil.MakeDocker(t)
+			defer d.CleanUp()
+			if err := d.Spawn(dockerutil.RunOpts{
+				Image: "basic/alpine",
+				Extra: tc.extra,
+			}, "sleep", "10000"); err != nil {
+				t.Fatalf("docker run failed: %v", err)
+			}
+
+			got, err := d.CgroupPath()
+			if err != nil {
+				t.Fatalf("Docker.CgroupPath() failed: %v", err)
+			}
+
+			// The expected path is built from what docker was asked for, with
+			// the cgroupfs driver's default parent.
+			gid, err := d.ID()
+			if err != nil {
+				t.Fatalf("Docker.ID() failed: %v", err)
+			}
+			out, err := exec.Command("docker", "inspect", "-f={{.HostConfig.CgroupParent}}", d.Name).CombinedOutput()
+			if err != nil {
+				t.Fatalf("docker inspect: %v: %s", err, out)
+			}
+			parent := strings.TrimSpace(string(out))
+			if parent == "" {
+				parent = "docker"
+			}
+			if want := filepath.Join("/", parent, gid); got != want {
+				t.Errorf("Docker.CgroupPath() got: %q, want: %q", got, want)
+			}
+		})
+	}
+}
+
 // TestCgroup sets cgroup options and checks that cgroup was properly configured.
 func TestCgroupParent(t *testing.T) {
 	d := dockerutil.MakeDocker(t)
@@ -307,8 +386,652 @@ func TestCgroupParent(t *testing.T) {
 	if err != nil {
 		t.Fatalf("cgroup.LoadPath(%s): %v", ppid, err)
 	}
-	path := filepath.Join("/sys/fs/cgroup/memory", cgroups["memory"], parent, gid, "cgroup.procs")
+	cg := cgroup.Cgroup{Name: filepath.Join(cgroups["memory"], parent, gid)}
+	waitPopulated(t, &cg)
+	path := filepath.Join("/sys/fs/cgroup/memory", cg.Name, "cgroup.procs")
 	if err := verifyPid(pid, path); err != nil {
 		t.Errorf("cgroup control %q processes: %v", "memory", err)
 	}
 }
+
+// TestCgroupCPUQuotaEnforced checks that a busy sandbox is actually throttled
+// at its CPU quota, not only that the quota is written to the cgroup.
+func TestCgroupCPUQuotaEnforced(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+		Extra: []string{"--cpus=0.5"},
+	}, "sh", "-c", "while true; do :; done"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	cgPath, err := d.CgroupPath()
+	if err != nil {
+		t.Fatalf("Docker.CgroupPath() failed: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: cgPath}
+	if err := cgroup.VerifyCPUQuota(&cg, 5*time.Second, 0.2); err != nil {
+		t.Errorf("VerifyCPUQuota(): %v", err)
+	}
+}
+
+// TestCgroupKernelMemoryUsage checks that kernel memory used by a running
+// container is accounted in its cgroup v1 memory controller.
+func TestCgroupKernelMemoryUsage(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		t.Skipf("kernel memory usage is only reported by cgroup v1")
+	}
+
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{
+		Image: "basic/alpine",
+	}, "sleep", "10000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	cgPath, err := d.CgroupPath()
+	if err != nil {
+		t.Fatalf("Docker.CgroupPath() failed: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: cgPath}
+	usage, err := cg.KernelMemoryUsage()
+	if err != nil {
+		if errors.Is(err, cgroup.ErrNotSupported) {
+			t.Skipf("KernelMemoryUsage(): %v", err)
+		}
+		t.Fatalf("KernelMemoryUsage(): %v", err)
+	}
+	if usage == 0 {
+		t.Errorf("KernelMemoryUsage() got: 0, want: > 0")
+	}
+	if _, err := cg.KernelMemoryTCPUsage(); err != nil {
+		t.Errorf("KernelMemoryTCPUsage(): %v", err)
+	}
+}
+
+// TestCgroupUseHierarchy checks that UseHierarchy reports the cgroup v1
+// memory.use_hierarchy flag.
+func TestCgroupUseHierarchy(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		t.Skipf("memory.use_hierarchy only exists on cgroup v1")
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-hierarchy")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	got, err := cg.UseHierarchy()
+	if err != nil {
+		if errors.Is(err, cgroup.ErrNotSupported) {
+			t.Skipf("UseHierarchy(): %v", err)
+		}
+		t.Fatalf("UseHierarchy(): %v", err)
+	}
+	path, err := cg.FilePath("memory", "memory.use_hierarchy")
+	if err != nil {
+		t.Fatalf("FilePath(): %v", err)
+	}
+	val, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): %v", err)
+	}
+	if want := strings.TrimSpace(string(val)) == "1"; got != want {
+		t.Errorf("UseHierarchy() got: %t, want: %t (%q)", got, want, val)
+	}
+}
+
+// TestCgroupSwappiness checks that the cgroup v1 memory.swappiness can be set
+// and read back.
+func TestCgroupSwappiness(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		t.Skipf("memory.swappiness only exists on cgroup v1")
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-swappiness")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	if err := cg.SetSwappiness(10); err != nil {
+		if errors.Is(err, cgroup.ErrNotSupported) {
+			t.Skipf("SetSwappiness(): %v", err)
+		}
+		t.Fatalf("SetSwappiness(10): %v", err)
+	}
+	if got, err := cg.Swappiness(); err != nil || got != 10 {
+		t.Errorf("Swappiness() got: %d, %v, want: 10, nil", got, err)
+	}
+}
+
+// TestCgroupRT checks that the cgroup v1 realtime bandwidth knobs can be set
+// and read back.
+func TestCgroupRT(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		t.Skipf("realtime group scheduling is only supported by cgroup v1")
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-rt")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	if err := cg.SetRTPeriod(500000); err != nil {
+		if errors.Is(err, cgroup.ErrNotSupported) {
+			t.Skipf("SetRTPeriod(): %v", err)
+		}
+		t.Fatalf("SetRTPeriod(): %v", err)
+	}
+	// New cgroups get no runtime, and any non-zero runtime must fit within
+	// the parent's allocation, so only 0 is guaranteed to be accepted.
+	if err := cg.SetRTRuntime(0); err != nil {
+		t.Fatalf("SetRTRuntime(): %v", err)
+	}
+	if period, err := cg.RTPeriod(); err != nil || period != 500000 {
+		t.Errorf("RTPeriod() got: %d, %v, want: 500000, nil", period, err)
+	}
+	if runtime, err := cg.RTRuntime(); err != nil || runtime != 0 {
+		t.Errorf("RTRuntime() got: %d, %v, want: 0, nil", runtime, err)
+	}
+}
+
+// TestCgroupCPUWeightNice checks that cpu.weight.nice and cpu.weight are views
+// of the same weight.
+func TestCgroupCPUWeightNice(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("cgroup v2 is not available: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-nice")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	// Weights are mapped from the kernel's nice to weight table, scaled so that
+	// a nice value of 0 is the default weight of 100.
+	for _, tc := range []struct {
+		nice   int
+		weight uint64
+	}{
+		{nice: 0, weight: 100},
+		{nice: 10, weight: 11},
+		{nice: -10, weight: 932},
+	} {
+		if err := cg.SetCPUWeightNice(tc.nice); err != nil {
+			if errors.Is(err, cgroup.ErrNotSupported) {
+				t.Skipf("SetCPUWeightNice(): %v", err)
+			}
+			t.Fatalf("SetCPUWeightNice(%d): %v", tc.nice, err)
+		}
+		weight, err := cg.CPUWeight()
+		if err != nil {
+			t.Fatalf("CPUWeight(): %v", err)
+		}
+		if weight != tc.weight {
+			t.Errorf("CPUWeight() with nice %d got: %d, want: %d", tc.nice, weight, tc.weight)
+		}
+		nice, err := cg.CPUWeightNice()
+		if err != nil {
+			t.Fatalf("CPUWeightNice(): %v", err)
+		}
+		if nice != tc.nice {
+			t.Errorf("CPUWeightNice() got: %d, want: %d", nice, tc.nice)
+		}
+	}
+}
+
+// TestCgroupIOCost checks that the host's iocost configuration can be read,
+// and that writing back the current QoS parameters of a device is accepted by
+// the kernel.
+func TestCgroupIOCost(t *testing.T) {
+	qos, err := cgroup.IOCostQoS()
+	if err != nil {
+		if errors.Is(err, cgroup.ErrNotSupported) {
+			t.Skipf("IOCostQoS(): %v", err)
+		}
+		t.Fatalf("IOCostQoS(): %v", err)
+	}
+	if _, err := cgroup.IOCostModel(); err != nil {
+		t.Fatalf("IOCostModel(): %v", err)
+	}
+	for dev, spec := range qos {
+		if err := cgroup.SetIOCostQoS(dev, spec); err != nil {
+			t.Errorf("SetIOCostQoS(%q, %q): %v", dev, spec, err)
+		}
+	}
+}
+
+// threadCountHelperEnv is set when the test binary is re-executed as the
+// workload of TestCgroupThreadCount, see TestMain.
+const threadCountHelperEnv = "RUNSC_TEST_THREAD_COUNT_HELPER"
+
+// TestCgroupThreadCount checks that threads and processes are counted
+// separately, using a copy of the test binary as a multi-threaded workload.
+func TestCgroupThreadCount(t *testing.T) {
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-threads")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), threadCountHelperEnv+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe(): %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %q: %v", cmd.Args, err)
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+	// Moving the process moves all of its threads.
+	procs, err := cg.FilePath("memory", "cgroup.procs")
+	if err != nil {
+		t.Fatalf("FilePath(): %v", err)
+	}
+	if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("moving pid %d to %q: %v", cmd.Process.Pid, procs, err)
+	}
+
+	processes, err := cg.ProcessCount()
+	if err != nil {
+		t.Fatalf("ProcessCount(): %v", err)
+	}
+	threads, err := cg.ThreadCount()
+	if err != nil {
+		t.Fatalf("ThreadCount(): %v", err)
+	}
+	if processes != 1 {
+		t.Errorf("ProcessCount() got: %d, want: 1", processes)
+	}
+	if threads <= processes {
+		t.Errorf("ThreadCount() got: %d, want more than %d", threads, processes)
+	}
+}
+
+// TestCgroupMemoryFailcnt checks that the memory failcnt rises when a workload
+// fills the page cache over the cgroup's limit, which triggers reclaim.
+func TestCgroupMemoryFailcnt(t *testing.T) {
+	limit := int64(32 << 20)
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-failcnt")}
+	if err := cg.Install(&specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+	}); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	dir, err := ioutil.TempDir(testutil.TmpDir(), "failcnt")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := startInCgroup(t, &cg, fmt.Sprintf("dd if=/dev/zero of=%s bs=1M count=128 2>/dev/null", filepath.Join(dir, "file")))
+	defer cmd.Process.Kill()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%q failed: %v", cmd.Args, err)
+	}
+
+	failcnt, err := cg.MemoryFailcnt()
+	if err != nil {
+		t.Fatalf("MemoryFailcnt(): %v", err)
+	}
+	if failcnt == 0 {
+		t.Errorf("MemoryFailcnt() got: 0, want: > 0")
+	}
+}
+
+// TestCgroupMemoryThreshold checks that a cgroup v1 memory threshold notifies
+// once usage crosses it.
+func TestCgroupMemoryThreshold(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		t.Skipf("memory threshold notifications require cgroup v1")
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-threshold")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	ch, cancel, err := cg.WatchMemoryThreshold(16 << 20)
+	if err != nil {
+		t.Fatalf("WatchMemoryThreshold(): %v", err)
+	}
+	defer cancel()
+
+	dir, err := ioutil.TempDir(testutil.TmpDir(), "threshold")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The page cache of the file is charged to the cgroup.
+	cmd := startInCgroup(t, &cg, fmt.Sprintf("dd if=/dev/zero of=%s bs=1M count=64 2>/dev/null", filepath.Join(dir, "file")))
+	defer cmd.Process.Kill()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%q failed: %v", cmd.Args, err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("WatchMemoryThreshold() didn't notify")
+	}
+}
+
+// TestCgroupPopulated checks that the populated state of a cgroup flips once
+// its last task exits.
+func TestCgroupPopulated(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("cgroup v2 is not available: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-populated")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	cmd := exec.Command("sleep", "10000")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %q: %v", cmd.Args, err)
+	}
+	defer cmd.Process.Kill()
+
+	procs, err := cg.FilePath("memory", "cgroup.procs")
+	if err != nil {
+		t.Fatalf("FilePath(): %v", err)
+	}
+	if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("moving pid %d to %q: %v", cmd.Process.Pid, procs, err)
+	}
+
+	ch, cancel, err := cg.WatchPopulated()
+	if err != nil {
+		t.Fatalf("WatchPopulated(): %v", err)
+	}
+	defer cancel()
+	if populated := <-ch; !populated {
+		t.Fatalf("cgroup should be populated after moving pid %d", cmd.Process.Pid)
+	}
+
+	// Kill the last task and wait for the state to flip.
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatalf("Kill(): %v", err)
+	}
+	_ = cmd.Wait()
+	select {
+	case populated := <-ch:
+		if populated {
+			t.Errorf("cgroup should not be populated after the last task exited")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for cgroup to become unpopulated")
+	}
+}
+
+// TestCgroupKill checks that Kill terminates a workload that keeps forking.
+func TestCgroupKill(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("cgroup v2 is not available: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-kill")}
+	// The workload forks until it hits the pids limit.
+	if err := cg.Install(&specs.LinuxResources{Pids: &specs.LinuxPids{Limit: 64}}); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	cmd := startInCgroup(t, &cg, "while true; do sleep 1000 & done")
+	defer cmd.Process.Kill()
+	// Let it fork for a while.
+	time.Sleep(500 * time.Millisecond)
+
+	if err := cg.Kill(); err != nil {
+		t.Fatalf("Kill(): %v", err)
+	}
+	_ = cmd.Wait()
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		populated, err := cg.Populated()
+		if err != nil {
+			t.Fatalf("Populated(): %v", err)
+		}
+		if !populated {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			pids, _ := cg.Tasks()
+			t.Fatalf("cgroup still has tasks after Kill(): %v", pids)
+		}
+	}
+}
+
+// TestCgroupDescendantStats checks that child cgroups are counted as live
+// descendants, and no longer once removed.
+func TestCgroupDescendantStats(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("cgroup v2 is not available: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-descendants")}
+	if err := cg.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.UninstallWithOpts(cgroup.UninstallOpts{Cascade: true})
+
+	var children []*cgroup.Cgroup
+	for _, name := range []string{"a", "b"} {
+		child, err := cg.Child(name, nil)
+		if err != nil {
+			t.Fatalf("Child(%q): %v", name, err)
+		}
+		children = append(children, child)
+	}
+	if live, _, err := cg.DescendantStats(); err != nil || live != 2 {
+		t.Errorf("DescendantStats() got live: %d, %v, want: 2, nil", live, err)
+	}
+
+	if err := children[0].Uninstall(); err != nil {
+		t.Fatalf("Uninstall(): %v", err)
+	}
+	// The removed child may still be counted as dying until it's reclaimed.
+	live, dying, err := cg.DescendantStats()
+	if err != nil {
+		t.Fatalf("DescendantStats(): %v", err)
+	}
+	if live != 1 {
+		t.Errorf("DescendantStats() got live: %d, want: 1", live)
+	}
+	if dying > 1 {
+		t.Errorf("DescendantStats() got dying: %d, want: <= 1", dying)
+	}
+}
+
+// TestCgroupFreeze checks that Frozen only reports a cgroup as frozen once the
+// freeze has taken effect on all of its tasks.
+func TestCgroupFreeze(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("cgroup v2 is not available: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-freeze")}
+	// The workload forks until it hits the pids limit.
+	if err := cg.Install(&specs.LinuxResources{Pids: &specs.LinuxPids{Limit: 64}}); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	// The shell keeps trying to fork so that the freeze has tasks to catch up
+	// with.
+	startInCgroup(t, &cg, "while true; do sleep 1000 & done")
+	defer cg.Kill()
+	time.Sleep(100 * time.Millisecond)
+
+	if frozen, err := cg.Frozen(); err != nil || frozen {
+		t.Fatalf("Frozen() before Freeze() got: %t, %v, want: false, nil", frozen, err)
+	}
+	if err := cg.Freeze(); err != nil {
+		t.Fatalf("Freeze(): %v", err)
+	}
+	if frozen, err := cg.Frozen(); err != nil || !frozen {
+		t.Errorf("Frozen() after Freeze() got: %t, %v, want: true, nil", frozen, err)
+	}
+	if err := cg.Thaw(); err != nil {
+		t.Fatalf("Thaw(): %v", err)
+	}
+	if frozen, err := cg.Frozen(); err != nil || frozen {
+		t.Errorf("Frozen() after Thaw() got: %t, %v, want: false, nil", frozen, err)
+	}
+}
+
+// TestCgroupPressure checks that a PSI trigger fires when the cgroup is under
+// memory pressure, which is induced by writing more than its limit to the page
+// cache.
+func TestCgroupPressure(t *testing.T) {
+	if _, err := os.Stat("/proc/pressure/memory"); err != nil {
+		t.Skipf("PSI is not available: %v", err)
+	}
+	if mode, err := cgroup.Mode(); err != nil || mode != cgroup.Unified {
+		t.Skipf("cgroup v2 is not available: %v, %v", mode, err)
+	}
+
+	limit := int64(32 << 20)
+	cg := cgroup.Cgroup{Name: testutil.RandomID("runsc-pressure")}
+	if err := cg.Install(&specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+	}); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer cg.Uninstall()
+
+	ch, cancel, err := cg.WatchPressure("memory", "some 10000 2000000")
+	if err != nil {
+		t.Fatalf("WatchPressure(): %v", err)
+	}
+	defer cancel()
+
+	dir, err := ioutil.TempDir(testutil.TmpDir(), "pressure")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := startInCgroup(t, &cg, fmt.Sprintf("while true; do dd if=/dev/zero of=%s bs=1M count=256 2>/dev/null; done", filepath.Join(dir, "file")))
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	select {
+	case <-ch:
+	case <-time.After(30 * time.Second):
+		t.Errorf("timeout waiting for memory pressure notification")
+	}
+}
+
+// TestCgroupMigrate checks that a running workload that keeps forking is moved
+// to the new cgroup and that the old one is removed.
+func TestCgroupMigrate(t *testing.T) {
+	old := &cgroup.Cgroup{Name: testutil.RandomID("runsc-migrate-old")}
+	if err := old.Install(nil); err != nil {
+		t.Fatalf("Install(): %v", err)
+	}
+	defer old.Uninstall()
+
+	cmd := startInCgroup(t, old, "while true; do sleep 0.01; done", "memory", "pids")
+	defer cmd.Process.Kill()
+	// Let it fork for a while.
+	time.Sleep(100 * time.Millisecond)
+
+	limit := int64(100)
+	c, err := cgroup.Migrate(old, testutil.RandomID("runsc-migrate-new"), &specs.LinuxResources{
+		Pids: &specs.LinuxPids{Limit: limit},
+	})
+	if err != nil {
+		t.Fatalf("Migrate(): %v", err)
+	}
+	defer c.Uninstall()
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	if ok, err := c.ContainsPID(cmd.Process.Pid); err != nil || !ok {
+		t.Errorf("ContainsPID(%d) got: %t, %v, want: true, nil", cmd.Process.Pid, ok, err)
+	}
+	if exists, err := old.Exists(); err != nil || exists {
+		t.Errorf("old cgroup Exists() got: %t, %v, want: false, nil", exists, err)
+	}
+	procs, err := c.FilePath("pids", "cgroup.procs")
+	if err != nil {
+		t.Fatalf("FilePath(): %v", err)
+	}
+	if err := verifyPid(cmd.Process.Pid, procs); err != nil {
+		t.Errorf("pid %d not in the new pids cgroup: %v", cmd.Process.Pid, err)
+	}
+}
+
+// TestCgroupSystemdMemoryMax checks that the memory limit of a cgroup owned by
+// a systemd scope is set as the MemoryMax property of the scope.
+func TestCgroupSystemdMemoryMax(t *testing.T) {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		t.Skipf("systemd is not running: %v", err)
+	}
+
+	unit := testutil.RandomID("runsc-systemd") + ".scope"
+	cmd := exec.Command("systemd-run", "--scope", "--unit="+unit, "-p", "Delegate=yes", "sleep", "10000")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting %q: %v", cmd.Args, err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	show := func(prop string) string {
+		out, err := exec.Command("systemctl", "show", "-p", prop, "--value", unit).CombinedOutput()
+		if err != nil {
+			t.Fatalf("systemctl show %s %s: %v: %s", prop, unit, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	var path string
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		if path = show("ControlGroup"); path != "" {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timeout waiting for scope %q", unit)
+		}
+	}
+
+	prop := "MemoryLimit"
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		prop = "MemoryMax"
+	}
+	limit := int64(256 << 20)
+	cg := cgroup.Cgroup{Name: path}
+	if err := cg.InstallWithOpts(context.Background(), &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+	}, cgroup.InstallOpts{SystemdUnit: unit}); err != nil {
+		t.Fatalf("InstallWithOpts(): %v", err)
+	}
+	if got, want := show(prop), strconv.FormatInt(limit, 10); got != want {
+		t.Errorf("%s of %q got: %q, want: %q", prop, unit, got, want)
+	}
+	if got, err := cg.MemoryLimit(); err != nil || got != limit {
+		t.Errorf("MemoryLimit() got: %d, %v, want: %d, nil", got, err, limit)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/test/dockerutil"
+)
+
+// TestSandboxFDLeak checks that the sandbox process doesn't leak file
+// descriptors across exec'd workloads.
+func TestSandboxFDLeak(t *testing.T) {
+	d := dockerutil.MakeDocker(t)
+	defer d.CleanUp()
+
+	if err := d.Spawn(dockerutil.RunOpts{Image: "basic/alpine"}, "sleep", "10000"); err != nil {
+		t.Fatalf("docker run failed: %v", err)
+	}
+	workload := func() {
+		if _, err := d.Exec(dockerutil.RunOpts{}, "sh", "-c", "for i in $(seq 20); do cat /etc/hostname > /dev/null; done"); err != nil {
+			t.Fatalf("docker exec failed: %v", err)
+		}
+	}
+
+	// The first exec may set up resources that are kept for the lifetime of
+	// the sandbox.
+	workload()
+	baseFDs, baseThreads, err := d.SandboxResourceSnapshot()
+	if err != nil {
+		t.Fatalf("SandboxResourceSnapshot() failed: %v", err)
+	}
+	t.Logf("baseline: %d fds, %d threads", baseFDs, baseThreads)
+
+	for i := 0; i < 10; i++ {
+		workload()
+	}
+
+	// Resources are released asynchronously after the processes exit.
+	var fds, threads int
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(100 * time.Millisecond) {
+		fds, threads, err = d.SandboxResourceSnapshot()
+		if err != nil {
+			t.Fatalf("SandboxResourceSnapshot() failed: %v", err)
+		}
+		if fds <= baseFDs {
+			return
+		}
+	}
+	t.Errorf("sandbox has %d fds (%d threads) after workload, baseline: %d fds (%d threads)", fds, threads, baseFDs, baseThreads)
+}
@@ -17,6 +17,7 @@ package root
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -29,6 +30,12 @@ import (
 // supported docker version, required capabilities, and configures the executable
 // path for runsc.
 func TestMain(m *testing.M) {
+	if os.Getenv(threadCountHelperEnv) != "" {
+		// The Go runtime always runs more than one thread. Wait until the
+		// parent is done, without forking anything into its cgroup.
+		_, _ = ioutil.ReadAll(os.Stdin)
+		os.Exit(0)
+	}
 	flag.Parse()
 
 	if !specutils.HasCapabilities(capability.CAP_SYS_ADMIN, capability.CAP_DAC_OVERRIDE) {
@@ -0,0 +1,156 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"gvisor.dev/gvisor/pkg/test/testutil"
+	"gvisor.dev/gvisor/runsc/boot"
+	"gvisor.dev/gvisor/runsc/cgroup"
+	"gvisor.dev/gvisor/runsc/container"
+)
+
+// TestNetClsHostNetwork checks that net_cls.classid is set on the sandbox's
+// cgroup when it uses host networking, where the sandbox's sockets are host
+// sockets classified by it.
+func TestNetClsHostNetwork(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/net_cls/net_cls.classid"); err != nil {
+		t.Skipf("net_cls controller is not available: %v", err)
+	}
+
+	classID := uint32(0x100001)
+	id := testutil.RandomContainerID()
+	spec := testutil.NewSpecWithArgs("sleep", "10000")
+	spec.Linux = &specs.Linux{
+		CgroupsPath: "/" + testutil.RandomID("runsc-netcls"),
+		Resources: &specs.LinuxResources{
+			Network: &specs.LinuxNetwork{ClassID: &classID},
+		},
+	}
+
+	conf := testutil.TestConfig(t)
+	conf.Network = boot.NetworkHost
+	_, bundleDir, cleanup, err := testutil.SetupContainer(spec, conf)
+	if err != nil {
+		t.Fatalf("error setting up container: %v", err)
+	}
+	defer cleanup()
+
+	cont, err := container.New(conf, container.Args{
+		ID:        id,
+		Spec:      spec,
+		BundleDir: bundleDir,
+	})
+	if err != nil {
+		t.Fatalf("error creating container: %v", err)
+	}
+	defer cont.Destroy()
+	if err := cont.Start(conf); err != nil {
+		t.Fatalf("error starting container: %v", err)
+	}
+
+	cg := cgroup.Cgroup{Name: spec.Linux.CgroupsPath}
+	path, err := cg.Path("net_cls")
+	if err != nil {
+		t.Fatalf("Path(): %v", err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(path, "net_cls.classid"))
+	if err != nil {
+		t.Fatalf("reading net_cls.classid: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != strconv.FormatUint(uint64(classID), 10) {
+		t.Errorf("net_cls.classid got: %s, want: %d", got, classID)
+	}
+	if err := verifyPid(cont.SandboxPid(), filepath.Join(path, "cgroup.procs")); err != nil {
+		t.Errorf("net_cls cgroup processes: %v", err)
+	}
+}
+
+// TestNetClsStats checks that traffic sent by a sandbox using host networking
+// is counted by the accounting rule of its net_cls.classid.
+func TestNetClsStats(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/net_cls/net_cls.classid"); err != nil {
+		t.Skipf("net_cls controller is not available: %v", err)
+	}
+
+	classID := uint32(0x100002)
+	id := testutil.RandomContainerID()
+	// Send UDP datagrams to the discard port, whether or not anything listens.
+	spec := testutil.NewSpecWithArgs("bash", "-c", "while true; do echo x > /dev/udp/127.0.0.1/9; sleep 0.1; done")
+	spec.Linux = &specs.Linux{
+		CgroupsPath: "/" + testutil.RandomID("runsc-netcls"),
+		Resources: &specs.LinuxResources{
+			Network: &specs.LinuxNetwork{ClassID: &classID},
+		},
+	}
+
+	conf := testutil.TestConfig(t)
+	conf.Network = boot.NetworkHost
+	_, bundleDir, cleanup, err := testutil.SetupContainer(spec, conf)
+	if err != nil {
+		t.Fatalf("error setting up container: %v", err)
+	}
+	defer cleanup()
+
+	cont, err := container.New(conf, container.Args{
+		ID:        id,
+		Spec:      spec,
+		BundleDir: bundleDir,
+	})
+	if err != nil {
+		t.Fatalf("error creating container: %v", err)
+	}
+	defer cont.Destroy()
+
+	// The rule is added before the sandbox sends anything, once the cgroup
+	// exists.
+	cg := &cgroup.Cgroup{Name: spec.Linux.CgroupsPath}
+	if err := cg.AddNetClassAccounting(); err != nil {
+		if errors.Is(err, cgroup.ErrNotSupported) {
+			t.Skipf("net_cls accounting is not supported: %v", err)
+		}
+		t.Fatalf("AddNetClassAccounting(): %v", err)
+	}
+	defer cg.RemoveNetClassAccounting()
+	if stats, err := cg.NetClassStats(); err != nil || stats.Packets != 0 {
+		t.Errorf("NetClassStats() before start got: %+v, %v, want no packets", stats, err)
+	}
+
+	if err := cont.Start(conf); err != nil {
+		t.Fatalf("error starting container: %v", err)
+	}
+	if err := testutil.Poll(func() error {
+		stats, err := cg.NetClassStats()
+		if err != nil {
+			return err
+		}
+		if stats.Packets == 0 || stats.Bytes == 0 {
+			return fmt.Errorf("no traffic counted: %+v", stats)
+		}
+		return nil
+	}, 10*time.Second); err != nil {
+		t.Errorf("NetClassStats(): %v", err)
+	}
+}